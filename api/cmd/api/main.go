@@ -18,10 +18,22 @@ import (
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/guardrails"
 	"github.com/kava-labs/kavachat/api/internal/handlers"
+	"github.com/kava-labs/kavachat/api/internal/hedging"
+	"github.com/kava-labs/kavachat/api/internal/images"
 	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/moderation"
 	"github.com/kava-labs/kavachat/api/internal/otel"
+	"github.com/kava-labs/kavachat/api/internal/prompts"
+	"github.com/kava-labs/kavachat/api/internal/scanner"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/streams"
+	"github.com/kava-labs/kavachat/api/internal/tools"
+	"github.com/kava-labs/kavachat/api/internal/urlsign"
 )
 
 func main() {
@@ -40,6 +52,9 @@ func main() {
 		logger.Fatal().Err(err).Msgf("invalid config")
 	}
 
+	// Clients are shared by all requests to a backend
+	cfg.Backends.InitClients()
+
 	// Replace logger with configured format
 	logger = InitializeLogger(cfg.LogFormatIsJSON(), cfg.LogLevel)
 
@@ -58,9 +73,202 @@ func main() {
 	// -------------------------------------------------------------------------
 	// API Routes
 
+	// Background tasks are stopped on shutdown
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Optional features of the OpenAI proxy handlers
+	var proxyOpts []handlers.OpenAIProxyOption
+
+	// Uploaded files, also used by downloads and file management
+	var fileStorage storage.Storage
+	switch cfg.Storage.Backend {
+	case "memory":
+		fileStorage = storage.NewMemory(cfg.Storage.TTL)
+	case "local":
+		fileStorage, err = storage.NewLocal(cfg.Storage.LocalPath, cfg.Storage.TTL)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error opening local file storage")
+		}
+	default:
+		fileStorage, err = storage.NewS3FromConfig(context.Background(), cfg.S3BucketName, cfg.S3PathStyleRequests, cfg.Storage.TTL)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error creating S3 file storage")
+		}
+	}
+
+	// Uploads with the same content share a blob, the sweeper deletes the
+	// blob with the last file that references it. Uses the storage TTL like
+	// the wrapped storage for objects stored without an expiration.
+	if cfg.Storage.Dedup {
+		fileStorage = storage.NewDedup(fileStorage, cfg.Storage.TTL)
+	}
+
+	if cfg.FileRetention.SweepEnabled {
+		// Stopped on shutdown
+		go storage.NewSweeper(fileStorage, cfg.FileRetention.SweepInterval, handlers.IsFileKey, logger).Run(backgroundCtx)
+	}
+
+	// Signed file URLs and owner only downloads, files are available to anyone
+	// with the file ID if nil
+	var fileAccess *handlers.FileAccess
+	if cfg.FileAccess.SignedURLs || cfg.FileAccess.OwnerOnly {
+		var signer *urlsign.Signer
+		if cfg.FileAccess.SignedURLs {
+			keys := make(map[string][]byte, len(cfg.FileAccess.SigningKeys))
+			for keyID, key := range cfg.FileAccess.SigningKeys {
+				keys[keyID] = []byte(key)
+			}
+
+			signer, err = urlsign.NewSigner(keys, cfg.FileAccess.SigningKeyID)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("invalid file URL signing config")
+			}
+		}
+
+		fileAccess = handlers.NewFileAccess(signer, cfg.FileAccess.URLTTL, cfg.FileAccess.OwnerOnly)
+	}
+
+	uploadOpts := []handlers.FileUploadOption{
+		handlers.WithAllowedContentTypes(cfg.UploadAllowedContentTypes),
+		handlers.WithMaxFileSize(cfg.UploadMaxBytes),
+		handlers.WithRetention(handlers.FileRetention{
+			Uploads:         cfg.FileRetention.Uploads,
+			GeneratedImages: cfg.FileRetention.GeneratedImages,
+		}),
+	}
+	if fileAccess != nil {
+		uploadOpts = append(uploadOpts, handlers.WithSignedFileURLs(fileAccess))
+	}
+
+	if cfg.Scanner.Enabled {
+		clamd, err := scanner.NewClamdScanner(scanner.ClamdConfig{
+			Address: cfg.Scanner.ClamdAddress,
+			Timeout: cfg.Scanner.Timeout,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid scanner config")
+		}
+
+		uploadOpts = append(uploadOpts, handlers.WithScanner(clamd, cfg.Scanner.FailOpen))
+	}
+
+	if cfg.ImageProcessing.Enabled {
+		processor, err := images.NewProcessor(images.Config{
+			MaxDimension:       cfg.ImageProcessing.MaxDimension,
+			MaxPixels:          cfg.ImageProcessing.MaxPixels,
+			ThumbnailDimension: cfg.ImageProcessing.ThumbnailDimension,
+			JPEGQuality:        cfg.ImageProcessing.JPEGQuality,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid image processing config")
+		}
+
+		uploadOpts = append(uploadOpts, handlers.WithImageProcessing(processor))
+	}
+
+	if cfg.TextExtraction.Enabled {
+		uploadOpts = append(uploadOpts, handlers.WithTextExtraction(cfg.TextExtraction.MaxBytes))
+	}
+
+	// Also stores generated images
+	fileUploadHandler := handlers.NewFileUploadHandler(
+		fileStorage,
+		cfg.PublicURL,
+		logger,
+		uploadOpts...,
+	)
+
+	if cfg.PersistGeneratedImages {
+		proxyOpts = append(proxyOpts, handlers.WithGeneratedImageStorage(fileUploadHandler))
+	}
+
+	downloadOpts := []handlers.FileDownloadOption{
+		handlers.WithCacheControl(cfg.FileCacheControl),
+	}
+	if cfg.PresignedURLs.DownloadRedirects {
+		downloadOpts = append(downloadOpts, handlers.WithPresignedRedirects(cfg.PresignedURLs.TTL))
+	}
+
+	var filesOpts []handlers.FilesOption
+	if fileAccess != nil {
+		downloadOpts = append(downloadOpts, handlers.WithFileAccess(fileAccess))
+		filesOpts = append(filesOpts, handlers.WithFileMetadataAccess(fileAccess))
+	}
+
+	// Also inlines uploaded files and their text in chat completions
+	downloadHandler := handlers.NewFileDownloadHandler(
+		fileStorage,
+		logger,
+		downloadOpts...,
+	)
+
+	if cfg.InlineFiles.Enabled {
+		proxyOpts = append(proxyOpts, handlers.WithInlineFiles(downloadHandler, handlers.InlineFilesConfig{
+			PublicURL:     cfg.PublicURL,
+			MaxBytes:      cfg.InlineFiles.MaxBytes,
+			MaxTotalBytes: cfg.InlineFiles.MaxTotalBytes,
+			ContentTypes:  cfg.InlineFiles.ContentTypes,
+		}))
+	}
+
+	if cfg.TextExtraction.Enabled {
+		proxyOpts = append(proxyOpts, handlers.WithFileText(downloadHandler, cfg.TextExtraction.MaxFileTokens))
+	}
+
+	var streamRegistry *streams.Registry
+	if cfg.ResumableStreams.Enabled {
+		streamRegistry = streams.NewRegistry(streams.RegistryConfig{
+			TTL:         cfg.ResumableStreams.TTL,
+			MaxBytes:    cfg.ResumableStreams.MaxBytes,
+			MaxDuration: cfg.ResumableStreams.MaxDuration,
+		})
+		go streamRegistry.Run(backgroundCtx)
+
+		proxyOpts = append(proxyOpts, handlers.WithResumableStreams(streamRegistry))
+	}
+
+	var conversationStore conversations.Store
+	if cfg.Conversations.Enabled {
+		switch cfg.Conversations.Store {
+		case "memory":
+			conversationStore = conversations.NewMemoryStore()
+		default:
+			conversationStore, err = conversations.NewSQLiteStore(cfg.Conversations.SQLitePath)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("error opening conversations store")
+			}
+		}
+
+		proxyOpts = append(proxyOpts, handlers.WithConversations(conversationStore))
+	}
+
+	identityMiddleware := middleware.IdentityMiddleware(middleware.IdentityConfig{
+		UserHeader: cfg.Conversations.UserHeader,
+		APIKeys:    cfg.Conversations.APIKeys,
+	})
+
+	// Only used for backends with hedged models
+	proxyOpts = append(proxyOpts, handlers.WithHedging(hedging.New(hedging.Config{
+		Percentile:   cfg.Hedging.Percentile,
+		InitialDelay: cfg.Hedging.InitialDelay,
+		MinDelay:     cfg.Hedging.MinDelay,
+		MaxDelay:     cfg.Hedging.MaxDelay,
+		MinSamples:   cfg.Hedging.MinSamples,
+		WindowSize:   cfg.Hedging.WindowSize,
+	})))
+
 	r := chi.NewRouter()
 
-	r.Use(chimiddleware.Recoverer) // Recover from panics, 500 response, logs stack trace
+	r.Use(middleware.RequestIDMiddleware)
+	r.Use(middleware.RecovererMiddleware(logger)) // Recover from panics, 500 response, logs stack trace
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, r, apierror.NotFound("unknown route"))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, r, apierror.MethodNotAllowed())
+	})
 
 	// /v1/ custom routes
 	r.Route("/v1", func(r chi.Router) {
@@ -82,45 +290,214 @@ func main() {
 			fmt.Fprintln(w, "available")
 		})
 
-		// POST /v1/files - File uploads
-		fileUploadHandler := handlers.NewFileUploadHandler(
-			cfg.S3BucketName,
-			cfg.S3PathStyleRequests,
+		// /v1/files - Files, uploads record the owner of the user or anonymous
+		// session
+		filesHandler := handlers.NewFilesHandler(
+			fileStorage,
 			cfg.PublicURL,
 			logger,
-		)
-		r.With(
-			metricsMiddleware,
-			// Need to set real IP
-			chimiddleware.RealIP,
-			// Before rate limiter
-			middleware.NewRateLimiter(middleware.RateLimiterConfig{
-				MaxRequests: 10,
-				WindowSize:  1 * time.Minute,
-			}),
-		).Post(
-			"/files",
-			fileUploadHandler.ServeHTTP,
+			filesOpts...,
 		)
 
-		// GET /v1/files/{file_id} - File downloads
-		downloadHandler := handlers.NewFileDownloadHandler(
-			cfg.S3BucketName,
-			cfg.S3PathStyleRequests,
-			logger,
-		)
-		r.With(metricsMiddleware).Get(
-			"/files/{file_id}",
-			downloadHandler.ServeHTTP,
-		)
+		r.Route("/files", func(r chi.Router) {
+			r.Use(
+				metricsMiddleware,
+				middleware.PreflightMiddlewareForMethods(
+					http.MethodGet,
+					http.MethodPost,
+					http.MethodPut,
+					http.MethodDelete,
+				),
+			)
+
+			// Uploads and direct uploads share the rate limit
+			uploadRateLimit := chi.Chain(
+				// Need to set real IP
+				chimiddleware.RealIP,
+				// Before rate limiter
+				middleware.NewRateLimiter(middleware.RateLimiterConfig{
+					MaxRequests: 10,
+					WindowSize:  1 * time.Minute,
+				}),
+			)
+
+			// POST /v1/files - File uploads
+			r.With(uploadRateLimit...).With(identityMiddleware).Post("/", fileUploadHandler.ServeHTTP)
+
+			// POST /v1/files/uploads - Presigned direct uploads to S3
+			if cfg.PresignedURLs.DirectUploads {
+				directUploadHandler, err := handlers.NewDirectUploadHandler(
+					cfg.PublicURL,
+					cfg.PresignedURLs.TTL,
+					fileUploadHandler,
+					logger,
+				)
+				if err != nil {
+					logger.Fatal().Err(err).Msg("error creating direct upload handler")
+				}
+
+				r.With(uploadRateLimit...).With(identityMiddleware).Post("/uploads", directUploadHandler.Create)
+				r.With(identityMiddleware).Post("/uploads/{file_id}/complete", directUploadHandler.Complete)
+			}
+
+			// /v1/files/multipart - Chunked uploads of large files
+			if cfg.MultipartUploads.Enabled {
+				multipartHandler, err := handlers.NewMultipartUploadHandler(
+					cfg.PublicURL,
+					handlers.MultipartUploadConfig{
+						MaxBytes:     cfg.MultipartUploads.MaxBytes,
+						MaxPartBytes: cfg.MultipartUploads.MaxPartBytes,
+						AbandonAfter: cfg.MultipartUploads.AbandonAfter,
+					},
+					fileUploadHandler,
+					logger,
+				)
+				if err != nil {
+					logger.Fatal().Err(err).Msg("error creating multipart upload handler")
+				}
+
+				// Stopped on shutdown
+				go multipartHandler.RunCleanup(backgroundCtx, cfg.MultipartUploads.CleanupInterval)
+
+				r.With(uploadRateLimit...).With(identityMiddleware).Post("/multipart", multipartHandler.Create)
+				r.With(identityMiddleware).Get("/multipart/{file_id}", multipartHandler.Status)
+				r.With(identityMiddleware).Put("/multipart/{file_id}/parts/{part_number}", multipartHandler.UploadPart)
+				r.With(identityMiddleware).Post("/multipart/{file_id}/complete", multipartHandler.Complete)
+				r.With(identityMiddleware).Delete("/multipart/{file_id}", multipartHandler.Abort)
+			}
+
+			// GET /v1/files - Files of the owner
+			r.With(identityMiddleware).Get("/", filesHandler.List)
+
+			// Owner only downloads need the owner of the request
+			var downloadMiddlewares chi.Middlewares
+			if cfg.FileAccess.OwnerOnly {
+				downloadMiddlewares = append(downloadMiddlewares, identityMiddleware)
+			}
+
+			// GET /v1/files/{file_id} - File downloads
+			r.With(downloadMiddlewares...).Get("/{file_id}", downloadHandler.ServeHTTP)
+
+			// GET /v1/files/{file_id}/text - Extracted text of document uploads
+			r.With(downloadMiddlewares...).Get("/{file_id}/text", downloadHandler.ServeText)
+
+			// GET /v1/files/{file_id}/metadata - File metadata
+			r.With(downloadMiddlewares...).Get("/{file_id}/metadata", filesHandler.Metadata)
+
+			// DELETE /v1/files/{file_id} - Delete a file of the owner
+			r.With(identityMiddleware).Delete("/{file_id}", filesHandler.Delete)
+		})
+
+		// /v1/conversations - Conversations of the user or anonymous session
+		if conversationStore != nil {
+			conversationsHandler := handlers.NewConversationsHandler(conversationStore, logger)
+
+			r.Route("/conversations", func(r chi.Router) {
+				r.Use(
+					metricsMiddleware,
+					middleware.PreflightMiddlewareForMethods(
+						http.MethodGet,
+						http.MethodPost,
+						http.MethodPatch,
+						http.MethodDelete,
+					),
+					identityMiddleware,
+				)
+
+				r.Post("/", conversationsHandler.Create)
+				r.Get("/", conversationsHandler.List)
+				r.Get("/{conversation_id}", conversationsHandler.Get)
+				r.Patch("/{conversation_id}", conversationsHandler.Rename)
+				r.Delete("/{conversation_id}", conversationsHandler.Delete)
+				r.Post("/{conversation_id}/messages", conversationsHandler.AppendMessage)
+			})
+		}
+
+		// GET /v1/streams/{stream_id} - Resume a stream with Last-Event-ID,
+		// cross-origin resumes are preflighted for the header
+		if streamRegistry != nil {
+			resumeHandler := handlers.NewStreamResumeHandler(streamRegistry, logger)
+			r.With(
+				metricsMiddleware,
+				middleware.PreflightMiddlewareWithHeaders(
+					[]string{http.MethodGet},
+					"Last-Event-ID",
+				),
+				identityMiddleware,
+			).Handle(
+				"/streams/{stream_id}",
+				resumeHandler,
+			)
+		}
 	})
 
+	if cfg.Moderation.Enabled {
+		proxyOpts = append(proxyOpts, handlers.WithModeration(moderation.NewClient(moderation.Config{
+			BaseURL:    cfg.Moderation.BaseURL,
+			APIKey:     cfg.Moderation.APIKey,
+			Model:      cfg.Moderation.Model,
+			Thresholds: cfg.Moderation.CategoryThresholds,
+			FailOpen:   cfg.Moderation.FailOpen,
+			Timeout:    cfg.Moderation.Timeout,
+		})))
+	}
+
+	if cfg.Guardrails.Enabled {
+		rules, err := guardrails.NewRules(
+			cfg.Guardrails.BlockedTerms,
+			cfg.Guardrails.BlockedPatterns,
+			cfg.Guardrails.MaxOutputChars,
+		)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid guardrails config")
+		}
+
+		proxyOpts = append(proxyOpts, handlers.WithGuardrails(rules))
+	}
+
+	if cfg.StreamHeartbeatInterval > 0 {
+		proxyOpts = append(proxyOpts, handlers.WithHeartbeat(cfg.StreamHeartbeatInterval))
+	}
+
+	if cfg.ServerTools.Enabled {
+		registry, err := tools.NewRegistry(tools.CurrentTime{})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error registering server tools")
+		}
+
+		executor, err := tools.NewExecutor(registry, tools.ExecutorConfig{
+			ModelTools:    cfg.ServerTools.AllModelTools(),
+			Timeout:       cfg.ServerTools.Timeout,
+			MaxIterations: cfg.ServerTools.MaxIterations,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid server tools config")
+		}
+
+		proxyOpts = append(proxyOpts, handlers.WithServerTools(executor))
+	}
+
+	if cfg.SystemPrompts.File != "" {
+		systemPrompts, err := prompts.Load(cfg.SystemPrompts.File)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error loading system prompts")
+		}
+
+		proxyOpts = append(proxyOpts, handlers.WithSystemPrompts(systemPrompts, cfg.SystemPrompts.DefaultLocale))
+	}
+
 	// OpenAI compatible routes
 	r.Route("/openai/v1", func(r chi.Router) {
 		r.Use(middleware.PreflightMiddleware)
 		r.Use(middleware.ExtractModelMiddleware(logger))
 		r.Use(middleware.ModelAllowlistMiddleware(logger, cfg.Backends))
 
+		// Owner of conversations referenced by conversation_id, of inlined
+		// files in owner only mode, and of resumable streams
+		if conversationStore != nil || cfg.FileAccess.OwnerOnly || streamRegistry != nil {
+			r.Use(identityMiddleware)
+		}
+
 		// Do not use r.Use as it will match every /openai/v1/* route, only
 		// want to match specific routes.
 		// Needs to run after ExtractModelMiddleware.
@@ -147,6 +524,7 @@ func main() {
 				cfg.Backends,
 				logger,
 				chatCompletionsRoute,
+				proxyOpts...,
 			),
 		)
 
@@ -157,6 +535,7 @@ func main() {
 				cfg.Backends,
 				logger,
 				imageGenerationsRoute,
+				proxyOpts...,
 			),
 		)
 	})
@@ -215,6 +594,8 @@ func main() {
 
 	logger.Info().Msg("Received signal, shutting down server (10s timeout)...")
 
+	stopBackground()
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -230,5 +611,11 @@ func main() {
 		logger.Error().Err(err).Msg("shutdown API server err")
 	}
 
+	if conversationStore != nil {
+		if err := conversationStore.Close(); err != nil {
+			logger.Error().Err(err).Msg("close conversations store err")
+		}
+	}
+
 	logger.Info().Msg("Server shut down")
 }
@@ -0,0 +1,218 @@
+package apierror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// Error types, the same as the OpenAI API
+const (
+	TypeInvalidRequest = "invalid_request_error"
+	TypeRateLimit      = "rate_limit_error"
+	TypeServer         = "server_error"
+)
+
+// Error codes for errors that are not request validation errors
+const (
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeRequestTooLarge  = "request_too_large"
+	CodeRateLimited      = "rate_limit_exceeded"
+	CodeUpstreamError    = "upstream_error"
+	CodeUpstreamTimeout  = "upstream_timeout"
+)
+
+// maxUpstreamErrorSize is the maximum upstream error body that is read, larger
+// bodies are truncated
+const maxUpstreamErrorSize = 64 * 1024
+
+// maxUpstreamMessageSize is the maximum plain text upstream error used as the
+// error message
+const maxUpstreamMessageSize = 1024
+
+// Error is an API error that is written as an OpenAI error response
+type Error struct {
+	StatusCode int
+	Type       string
+	// Code and Param are optional
+	Code    string
+	Param   string
+	Message string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New creates a new Error
+func New(statusCode int, errorType, code, message string) *Error {
+	return &Error{
+		StatusCode: statusCode,
+		Type:       errorType,
+		Code:       code,
+		Message:    message,
+	}
+}
+
+// WithParam returns a copy of the error for the given request parameter
+func (e *Error) WithParam(param string) *Error {
+	withParam := *e
+	withParam.Param = param
+
+	return &withParam
+}
+
+// Response returns the error as an OpenAI error response body
+func (e *Error) Response(requestID string) types.ErrorResponse {
+	return types.ErrorResponse{
+		ErrorBody: &types.Error{
+			Message:   e.Message,
+			Type:      e.Type,
+			Param:     nullable(e.Param),
+			Code:      nullable(e.Code),
+			RequestID: requestID,
+		},
+	}
+}
+
+// InvalidRequest is a 400 error for an invalid request, code is optional
+func InvalidRequest(code, message string) *Error {
+	return New(http.StatusBadRequest, TypeInvalidRequest, code, message)
+}
+
+// Forbidden is a 403 error for a request that is not allowed to access the
+// resource
+func Forbidden(code, message string) *Error {
+	return New(http.StatusForbidden, TypeInvalidRequest, code, message)
+}
+
+// NotFound is a 404 error for an unknown resource
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, TypeInvalidRequest, CodeNotFound, message)
+}
+
+// Gone is a 410 error for a resource that no longer exists
+func Gone(code, message string) *Error {
+	return New(http.StatusGone, TypeInvalidRequest, code, message)
+}
+
+// MethodNotAllowed is a 405 error for an unsupported method
+func MethodNotAllowed() *Error {
+	return New(
+		http.StatusMethodNotAllowed,
+		TypeInvalidRequest,
+		CodeMethodNotAllowed,
+		"method not allowed",
+	)
+}
+
+// RequestTooLarge is a 413 error for a request body over the size limit
+func RequestTooLarge(message string) *Error {
+	return New(http.StatusRequestEntityTooLarge, TypeInvalidRequest, CodeRequestTooLarge, message)
+}
+
+// RateLimited is a 429 error for clients over the rate limit
+func RateLimited(message string) *Error {
+	return New(http.StatusTooManyRequests, TypeRateLimit, CodeRateLimited, message)
+}
+
+// Internal is a 500 error, the message should not include internal details
+func Internal(message string) *Error {
+	return New(http.StatusInternalServerError, TypeServer, "", message)
+}
+
+// Unavailable is a 503 error for a dependency that is unavailable
+func Unavailable(code, message string) *Error {
+	return New(http.StatusServiceUnavailable, TypeServer, code, message)
+}
+
+// Upstream maps an error from a backend request to a 504 error for timeouts
+// or a 502 error otherwise. The underlying error is not included as it may
+// contain backend URLs.
+func Upstream(err error) *Error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return New(
+			http.StatusGatewayTimeout,
+			TypeServer,
+			CodeUpstreamTimeout,
+			"the backend did not respond in time",
+		)
+	}
+
+	return New(
+		http.StatusBadGateway,
+		TypeServer,
+		CodeUpstreamError,
+		"error communicating with the backend",
+	)
+}
+
+// Write writes the error as an OpenAI error response with the request ID
+func Write(w http.ResponseWriter, r *http.Request, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.StatusCode)
+
+	json.NewEncoder(w).Encode(e.Response(types.RequestIDFromContext(r.Context())))
+}
+
+// UpstreamResponseBody returns the body of an upstream error response. JSON
+// bodies, e.g. OpenAI errors, are returned unchanged. Other bodies, e.g. an
+// HTML page from a load balancer, are wrapped in an OpenAI error with the same
+// status.
+func UpstreamResponseBody(statusCode int, body []byte, requestID string) []byte {
+	if json.Valid(body) {
+		return body
+	}
+
+	errorType := TypeServer
+	if statusCode < http.StatusInternalServerError {
+		errorType = TypeInvalidRequest
+	}
+
+	// Plain text errors are kept, markup is not useful to API clients
+	message := strings.TrimSpace(string(body))
+	if message == "" || strings.HasPrefix(message, "<") || len(message) > maxUpstreamMessageSize {
+		message = http.StatusText(statusCode)
+	}
+
+	data, _ := json.Marshal(
+		New(statusCode, errorType, CodeUpstreamError, message).Response(requestID),
+	)
+
+	return data
+}
+
+// ReadUpstreamBody reads an upstream error response body up to the maximum
+// size and closes it, replacing it with the body for the client
+func ReadUpstreamBody(res *http.Response, requestID string) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxUpstreamErrorSize))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	body = UpstreamResponseBody(res.StatusCode, body, requestID)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Type", "application/json")
+
+	return body, nil
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
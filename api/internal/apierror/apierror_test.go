@@ -0,0 +1,113 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req = req.WithContext(types.AddRequestIDToContext(req.Context(), "req-123"))
+
+	rr := httptest.NewRecorder()
+	Write(rr, req, InvalidRequest("model_not_found", "invalid model ID").WithParam("model"))
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	require.JSONEq(t, `{
+		"error": {
+			"message": "invalid model ID",
+			"type": "invalid_request_error",
+			"param": "model",
+			"code": "model_not_found",
+			"request_id": "req-123"
+		}
+	}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	Write(rr, httptest.NewRequest(http.MethodGet, "/", nil), Internal("internal server error"))
+
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.JSONEq(t, `{
+		"error": {
+			"message": "internal server error",
+			"type": "server_error",
+			"param": null,
+			"code": null
+		}
+	}`, rr.Body.String(), "param and code should be null and request ID omitted")
+}
+
+func TestUpstream(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		expectedCode int
+	}{
+		{
+			name:         "deadline exceeded",
+			err:          fmt.Errorf("post: %w", context.DeadlineExceeded),
+			expectedCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:         "network timeout",
+			err:          fmt.Errorf("dial: %w", os.ErrDeadlineExceeded),
+			expectedCode: http.StatusGatewayTimeout,
+		},
+		{
+			name:         "connection refused",
+			err:          errors.New("dial tcp 10.0.0.1:443: connect: connection refused"),
+			expectedCode: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := Upstream(tt.err)
+
+			require.Equal(t, tt.expectedCode, apiErr.StatusCode)
+			require.Equal(t, TypeServer, apiErr.Type)
+			require.NotContains(t, apiErr.Message, "10.0.0.1", "backend address should not be exposed")
+		})
+	}
+}
+
+func TestUpstreamResponseBody(t *testing.T) {
+	t.Run("JSON body is unchanged", func(t *testing.T) {
+		body := []byte(`{"error": {"message": "Rate limit reached", "type": "requests", "param": null, "code": "rate_limit_exceeded"}}`)
+		require.Equal(t, body, UpstreamResponseBody(http.StatusTooManyRequests, body, "req-1"))
+	})
+
+	t.Run("plain text body is wrapped", func(t *testing.T) {
+		body := UpstreamResponseBody(http.StatusBadRequest, []byte("model is overloaded\n"), "req-1")
+		require.JSONEq(t, `{
+			"error": {
+				"message": "model is overloaded",
+				"type": "invalid_request_error",
+				"param": null,
+				"code": "upstream_error",
+				"request_id": "req-1"
+			}
+		}`, string(body))
+	})
+
+	t.Run("HTML body is replaced with status text", func(t *testing.T) {
+		body := UpstreamResponseBody(http.StatusBadGateway, []byte("<html><body>502 Bad Gateway</body></html>"), "")
+		require.JSONEq(t, `{
+			"error": {
+				"message": "Bad Gateway",
+				"type": "server_error",
+				"param": null,
+				"code": "upstream_error"
+			}
+		}`, string(body))
+	})
+}
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/kava-labs/kavachat/api/internal/types"
@@ -23,7 +29,76 @@ type Config struct {
 	S3BucketName        string `env:"S3_BUCKET"`
 	S3PathStyleRequests bool   `env:"S3_PATH_STYLE_REQUESTS" envDefault:"false"`
 
+	// Storage backend of uploaded files
+	Storage StorageConfig `envPrefix:"STORAGE_"`
+
+	// Retention of files per upload type and deletion of expired files
+	FileRetention FileRetentionConfig `envPrefix:"FILE_RETENTION_"`
+
+	// FileCacheControl is the Cache-Control header of file downloads, empty
+	// for none. File keys are never reused so files are immutable.
+	FileCacheControl string `env:"FILE_CACHE_CONTROL" envDefault:"public, max-age=31536000, immutable"`
+
+	// Signed file URLs and owner only downloads
+	FileAccess FileAccessConfig `envPrefix:"FILE_ACCESS_"`
+
+	// Presigned S3 URLs for downloads and direct uploads
+	PresignedURLs PresignedURLsConfig `envPrefix:"PRESIGNED_URLS_"`
+
+	// UploadMaxBytes is the max size of uploads in a single request, files are
+	// processed in memory
+	UploadMaxBytes int64 `env:"UPLOAD_MAX_BYTES" envDefault:"10485760"`
+
+	// Chunked uploads of large files with S3 multipart uploads
+	MultipartUploads MultipartUploadsConfig `envPrefix:"MULTIPART_UPLOADS_"`
+
+	// UploadAllowedContentTypes are the content types of uploaded files, as
+	// detected from the file content. Audio files are detected as audio/mpeg,
+	// audio/wav and audio/mp4.
+	UploadAllowedContentTypes []string `env:"UPLOAD_ALLOWED_CONTENT_TYPES" envSeparator:"," envDefault:"image/png,image/jpeg,image/gif,image/webp,image/heic,application/pdf,text/plain,text/markdown,text/csv,application/vnd.openxmlformats-officedocument.wordprocessingml.document,audio/mpeg,audio/wav,audio/mp4"`
+
+	// Malware scanning of uploads
+	Scanner ScannerConfig `envPrefix:"SCANNER_"`
+
+	// Image upload processing
+	ImageProcessing ImageProcessingConfig `envPrefix:"IMAGE_PROCESSING_"`
+
+	// Document text extraction and file parts in chat completions
+	TextExtraction TextExtractionConfig `envPrefix:"TEXT_EXTRACTION_"`
+
+	// PersistGeneratedImages stores generated images as files and returns
+	// file URLs instead of the short-lived provider URLs
+	PersistGeneratedImages bool `env:"PERSIST_GENERATED_IMAGES" envDefault:"false"`
+
+	// Uploaded file URLs in chat completions inlined as data URLs
+	InlineFiles InlineFilesConfig `envPrefix:"INLINE_FILES_"`
+
 	Backends OpenAIBackends `envPrefix:"BACKEND"`
+
+	// Pre-request moderation
+	Moderation ModerationConfig `envPrefix:"MODERATION_"`
+
+	// Streaming output guardrails
+	Guardrails GuardrailsConfig `envPrefix:"GUARDRAILS_"`
+
+	// StreamHeartbeatInterval is the idle interval after which SSE comment
+	// lines are sent on streaming requests, 0 to disable
+	StreamHeartbeatInterval time.Duration `env:"STREAM_HEARTBEAT_INTERVAL" envDefault:"0s"`
+
+	// Resumable streams with Last-Event-ID reconnects
+	ResumableStreams ResumableStreamsConfig `envPrefix:"RESUMABLE_STREAMS_"`
+
+	// Request hedging for backends with HEDGED_MODELS
+	Hedging HedgingConfig `envPrefix:"HEDGING_"`
+
+	// Server-side tool execution for chat completions
+	ServerTools ServerToolsConfig `envPrefix:"SERVER_TOOLS_"`
+
+	// Server-side conversation persistence
+	Conversations ConversationsConfig `envPrefix:"CONVERSATIONS_"`
+
+	// System prompt templates for chat completions
+	SystemPrompts SystemPromptsConfig `envPrefix:"SYSTEM_PROMPTS_"`
 }
 
 // Validate checks if the required fields are set
@@ -46,11 +121,124 @@ func (c Config) Validate() error {
 		return errors.New("LOG_FORMAT must be 'plain' or 'json'")
 	}
 
-	// S3 bucket required
-	if strings.TrimSpace(c.S3BucketName) == "" {
+	if err := c.Storage.Validate(); err != nil {
+		return fmt.Errorf("invalid storage config: %w", err)
+	}
+
+	if err := c.FileRetention.Validate(); err != nil {
+		return fmt.Errorf("invalid file retention config: %w", err)
+	}
+
+	if err := c.FileAccess.Validate(); err != nil {
+		return fmt.Errorf("invalid file access config: %w", err)
+	}
+
+	// Files without a stored expiration must not be deleted before the
+	// uploads stored with one
+	if c.Storage.TTL < c.FileRetention.Uploads {
+		return errors.New("STORAGE_TTL cannot be shorter than FILE_RETENTION_UPLOADS")
+	}
+
+	// Shared caches would serve files of an owner to anyone
+	if c.FileAccess.OwnerOnly && strings.Contains(strings.ToLower(c.FileCacheControl), "public") {
+		return errors.New("FILE_CACHE_CONTROL cannot be public with FILE_ACCESS_OWNER_ONLY")
+	}
+
+	// Cached responses would be served for signed URLs after they expired
+	if c.FileAccess.SignedURLs {
+		directives := cacheControlDirectives(c.FileCacheControl)
+		if _, ok := directives["public"]; ok {
+			return errors.New("FILE_CACHE_CONTROL cannot be public with FILE_ACCESS_SIGNED_URLS")
+		}
+
+		if _, ok := directives["s-maxage"]; ok {
+			return errors.New("FILE_CACHE_CONTROL cannot have s-maxage with FILE_ACCESS_SIGNED_URLS")
+		}
+
+		if maxAge, err := strconv.Atoi(directives["max-age"]); err == nil && time.Duration(maxAge)*time.Second > c.FileAccess.URLTTL {
+			return errors.New("FILE_CACHE_CONTROL max-age cannot be longer than FILE_ACCESS_URL_TTL")
+		}
+	}
+
+	// S3 bucket required for the S3 storage and S3-only features
+	if c.Storage.Backend == "s3" && strings.TrimSpace(c.S3BucketName) == "" {
 		return errors.New("S3_BUCKET cannot be empty string")
 	}
 
+	if c.Storage.Backend != "s3" {
+		if c.PresignedURLs.DownloadRedirects || c.PresignedURLs.DirectUploads {
+			return errors.New("presigned URLs require the s3 storage backend")
+		}
+
+		if c.MultipartUploads.Enabled {
+			return errors.New("multipart uploads require the s3 storage backend")
+		}
+	}
+
+	if c.StreamHeartbeatInterval < 0 {
+		return errors.New("STREAM_HEARTBEAT_INTERVAL cannot be negative")
+	}
+
+	if err := c.Moderation.Validate(); err != nil {
+		return fmt.Errorf("invalid moderation config: %w", err)
+	}
+
+	if err := c.Guardrails.Validate(); err != nil {
+		return fmt.Errorf("invalid guardrails config: %w", err)
+	}
+
+	if err := c.ResumableStreams.Validate(); err != nil {
+		return fmt.Errorf("invalid resumable streams config: %w", err)
+	}
+
+	// Hedging settings are only used by backends with hedged models
+	if c.Backends.hasHedgedModels() {
+		if err := c.Hedging.Validate(); err != nil {
+			return fmt.Errorf("invalid hedging config: %w", err)
+		}
+	}
+
+	if err := c.ServerTools.Validate(); err != nil {
+		return fmt.Errorf("invalid server tools config: %w", err)
+	}
+
+	if err := c.Conversations.Validate(); err != nil {
+		return fmt.Errorf("invalid conversations config: %w", err)
+	}
+
+	if err := c.PresignedURLs.Validate(); err != nil {
+		return fmt.Errorf("invalid presigned URLs config: %w", err)
+	}
+
+	// Zero uses the handler default
+	if c.UploadMaxBytes < 0 {
+		return errors.New("UPLOAD_MAX_BYTES must not be negative")
+	}
+
+	if err := c.MultipartUploads.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Scanner.Validate(); err != nil {
+		return fmt.Errorf("invalid scanner config: %w", err)
+	}
+
+	if err := c.ImageProcessing.Validate(); err != nil {
+		return fmt.Errorf("invalid image processing config: %w", err)
+	}
+
+	if err := c.TextExtraction.Validate(); err != nil {
+		return fmt.Errorf("invalid text extraction config: %w", err)
+	}
+
+	if err := c.InlineFiles.Validate(); err != nil {
+		return fmt.Errorf("invalid inline files config: %w", err)
+	}
+
+	if err := c.SystemPrompts.Validate(); err != nil {
+		return fmt.Errorf("invalid system prompts config: %w", err)
+	}
+
 	// Validate backends
 	return c.Backends.Validate()
 }
@@ -63,8 +251,8 @@ func (c Config) LogFormatIsJSON() bool {
 // String returns a string representation of the configuration with the API key redacted
 func (c Config) String() string {
 	return fmt.Sprintf(
-		"LogLevel: %s, ServerPort: %d, ServerHost: %s, PublicURL: %s, MetricsPort: %d, S3BucketName: %s, Backends: %v",
-		c.LogLevel, c.ServerPort, c.ServerHost, c.PublicURL, c.MetricsPort, c.S3BucketName, c.Backends,
+		"LogLevel: %s, ServerPort: %d, ServerHost: %s, PublicURL: %s, MetricsPort: %d, S3BucketName: %s, Storage: %+v, FileRetention: %+v, FileAccess: %v, FileCacheControl: %s, PresignedURLs: %+v, UploadMaxBytes: %d, MultipartUploads: %+v, UploadAllowedContentTypes: %v, Scanner: %+v, ImageProcessing: %+v, TextExtraction: %+v, PersistGeneratedImages: %t, InlineFiles: %+v, Backends: %v, Moderation: %v, Guardrails: %v, StreamHeartbeatInterval: %s, ResumableStreams: %+v, Hedging: %+v, ServerTools: %+v, Conversations: %+v, SystemPrompts: %+v",
+		c.LogLevel, c.ServerPort, c.ServerHost, c.PublicURL, c.MetricsPort, c.S3BucketName, c.Storage, c.FileRetention, c.FileAccess, c.FileCacheControl, c.PresignedURLs, c.UploadMaxBytes, c.MultipartUploads, c.UploadAllowedContentTypes, c.Scanner, c.ImageProcessing, c.TextExtraction, c.PersistGeneratedImages, c.InlineFiles, c.Backends, c.Moderation, c.Guardrails, c.StreamHeartbeatInterval, c.ResumableStreams, c.Hedging, c.ServerTools, c.Conversations, c.SystemPrompts,
 	)
 }
 
@@ -76,6 +264,639 @@ func NewConfigFromEnv() (Config, error) {
 	return cfg, err
 }
 
+// ModerationConfig is the configuration for the moderation gate that checks
+// chat completion and image generation requests before they are forwarded.
+type ModerationConfig struct {
+	Enabled bool   `env:"ENABLED" envDefault:"false"`
+	BaseURL string `env:"BASE_URL"`
+	APIKey  string `env:"API_KEY"`
+	Model   string `env:"MODEL" envDefault:"omni-moderation-latest"`
+
+	// CategoryThresholds e.g. "violence:0.7,self-harm:0.2"
+	CategoryThresholds map[string]float64 `env:"CATEGORY_THRESHOLDS" envSeparator:"," envKeyValSeparator:":"`
+
+	// FailOpen allows requests when the moderation backend is unavailable,
+	// otherwise they are rejected.
+	FailOpen bool          `env:"FAIL_OPEN" envDefault:"false"`
+	Timeout  time.Duration `env:"TIMEOUT" envDefault:"5s"`
+}
+
+// Validate checks if the required fields are set when moderation is enabled
+func (m ModerationConfig) Validate() error {
+	if !m.Enabled {
+		return nil
+	}
+
+	if m.BaseURL == "" {
+		return errors.New("MODERATION_BASE_URL is required when moderation is enabled")
+	}
+
+	if m.Model == "" {
+		return errors.New("MODERATION_MODEL cannot be empty")
+	}
+
+	if m.Timeout <= 0 {
+		return errors.New("MODERATION_TIMEOUT must be positive")
+	}
+
+	for category, threshold := range m.CategoryThresholds {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf(
+				"MODERATION_CATEGORY_THRESHOLDS value for '%s' must be between 0 and 1",
+				category,
+			)
+		}
+	}
+
+	return nil
+}
+
+// String returns a string representation of the moderation config with the
+// API key redacted
+func (m ModerationConfig) String() string {
+	return fmt.Sprintf(
+		"Enabled: %t, BaseURL: %s, APIKey: %s, Model: %s, CategoryThresholds: %v, FailOpen: %t, Timeout: %s",
+		m.Enabled, m.BaseURL, "REDACTED", m.Model, m.CategoryThresholds, m.FailOpen, m.Timeout,
+	)
+}
+
+// GuardrailsConfig is the configuration for the output guardrails that inspect
+// streamed chat completions and terminate them when a rule trips.
+type GuardrailsConfig struct {
+	Enabled      bool     `env:"ENABLED" envDefault:"false"`
+	BlockedTerms []string `env:"BLOCKED_TERMS" envSeparator:","`
+	// Patterns are separated by semicolons as regular expressions commonly
+	// contain commas
+	BlockedPatterns []string `env:"BLOCKED_PATTERNS" envSeparator:";"`
+	// MaxOutputChars limits the assistant text length, 0 to disable
+	MaxOutputChars int `env:"MAX_OUTPUT_CHARS" envDefault:"0"`
+}
+
+// Validate checks that the patterns compile and at least one rule is set when
+// guardrails are enabled
+func (g GuardrailsConfig) Validate() error {
+	if !g.Enabled {
+		return nil
+	}
+
+	if len(g.BlockedTerms) == 0 && len(g.BlockedPatterns) == 0 && g.MaxOutputChars == 0 {
+		return errors.New("at least one of GUARDRAILS_BLOCKED_TERMS, GUARDRAILS_BLOCKED_PATTERNS or GUARDRAILS_MAX_OUTPUT_CHARS is required when guardrails are enabled")
+	}
+
+	if g.MaxOutputChars < 0 {
+		return errors.New("GUARDRAILS_MAX_OUTPUT_CHARS cannot be negative")
+	}
+
+	for _, pattern := range g.BlockedPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("GUARDRAILS_BLOCKED_PATTERNS has invalid pattern '%s': %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// String returns a string representation of the guardrails config, terms and
+// patterns are summarized to avoid logging them
+func (g GuardrailsConfig) String() string {
+	return fmt.Sprintf(
+		"Enabled: %t, BlockedTerms: %d, BlockedPatterns: %d, MaxOutputChars: %d",
+		g.Enabled, len(g.BlockedTerms), len(g.BlockedPatterns), g.MaxOutputChars,
+	)
+}
+
+// ResumableStreamsConfig is the configuration for resumable streams. Streamed
+// chat completions are buffered so clients can reconnect and receive missed
+// events, while the upstream request continues without the client.
+type ResumableStreamsConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// TTL is how long a finished stream is kept for reconnects
+	TTL time.Duration `env:"TTL" envDefault:"5m"`
+	// MaxBytes is the maximum buffered size per stream, the oldest events are
+	// dropped when exceeded
+	MaxBytes int `env:"MAX_BYTES" envDefault:"1048576"`
+	// MaxDuration limits how long the upstream request of a stream may run
+	MaxDuration time.Duration `env:"MAX_DURATION" envDefault:"10m"`
+}
+
+// Validate checks the limits are positive when resumable streams are enabled
+func (s ResumableStreamsConfig) Validate() error {
+	if !s.Enabled {
+		return nil
+	}
+
+	if s.TTL <= 0 {
+		return errors.New("RESUMABLE_STREAMS_TTL must be positive")
+	}
+
+	if s.MaxBytes <= 0 {
+		return errors.New("RESUMABLE_STREAMS_MAX_BYTES must be positive")
+	}
+
+	if s.MaxDuration <= 0 {
+		return errors.New("RESUMABLE_STREAMS_MAX_DURATION must be positive")
+	}
+
+	return nil
+}
+
+// HedgingConfig is the configuration for the hedge delay of hedged models. The
+// delay is a percentile of the recent time to first byte of the primary
+// backend.
+type HedgingConfig struct {
+	Percentile float64 `env:"PERCENTILE" envDefault:"95"`
+	// InitialDelay is used until there are enough samples
+	InitialDelay time.Duration `env:"INITIAL_DELAY" envDefault:"2s"`
+	MinDelay     time.Duration `env:"MIN_DELAY" envDefault:"100ms"`
+	MaxDelay     time.Duration `env:"MAX_DELAY" envDefault:"10s"`
+	MinSamples   int           `env:"MIN_SAMPLES" envDefault:"20"`
+	WindowSize   int           `env:"WINDOW_SIZE" envDefault:"200"`
+}
+
+// Validate checks the hedging delay settings are consistent
+func (h HedgingConfig) Validate() error {
+	if h.Percentile <= 0 || h.Percentile > 100 {
+		return errors.New("HEDGING_PERCENTILE must be between 0 and 100")
+	}
+
+	if h.MinDelay < 0 || h.InitialDelay < 0 {
+		return errors.New("HEDGING_MIN_DELAY and HEDGING_INITIAL_DELAY must not be negative")
+	}
+
+	if h.MaxDelay < h.MinDelay {
+		return errors.New("HEDGING_MAX_DELAY must not be less than HEDGING_MIN_DELAY")
+	}
+
+	if h.WindowSize <= 0 {
+		return errors.New("HEDGING_WINDOW_SIZE must be positive")
+	}
+
+	if h.MinSamples < 0 || h.MinSamples > h.WindowSize {
+		return errors.New("HEDGING_MIN_SAMPLES must be between 0 and HEDGING_WINDOW_SIZE")
+	}
+
+	return nil
+}
+
+// ServerToolsConfig is the configuration for server-side tools that are
+// executed by the proxy for chat completion requests with server_tools set.
+type ServerToolsConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// ModelTools are the tools each model may use, tool names are separated
+	// by "|", e.g. "gpt-4o:current_time|calculator,deepseek-r1:current_time"
+	ModelTools map[string]string `env:"MODEL_TOOLS" envSeparator:"," envKeyValSeparator:":"`
+	// Timeout limits each tool execution
+	Timeout time.Duration `env:"TIMEOUT" envDefault:"10s"`
+	// MaxIterations is the maximum number of rounds of tool calls before the
+	// model must give a final answer
+	MaxIterations int `env:"MAX_ITERATIONS" envDefault:"5"`
+}
+
+// Validate checks the limits are positive and tools are configured when server
+// tools are enabled. Tool names are checked against the registry on startup.
+func (s ServerToolsConfig) Validate() error {
+	if !s.Enabled {
+		return nil
+	}
+
+	if len(s.ModelTools) == 0 {
+		return errors.New("SERVER_TOOLS_MODEL_TOOLS is required when server tools are enabled")
+	}
+
+	for model := range s.ModelTools {
+		if len(s.Tools(model)) == 0 {
+			return fmt.Errorf("SERVER_TOOLS_MODEL_TOOLS has no tools for model '%s'", model)
+		}
+	}
+
+	if s.Timeout <= 0 {
+		return errors.New("SERVER_TOOLS_TIMEOUT must be positive")
+	}
+
+	if s.MaxIterations <= 0 {
+		return errors.New("SERVER_TOOLS_MAX_ITERATIONS must be positive")
+	}
+
+	return nil
+}
+
+// Tools returns the tool names the model may use
+func (s ServerToolsConfig) Tools(model string) []string {
+	var names []string
+	for _, name := range strings.Split(s.ModelTools[model], "|") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// AllModelTools returns the tool names of every model
+func (s ServerToolsConfig) AllModelTools() map[string][]string {
+	modelTools := make(map[string][]string, len(s.ModelTools))
+	for model := range s.ModelTools {
+		modelTools[model] = s.Tools(model)
+	}
+
+	return modelTools
+}
+
+// ConversationsConfig is the configuration for the conversations API and
+// conversation_id on chat completion requests.
+type ConversationsConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// Store is "sqlite" or "memory"
+	Store      string `env:"STORE" envDefault:"sqlite"`
+	SQLitePath string `env:"SQLITE_PATH" envDefault:"kavachat.db"`
+	// UserHeader is the header with the authenticated user ID set by a
+	// trusted authentication proxy. Requests without it use anonymous
+	// sessions.
+	UserHeader string `env:"USER_HEADER"`
+	// APIKeys are client API keys sent as a Bearer token, requests with one
+	// of them are owned by the key instead of an anonymous session
+	APIKeys []string `env:"API_KEYS" envSeparator:","`
+}
+
+// Validate checks the store settings when conversations are enabled
+func (c ConversationsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	switch c.Store {
+	case "sqlite":
+		if c.SQLitePath == "" {
+			return errors.New("CONVERSATIONS_SQLITE_PATH is required for the sqlite store")
+		}
+	case "memory":
+	default:
+		return errors.New("CONVERSATIONS_STORE must be 'sqlite' or 'memory'")
+	}
+
+	return nil
+}
+
+// String returns a string representation of the conversations config with
+// the API keys redacted
+func (c ConversationsConfig) String() string {
+	return fmt.Sprintf(
+		"Enabled: %t, Store: %s, SQLitePath: %s, UserHeader: %s, APIKeys: %d REDACTED",
+		c.Enabled, c.Store, c.SQLitePath, c.UserHeader, len(c.APIKeys),
+	)
+}
+
+// ScannerConfig is the configuration for scanning uploads for malware with
+// clamd before they are stored.
+type ScannerConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// ClamdAddress is unix:///path/to/clamd.sock or tcp://host:port
+	ClamdAddress string        `env:"CLAMD_ADDRESS" envDefault:"unix:///var/run/clamav/clamd.ctl"`
+	Timeout      time.Duration `env:"TIMEOUT" envDefault:"30s"`
+	// FailOpen stores files when the scanner is unavailable, otherwise
+	// uploads are rejected.
+	FailOpen bool `env:"FAIL_OPEN" envDefault:"false"`
+}
+
+// Validate checks the clamd address when scanning is enabled
+func (s ScannerConfig) Validate() error {
+	if !s.Enabled {
+		return nil
+	}
+
+	if !strings.HasPrefix(s.ClamdAddress, "unix://") && !strings.HasPrefix(s.ClamdAddress, "tcp://") {
+		return errors.New("SCANNER_CLAMD_ADDRESS must start with unix:// or tcp://")
+	}
+
+	if s.Timeout <= 0 {
+		return errors.New("SCANNER_TIMEOUT must be positive")
+	}
+
+	return nil
+}
+
+// StorageConfig is the configuration for the storage of uploaded files.
+type StorageConfig struct {
+	// Backend is "s3", "local" or "memory"
+	Backend string `env:"BACKEND" envDefault:"s3"`
+	// LocalPath is the directory of the local backend
+	LocalPath string `env:"LOCAL_PATH" envDefault:"./data/files"`
+	// TTL is how long objects stored without an expiration are kept, e.g.
+	// staged uploads and files stored before FILE_RETENTION. Files are stored
+	// with the expiration of their FILE_RETENTION, which takes precedence.
+	// The S3 bucket lifecycle rules take precedence if the bucket has an
+	// expiration rule.
+	TTL time.Duration `env:"TTL" envDefault:"24h"`
+	// Dedup stores uploads with the same content once, each upload still gets
+	// its own file ID
+	Dedup bool `env:"DEDUP" envDefault:"false"`
+}
+
+// Validate checks the backend settings
+func (s StorageConfig) Validate() error {
+	switch s.Backend {
+	case "local":
+		if s.LocalPath == "" {
+			return errors.New("STORAGE_LOCAL_PATH is required for the local backend")
+		}
+	case "s3", "memory":
+	default:
+		return errors.New("STORAGE_BACKEND must be 's3', 'local' or 'memory'")
+	}
+
+	if s.TTL <= 0 {
+		return errors.New("STORAGE_TTL must be positive")
+	}
+
+	return nil
+}
+
+// FileRetentionConfig is the configuration for how long files are kept per
+// upload type, and the sweeper that deletes expired files.
+type FileRetentionConfig struct {
+	// Uploads is the retention of files uploaded by clients
+	Uploads time.Duration `env:"UPLOADS" envDefault:"24h"`
+	// GeneratedImages is the retention of stored generated images
+	GeneratedImages time.Duration `env:"GENERATED_IMAGES" envDefault:"24h"`
+	// SweepEnabled deletes expired files in the background, only one replica
+	// sweeps at a time
+	SweepEnabled  bool          `env:"SWEEP_ENABLED" envDefault:"true"`
+	SweepInterval time.Duration `env:"SWEEP_INTERVAL" envDefault:"1h"`
+}
+
+// Validate checks the retention periods and the sweep interval when the
+// sweeper is enabled
+func (f FileRetentionConfig) Validate() error {
+	if f.Uploads <= 0 || f.GeneratedImages <= 0 {
+		return errors.New("FILE_RETENTION_UPLOADS and FILE_RETENTION_GENERATED_IMAGES must be positive")
+	}
+
+	if f.SweepEnabled && f.SweepInterval <= 0 {
+		return errors.New("FILE_RETENTION_SWEEP_INTERVAL must be positive")
+	}
+
+	return nil
+}
+
+// FileAccessConfig is the configuration for who can download files. File URLs
+// are signed with HMAC keys so they expire, and owner only downloads restrict
+// files to the session or user that uploaded them.
+type FileAccessConfig struct {
+	// SignedURLs signs file URLs and rejects downloads without a valid
+	// signature
+	SignedURLs bool `env:"SIGNED_URLS" envDefault:"false"`
+	// SigningKeyID is the ID of the key used to sign new URLs
+	SigningKeyID string `env:"SIGNING_KEY_ID"`
+	// SigningKeys are the secrets by key ID, e.g. "2025a:secret,2025b:secret".
+	// URLs signed with any of the keys are valid, keys are rotated by adding a
+	// new key, signing with it, and removing the old key after the URL TTL.
+	SigningKeys map[string]string `env:"SIGNING_KEYS" envSeparator:"," envKeyValSeparator:":"`
+	// URLTTL is how long signed URLs are valid
+	URLTTL time.Duration `env:"URL_TTL" envDefault:"24h"`
+	// OwnerOnly only serves files to the session or user that uploaded them
+	OwnerOnly bool `env:"OWNER_ONLY" envDefault:"false"`
+}
+
+// cacheControlDirectives parses the Cache-Control header into lowercase
+// directives and their values
+func cacheControlDirectives(cacheControl string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name == "" {
+			continue
+		}
+
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+
+	return directives
+}
+
+// minSigningKeyBytes is the min length of signing keys, the size of the
+// HMAC-SHA256 output
+const minSigningKeyBytes = 32
+
+// Validate checks the signing keys and URL TTL when signed URLs are enabled
+func (f FileAccessConfig) Validate() error {
+	if !f.SignedURLs {
+		return nil
+	}
+
+	if _, ok := f.SigningKeys[f.SigningKeyID]; !ok {
+		return errors.New("FILE_ACCESS_SIGNING_KEY_ID must be a key ID in FILE_ACCESS_SIGNING_KEYS")
+	}
+
+	for keyID, key := range f.SigningKeys {
+		if keyID == "" {
+			return errors.New("FILE_ACCESS_SIGNING_KEYS key IDs cannot be empty")
+		}
+
+		if len(key) < minSigningKeyBytes {
+			return fmt.Errorf("FILE_ACCESS_SIGNING_KEYS key %s must be at least %d bytes", keyID, minSigningKeyBytes)
+		}
+	}
+
+	if f.URLTTL <= 0 {
+		return errors.New("FILE_ACCESS_URL_TTL must be positive")
+	}
+
+	return nil
+}
+
+// String returns a string representation of the file access config with the
+// signing keys redacted
+func (f FileAccessConfig) String() string {
+	return fmt.Sprintf(
+		"SignedURLs: %t, SigningKeyID: %s, SigningKeys: %s, URLTTL: %s, OwnerOnly: %t",
+		f.SignedURLs, f.SigningKeyID, "REDACTED", f.URLTTL, f.OwnerOnly,
+	)
+}
+
+// PresignedURLsConfig is the configuration for redirecting downloads to S3
+// presigned URLs and uploading files directly to S3.
+type PresignedURLsConfig struct {
+	// DownloadRedirects redirects downloads to presigned GET URLs
+	DownloadRedirects bool `env:"DOWNLOAD_REDIRECTS" envDefault:"false"`
+	// DirectUploads enables POST /v1/files/uploads with presigned PUT URLs
+	DirectUploads bool `env:"DIRECT_UPLOADS" envDefault:"false"`
+	// TTL is how long presigned URLs are valid
+	TTL time.Duration `env:"TTL" envDefault:"15m"`
+}
+
+// Validate checks the TTL when presigned URLs are enabled
+func (p PresignedURLsConfig) Validate() error {
+	if !p.DownloadRedirects && !p.DirectUploads {
+		return nil
+	}
+
+	// S3 presigned URLs are valid for at most 7 days
+	if p.TTL <= 0 || p.TTL > 7*24*time.Hour {
+		return errors.New("PRESIGNED_URLS_TTL must be greater than 0 and at most 7 days")
+	}
+
+	return nil
+}
+
+// MultipartUploadsConfig is the configuration for chunked uploads of large
+// files with S3 multipart uploads.
+type MultipartUploadsConfig struct {
+	// Enabled enables the /v1/files/multipart routes
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxBytes is the max size of uploaded files
+	MaxBytes int64 `env:"MAX_BYTES" envDefault:"536870912"`
+	// MaxPartBytes is the max size of each part, parts are spooled to disk
+	MaxPartBytes int64 `env:"MAX_PART_BYTES" envDefault:"67108864"`
+	// AbandonAfter is how long uploads can be incomplete before their parts
+	// are deleted
+	AbandonAfter    time.Duration `env:"ABANDON_AFTER" envDefault:"24h"`
+	CleanupInterval time.Duration `env:"CLEANUP_INTERVAL" envDefault:"1h"`
+}
+
+// Validate checks the limits against the S3 multipart upload limits when
+// multipart uploads are enabled
+func (m MultipartUploadsConfig) Validate() error {
+	if !m.Enabled {
+		return nil
+	}
+
+	// Completed uploads are copied, S3 copies at most 5GB in one request
+	if m.MaxBytes <= 0 || m.MaxBytes > 5*1024*1024*1024 {
+		return errors.New("MULTIPART_UPLOADS_MAX_BYTES must be greater than 0 and at most 5GB")
+	}
+
+	// S3 parts except the last are at least 5MB and at most 5GB
+	if m.MaxPartBytes < 5*1024*1024 || m.MaxPartBytes > 5*1024*1024*1024 {
+		return errors.New("MULTIPART_UPLOADS_MAX_PART_BYTES must be between 5MB and 5GB")
+	}
+
+	if m.AbandonAfter <= 0 {
+		return errors.New("MULTIPART_UPLOADS_ABANDON_AFTER must be positive")
+	}
+
+	if m.CleanupInterval <= 0 {
+		return errors.New("MULTIPART_UPLOADS_CLEANUP_INTERVAL must be positive")
+	}
+
+	return nil
+}
+
+// ImageProcessingConfig is the configuration for re-encoding image uploads
+// without metadata, downscaling them and creating thumbnails.
+type ImageProcessingConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxDimension is the max width and height of stored images
+	MaxDimension int `env:"MAX_DIMENSION" envDefault:"2048"`
+	// MaxPixels is the max width * height of uploaded images, larger images
+	// are rejected before decoding
+	MaxPixels          int `env:"MAX_PIXELS" envDefault:"50000000"`
+	ThumbnailDimension int `env:"THUMBNAIL_DIMENSION" envDefault:"256"`
+	JPEGQuality        int `env:"JPEG_QUALITY" envDefault:"85"`
+}
+
+// Validate checks the limits when image processing is enabled
+func (i ImageProcessingConfig) Validate() error {
+	if !i.Enabled {
+		return nil
+	}
+
+	if i.MaxDimension <= 0 || i.ThumbnailDimension <= 0 {
+		return errors.New("IMAGE_PROCESSING_MAX_DIMENSION and IMAGE_PROCESSING_THUMBNAIL_DIMENSION must be greater than 0")
+	}
+
+	if i.MaxPixels <= 0 {
+		return errors.New("IMAGE_PROCESSING_MAX_PIXELS must be greater than 0")
+	}
+
+	if i.JPEGQuality < 1 || i.JPEGQuality > 100 {
+		return errors.New("IMAGE_PROCESSING_JPEG_QUALITY must be between 1 and 100")
+	}
+
+	return nil
+}
+
+// TextExtractionConfig is the configuration for extracting the text of
+// document uploads and expanding file parts of chat completions.
+type TextExtractionConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxBytes is the max size of the stored text of each document
+	MaxBytes int `env:"MAX_BYTES" envDefault:"1048576"`
+	// MaxFileTokens is the max estimated tokens of each file expanded in chat
+	// completions, longer text is truncated
+	MaxFileTokens int `env:"MAX_FILE_TOKENS" envDefault:"8000"`
+}
+
+// Validate checks the limits when text extraction is enabled
+func (t TextExtractionConfig) Validate() error {
+	if !t.Enabled {
+		return nil
+	}
+
+	if t.MaxBytes <= 0 {
+		return errors.New("TEXT_EXTRACTION_MAX_BYTES must be greater than 0")
+	}
+
+	if t.MaxFileTokens <= 0 {
+		return errors.New("TEXT_EXTRACTION_MAX_FILE_TOKENS must be greater than 0")
+	}
+
+	return nil
+}
+
+// InlineFilesConfig is the configuration for replacing uploaded file URLs in
+// chat completion image_url parts with base64 data URLs.
+type InlineFilesConfig struct {
+	Enabled bool `env:"ENABLED" envDefault:"false"`
+	// MaxBytes is the max size of each inlined file
+	MaxBytes int64 `env:"MAX_BYTES" envDefault:"10485760"`
+	// MaxTotalBytes is the max size of all inlined files of a request
+	MaxTotalBytes int64    `env:"MAX_TOTAL_BYTES" envDefault:"20971520"`
+	ContentTypes  []string `env:"CONTENT_TYPES" envSeparator:"," envDefault:"image/png,image/jpeg,image/gif,image/webp"`
+}
+
+// Validate checks the limits when inlining is enabled
+func (i InlineFilesConfig) Validate() error {
+	if !i.Enabled {
+		return nil
+	}
+
+	if i.MaxBytes <= 0 {
+		return errors.New("INLINE_FILES_MAX_BYTES must be greater than 0")
+	}
+
+	if i.MaxTotalBytes < i.MaxBytes {
+		return errors.New("INLINE_FILES_MAX_TOTAL_BYTES cannot be less than INLINE_FILES_MAX_BYTES")
+	}
+
+	if len(i.ContentTypes) == 0 {
+		return errors.New("INLINE_FILES_CONTENT_TYPES cannot be empty")
+	}
+
+	return nil
+}
+
+// SystemPromptsConfig is the configuration for system prompt templates added
+// to chat completion requests.
+type SystemPromptsConfig struct {
+	// File is the path to the JSON prompt templates file, disabled if empty
+	File string `env:"FILE"`
+	// DefaultLocale is the {{.Locale}} for requests without Accept-Language
+	DefaultLocale string `env:"DEFAULT_LOCALE" envDefault:"en-US"`
+}
+
+// Validate checks the default locale when system prompts are enabled
+func (s SystemPromptsConfig) Validate() error {
+	if s.File == "" {
+		return nil
+	}
+
+	if strings.TrimSpace(s.DefaultLocale) == "" {
+		return errors.New("SYSTEM_PROMPTS_DEFAULT_LOCALE cannot be empty")
+	}
+
+	return nil
+}
+
 // OpenAIBackend is the configuration for each OpenAI compatible backend
 type OpenAIBackend struct {
 	Name          string   `env:"NAME"`
@@ -83,6 +904,29 @@ type OpenAIBackend struct {
 	APIKey        string   `env:"API_KEY"`
 	AllowedModels []string `env:"ALLOWED_MODELS" envSeparator:","`
 
+	// SimulatedStreamingModels are models that do not support streaming. For
+	// these, streaming requests are sent upstream as non-streaming requests
+	// and the response is converted to a stream.
+	SimulatedStreamingModels []string `env:"SIMULATED_STREAMING_MODELS" envSeparator:","`
+
+	// HedgedModels are latency-sensitive models that are also served by the
+	// HedgeBackend. Requests are sent to the hedge backend as well when this
+	// backend is slower than the hedge delay.
+	HedgedModels []string `env:"HEDGED_MODELS" envSeparator:","`
+	HedgeBackend string   `env:"HEDGE_BACKEND"`
+
+	// Upstream transport, zero values use the default transport settings
+	TLSCAFile   string `env:"TLS_CA_FILE"`
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// TLSMinVersion is one of 1.0, 1.1, 1.2 or 1.3
+	TLSMinVersion       string        `env:"TLS_MIN_VERSION"`
+	ProxyURL            string        `env:"PROXY_URL"`
+	DisableHTTP2        bool          `env:"DISABLE_HTTP2"`
+	MaxIdleConns        int           `env:"MAX_IDLE_CONNS"`
+	MaxIdleConnsPerHost int           `env:"MAX_IDLE_CONNS_PER_HOST"`
+	IdleConnTimeout     time.Duration `env:"IDLE_CONN_TIMEOUT"`
+
 	// client is the OpenAI client for this backend, initialized once after the
 	// configuration is validated
 	client *types.OpenAIPassthroughClient
@@ -106,22 +950,165 @@ func (b OpenAIBackend) Validate() error {
 		return fmt.Errorf("ALLOWED_MODELS needs at least one model for backend %s", b.Name)
 	}
 
+	for _, model := range b.SimulatedStreamingModels {
+		if !b.IsAllowedModel(model) {
+			return fmt.Errorf(
+				"SIMULATED_STREAMING_MODELS model '%s' is not in ALLOWED_MODELS for backend %s",
+				model, b.Name,
+			)
+		}
+	}
+
+	for _, model := range b.HedgedModels {
+		if !b.IsAllowedModel(model) {
+			return fmt.Errorf(
+				"HEDGED_MODELS model '%s' is not in ALLOWED_MODELS for backend %s",
+				model, b.Name,
+			)
+		}
+	}
+
+	if len(b.HedgedModels) > 0 && b.HedgeBackend == "" {
+		return fmt.Errorf("HEDGE_BACKEND is required with HEDGED_MODELS for backend %s", b.Name)
+	}
+
+	if b.HedgeBackend == b.Name {
+		return fmt.Errorf("HEDGE_BACKEND must be a different backend for backend %s", b.Name)
+	}
+
+	if (b.TLSCertFile == "") != (b.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together for backend %s", b.Name)
+	}
+
+	if b.ProxyURL != "" {
+		proxyURL, err := url.Parse(b.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("PROXY_URL must be an absolute URL for backend %s", b.Name)
+		}
+	}
+
+	if b.MaxIdleConns < 0 || b.MaxIdleConnsPerHost < 0 || b.IdleConnTimeout < 0 {
+		return fmt.Errorf("connection pool settings must not be negative for backend %s", b.Name)
+	}
+
+	if !b.hasCustomTransport() {
+		return nil
+	}
+
+	// Loads the CA and client certificate files to fail on startup instead of
+	// on the first request
+	transportConfig, err := b.TransportConfig()
+	if err != nil {
+		return err
+	}
+
+	if _, err := types.NewTransport(transportConfig); err != nil {
+		return fmt.Errorf("invalid transport for backend %s: %w", b.Name, err)
+	}
+
 	return nil
 }
 
+// tlsVersions are the supported TLS_MIN_VERSION values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TransportConfig returns the upstream transport configuration of the backend
+func (b OpenAIBackend) TransportConfig() (types.TransportConfig, error) {
+	var minVersion uint16
+	if b.TLSMinVersion != "" {
+		var ok bool
+		minVersion, ok = tlsVersions[b.TLSMinVersion]
+		if !ok {
+			return types.TransportConfig{}, fmt.Errorf(
+				"TLS_MIN_VERSION '%s' must be one of 1.0, 1.1, 1.2, 1.3 for backend %s",
+				b.TLSMinVersion, b.Name,
+			)
+		}
+	}
+
+	return types.TransportConfig{
+		CAFile:              b.TLSCAFile,
+		CertFile:            b.TLSCertFile,
+		KeyFile:             b.TLSKeyFile,
+		MinTLSVersion:       minVersion,
+		ProxyURL:            b.ProxyURL,
+		DisableHTTP2:        b.DisableHTTP2,
+		MaxIdleConns:        b.MaxIdleConns,
+		MaxIdleConnsPerHost: b.MaxIdleConnsPerHost,
+		IdleConnTimeout:     b.IdleConnTimeout,
+	}, nil
+}
+
+// hasCustomTransport returns true if any transport setting is configured
+func (b OpenAIBackend) hasCustomTransport() bool {
+	return b.TLSCAFile != "" ||
+		b.TLSCertFile != "" ||
+		b.TLSKeyFile != "" ||
+		b.TLSMinVersion != "" ||
+		b.ProxyURL != "" ||
+		b.DisableHTTP2 ||
+		b.MaxIdleConns != 0 ||
+		b.MaxIdleConnsPerHost != 0 ||
+		b.IdleConnTimeout != 0
+}
+
 // String returns a string representation of the backend with the API key redacted
 func (b OpenAIBackend) String() string {
 	// Return with API key redacted
 	return fmt.Sprintf(
-		"Name: %s, BaseURL: %s, APIKey: %s, AllowedModels: %v",
-		b.Name, b.BaseURL, "REDACTED", b.AllowedModels,
+		"Name: %s, BaseURL: %s, APIKey: %s, AllowedModels: %v, SimulatedStreamingModels: %v, HedgedModels: %v, HedgeBackend: %s, "+
+			"TLSCAFile: %s, TLSCertFile: %s, TLSKeyFile: %s, TLSMinVersion: %s, ProxyURL: %s, DisableHTTP2: %t, "+
+			"MaxIdleConns: %d, MaxIdleConnsPerHost: %d, IdleConnTimeout: %s",
+		b.Name, b.BaseURL, "REDACTED", b.AllowedModels, b.SimulatedStreamingModels, b.HedgedModels, b.HedgeBackend,
+		b.TLSCAFile, b.TLSCertFile, b.TLSKeyFile, b.TLSMinVersion, redactURL(b.ProxyURL), b.DisableHTTP2,
+		b.MaxIdleConns, b.MaxIdleConnsPerHost, b.IdleConnTimeout,
 	)
 }
 
+// IsAllowedModel returns true if the model is in the allowlist of the backend
+func (b OpenAIBackend) IsAllowedModel(model string) bool {
+	for _, allowedModel := range b.AllowedModels {
+		if model == allowedModel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SimulatesStreaming returns true if streaming requests for the model should
+// be sent upstream as non-streaming requests
+func (b OpenAIBackend) SimulatesStreaming(model string) bool {
+	for _, simulatedModel := range b.SimulatedStreamingModels {
+		if model == simulatedModel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HedgesModel returns true if requests for the model should be hedged to the
+// hedge backend
+func (b OpenAIBackend) HedgesModel(model string) bool {
+	for _, hedgedModel := range b.HedgedModels {
+		if model == hedgedModel {
+			return true
+		}
+	}
+
+	return false
+}
+
 // GetClient returns the OpenAI client for the backend and caches it
 func (b *OpenAIBackend) GetClient() *types.OpenAIPassthroughClient {
 	if b.client == nil {
-		b.client = types.NewOpenAIClient(b.BaseURL, b.APIKey)
+		b.client = b.newClient()
 
 		return b.client
 	}
@@ -129,6 +1116,38 @@ func (b *OpenAIBackend) GetClient() *types.OpenAIPassthroughClient {
 	return b.client
 }
 
+// newClient creates the OpenAI client with the backend transport. If the
+// transport cannot be created, requests fail with the error instead of using
+// the default transport without the configured TLS and proxy settings.
+func (b OpenAIBackend) newClient() *types.OpenAIPassthroughClient {
+	if !b.hasCustomTransport() {
+		return types.NewOpenAIClient(b.BaseURL, b.APIKey)
+	}
+
+	var transport http.RoundTripper
+	transportConfig, err := b.TransportConfig()
+	if err == nil {
+		transport, err = types.NewTransport(transportConfig)
+	}
+	if err != nil {
+		transport = types.NewErrorTransport(
+			fmt.Errorf("invalid transport for backend %s: %w", b.Name, err),
+		)
+	}
+
+	return types.NewOpenAIClientWithTransport(b.BaseURL, b.APIKey, transport)
+}
+
+// redactURL removes the password from a URL, e.g. proxy credentials
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	return u.Redacted()
+}
+
 // OpenAIBackends is a list of OpenAIBackend
 type OpenAIBackends []OpenAIBackend
 
@@ -173,19 +1192,66 @@ func (bs OpenAIBackends) Validate() error {
 		}
 	}
 
+	for _, backend := range bs {
+		if backend.HedgeBackend == "" {
+			continue
+		}
+
+		if _, ok := names[backend.HedgeBackend]; !ok {
+			return fmt.Errorf(
+				"HEDGE_BACKEND '%s' does not exist for backend %s",
+				backend.HedgeBackend, backend.Name,
+			)
+		}
+	}
+
 	return nil
 }
 
 // GetBackendFromModel returns the backend that has the given model in its
 // allowlist. If no backend supports the model, it returns nil and false
 func (b *OpenAIBackends) GetBackendFromModel(model string) (*OpenAIBackend, bool) {
-	for _, backend := range *b {
-		for _, allowedModel := range backend.AllowedModels {
+	// Return the backend in the slice instead of a copy, so the cached client
+	// and its connection pool are shared between requests
+	for i := range *b {
+		for _, allowedModel := range (*b)[i].AllowedModels {
 			if model == allowedModel {
-				return &backend, true
+				return &(*b)[i], true
 			}
 		}
 	}
 
 	return nil, false
 }
+
+// InitClients creates the OpenAI client of each backend. Must be called once
+// after the configuration is validated and before the backends are used
+// concurrently.
+func (bs OpenAIBackends) InitClients() {
+	for i := range bs {
+		bs[i].GetClient()
+	}
+}
+
+// hasHedgedModels returns true if any backend has hedged models
+func (bs OpenAIBackends) hasHedgedModels() bool {
+	for _, backend := range bs {
+		if len(backend.HedgedModels) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetBackendByName returns the backend with the given name. If no backend has
+// the name, it returns nil and false
+func (b *OpenAIBackends) GetBackendByName(name string) (*OpenAIBackend, bool) {
+	for i := range *b {
+		if (*b)[i].Name == name {
+			return &(*b)[i], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,99 @@
+package conversations
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/oklog/ulid/v2"
+)
+
+// ErrNotFound is returned when a conversation does not exist or is not owned
+// by the requesting owner
+var ErrNotFound = errors.New("conversation not found")
+
+// Conversation is a stored chat conversation
+type Conversation struct {
+	ID        string    `json:"id"`
+	Object    string    `json:"object"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Messages are only included when getting a single conversation
+	Messages []Message `json:"messages,omitempty"`
+
+	// Owner is the user or anonymous session the conversation belongs to
+	Owner string `json:"-"`
+}
+
+// Message is a stored chat completion message
+type Message struct {
+	ID        string        `json:"id"`
+	Message   types.Message `json:"message"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// ListOptions are the pagination options for listing conversations, newest
+// first
+type ListOptions struct {
+	Limit int
+	// After is the ID of the last conversation of the previous page
+	After string
+}
+
+// Store stores conversations. Every method is scoped to the owner, other
+// owners' conversations return ErrNotFound.
+type Store interface {
+	Create(ctx context.Context, conversation Conversation) error
+	// List returns the owner's conversations without messages
+	List(ctx context.Context, owner string, opts ListOptions) ([]Conversation, error)
+	// Get returns the conversation with its messages in order
+	Get(ctx context.Context, owner, id string) (Conversation, error)
+	// AppendMessages adds messages to the end of the conversation
+	AppendMessages(ctx context.Context, owner, id string, messages []Message) error
+	Rename(ctx context.Context, owner, id, title string) error
+	Delete(ctx context.Context, owner, id string) error
+	Close() error
+}
+
+// New creates a conversation with a new ID for the owner
+func New(owner, title string) Conversation {
+	now := time.Now().UTC()
+
+	return Conversation{
+		ID:        ulid.Make().String(),
+		Object:    "conversation",
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Owner:     owner,
+	}
+}
+
+// NewMessages wraps chat completion messages with new IDs, in the same order
+func NewMessages(messages []types.Message) []Message {
+	now := time.Now().UTC()
+
+	wrapped := make([]Message, 0, len(messages))
+	for _, message := range messages {
+		wrapped = append(wrapped, Message{
+			// Monotonic within the same millisecond, so IDs keep the order
+			ID:        ulid.Make().String(),
+			Message:   message,
+			CreatedAt: now,
+		})
+	}
+
+	return wrapped
+}
+
+// ChatMessages returns the chat completion messages of the conversation
+func (c Conversation) ChatMessages() []types.Message {
+	messages := make([]types.Message, 0, len(c.Messages))
+	for _, message := range c.Messages {
+		messages = append(messages, message.Message)
+	}
+
+	return messages
+}
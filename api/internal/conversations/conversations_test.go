@@ -0,0 +1,99 @@
+package conversations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "conversations.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+
+			return store
+		},
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, newStore(t))
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	const owner = "session:abc"
+
+	first := New(owner, "First")
+	first.Messages = NewMessages([]types.Message{types.NewTextMessage("user", "hello")})
+	require.NoError(t, store.Create(ctx, first))
+
+	second := New(owner, "Second")
+	require.NoError(t, store.Create(ctx, second))
+
+	other := New("user:someone-else", "Other")
+	require.NoError(t, store.Create(ctx, other))
+
+	t.Run("list is scoped to owner, newest first", func(t *testing.T) {
+		list, err := store.List(ctx, owner, ListOptions{Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		require.Equal(t, second.ID, list[0].ID)
+		require.Equal(t, first.ID, list[1].ID)
+		require.Empty(t, list[1].Messages, "list should not include messages")
+
+		page, err := store.List(ctx, owner, ListOptions{Limit: 10, After: second.ID})
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		require.Equal(t, first.ID, page[0].ID)
+	})
+
+	t.Run("append messages keeps order", func(t *testing.T) {
+		err := store.AppendMessages(ctx, owner, first.ID, NewMessages([]types.Message{
+			types.NewTextMessage("assistant", "hi"),
+			types.NewTextMessage("user", "how are you?"),
+		}))
+		require.NoError(t, err)
+
+		c, err := store.Get(ctx, owner, first.ID)
+		require.NoError(t, err)
+		require.Equal(t, "First", c.Title)
+		require.Len(t, c.Messages, 3)
+		require.Equal(t, "hello", c.Messages[0].Message.Text())
+		require.Equal(t, "hi", c.Messages[1].Message.Text())
+		require.Equal(t, "how are you?", c.Messages[2].Message.Text())
+	})
+
+	t.Run("other owners cannot access", func(t *testing.T) {
+		_, err := store.Get(ctx, owner, other.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.ErrorIs(t, store.AppendMessages(ctx, owner, other.ID, nil), ErrNotFound)
+		require.ErrorIs(t, store.Rename(ctx, owner, other.ID, "mine"), ErrNotFound)
+		require.ErrorIs(t, store.Delete(ctx, owner, other.ID), ErrNotFound)
+	})
+
+	t.Run("rename and delete", func(t *testing.T) {
+		require.NoError(t, store.Rename(ctx, owner, second.ID, "Renamed"))
+
+		c, err := store.Get(ctx, owner, second.ID)
+		require.NoError(t, err)
+		require.Equal(t, "Renamed", c.Title)
+		require.Empty(t, c.Messages)
+
+		require.NoError(t, store.Delete(ctx, owner, second.ID))
+
+		_, err = store.Get(ctx, owner, second.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -0,0 +1,130 @@
+package conversations
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store in memory, conversations are lost on restart
+type MemoryStore struct {
+	mu            sync.Mutex
+	conversations map[string]Conversation
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		conversations: make(map[string]Conversation),
+	}
+}
+
+// Create implements Store
+func (s *MemoryStore) Create(_ context.Context, c Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.Messages = slices.Clone(c.Messages)
+	s.conversations[c.ID] = c
+
+	return nil
+}
+
+// List implements Store
+func (s *MemoryStore) List(_ context.Context, owner string, opts ListOptions) ([]Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversations := []Conversation{}
+	for _, c := range s.conversations {
+		if c.Owner != owner || (opts.After != "" && c.ID >= opts.After) {
+			continue
+		}
+
+		c.Messages = nil
+		conversations = append(conversations, c)
+	}
+
+	// Newest first, IDs are ULIDs
+	slices.SortFunc(conversations, func(a, b Conversation) int {
+		return strings.Compare(b.ID, a.ID)
+	})
+
+	if len(conversations) > opts.Limit {
+		conversations = conversations[:opts.Limit]
+	}
+
+	return conversations, nil
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(_ context.Context, owner, id string) (Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conversations[id]
+	if !ok || c.Owner != owner {
+		return Conversation{}, ErrNotFound
+	}
+
+	c.Messages = slices.Clone(c.Messages)
+	if c.Messages == nil {
+		c.Messages = []Message{}
+	}
+
+	return c, nil
+}
+
+// AppendMessages implements Store
+func (s *MemoryStore) AppendMessages(_ context.Context, owner, id string, messages []Message) error {
+	return s.update(owner, id, func(c *Conversation) {
+		c.Messages = append(c.Messages, messages...)
+	})
+}
+
+// Rename implements Store
+func (s *MemoryStore) Rename(_ context.Context, owner, id, title string) error {
+	return s.update(owner, id, func(c *Conversation) {
+		c.Title = title
+	})
+}
+
+// Delete implements Store
+func (s *MemoryStore) Delete(_ context.Context, owner, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conversations[id]
+	if !ok || c.Owner != owner {
+		return ErrNotFound
+	}
+
+	delete(s.conversations, id)
+
+	return nil
+}
+
+// Close implements Store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) update(owner, id string, fn func(c *Conversation)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conversations[id]
+	if !ok || c.Owner != owner {
+		return ErrNotFound
+	}
+
+	fn(&c)
+	c.UpdatedAt = time.Now().UTC()
+	s.conversations[id] = c
+
+	return nil
+}
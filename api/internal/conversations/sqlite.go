@@ -0,0 +1,279 @@
+package conversations
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	// Registers the pure Go sqlite driver
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id         TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	title      TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS conversations_owner ON conversations (owner, id);
+
+CREATE TABLE IF NOT EXISTS conversation_messages (
+	id              TEXT PRIMARY KEY,
+	conversation_id TEXT NOT NULL,
+	message         TEXT NOT NULL,
+	created_at      INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS conversation_messages_conversation
+	ON conversation_messages (conversation_id, id);
+`
+
+// SQLiteStore is a Store in an embedded SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLiteStore)(nil)
+
+// NewSQLiteStore opens or creates the SQLite database at path, ":memory:" for
+// an in-memory database
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open conversations database: %w", err)
+	}
+
+	// SQLite allows a single writer, this also keeps in-memory databases on
+	// one connection
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create conversations schema: %w", err)
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// Create implements Store
+func (s *SQLiteStore) Create(ctx context.Context, c Conversation) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO conversations (id, owner, title, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		c.ID, c.Owner, c.Title, c.CreatedAt.UnixMilli(), c.UpdatedAt.UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation: %w", err)
+	}
+
+	if err := insertMessages(ctx, tx, c.ID, c.Messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// List implements Store
+func (s *SQLiteStore) List(ctx context.Context, owner string, opts ListOptions) ([]Conversation, error) {
+	query := `SELECT id, title, created_at, updated_at FROM conversations WHERE owner = ?`
+	args := []any{owner}
+
+	if opts.After != "" {
+		query += ` AND id < ?`
+		args = append(args, opts.After)
+	}
+
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, opts.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	for rows.Next() {
+		c := Conversation{Object: "conversation", Owner: owner}
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&c.ID, &c.Title, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read conversation: %w", err)
+		}
+
+		c.CreatedAt = time.UnixMilli(createdAt).UTC()
+		c.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+		conversations = append(conversations, c)
+	}
+
+	return conversations, rows.Err()
+}
+
+// Get implements Store
+func (s *SQLiteStore) Get(ctx context.Context, owner, id string) (Conversation, error) {
+	c := Conversation{Object: "conversation", Owner: owner}
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT id, title, created_at, updated_at FROM conversations WHERE id = ? AND owner = ?`,
+		id, owner,
+	).Scan(&c.ID, &c.Title, &createdAt, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Conversation{}, ErrNotFound
+	}
+	if err != nil {
+		return Conversation{}, fmt.Errorf("failed to get conversation: %w", err)
+	}
+
+	c.CreatedAt = time.UnixMilli(createdAt).UTC()
+	c.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT id, message, created_at FROM conversation_messages WHERE conversation_id = ? ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return Conversation{}, fmt.Errorf("failed to get conversation messages: %w", err)
+	}
+	defer rows.Close()
+
+	c.Messages = []Message{}
+	for rows.Next() {
+		var m Message
+		var data string
+		var messageCreatedAt int64
+		if err := rows.Scan(&m.ID, &data, &messageCreatedAt); err != nil {
+			return Conversation{}, fmt.Errorf("failed to read conversation message: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(data), &m.Message); err != nil {
+			return Conversation{}, fmt.Errorf("failed to decode conversation message: %w", err)
+		}
+
+		m.CreatedAt = time.UnixMilli(messageCreatedAt).UTC()
+		c.Messages = append(c.Messages, m)
+	}
+
+	return c, rows.Err()
+}
+
+// AppendMessages implements Store
+func (s *SQLiteStore) AppendMessages(ctx context.Context, owner, id string, messages []Message) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := touch(ctx, tx, owner, id); err != nil {
+		return err
+	}
+
+	if err := insertMessages(ctx, tx, id, messages); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Rename implements Store
+func (s *SQLiteStore) Rename(ctx context.Context, owner, id, title string) error {
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE conversations SET title = ?, updated_at = ? WHERE id = ? AND owner = ?`,
+		title, time.Now().UnixMilli(), id, owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rename conversation: %w", err)
+	}
+
+	return requireAffected(res)
+}
+
+// Delete implements Store
+func (s *SQLiteStore) Delete(ctx context.Context, owner, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM conversations WHERE id = ? AND owner = ?`, id, owner)
+	if err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+
+	if err := requireAffected(res); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM conversation_messages WHERE conversation_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete conversation messages: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// touch updates the conversation updated_at time, ErrNotFound is returned if
+// the owner has no conversation with the ID
+func touch(ctx context.Context, tx *sql.Tx, owner, id string) error {
+	res, err := tx.ExecContext(
+		ctx,
+		`UPDATE conversations SET updated_at = ? WHERE id = ? AND owner = ?`,
+		time.Now().UnixMilli(), id, owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	return requireAffected(res)
+}
+
+func insertMessages(ctx context.Context, tx *sql.Tx, conversationID string, messages []Message) error {
+	for _, m := range messages {
+		data, err := json.Marshal(m.Message)
+		if err != nil {
+			return fmt.Errorf("failed to encode conversation message: %w", err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO conversation_messages (id, conversation_id, message, created_at) VALUES (?, ?, ?, ?)`,
+			m.ID, conversationID, string(data), m.CreatedAt.UnixMilli(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add conversation message: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxDocumentXMLSize is the max uncompressed size of word/document.xml, to
+// prevent zip bombs
+const maxDocumentXMLSize = 64 * 1024 * 1024 // 64MB
+
+// docxText returns the text of the paragraphs of a Word document, one per line
+func docxText(data []byte, maxBytes int) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX: %w", err)
+	}
+
+	var document *zip.File
+	for _, f := range archive.File {
+		if f.Name == "word/document.xml" {
+			document = f
+			break
+		}
+	}
+
+	if document == nil {
+		return "", errors.New("invalid DOCX: missing word/document.xml")
+	}
+
+	rc, err := document.Open()
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX: %w", err)
+	}
+	defer rc.Close()
+
+	text := limitedBuffer{max: maxBytes}
+	decoder := xml.NewDecoder(io.LimitReader(rc, maxDocumentXMLSize))
+	inText := false
+
+	for !text.full() {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid DOCX document: %w", err)
+		}
+
+		// Elements are in the w: namespace, only the local names are used
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+
+	return text.String(), nil
+}
@@ -0,0 +1,101 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentTypeDOCX is the content type of Word documents
+const ContentTypeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+// ErrUnsupported is returned for content types without text extraction
+var ErrUnsupported = errors.New("text extraction not supported for content type")
+
+// Supported returns true if text can be extracted from the content type
+func Supported(contentType string) bool {
+	switch mediaType(contentType) {
+	case "application/pdf", ContentTypeDOCX, "text/plain", "text/markdown", "text/csv":
+		return true
+	default:
+		return false
+	}
+}
+
+// Text returns the text of the document, at most maxBytes. Documents with
+// more text are cut at maxBytes.
+func Text(data []byte, contentType string, maxBytes int) (text string, err error) {
+	// Parsers of binary formats may panic on malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to extract text: %v", r)
+		}
+	}()
+
+	switch mediaType(contentType) {
+	case "application/pdf":
+		text, err = pdfText(data, maxBytes)
+	case ContentTypeDOCX:
+		text, err = docxText(data, maxBytes)
+	case "text/plain", "text/markdown", "text/csv":
+		if !utf8.Valid(data) {
+			return "", errors.New("text is not valid UTF-8")
+		}
+
+		text = string(data)
+	default:
+		return "", ErrUnsupported
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return truncate(strings.TrimSpace(text), maxBytes), nil
+}
+
+// Truncate returns the text cut at maxBytes without splitting a UTF-8
+// character, and whether it was cut
+func Truncate(text string, maxBytes int) (string, bool) {
+	if len(text) <= maxBytes {
+		return text, false
+	}
+
+	return truncate(text, maxBytes), true
+}
+
+func truncate(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+
+	return text[:cut]
+}
+
+// limitedBuffer is a buffer that stops accepting text at max bytes
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+// full returns true if the buffer has reached the max size
+func (b *limitedBuffer) full() bool {
+	return b.Len() >= b.max
+}
+
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
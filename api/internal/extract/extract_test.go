@@ -0,0 +1,147 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// minimalPDF returns a PDF with a page for each text
+func minimalPDF(t *testing.T, pages ...string) []byte {
+	t.Helper()
+
+	var objects []string
+	kids := ""
+	for i := range pages {
+		kids += fmt.Sprintf("%d 0 R ", 4+i*2)
+	}
+
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	)
+
+	for i, text := range pages {
+		content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+i*2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.Bytes()
+}
+
+// minimalDOCX returns a Word document with the document XML body
+func minimalDOCX(t *testing.T, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	f, err := archive.Create("word/document.xml")
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		body +
+		`</w:body></w:document>`))
+	require.NoError(t, err)
+	require.NoError(t, archive.Close())
+
+	return buf.Bytes()
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		maxBytes    int
+		expected    string
+	}{
+		{
+			name:        "pdf",
+			data:        minimalPDF(t, "Hello PDF", "Second page"),
+			contentType: "application/pdf",
+			maxBytes:    1000,
+			expected:    "Hello PDF\n\nSecond page",
+		},
+		{
+			name: "docx",
+			data: minimalDOCX(t, `<w:p><w:r><w:t>Title</w:t></w:r></w:p>`+
+				`<w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:tab/><w:t xml:space="preserve">world</w:t></w:r></w:p>`),
+			contentType: ContentTypeDOCX,
+			maxBytes:    1000,
+			expected:    "Title\nHello\tworld",
+		},
+		{
+			name:        "markdown",
+			data:        []byte("# Notes\n\n- item\n"),
+			contentType: "text/markdown; charset=utf-8",
+			maxBytes:    1000,
+			expected:    "# Notes\n\n- item",
+		},
+		{
+			name:        "truncated without splitting characters",
+			data:        []byte("a,b\nü,ü\n"),
+			contentType: "text/csv",
+			maxBytes:    5,
+			expected:    "a,b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := Text(tt.data, tt.contentType, tt.maxBytes)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, text)
+		})
+	}
+}
+
+func TestText_Errors(t *testing.T) {
+	_, err := Text([]byte("\x89PNG"), "image/png", 1000)
+	require.ErrorIs(t, err, ErrUnsupported)
+	require.False(t, Supported("image/png"))
+	require.True(t, Supported("text/csv; charset=utf-8"))
+
+	_, err = Text([]byte("%PDF-1.4 broken"), "application/pdf", 1000)
+	require.Error(t, err)
+
+	_, err = Text([]byte("not a zip"), ContentTypeDOCX, 1000)
+	require.Error(t, err)
+
+	_, err = Text([]byte{0xff, 0xfe}, "text/plain", 1000)
+	require.EqualError(t, err, "text is not valid UTF-8")
+}
+
+func TestTruncate(t *testing.T) {
+	text, truncated := Truncate("hello", 10)
+	require.Equal(t, "hello", text)
+	require.False(t, truncated)
+
+	text, truncated = Truncate("héllo", 2)
+	require.Equal(t, "h", text)
+	require.True(t, truncated)
+}
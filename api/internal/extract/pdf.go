@@ -0,0 +1,46 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// pdfText returns the text of each page of the PDF, separated by blank lines
+func pdfText(data []byte, maxBytes int) (string, error) {
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid PDF: %w", err)
+	}
+
+	text := limitedBuffer{max: maxBytes}
+	fonts := make(map[string]*pdf.Font)
+
+	for i := 1; i <= reader.NumPage() && !text.full(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+
+		// Fonts are shared across pages, cached to parse them once
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return "", fmt.Errorf("failed to extract text of page %d: %w", i, err)
+		}
+
+		if text.Len() > 0 {
+			text.WriteString("\n\n")
+		}
+		text.WriteString(pageText)
+	}
+
+	return text.String(), nil
+}
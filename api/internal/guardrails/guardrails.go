@@ -0,0 +1,367 @@
+package guardrails
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// FinishReasonContentFilter is the finish reason sent to the client when a
+// stream is terminated by a guardrail
+const FinishReasonContentFilter = "content_filter"
+
+// Rules are the output guardrails evaluated against the assistant text of a
+// streamed chat completion
+type Rules struct {
+	// BlockedTerms are matched case-insensitively
+	BlockedTerms []string
+	Patterns     []*regexp.Regexp
+	// MaxOutputChars is the maximum number of characters of assistant text,
+	// 0 to disable
+	MaxOutputChars int
+}
+
+// NewRules creates Rules, compiling the given regular expressions
+func NewRules(blockedTerms []string, patterns []string, maxOutputChars int) (Rules, error) {
+	rules := Rules{
+		MaxOutputChars: maxOutputChars,
+	}
+
+	for _, term := range blockedTerms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		rules.BlockedTerms = append(rules.BlockedTerms, strings.ToLower(term))
+	}
+
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid guardrail pattern '%s': %w", pattern, err)
+		}
+
+		rules.Patterns = append(rules.Patterns, re)
+	}
+
+	return rules, nil
+}
+
+// Violation describes the rule that tripped
+type Violation struct {
+	// Rule is the kind of rule, blocked_term, pattern or max_output_length
+	Rule string
+	// Detail is the term, pattern or limit that tripped
+	Detail string
+}
+
+// Result is the outcome of inspecting a stream
+type Result struct {
+	BytesWritten int64
+	// Violation is set if the stream was terminated by a rule
+	Violation *Violation
+}
+
+// patternWindow is the number of bytes of recent text of a stream that
+// patterns are matched against, matches spanning more are not detected
+const patternWindow = 4096
+
+// Inspect copies a chat completion SSE stream from src to dst, evaluating the
+// rules against the content, refusal and tool call text of each choice. Events
+// are held back until enough text follows them to complete the longest blocked
+// term, so no part of a blocked term is forwarded. When a rule trips, the
+// offending and held back events are dropped and the stream is ended with a
+// content_filter finish chunk and [DONE].
+//
+// Only a bounded window of recent text is evaluated per event, patterns are
+// matched against the last patternWindow bytes and may forward the start of a
+// match that is completed by a later event.
+func (r Rules) Inspect(dst io.Writer, src io.Reader) (Result, error) {
+	var result Result
+
+	reader := sse.NewReader(src)
+	inspector := newStreamInspector(r)
+
+	flush := func(all bool) error {
+		for len(inspector.pending) > 0 && (all || inspector.releasable(inspector.pending[0])) {
+			n, err := dst.Write(inspector.pending[0].raw)
+			result.BytesWritten += int64(n)
+			if err != nil {
+				return err
+			}
+
+			inspector.pending = inspector.pending[1:]
+		}
+
+		return nil
+	}
+
+	for {
+		event, readErr := reader.Next()
+		if readErr == io.EOF {
+			return result, flush(true)
+		}
+
+		held := heldEvent{raw: event.Raw}
+
+		if chunk, isChunk := parseChunk(event); isChunk {
+			for _, choice := range chunk.Choices {
+				for _, text := range choiceTexts(choice) {
+					violation, tripped, need := inspector.add(text)
+					if tripped {
+						result.Violation = &violation
+
+						n, err := writeContentFilterEnd(dst, chunk)
+						result.BytesWritten += int64(n)
+
+						return result, err
+					}
+
+					held.needs = append(held.needs, need)
+				}
+
+				if choice.FinishReason != nil {
+					inspector.finished[choice.Index] = true
+				}
+			}
+		}
+
+		inspector.pending = append(inspector.pending, held)
+
+		// No text follows the end of the stream
+		end := event.IsDone() || readErr == io.ErrUnexpectedEOF
+		if err := flush(end); err != nil {
+			return result, err
+		}
+
+		// Stream ended without a trailing blank line, same as a plain copy
+		if readErr == io.ErrUnexpectedEOF {
+			return result, nil
+		}
+
+		if readErr != nil {
+			return result, readErr
+		}
+	}
+}
+
+// textKey identifies a text of a choice, the content, the refusal or the
+// arguments of a tool call
+type textKey struct {
+	choice int
+	field  string
+	tool   int
+}
+
+// choiceText is text of a choice in a chunk
+type choiceText struct {
+	key  textKey
+	text string
+}
+
+// choiceTexts returns the inspected texts of the choice delta
+func choiceTexts(choice types.ChunkChoice) []choiceText {
+	var texts []choiceText
+
+	if choice.Delta.Content != nil {
+		texts = append(texts, choiceText{
+			key:  textKey{choice: choice.Index, field: "content"},
+			text: *choice.Delta.Content,
+		})
+	}
+
+	if choice.Delta.Refusal != nil {
+		texts = append(texts, choiceText{
+			key:  textKey{choice: choice.Index, field: "refusal"},
+			text: *choice.Delta.Refusal,
+		})
+	}
+
+	for _, call := range choice.Delta.ToolCalls {
+		texts = append(texts, choiceText{
+			key:  textKey{choice: choice.Index, field: "tool_call", tool: call.Index},
+			text: call.Function.Name + call.Function.Arguments,
+		})
+	}
+
+	return texts
+}
+
+// textState is the evaluated text of a textKey
+type textState struct {
+	// tail is the end of the lowercase text that a blocked term may start in
+	tail string
+	// recent is the end of the text matched against patterns
+	recent string
+	// size is the number of bytes of lowercase text
+	size int
+}
+
+// textNeed is the size a text must reach before an event is forwarded
+type textNeed struct {
+	key  textKey
+	size int
+}
+
+// heldEvent is an event that is not forwarded yet
+type heldEvent struct {
+	raw   []byte
+	needs []textNeed
+}
+
+// streamInspector evaluates the rules incrementally against the texts of a
+// stream
+type streamInspector struct {
+	rules Rules
+	// holdBack is the number of bytes of text that must follow an event
+	// before it is forwarded, one less than the longest blocked term
+	holdBack int
+	texts    map[textKey]*textState
+	// chars is the number of characters per choice
+	chars    map[int]int
+	finished map[int]bool
+	pending  []heldEvent
+}
+
+func newStreamInspector(rules Rules) *streamInspector {
+	holdBack := 0
+	for _, term := range rules.BlockedTerms {
+		holdBack = max(holdBack, len(term)-1)
+	}
+
+	return &streamInspector{
+		rules:    rules,
+		holdBack: holdBack,
+		texts:    make(map[textKey]*textState),
+		chars:    make(map[int]int),
+		finished: make(map[int]bool),
+	}
+}
+
+// add evaluates the text appended to its key, returning the violation or the
+// size the text must reach before the event is forwarded
+func (s *streamInspector) add(text choiceText) (Violation, bool, textNeed) {
+	state, ok := s.texts[text.key]
+	if !ok {
+		state = &textState{}
+		s.texts[text.key] = state
+	}
+
+	s.chars[text.key.choice] += utf8.RuneCountInString(text.text)
+	if s.rules.MaxOutputChars > 0 && s.chars[text.key.choice] > s.rules.MaxOutputChars {
+		return Violation{
+			Rule:   "max_output_length",
+			Detail: fmt.Sprintf("%d", s.rules.MaxOutputChars),
+		}, true, textNeed{}
+	}
+
+	lower := strings.ToLower(text.text)
+	window := state.tail + lower
+	for _, term := range s.rules.BlockedTerms {
+		if strings.Contains(window, term) {
+			return Violation{Rule: "blocked_term", Detail: term}, true, textNeed{}
+		}
+	}
+
+	recent := state.recent + text.text
+	for _, re := range s.rules.Patterns {
+		if re.MatchString(recent) {
+			return Violation{Rule: "pattern", Detail: re.String()}, true, textNeed{}
+		}
+	}
+
+	state.tail = suffix(window, s.holdBack)
+	state.recent = suffix(recent, patternWindow)
+	state.size += len(lower)
+
+	return Violation{}, false, textNeed{key: text.key, size: state.size + s.holdBack}
+}
+
+// releasable returns true if enough text follows the event to complete any
+// blocked term that starts in it
+func (s *streamInspector) releasable(event heldEvent) bool {
+	for _, need := range event.needs {
+		if s.finished[need.key.choice] {
+			continue
+		}
+
+		if s.texts[need.key].size < need.size {
+			return false
+		}
+	}
+
+	return true
+}
+
+// suffix returns at most the last n bytes of s, starting at a rune
+func suffix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	i := len(s) - n
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+
+	return s[i:]
+}
+
+// parseChunk decodes a chat completion chunk from the event data
+func parseChunk(event sse.Event) (types.ChatCompletionChunk, bool) {
+	if event.Comment || event.Data == "" || event.IsDone() {
+		return types.ChatCompletionChunk{}, false
+	}
+
+	var chunk types.ChatCompletionChunk
+	if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+		return types.ChatCompletionChunk{}, false
+	}
+
+	return chunk, true
+}
+
+// writeContentFilterEnd writes a final chunk with the content_filter finish
+// reason for every choice in the chunk, followed by [DONE]
+func writeContentFilterEnd(w io.Writer, chunk types.ChatCompletionChunk) (int, error) {
+	finishReason := FinishReasonContentFilter
+
+	final := types.ChatCompletionChunk{
+		ID:      chunk.ID,
+		Object:  "chat.completion.chunk",
+		Created: chunk.Created,
+		Model:   chunk.Model,
+	}
+
+	for _, choice := range chunk.Choices {
+		final.Choices = append(final.Choices, types.ChunkChoice{
+			Index:        choice.Index,
+			FinishReason: &finishReason,
+		})
+	}
+
+	data, err := json.Marshal(final)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode content filter chunk: %w", err)
+	}
+
+	written, err := sse.WriteData(w, data)
+	if err != nil {
+		return written, err
+	}
+
+	n, err := sse.WriteDone(w)
+
+	return written + n, err
+}
@@ -0,0 +1,145 @@
+package guardrails_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/guardrails"
+	"github.com/stretchr/testify/require"
+)
+
+func contentChunk(content string) string {
+	return fmt.Sprintf(
+		"data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":null}]}\n\n",
+		content,
+	)
+}
+
+func TestRules_InspectRules(t *testing.T) {
+	rules, err := guardrails.NewRules(
+		[]string{"Forbidden", " "},
+		[]string{`\b\d{3}-\d{2}-\d{4}\b`},
+		20,
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		text     string
+		wantRule string
+	}{
+		{"allowed", "hello there", ""},
+		{"blocked term case insensitive", "this is FORBIDDEN", "blocked_term"},
+		{"pattern", "ssn 123-45-6789", "pattern"},
+		{"max length", strings.Repeat("a", 21), "max_output_length"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			result, err := rules.Inspect(&out, strings.NewReader(contentChunk(tt.text)+"data: [DONE]\n\n"))
+			require.NoError(t, err)
+
+			if tt.wantRule == "" {
+				require.Nil(t, result.Violation)
+				return
+			}
+
+			require.NotNil(t, result.Violation)
+			require.Equal(t, tt.wantRule, result.Violation.Rule)
+		})
+	}
+}
+
+func TestNewRules_InvalidPattern(t *testing.T) {
+	_, err := guardrails.NewRules(nil, []string{"("}, 0)
+	require.Error(t, err)
+}
+
+func TestRules_Inspect(t *testing.T) {
+	rules, err := guardrails.NewRules([]string{"secret"}, nil, 0)
+	require.NoError(t, err)
+
+	t.Run("passes through stream without violations", func(t *testing.T) {
+		stream := contentChunk("Hello") + ": comment\n\n" + contentChunk(" world") + "data: [DONE]\n\n"
+
+		var out bytes.Buffer
+		result, err := rules.Inspect(&out, strings.NewReader(stream))
+		require.NoError(t, err)
+		require.Nil(t, result.Violation)
+		require.Equal(t, stream, out.String())
+		require.Equal(t, int64(len(stream)), result.BytesWritten)
+	})
+
+	t.Run("terminates stream on violation across chunks", func(t *testing.T) {
+		stream := contentChunk("The sec") + contentChunk("ret is") + contentChunk(" 42") + "data: [DONE]\n\n"
+
+		var out bytes.Buffer
+		result, err := rules.Inspect(&out, strings.NewReader(stream))
+		require.NoError(t, err)
+		require.NotNil(t, result.Violation)
+		require.Equal(t, "blocked_term", result.Violation.Rule)
+
+		// The start of the term is held back and never forwarded
+		expected := "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"content_filter\"}]}\n\n" +
+			"data: [DONE]\n\n"
+		require.Equal(t, expected, out.String())
+		require.NotContains(t, out.String(), "sec")
+		require.Equal(t, int64(len(expected)), result.BytesWritten)
+	})
+
+	t.Run("does not leak the start of a split term", func(t *testing.T) {
+		rules, err := guardrails.NewRules([]string{"bad"}, nil, 0)
+		require.NoError(t, err)
+
+		stream := contentChunk("This is ") + contentChunk("ba") + contentChunk("d") + "data: [DONE]\n\n"
+
+		var out bytes.Buffer
+		result, err := rules.Inspect(&out, strings.NewReader(stream))
+		require.NoError(t, err)
+		require.NotNil(t, result.Violation)
+		require.True(t, strings.HasPrefix(out.String(), contentChunk("This is ")))
+		require.NotContains(t, out.String(), `"ba"`)
+		require.Contains(t, out.String(), `"finish_reason":"content_filter"`)
+	})
+
+	t.Run("inspects refusals and tool calls", func(t *testing.T) {
+		deltaChunk := func(delta string) string {
+			return "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":" + delta + ",\"finish_reason\":null}]}\n\n"
+		}
+
+		for _, stream := range []string{
+			deltaChunk(`{"refusal":"a sec"}`) + deltaChunk(`{"refusal":"ret"}`),
+			deltaChunk(`{"tool_calls":[{"index":0,"function":{"name":"search","arguments":"{\"q\":\"sec"}}]}`) +
+				deltaChunk(`{"tool_calls":[{"index":0,"function":{"arguments":"ret\"}"}}]}`),
+		} {
+			var out bytes.Buffer
+			result, err := rules.Inspect(&out, strings.NewReader(stream+"data: [DONE]\n\n"))
+			require.NoError(t, err)
+			require.NotNil(t, result.Violation, stream)
+			require.NotContains(t, out.String(), "sec", stream)
+		}
+	})
+
+	t.Run("releases held events when the choice finishes", func(t *testing.T) {
+		finish := "data: {\"id\":\"chatcmpl-1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n"
+		stream := contentChunk("Hi") + finish + "data: [DONE]\n\n"
+
+		var out bytes.Buffer
+		result, err := rules.Inspect(&out, strings.NewReader(stream))
+		require.NoError(t, err)
+		require.Nil(t, result.Violation)
+		require.Equal(t, stream, out.String())
+	})
+
+	t.Run("forwards partial trailing event", func(t *testing.T) {
+		stream := contentChunk("Hello") + "data: partial"
+
+		var out bytes.Buffer
+		_, err := rules.Inspect(&out, strings.NewReader(stream))
+		require.NoError(t, err)
+		require.Equal(t, stream, out.String())
+	})
+}
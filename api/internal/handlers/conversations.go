@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultConversationListLimit = 20
+	maxConversationListLimit     = 100
+	maxConversationTitleLength   = 256
+	// maxConversationRequestSize limits create and append request bodies,
+	// messages may contain inline images
+	maxConversationRequestSize = 10 * 1024 * 1024 // 10MB
+	defaultConversationTitle   = "New conversation"
+)
+
+// validMessageRoles are the roles of messages that can be stored
+var validMessageRoles = map[string]struct{}{
+	"system":    {},
+	"developer": {},
+	"user":      {},
+	"assistant": {},
+	"tool":      {},
+}
+
+// ConversationListResponse is the response for listing conversations
+type ConversationListResponse struct {
+	Object  string                       `json:"object"`
+	Data    []conversations.Conversation `json:"data"`
+	HasMore bool                         `json:"has_more"`
+}
+
+// ConversationDeletedResponse is the response for a deleted conversation
+type ConversationDeletedResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// ConversationsHandler serves the /v1/conversations API. Conversations are
+// scoped to the owner in the request context.
+type ConversationsHandler struct {
+	store  conversations.Store
+	logger *zerolog.Logger
+}
+
+// NewConversationsHandler creates a new ConversationsHandler
+func NewConversationsHandler(
+	store conversations.Store,
+	baseLogger *zerolog.Logger,
+) *ConversationsHandler {
+	logger := baseLogger.With().
+		Str("handler", "ConversationsHandler").
+		Logger()
+
+	return &ConversationsHandler{
+		store:  store,
+		logger: &logger,
+	}
+}
+
+// Create handles POST /v1/conversations with an optional title and messages
+func (h *ConversationsHandler) Create(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title    *string         `json:"title"`
+		Messages []types.Message `json:"messages"`
+	}
+	if !decodeConversationRequest(w, r, &req) {
+		return
+	}
+
+	title := defaultConversationTitle
+	if req.Title != nil {
+		title = *req.Title
+	}
+
+	if e := validateConversationTitle(title); e != nil {
+		apierror.Write(w, r, e)
+		return
+	}
+
+	for _, message := range req.Messages {
+		if e := validateConversationMessage(message); e != nil {
+			apierror.Write(w, r, e.WithParam("messages"))
+			return
+		}
+	}
+
+	conversation := conversations.New(owner, title)
+	conversation.Messages = conversations.NewMessages(req.Messages)
+
+	if err := h.store.Create(r.Context(), conversation); err != nil {
+		h.logger.Error().Err(err).Msg("error creating conversation")
+		apierror.Write(w, r, apierror.Internal("error creating conversation"))
+		return
+	}
+
+	writeConversationJSON(w, http.StatusCreated, conversation)
+}
+
+// List handles GET /v1/conversations, newest first. The limit query parameter
+// sets the page size and after is the ID of the last conversation of the
+// previous page.
+func (h *ConversationsHandler) List(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultConversationListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxConversationListLimit {
+			apierror.Write(w, r, apierror.InvalidRequest(
+				"",
+				"limit must be between 1 and "+strconv.Itoa(maxConversationListLimit),
+			).WithParam("limit"))
+			return
+		}
+	}
+
+	// One more than the limit to know if there are more
+	list, err := h.store.List(r.Context(), owner, conversations.ListOptions{
+		Limit: limit + 1,
+		After: r.URL.Query().Get("after"),
+	})
+	if err != nil {
+		h.logger.Error().Err(err).Msg("error listing conversations")
+		apierror.Write(w, r, apierror.Internal("error listing conversations"))
+		return
+	}
+
+	response := ConversationListResponse{
+		Object:  "list",
+		Data:    list,
+		HasMore: len(list) > limit,
+	}
+	if response.HasMore {
+		response.Data = list[:limit]
+	}
+
+	writeConversationJSON(w, http.StatusOK, response)
+}
+
+// Get handles GET /v1/conversations/{conversation_id} with messages
+func (h *ConversationsHandler) Get(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	conversation, err := h.store.Get(r.Context(), owner, r.PathValue("conversation_id"))
+	if err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+
+	writeConversationJSON(w, http.StatusOK, conversation)
+}
+
+// AppendMessage handles POST /v1/conversations/{conversation_id}/messages
+// with a chat completion message as the body
+func (h *ConversationsHandler) AppendMessage(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var message types.Message
+	if !decodeConversationRequest(w, r, &message) {
+		return
+	}
+
+	if e := validateConversationMessage(message); e != nil {
+		apierror.Write(w, r, e)
+		return
+	}
+
+	messages := conversations.NewMessages([]types.Message{message})
+
+	err := h.store.AppendMessages(r.Context(), owner, r.PathValue("conversation_id"), messages)
+	if err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+
+	writeConversationJSON(w, http.StatusCreated, messages[0])
+}
+
+// Rename handles PATCH /v1/conversations/{conversation_id} with a new title
+func (h *ConversationsHandler) Rename(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title string `json:"title"`
+	}
+	if !decodeConversationRequest(w, r, &req) {
+		return
+	}
+
+	if e := validateConversationTitle(req.Title); e != nil {
+		apierror.Write(w, r, e)
+		return
+	}
+
+	id := r.PathValue("conversation_id")
+	if err := h.store.Rename(r.Context(), owner, id, req.Title); err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+
+	conversation, err := h.store.Get(r.Context(), owner, id)
+	if err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+
+	// Messages are not needed after a rename
+	conversation.Messages = nil
+	writeConversationJSON(w, http.StatusOK, conversation)
+}
+
+// Delete handles DELETE /v1/conversations/{conversation_id}
+func (h *ConversationsHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("conversation_id")
+	if err := h.store.Delete(r.Context(), owner, id); err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+
+	writeConversationJSON(w, http.StatusOK, ConversationDeletedResponse{
+		ID:      id,
+		Object:  "conversation.deleted",
+		Deleted: true,
+	})
+}
+
+func (h *ConversationsHandler) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, conversations.ErrNotFound) {
+		apierror.Write(w, r, apierror.NotFound("conversation not found"))
+		return
+	}
+
+	h.logger.Error().Err(err).Msg("error accessing conversation store")
+	apierror.Write(w, r, apierror.Internal("error accessing conversation"))
+}
+
+// requestOwner returns the owner of the request set by the identity
+// middleware
+func requestOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	owner := types.OwnerFromContext(r.Context())
+	if owner == "" {
+		// Identity middleware should always set an owner
+		apierror.Write(w, r, apierror.Internal("no owner for request"))
+		return "", false
+	}
+
+	return owner, true
+}
+
+// decodeConversationRequest decodes the JSON request body, writing an error
+// response if it is invalid
+func decodeConversationRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	return decodeJSONRequest(w, r, v, maxConversationRequestSize)
+}
+
+// decodeJSONRequest decodes the JSON request body of at most maxBytes,
+// writing an error response if it is invalid or too large
+func decodeJSONRequest(w http.ResponseWriter, r *http.Request, v any, maxBytes int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			apierror.Write(w, r, apierror.RequestTooLarge("request body is too large"))
+			return false
+		}
+
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"",
+			"We could not parse the JSON body of your request.",
+		))
+		return false
+	}
+
+	return true
+}
+
+func validateConversationTitle(title string) *apierror.Error {
+	if strings.TrimSpace(title) == "" || len(title) > maxConversationTitleLength {
+		return apierror.InvalidRequest(
+			"",
+			"title must be between 1 and "+strconv.Itoa(maxConversationTitleLength)+" characters",
+		).WithParam("title")
+	}
+
+	return nil
+}
+
+func validateConversationMessage(message types.Message) *apierror.Error {
+	if _, ok := validMessageRoles[message.Role()]; !ok {
+		return apierror.InvalidRequest("", "message role is missing or invalid").WithParam("role")
+	}
+
+	return nil
+}
+
+func writeConversationJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
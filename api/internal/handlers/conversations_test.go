@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func conversationRequest(method, target, body, owner, id string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if id != "" {
+		req.SetPathValue("conversation_id", id)
+	}
+
+	return req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+}
+
+func TestConversationsHandler(t *testing.T) {
+	logger := zerolog.Nop()
+	handler := NewConversationsHandler(conversations.NewMemoryStore(), &logger)
+
+	const owner = "session:owner"
+
+	// Create
+	rr := httptest.NewRecorder()
+	handler.Create(rr, conversationRequest(http.MethodPost, "/v1/conversations", `{
+		"title": "Trip planning",
+		"messages": [{"role": "user", "content": "Plan a trip"}]
+	}`, owner, ""))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	var created conversations.Conversation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	require.NotEmpty(t, created.ID)
+	require.Equal(t, "conversation", created.Object)
+	require.Equal(t, "Trip planning", created.Title)
+	require.Len(t, created.Messages, 1)
+
+	// Append
+	rr = httptest.NewRecorder()
+	handler.AppendMessage(rr, conversationRequest(
+		http.MethodPost,
+		"/v1/conversations/"+created.ID+"/messages",
+		`{"role": "assistant", "content": "Where to?"}`,
+		owner,
+		created.ID,
+	))
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	// Rename
+	rr = httptest.NewRecorder()
+	handler.Rename(rr, conversationRequest(
+		http.MethodPatch,
+		"/v1/conversations/"+created.ID,
+		`{"title": "Japan trip"}`,
+		owner,
+		created.ID,
+	))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// Get
+	rr = httptest.NewRecorder()
+	handler.Get(rr, conversationRequest(http.MethodGet, "/v1/conversations/"+created.ID, "", owner, created.ID))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var got conversations.Conversation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Equal(t, "Japan trip", got.Title)
+	require.Len(t, got.Messages, 2)
+	require.Equal(t, "Where to?", got.Messages[1].Message.Text())
+
+	// List, scoped to owner
+	rr = httptest.NewRecorder()
+	handler.List(rr, conversationRequest(http.MethodGet, "/v1/conversations?limit=1", "", owner, ""))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var list ConversationListResponse
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Equal(t, "list", list.Object)
+	require.Len(t, list.Data, 1)
+	require.False(t, list.HasMore)
+
+	rr = httptest.NewRecorder()
+	handler.List(rr, conversationRequest(http.MethodGet, "/v1/conversations", "", "session:other", ""))
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Empty(t, list.Data)
+
+	// Other owners get 404
+	rr = httptest.NewRecorder()
+	handler.Get(rr, conversationRequest(http.MethodGet, "/v1/conversations/"+created.ID, "", "session:other", created.ID))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Delete
+	rr = httptest.NewRecorder()
+	handler.Delete(rr, conversationRequest(http.MethodDelete, "/v1/conversations/"+created.ID, "", owner, created.ID))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"id": "`+created.ID+`", "object": "conversation.deleted", "deleted": true}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	handler.Get(rr, conversationRequest(http.MethodGet, "/v1/conversations/"+created.ID, "", owner, created.ID))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestConversationsHandler_Validation(t *testing.T) {
+	logger := zerolog.Nop()
+	handler := NewConversationsHandler(conversations.NewMemoryStore(), &logger)
+
+	tests := []struct {
+		name  string
+		body  string
+		param string
+	}{
+		{name: "empty title", body: `{"title": " "}`, param: "title"},
+		{name: "invalid role", body: `{"messages": [{"role": "robot", "content": "hi"}]}`, param: "messages"},
+		{name: "invalid JSON", body: `{`, param: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.Create(rr, conversationRequest(http.MethodPost, "/v1/conversations", tt.body, "session:owner", ""))
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+
+			var res types.ErrorResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+			if tt.param != "" {
+				require.Equal(t, tt.param, *res.ErrorBody.Param)
+			}
+		})
+	}
+
+	t.Run("invalid limit", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.List(rr, conversationRequest(http.MethodGet, "/v1/conversations?limit=500", "", "session:owner", ""))
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
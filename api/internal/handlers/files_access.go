@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/kava-labs/kavachat/api/internal/urlsign"
+)
+
+// FileAccess restricts who can read files. File URLs are signed so they
+// expire, and in owner only mode files are only available to their owner.
+type FileAccess struct {
+	// signer is optional, URLs are not signed if nil
+	signer *urlsign.Signer
+	// ttl is how long signed URLs are valid
+	ttl time.Duration
+	// ownerOnly requires the owner of the request to be the file owner
+	ownerOnly bool
+}
+
+// NewFileAccess creates a new FileAccess. URLs are signed with the signer for
+// the TTL if it is not nil, and files are only available to their owner if
+// ownerOnly is true.
+func NewFileAccess(signer *urlsign.Signer, ttl time.Duration, ownerOnly bool) *FileAccess {
+	return &FileAccess{
+		signer:    signer,
+		ttl:       ttl,
+		ownerOnly: ownerOnly,
+	}
+}
+
+// sign returns the signature query parameters of the file URLs, none if URLs
+// are not signed
+func (a *FileAccess) sign(fileID string) url.Values {
+	if a == nil || a.signer == nil {
+		return nil
+	}
+
+	return a.signer.Sign(fileID, time.Now().Add(a.ttl))
+}
+
+// authorize returns nil if the request with the query of the file URL can
+// read the file. The signature is checked before the storage is, files of
+// other owners return errFileNotFound.
+func (a *FileAccess) authorize(ctx context.Context, store storage.Storage, fileID string, query url.Values) error {
+	if a == nil {
+		return nil
+	}
+
+	// Variants and the text are signed with the file ID
+	if a.signer != nil {
+		if err := a.signer.Verify(fileID, query); err != nil {
+			return err
+		}
+	}
+
+	if a.ownerOnly {
+		return a.authorizeOwner(ctx, store, fileID)
+	}
+
+	return nil
+}
+
+// authorizeOwner returns nil if the owner of the request owns the file or
+// owner only mode is disabled. Files without an owner are not available.
+func (a *FileAccess) authorizeOwner(ctx context.Context, store storage.Storage, fileID string) error {
+	if a == nil || !a.ownerOnly {
+		return nil
+	}
+
+	object, err := store.Head(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, storage.ErrExpired) {
+			return errFileExpired
+		}
+
+		if errors.Is(err, storage.ErrNotFound) {
+			return errFileNotFound
+		}
+
+		return err
+	}
+
+	owner, _, _ := parseFileMetadata(object.Metadata)
+	if requestOwner := types.OwnerFromContext(ctx); owner == "" || owner != requestOwner {
+		return errFileNotFound
+	}
+
+	return nil
+}
+
+// fileAccessError returns the API error of a failed authorization, nil for
+// storage errors
+func fileAccessError(err error) *apierror.Error {
+	switch {
+	case errors.Is(err, urlsign.ErrMissingSignature):
+		return apierror.Forbidden("missing_signature", "File URL is not signed")
+	case errors.Is(err, urlsign.ErrInvalidSignature):
+		return apierror.Forbidden("invalid_signature", "File URL signature is invalid")
+	case errors.Is(err, urlsign.ErrExpired):
+		return apierror.Forbidden("signature_expired", "File URL has expired")
+	case errors.Is(err, errFileNotFound):
+		return apierror.NotFound("File not found")
+	case errors.Is(err, errFileExpired):
+		return apierror.Gone("file_expired", "File has expired")
+	}
+
+	return nil
+}
+
+// signedURL returns the URL with the signature query parameters added
+func signedURL(rawURL string, signature url.Values) string {
+	if len(signature) == 0 {
+		return rawURL
+	}
+
+	return rawURL + "?" + signature.Encode()
+}
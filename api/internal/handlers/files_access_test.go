@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/kava-labs/kavachat/api/internal/urlsign"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fileRequest returns a GET request for the file URL with the file_id path
+// value set
+func fileRequest(t *testing.T, fileURL string, fileID string, owner string) *http.Request {
+	t.Helper()
+
+	parsed, err := url.Parse(fileURL)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, parsed.RequestURI(), nil)
+	req.SetPathValue("file_id", fileID)
+	if owner != "" {
+		req = req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+	}
+
+	return req
+}
+
+// errorCode returns the code of the API error response
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var response struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+	return response.Error.Code
+}
+
+func TestFileAccess_SignedURLs(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	store := storage.NewMemory(24 * time.Hour)
+
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}
+	signer, err := urlsign.NewSigner(keys, "k1")
+	require.NoError(t, err)
+	access := NewFileAccess(signer, time.Hour, false)
+
+	uploads := &FileUploadHandler{
+		storage:      store,
+		publicURL:    "http://example.com",
+		logger:       &logger,
+		textMaxBytes: 1024,
+		access:       access,
+	}
+	downloads := &FileDownloadHandler{storage: store, logger: &logger, access: access}
+	files := &FilesHandler{storage: store, publicURL: "http://example.com", logger: &logger, access: access}
+
+	req := createMultipartRequest(t, "file", "notes.txt", []byte("some notes"), "text/plain")
+	req = req.WithContext(types.AddOwnerToContext(req.Context(), "session:alice"))
+	w := httptest.NewRecorder()
+	uploads.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response FileUploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.Contains(t, response.URL, urlsign.ParamSignature+"=")
+	require.Contains(t, response.TextURL, urlsign.ParamSignature+"=")
+
+	w = httptest.NewRecorder()
+	downloads.ServeHTTP(w, fileRequest(t, response.URL, response.ID, ""))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "some notes", w.Body.String())
+
+	w = httptest.NewRecorder()
+	downloads.ServeText(w, fileRequest(t, response.TextURL, response.ID, ""))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Metadata is signed like downloads, and returns signed URLs
+	w = httptest.NewRecorder()
+	files.Metadata(w, fileRequest(t, response.URL, response.ID, ""))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var metadata FileUploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&metadata))
+	require.Contains(t, metadata.URL, urlsign.ParamSignature+"=")
+
+	expired := NewFileAccess(signer, -time.Minute, false)
+	tests := []struct {
+		name     string
+		fileURL  string
+		wantCode string
+	}{
+		{
+			name:     "unsigned",
+			fileURL:  "http://example.com/v1/files/" + response.ID,
+			wantCode: "missing_signature",
+		},
+		{
+			name:     "other file",
+			fileURL:  signedURL("http://example.com/v1/files/"+response.ID, access.sign("other-file")),
+			wantCode: "invalid_signature",
+		},
+		{
+			name:     "expired",
+			fileURL:  signedURL("http://example.com/v1/files/"+response.ID, expired.sign(response.ID)),
+			wantCode: "signature_expired",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			downloads.ServeHTTP(w, fileRequest(t, tt.fileURL, response.ID, ""))
+			require.Equal(t, http.StatusForbidden, w.Code)
+			require.Equal(t, tt.wantCode, errorCode(t, w))
+
+			w = httptest.NewRecorder()
+			downloads.ServeText(w, fileRequest(t, tt.fileURL, response.ID, ""))
+			require.Equal(t, http.StatusForbidden, w.Code)
+
+			w = httptest.NewRecorder()
+			files.Metadata(w, fileRequest(t, tt.fileURL, response.ID, ""))
+			require.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+}
+
+func TestFileAccess_ThumbnailURL(t *testing.T) {
+	signer, err := urlsign.NewSigner(map[string][]byte{"k1": []byte("secret")}, "k1")
+	require.NoError(t, err)
+
+	signature := NewFileAccess(signer, time.Hour, false).sign("file1")
+	response := newFileResponse(
+		"http://example.com",
+		"file1",
+		10,
+		time.Now(),
+		time.Time{},
+		"image.png",
+		[]string{variantThumb},
+		signature,
+	)
+
+	thumbnailURL, err := url.Parse(response.ThumbnailURL)
+	require.NoError(t, err)
+	require.Equal(t, variantThumb, thumbnailURL.Query().Get("variant"))
+	require.NoError(t, signer.Verify("file1", thumbnailURL.Query()))
+
+	// Unsigned URLs are unchanged
+	response = newFileResponse("http://example.com", "file1", 10, time.Now(), time.Time{}, "image.png", []string{variantThumb}, nil)
+	require.Equal(t, "http://example.com/v1/files/file1", response.URL)
+	require.Equal(t, "http://example.com/v1/files/file1?variant=thumb", response.ThumbnailURL)
+}
+
+func TestFileAccess_OwnerOnly(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	store := storage.NewMemory(24 * time.Hour)
+	access := NewFileAccess(nil, time.Hour, true)
+
+	for key, owner := range map[string]string{"alice-file": "session:alice", "legacy-file": ""} {
+		_, err := store.Put(context.Background(), storage.PutInput{
+			Key:         key,
+			Body:        strings.NewReader("\x89PNG\r\n\x1a\nimage data"),
+			Size:        18,
+			ContentType: "image/png",
+			Metadata:    newFileMetadata(owner, "image.png", []string{variantText}),
+		})
+		require.NoError(t, err)
+
+		_, err = store.Put(context.Background(), storage.PutInput{
+			Key:         textKey(key),
+			Body:        strings.NewReader("text"),
+			Size:        4,
+			ContentType: "text/plain",
+		})
+		require.NoError(t, err)
+	}
+
+	downloads := &FileDownloadHandler{storage: store, logger: &logger, access: access}
+	files := &FilesHandler{storage: store, publicURL: "http://example.com", logger: &logger, access: access}
+	inliner := &fileInliner{
+		downloads: downloads,
+		cfg: InlineFilesConfig{
+			PublicURL:     "http://example.com",
+			MaxBytes:      1024,
+			MaxTotalBytes: 1024,
+			ContentTypes:  []string{"image/png"},
+		},
+	}
+	proxy := openaiProxyHandler{fileTexts: downloads, fileTextMaxTokens: 100}
+
+	tests := []struct {
+		name       string
+		fileID     string
+		owner      string
+		wantStatus int
+	}{
+		{name: "owner", fileID: "alice-file", owner: "session:alice", wantStatus: http.StatusOK},
+		{name: "other owner", fileID: "alice-file", owner: "session:bob", wantStatus: http.StatusNotFound},
+		{name: "no owner", fileID: "alice-file", owner: "", wantStatus: http.StatusNotFound},
+		{name: "file without owner", fileID: "legacy-file", owner: "session:alice", wantStatus: http.StatusNotFound},
+		{name: "missing file", fileID: "missing-file", owner: "session:alice", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileURL := "http://example.com/v1/files/" + tt.fileID
+
+			w := httptest.NewRecorder()
+			downloads.ServeHTTP(w, fileRequest(t, fileURL, tt.fileID, tt.owner))
+			require.Equal(t, tt.wantStatus, w.Code)
+
+			w = httptest.NewRecorder()
+			downloads.ServeText(w, fileRequest(t, fileURL+"/text", tt.fileID, tt.owner))
+			require.Equal(t, tt.wantStatus, w.Code)
+
+			w = httptest.NewRecorder()
+			files.Metadata(w, fileRequest(t, fileURL, tt.fileID, tt.owner))
+			require.Equal(t, tt.wantStatus, w.Code)
+
+			ctx := types.AddOwnerToContext(context.Background(), tt.owner)
+			ref, ok := inliner.fileRef(fileURL)
+			require.True(t, ok)
+
+			_, _, inlineErr := inliner.dataURL(ctx, ref, 1024)
+			_, _, textErr := proxy.fileText(ctx, tt.fileID)
+			if tt.wantStatus == http.StatusOK {
+				require.NoError(t, inlineErr)
+				require.NoError(t, textErr)
+			} else {
+				require.ErrorIs(t, inlineErr, errInlineFile)
+				require.ErrorIs(t, textErr, errFileText)
+			}
+		})
+	}
+}
+
+func TestFileAccessError(t *testing.T) {
+	require.Nil(t, fileAccessError(io.EOF), "storage errors are not access errors")
+	require.Equal(t, http.StatusNotFound, fileAccessError(errFileNotFound).StatusCode)
+	require.Equal(t, http.StatusGone, fileAccessError(errFileExpired).StatusCode)
+	require.Equal(t, http.StatusForbidden, fileAccessError(urlsign.ErrExpired).StatusCode)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/extract"
+)
+
+const (
+	// sniffLen is the number of bytes used to detect the content type
+	sniffLen = 512
+)
+
+// inlineContentTypes are the content types that are safe to render in the
+// browser. Other files are downloaded as attachments.
+var inlineContentTypes = map[string]bool{
+	"image/png":     true,
+	"image/jpeg":    true,
+	"image/gif":     true,
+	"image/webp":    true,
+	"text/plain":    true,
+	"text/markdown": true,
+	"text/csv":      true,
+}
+
+// textExtensionContentTypes are plain text formats that can only be detected
+// by the file extension
+var textExtensionContentTypes = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+}
+
+// WithAllowedContentTypes rejects uploads with a detected content type that
+// is not in the list, e.g. image/png
+func WithAllowedContentTypes(contentTypes []string) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.allowedContentTypes = make(map[string]bool, len(contentTypes))
+		for _, contentType := range contentTypes {
+			h.allowedContentTypes[contentType] = true
+		}
+	}
+}
+
+// detectContentType returns the content type of the file from its content,
+// ignoring the content type sent by the client. Plain text files use the
+// filename extension for text formats such as Markdown and CSV.
+func detectContentType(file io.ReaderAt, size int64, filename string) (string, error) {
+	head := make([]byte, min(size, sniffLen))
+	if _, err := file.ReadAt(head, 0); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	detected := http.DetectContentType(head)
+	mediaType, params, err := mime.ParseMediaType(detected)
+	if err != nil {
+		return detected, nil
+	}
+
+	switch mediaType {
+	case "text/plain":
+		if textType, ok := textExtensionContentTypes[strings.ToLower(filepath.Ext(filename))]; ok {
+			return mime.FormatMediaType(textType, params), nil
+		}
+	case "application/zip":
+		if isDOCX(file, size) {
+			return extract.ContentTypeDOCX, nil
+		}
+	case "audio/wave":
+		// The registered type of WAV files, as sent by browsers
+		return "audio/wav", nil
+	case "application/octet-stream", "video/mp4":
+		if isM4A(head) {
+			return "audio/mp4", nil
+		}
+
+		if isHEIC(head) {
+			return "image/heic", nil
+		}
+	}
+
+	return detected, nil
+}
+
+// isDOCX returns true if the zip archive is a Word document
+func isDOCX(file io.ReaderAt, size int64) bool {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return false
+	}
+
+	for _, f := range archive.File {
+		if f.Name == "word/document.xml" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isM4A returns true if the file is an MP4 audio file, detected from the major
+// brand of its ftyp box
+func isM4A(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+
+	switch string(head[8:12]) {
+	case "M4A ", "M4B ":
+		return true
+	}
+
+	return false
+}
+
+// isHEIC returns true if the file is a HEIC image, detected from the major
+// brand of its ftyp box
+func isHEIC(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+
+	switch string(head[8:12]) {
+	case "heic", "heix":
+		return true
+	}
+
+	return false
+}
+
+// mediaType returns the content type without parameters such as charset
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// isInlineContentType returns true if the content type is safe to render in
+// the browser
+func isInlineContentType(contentType string) bool {
+	return inlineContentTypes[mediaType(contentType)]
+}
+
+// contentDisposition returns the Content-Disposition for the file, inline only
+// if the content type is safe to render
+func contentDisposition(filename string, contentType string) string {
+	disposition := "attachment"
+	if isInlineContentType(contentType) {
+		disposition = "inline"
+	}
+
+	return fmt.Sprintf("%s; filename=\"%s\"", disposition, sanitizeFilename(filename))
+}
+
+// forceAttachment returns the Content-Disposition with the attachment type,
+// keeping the parameters such as filename
+func forceAttachment(disposition string) string {
+	_, params, found := strings.Cut(disposition, ";")
+	if !found {
+		return "attachment"
+	}
+
+	return "attachment;" + params
+}
+
+// sanitizeFilename removes characters that cannot be used in a quoted header
+// value
+func sanitizeFilename(filename string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < 0x20 || r == 0x7f {
+			return -1
+		}
+
+		return r
+	}, filename)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/extract"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectContentType(t *testing.T) {
+	zipFile := func(names ...string) []byte {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for _, name := range names {
+			_, err := archive.Create(name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, archive.Close())
+
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		expected string
+	}{
+		{name: "jpeg", filename: "photo", content: []byte("\xFF\xD8\xFFdata"), expected: "image/jpeg"},
+		{name: "csv", filename: "data.CSV", content: []byte("a,b\n1,2\n"), expected: "text/csv; charset=utf-8"},
+		{name: "text with unknown extension", filename: "notes.log", content: []byte("hello"), expected: "text/plain; charset=utf-8"},
+		{name: "docx", filename: "doc.docx", content: zipFile("[Content_Types].xml", "word/document.xml"), expected: extract.ContentTypeDOCX},
+		{name: "zip", filename: "archive.docx", content: zipFile("other.txt"), expected: "application/zip"},
+		{name: "empty", filename: "empty.txt", content: nil, expected: "text/plain; charset=utf-8"},
+		{name: "mp3", filename: "song.mp3", content: []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), expected: "audio/mpeg"},
+		{name: "wav", filename: "voice.wav", content: []byte("RIFF\x24\x00\x00\x00WAVEfmt "), expected: "audio/wav"},
+		{name: "m4a", filename: "memo.m4a", content: []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00M4A mp42isom"), expected: "audio/mp4"},
+		{name: "mp4 video", filename: "clip.m4a", content: []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), expected: "video/mp4"},
+		{name: "heic", filename: "photo.heic", content: []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), expected: "image/heic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, err := detectContentType(bytes.NewReader(tt.content), int64(len(tt.content)), tt.filename)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, contentType)
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	require.Equal(t, `inline; filename="photo.png"`, contentDisposition("photo.png", "image/png"))
+	require.Equal(t, `attachment; filename="page.html"`, contentDisposition("page.html", "text/html; charset=utf-8"))
+	require.Equal(t, `attachment; filename="evil.svg"`, contentDisposition("ev\"il\r\n.svg", "image/svg+xml"))
+
+	require.Equal(t, `attachment; filename="a.html"`, forceAttachment(`inline; filename="a.html"`))
+	require.Equal(t, "attachment", forceAttachment("inline"))
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// stagingPrefix is the key prefix of direct uploads before completion
+	stagingPrefix = "uploads/"
+	// maxFilenameLength is the max length of direct upload filenames
+	maxFilenameLength = 255
+	// maxUploadRequestSize limits the JSON bodies of upload requests, the file
+	// content is not part of them
+	maxUploadRequestSize = 64 * 1024 // 64KB
+)
+
+// DirectUploadRequest is the request to create a direct upload
+type DirectUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// DirectUploadResponse is the presigned request to upload a file directly to
+// the storage, the upload is completed with a request to CompleteURL
+type DirectUploadResponse struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	UploadURL string `json:"upload_url"`
+	Method    string `json:"method"`
+	// Headers must be sent with the upload request, they are signed
+	Headers     map[string]string `json:"headers"`
+	ExpireAt    time.Time         `json:"expire_at"`
+	CompleteURL string            `json:"complete_url"`
+}
+
+// DirectUploadHandler creates presigned PUT requests to upload files directly
+// to the storage. Completed uploads are validated and processed like
+// multipart uploads.
+type DirectUploadHandler struct {
+	presigner storage.Presigner
+	publicURL string
+	ttl       time.Duration
+	uploads   *FileUploadHandler
+	logger    *zerolog.Logger
+}
+
+// NewDirectUploadHandler creates a new DirectUploadHandler, presigned uploads
+// are valid for the TTL. Completed uploads are stored with the upload handler,
+// its storage must support presigned URLs.
+func NewDirectUploadHandler(
+	publicURL string,
+	ttl time.Duration,
+	uploads *FileUploadHandler,
+	baseLogger *zerolog.Logger,
+) (*DirectUploadHandler, error) {
+	presigner, ok := uploads.storage.(storage.Presigner)
+	if !ok {
+		return nil, errors.New("direct uploads require a storage with presigned URLs")
+	}
+
+	logger := baseLogger.With().
+		Str("handler", "DirectUploadHandler").
+		Logger()
+
+	return &DirectUploadHandler{
+		presigner: presigner,
+		publicURL: publicURL,
+		ttl:       ttl,
+		uploads:   uploads,
+		logger:    &logger,
+	}, nil
+}
+
+// Create handles POST /v1/files/uploads, returning a presigned PUT request
+// for a file with the exact size and content type of the request
+func (h *DirectUploadHandler) Create(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req DirectUploadRequest
+	if !decodeJSONRequest(w, r, &req, maxUploadRequestSize) {
+		return
+	}
+
+	if e := h.validateRequest(req); e != nil {
+		apierror.Write(w, r, e)
+		return
+	}
+
+	fileID := ulid.Make().String()
+	expireAt := time.Now().Add(h.ttl).UTC()
+
+	presigned, err := h.presigner.PresignPut(r.Context(), storage.PutInput{
+		Key:         stagingKey(owner, fileID),
+		Size:        req.Bytes,
+		ContentType: req.ContentType,
+		Metadata:    newFileMetadata(owner, req.Filename, nil),
+	}, h.ttl)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("error presigning upload")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error creating upload"))
+		return
+	}
+
+	// Host and Content-Length are set by the client
+	headers := make(map[string]string)
+	for name, values := range presigned.Header {
+		switch strings.ToLower(name) {
+		case "host", "content-length":
+			continue
+		}
+
+		headers[name] = strings.Join(values, ",")
+	}
+
+	h.logger.Debug().
+		Str("file_id", fileID).
+		Str("content_type", req.ContentType).
+		Int64("bytes", req.Bytes).
+		Msg("Direct upload created")
+
+	writeFileJSON(w, http.StatusCreated, DirectUploadResponse{
+		ID:          fileID,
+		Object:      "file.upload",
+		UploadURL:   presigned.URL,
+		Method:      presigned.Method,
+		Headers:     headers,
+		ExpireAt:    expireAt,
+		CompleteURL: fmt.Sprintf("%s/v1/files/uploads/%s/complete", h.publicURL, fileID),
+	})
+}
+
+// Complete handles POST /v1/files/uploads/{file_id}/complete. The uploaded
+// object is validated and processed like a multipart upload and the staged
+// object is deleted, the client must upload again if it is rejected.
+func (h *DirectUploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	fileID := r.PathValue("file_id")
+	if !validFileID(fileID) {
+		apierror.Write(w, r, apierror.NotFound("upload not found"))
+		return
+	}
+
+	// Uploads of other owners are not found as the key includes the owner
+	key := stagingKey(owner, fileID)
+
+	object, err := h.uploads.storage.Get(r.Context(), storage.GetInput{Key: key})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			apierror.Write(w, r, apierror.NotFound("upload not found"))
+			return
+		}
+
+		h.logger.Error().Err(err).Str("file_id", fileID).Msg("error reading direct upload")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error reading upload"))
+		return
+	}
+	defer object.Body.Close()
+
+	defer h.uploads.deleteStaged(key)
+
+	h.uploads.storeObject(w, r, object, fileID)
+}
+
+// validateRequest checks the declared file of a direct upload, the content is
+// checked again on completion
+func (h *DirectUploadHandler) validateRequest(req DirectUploadRequest) *apierror.Error {
+	return validateUploadRequest(req, h.uploads.maxSize(), h.uploads)
+}
+
+// validateUploadRequest checks the declared filename, size and content type
+// of an upload to S3
+func validateUploadRequest(req DirectUploadRequest, maxBytes int64, uploads *FileUploadHandler) *apierror.Error {
+	if strings.TrimSpace(req.Filename) == "" || len(req.Filename) > maxFilenameLength {
+		return apierror.InvalidRequest(
+			"",
+			fmt.Sprintf("filename must be between 1 and %d characters", maxFilenameLength),
+		).WithParam("filename")
+	}
+
+	if req.Bytes < 1 || req.Bytes > maxBytes {
+		return apierror.InvalidRequest(
+			"file_too_large",
+			fmt.Sprintf("bytes must be between 1 and %d", maxBytes),
+		).WithParam("bytes")
+	}
+
+	contentType, _, err := mime.ParseMediaType(req.ContentType)
+	if err != nil {
+		return apierror.InvalidRequest("", "invalid content_type").WithParam("content_type")
+	}
+
+	if !uploads.isAllowedContentType(contentType) {
+		return apierror.InvalidRequest("unsupported_file_type", "File type not allowed").WithParam("content_type")
+	}
+
+	return nil
+}
+
+// stagingKey returns the storage key of a direct upload of the owner before it
+// is completed
+func stagingKey(owner string, fileID string) string {
+	return stagingPrefix + ownerHash(owner) + "/" + fileID
+}
+
+// stagedFile is a completed direct upload read into memory
+type stagedFile struct {
+	*bytes.Reader
+}
+
+func (stagedFile) Close() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectUploadHandler(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	bucket := storage.NewMemory(0)
+	presigner := &mockPresigner{}
+
+	uploads := &FileUploadHandler{
+		storage:   bucket,
+		publicURL: "http://example.com",
+		logger:    &logger,
+	}
+	WithAllowedContentTypes([]string{"text/plain", "image/png"})(uploads)
+
+	handler := &DirectUploadHandler{
+		presigner: presigner,
+		publicURL: "http://example.com",
+		ttl:       15 * time.Minute,
+		uploads:   uploads,
+		logger:    &logger,
+	}
+
+	create := func(owner string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/files/uploads", strings.NewReader(body))
+		req = req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+
+		w := httptest.NewRecorder()
+		handler.Create(w, req)
+		return w
+	}
+
+	complete := func(owner string, fileID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/files/uploads/"+fileID+"/complete", nil)
+		req.SetPathValue("file_id", fileID)
+		req = req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+
+		w := httptest.NewRecorder()
+		handler.Complete(w, req)
+		return w
+	}
+
+	// upload simulates the client PUT to the presigned URL
+	upload := func(content string) {
+		input := presigner.put
+		input.Body = strings.NewReader(content)
+		input.Size = int64(len(content))
+
+		_, err := bucket.Put(context.Background(), input)
+		require.NoError(t, err)
+	}
+
+	t.Run("create and complete", func(t *testing.T) {
+		w := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response DirectUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, "file.upload", response.Object)
+		require.Equal(t, http.MethodPut, response.Method)
+		require.Equal(t, "http://example.com/v1/files/uploads/"+response.ID+"/complete", response.CompleteURL)
+		require.Equal(t, map[string]string{
+			"Content-Type":        "text/plain",
+			"X-Amz-Meta-Filename": "notes.txt",
+			"X-Amz-Meta-Owner":    "session%3Aalice",
+		}, response.Headers)
+		require.WithinDuration(t, time.Now().Add(15*time.Minute), response.ExpireAt, time.Second)
+
+		require.Equal(t, stagingKey("session:alice", response.ID), presigner.put.Key)
+		require.Equal(t, int64(10), presigner.put.Size)
+		require.Equal(t, 15*time.Minute, presigner.ttl)
+
+		upload("some notes")
+
+		w = complete("user:bob", response.ID)
+		require.Equal(t, http.StatusNotFound, w.Code, "uploads of other owners are not found")
+
+		w = complete("session:alice", response.ID)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var file FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&file))
+		require.Equal(t, response.ID, file.ID)
+		require.Equal(t, "notes.txt", file.Filename)
+		require.Equal(t, int64(10), file.Bytes)
+
+		object, err := bucket.Head(context.Background(), response.ID)
+		require.NoError(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", object.ContentType)
+		require.Equal(t, "some notes", storedData(t, bucket, response.ID))
+		require.True(t, isStored(bucket, ownerIndexKey("session:alice", response.ID)))
+		require.False(t, isStored(bucket, stagingKey("session:alice", response.ID)), "staged upload is deleted")
+
+		w = complete("session:alice", response.ID)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("content is validated on completion", func(t *testing.T) {
+		w := create("session:alice", `{"filename": "photo.png", "content_type": "image/png", "bytes": 10}`)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response DirectUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+		upload("<html></html>")
+
+		w = complete("session:alice", response.ID)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		require.False(t, isStored(bucket, response.ID))
+		require.False(t, isStored(bucket, stagingKey("session:alice", response.ID)))
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, body := range []string{
+			`{"filename": "", "content_type": "text/plain", "bytes": 10}`,
+			`{"filename": "notes.txt", "content_type": "text/plain", "bytes": 0}`,
+			`{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10485761}`,
+			`{"filename": "page.html", "content_type": "text/html", "bytes": 10}`,
+			`{"filename": "notes.txt", "content_type": "", "bytes": 10}`,
+			`not json`,
+		} {
+			w := create("session:alice", body)
+			require.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+
+		w := create("session:alice", `{"filename": "`+strings.Repeat("a", maxUploadRequestSize)+`"}`)
+		require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+}
+
+func TestNewDirectUploadHandler(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	uploads := NewFileUploadHandler(storage.NewMemory(0), "http://example.com", &logger)
+	_, err := NewDirectUploadHandler("http://example.com", 15*time.Minute, uploads, &logger)
+	require.Error(t, err, "the memory storage cannot presign uploads")
+
+	uploads = NewFileUploadHandler(storage.NewS3(nil, "test-bucket", 0), "http://example.com", &logger)
+	_, err = NewDirectUploadHandler("http://example.com", 15*time.Minute, uploads, &logger)
+	require.NoError(t, err)
+}
@@ -1,103 +1,319 @@
 package handlers
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
 	"github.com/rs/zerolog"
 )
 
-// S3Downloader implements the GetObject method from the AWS SDK.
-type S3Downloader interface {
-	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+// FileDownloadHandler is a HTTP handler for file downloads from the file
+// storage.
+type FileDownloadHandler struct {
+	storage storage.Storage
+	logger  *zerolog.Logger
+
+	// cacheControl is the Cache-Control header of downloads, none if empty
+	cacheControl string
+	// presigner is optional, files are proxied if nil
+	presigner  storage.Presigner
+	presignTTL time.Duration
+	// access is optional, files are available to anyone with the file ID if
+	// nil
+	access *FileAccess
 }
 
-// FileDownloadHandler is a HTTP handler for file downloads from S3.
-type FileDownloadHandler struct {
-	s3Client   S3Downloader
-	bucketName string
-	logger     *zerolog.Logger
+// FileDownloadOption configures optional behavior of the file download handler
+type FileDownloadOption func(*FileDownloadHandler)
+
+// WithCacheControl sets the Cache-Control header of downloads. File keys are
+// ULIDs that are never reused, so files can be cached as immutable.
+func WithCacheControl(cacheControl string) FileDownloadOption {
+	return func(h *FileDownloadHandler) {
+		h.cacheControl = cacheControl
+	}
+}
+
+// WithPresignedRedirects redirects downloads to presigned URLs valid for the
+// TTL instead of proxying the file, if the storage supports presigning
+func WithPresignedRedirects(ttl time.Duration) FileDownloadOption {
+	return func(h *FileDownloadHandler) {
+		h.presignTTL = ttl
+	}
+}
+
+// WithFileAccess requires downloads to have a valid URL signature, or to be
+// requested by the file owner in owner only mode
+func WithFileAccess(access *FileAccess) FileDownloadOption {
+	return func(h *FileDownloadHandler) {
+		h.access = access
+	}
 }
 
-// NewFileDownloadHandler creates a new FileDownloadHandler with the given bucket name.
+// NewFileDownloadHandler creates a new FileDownloadHandler serving files from
+// the storage.
 func NewFileDownloadHandler(
-	bucketName string,
-	s3PathStyleRequests bool,
+	store storage.Storage,
 	baseLogger *zerolog.Logger,
+	opts ...FileDownloadOption,
 ) *FileDownloadHandler {
 	logger := baseLogger.With().
 		Str("handler", "FileDownloadHandler").
 		Logger()
 
-	// Load AWS config from environment
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		panic(fmt.Sprintf("unable to load AWS SDK config: %v", err))
+	h := &FileDownloadHandler{
+		storage: store,
+		logger:  &logger,
 	}
 
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = s3PathStyleRequests
-	})
+	for _, opt := range opts {
+		opt(h)
+	}
 
-	return &FileDownloadHandler{
-		s3Client:   client,
-		bucketName: bucketName,
-		logger:     &logger,
+	if presigner, ok := store.(storage.Presigner); ok && h.presignTTL > 0 {
+		h.presigner = presigner
 	}
+
+	return h
 }
 
 // ServeHTTP implements the http.Handler interface for the FileDownloadHandler.
 func (h *FileDownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		apierror.Write(w, r, apierror.MethodNotAllowed())
+		return
+	}
+
+	fileID := r.PathValue("file_id")
+	if fileID == "" {
+		apierror.Write(w, r, apierror.InvalidRequest("", "Missing file ID").WithParam("file_id"))
+		return
+	}
+
+	key, ok := variantKey(fileID, r.URL.Query().Get("variant"))
+	if !ok {
+		apierror.Write(w, r, apierror.InvalidRequest("", "Invalid file variant").WithParam("variant"))
+		return
+	}
+
+	if !h.authorize(w, r, fileID) {
+		return
+	}
+
+	h.serveObject(w, r, fileID, key)
+}
+
+// ServeText serves the text extracted from a document upload
+func (h *FileDownloadHandler) ServeText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, r, apierror.MethodNotAllowed())
 		return
 	}
 
 	fileID := r.PathValue("file_id")
 	if fileID == "" {
-		http.Error(w, "Missing file ID", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.InvalidRequest("", "Missing file ID").WithParam("file_id"))
+		return
+	}
+
+	if !h.authorize(w, r, fileID) {
+		return
+	}
+
+	h.serveObject(w, r, fileID, textKey(fileID))
+}
+
+// authorize checks the request can read the file before the storage is
+// requested or a presigned URL is returned. An error response is written if
+// false is returned.
+func (h *FileDownloadHandler) authorize(w http.ResponseWriter, r *http.Request, fileID string) bool {
+	err := h.access.authorize(r.Context(), h.storage, fileID, r.URL.Query())
+	if err == nil {
+		return true
+	}
+
+	if accessErr := fileAccessError(err); accessErr != nil {
+		apierror.Write(w, r, accessErr)
+		return false
+	}
+
+	h.logger.Error().Err(err).Str("file_id", fileID).Msg("Error authorizing file download")
+	apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "Error retrieving file"))
+	return false
+}
+
+// serveObject copies the object with the key of the file to the response.
+// Conditional and range requests are passed to the storage.
+func (h *FileDownloadHandler) serveObject(w http.ResponseWriter, r *http.Request, fileID string, key string) {
+	if h.presigner != nil {
+		h.redirectObject(w, r, fileID, key)
 		return
 	}
 
 	ctx := r.Context()
-	objectResult, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(h.bucketName),
-		Key:    aws.String(fileID),
-	})
+	object, err := h.storage.Get(ctx, newGetInput(r, key))
 	if err != nil {
-		h.logger.Error().Err(err).Str("file_id", fileID).Msg("Error retrieving file from S3")
-
-		http.Error(w, "Error retrieving file", http.StatusNotFound)
+		h.writeStorageError(w, r, fileID, err)
 		return
 	}
-	defer objectResult.Body.Close()
+	defer object.Body.Close()
+
+	// Browsers must use the stored content type
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	// Set content type if available
-	if objectResult.ContentType != nil {
-		w.Header().Set("Content-Type", *objectResult.ContentType)
+	if object.ContentType != "" {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+
+	if disposition := downloadDisposition(object.Object); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+
+	h.setCacheHeaders(w.Header(), object.ETag, object.LastModified)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if object.Length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(object.Length, 10))
 	}
 
-	// Set ContentDisposition if available
-	if objectResult.ContentDisposition != nil {
-		w.Header().Set("Content-Disposition", *objectResult.ContentDisposition)
+	statusCode := http.StatusOK
+	if object.ContentRange != "" {
+		w.Header().Set("Content-Range", object.ContentRange)
+		statusCode = http.StatusPartialContent
 	}
 
 	h.logger.Debug().
-		Str("bucket_name", h.bucketName).
-		Str("key", fileID).
+		Str("key", key).
 		Str("content_type", w.Header().Get("Content-Type")).
 		Str("content_disposition", w.Header().Get("Content-Disposition")).
+		Str("content_range", w.Header().Get("Content-Range")).
 		Msg("Downloading file")
 
+	w.WriteHeader(statusCode)
+
 	// Copy the file to the response
-	if _, err := io.Copy(w, objectResult.Body); err != nil {
+	if _, err := io.Copy(w, object.Body); err != nil {
+		// Headers and part of the body are already sent, the client sees a
+		// truncated response
 		h.logger.Error().Err(err).Str("file_id", fileID).Msg("Error streaming file")
-		http.Error(w, "Error streaming file", http.StatusInternalServerError)
 		return
 	}
 }
+
+// redirectObject redirects to a presigned GET URL of the object. Missing and
+// expired files are checked first, as presigned URLs do not check the
+// expiration. The storage handles conditional and range requests. The URL
+// is signed with the content type and disposition of a download from the
+// API, the storage cannot send nosniff.
+func (h *FileDownloadHandler) redirectObject(w http.ResponseWriter, r *http.Request, fileID string, key string) {
+	ctx := r.Context()
+	object, err := h.storage.Head(ctx, key)
+	if err != nil {
+		h.writeStorageError(w, r, fileID, err)
+		return
+	}
+
+	object.ContentDisposition = downloadDisposition(object)
+	presignedURL, err := h.presigner.PresignGet(ctx, object, h.presignTTL)
+	if err != nil {
+		h.writeStorageError(w, r, fileID, err)
+		return
+	}
+
+	// The presigned URL expires, the redirect must not be cached
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, presignedURL, http.StatusFound)
+}
+
+// downloadDisposition returns the Content-Disposition of a download of the
+// object. Files stored before content types were detected may not be safe to
+// display inline and are downloaded as attachments even without a stored
+// disposition.
+func downloadDisposition(object storage.Object) string {
+	if !isInlineContentType(object.ContentType) {
+		return forceAttachment(object.ContentDisposition)
+	}
+
+	return object.ContentDisposition
+}
+
+// newGetInput returns the storage request for the object key with the
+// conditional and range headers of the download request
+func newGetInput(r *http.Request, key string) storage.GetInput {
+	input := storage.GetInput{Key: key}
+
+	// If-Modified-Since is ignored with If-None-Match, RFC 9110 13.1.3
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		input.IfNoneMatch = ifNoneMatch
+	} else if ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		input.IfModifiedSince = ifModifiedSince
+	}
+
+	// Only a single range is supported. Multiple ranges and If-Range, which
+	// the storage cannot evaluate, get the full file.
+	rangeHeader := r.Header.Get("Range")
+	if strings.HasPrefix(rangeHeader, "bytes=") &&
+		!strings.Contains(rangeHeader, ",") &&
+		r.Header.Get("If-Range") == "" {
+		input.Range = rangeHeader
+	}
+
+	return input
+}
+
+// setCacheHeaders sets the validators and Cache-Control of the object
+func (h *FileDownloadHandler) setCacheHeaders(header http.Header, etag string, lastModified time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if h.cacheControl != "" {
+		header.Set("Cache-Control", h.cacheControl)
+	}
+}
+
+// writeStorageError writes the response for a failed storage request. Not
+// modified and unsatisfiable range responses are returned as errors.
+func (h *FileDownloadHandler) writeStorageError(w http.ResponseWriter, r *http.Request, fileID string, err error) {
+	// Expired files that are not deleted yet are also not found
+	if errors.Is(err, storage.ErrExpired) {
+		apierror.Write(w, r, apierror.Gone("file_expired", "File has expired"))
+		return
+	}
+
+	if errors.Is(err, storage.ErrNotFound) {
+		apierror.Write(w, r, apierror.NotFound("File not found"))
+		return
+	}
+
+	var notModified *storage.NotModifiedError
+	if errors.As(err, &notModified) {
+		h.setCacheHeaders(w.Header(), notModified.ETag, notModified.LastModified)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if errors.Is(err, storage.ErrInvalidRange) {
+		apierror.Write(w, r, apierror.New(
+			http.StatusRequestedRangeNotSatisfiable,
+			apierror.TypeInvalidRequest,
+			"invalid_range",
+			"Requested range not satisfiable",
+		).WithParam("Range"))
+		return
+	}
+
+	h.logger.Error().Err(err).Str("file_id", fileID).Msg("Error retrieving file from storage")
+	apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "Error retrieving file"))
+}
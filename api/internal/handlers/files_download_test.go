@@ -6,15 +6,24 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/kava-labs/kavachat/api/internal/storage"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
 
 type mockS3Downloader struct {
+	storage.S3Client
+
 	getObjectFn func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 }
 
@@ -92,9 +101,26 @@ func TestFileDownloadHandler_ServeHTTP(t *testing.T) {
 					Body: io.NopCloser(strings.NewReader("test content")),
 				}, nil
 			},
-			expectedStatus: http.StatusOK,
-			expectedBody:   "test content",
-			expectedType:   "",
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "test content",
+			expectedType:        "",
+			expectedDisposition: "attachment",
+		},
+		{
+			name:   "unsafe content type without content disposition",
+			method: http.MethodGet,
+			fileID: "test-file-legacy",
+			s3ClientFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				contentType := "text/html"
+				return &s3.GetObjectOutput{
+					Body:        io.NopCloser(strings.NewReader("<script></script>")),
+					ContentType: &contentType,
+				}, nil
+			},
+			expectedStatus:      http.StatusOK,
+			expectedBody:        "<script></script>",
+			expectedType:        "text/html",
+			expectedDisposition: "attachment",
 		},
 		{
 			name:           "invalid method",
@@ -115,6 +141,15 @@ func TestFileDownloadHandler_ServeHTTP(t *testing.T) {
 			s3ClientFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
 				return nil, errors.New("s3 error")
 			},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "missing file",
+			method: http.MethodGet,
+			fileID: "test-file",
+			s3ClientFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				return nil, &s3types.NoSuchKey{}
+			},
 			expectedStatus: http.StatusNotFound,
 		},
 	}
@@ -122,11 +157,10 @@ func TestFileDownloadHandler_ServeHTTP(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			handler := &FileDownloadHandler{
-				s3Client: &mockS3Downloader{
+				storage: storage.NewS3(&mockS3Downloader{
 					getObjectFn: tt.s3ClientFn,
-				},
-				bucketName: "test-bucket",
-				logger:     &logger,
+				}, "test-bucket", 0),
+				logger: &logger,
 			}
 
 			req := httptest.NewRequest(tt.method, "/files/"+tt.fileID, nil)
@@ -153,3 +187,351 @@ func TestFileDownloadHandler_ServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestFileDownloadHandler_Variant(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	var requestedKey string
+	handler := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Downloader{
+			getObjectFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				requestedKey = *params.Key
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("thumb"))}, nil
+			},
+		}, "test-bucket", 0),
+		logger: &logger,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/test-file?variant=thumb", nil)
+	req.SetPathValue("file_id", "test-file")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "test-file/thumb", requestedKey)
+
+	req = httptest.NewRequest(http.MethodGet, "/files/test-file?variant=large", nil)
+	req.SetPathValue("file_id", "test-file")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFileDownloadHandler_Expired(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	store := storage.NewMemory(0)
+
+	_, err := store.Put(context.Background(), storage.PutInput{
+		Key:      "expired-file",
+		Body:     strings.NewReader("content"),
+		Size:     7,
+		ExpireAt: time.Now().Add(-time.Minute),
+	})
+	require.NoError(t, err)
+
+	downloads := &FileDownloadHandler{storage: store, logger: &logger}
+	files := &FilesHandler{storage: store, publicURL: "http://example.com", logger: &logger}
+
+	for _, fileID := range []string{"expired-file", "missing-file"} {
+		wantStatus := http.StatusGone
+		if fileID == "missing-file" {
+			wantStatus = http.StatusNotFound
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/files/"+fileID, nil)
+		req.SetPathValue("file_id", fileID)
+		w := httptest.NewRecorder()
+		downloads.ServeHTTP(w, req)
+		require.Equal(t, wantStatus, w.Code, fileID)
+
+		req = httptest.NewRequest(http.MethodGet, "/files/"+fileID+"/metadata", nil)
+		req.SetPathValue("file_id", fileID)
+		w = httptest.NewRecorder()
+		files.Metadata(w, req)
+		require.Equal(t, wantStatus, w.Code, fileID)
+	}
+}
+
+func TestFileDownloadHandler_ServeText(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	var requestedKey string
+	handler := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Downloader{
+			getObjectFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				requestedKey = *params.Key
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("document text"))}, nil
+			},
+		}, "test-bucket", 0),
+		logger: &logger,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/test-file/text", nil)
+	req.SetPathValue("file_id", "test-file")
+	w := httptest.NewRecorder()
+	handler.ServeText(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "test-file/text", requestedKey)
+	require.Equal(t, "document text", w.Body.String())
+}
+
+func TestFileDownloadHandler_UnsafeContentType(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	handler := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Downloader{
+			getObjectFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				contentType := "text/html"
+				disposition := "inline; filename=\"page.html\""
+				return &s3.GetObjectOutput{
+					Body:               io.NopCloser(strings.NewReader("<script>alert(1)</script>")),
+					ContentType:        &contentType,
+					ContentDisposition: &disposition,
+				}, nil
+			},
+		}, "test-bucket", 0),
+		logger: &logger,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/test-file", nil)
+	req.SetPathValue("file_id", "test-file")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	require.Equal(t, "attachment; filename=\"page.html\"", w.Header().Get("Content-Disposition"))
+}
+
+// s3ResponseError returns the error of the SDK for an S3 response status
+func s3ResponseError(statusCode int, header http.Header) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: statusCode, Header: header}},
+			Err:      errors.New("s3 response error"),
+		},
+	}
+}
+
+func TestFileDownloadHandler_Caching(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	lastModified := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	content := "0123456789"
+
+	var input *s3.GetObjectInput
+	handler := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Downloader{
+			getObjectFn: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				input = params
+
+				if aws.ToString(params.IfNoneMatch) == `"abc"` ||
+					(params.IfModifiedSince != nil && !lastModified.After(*params.IfModifiedSince)) {
+					return nil, s3ResponseError(http.StatusNotModified, http.Header{
+						"Etag":          {`"abc"`},
+						"Last-Modified": {lastModified.Format(http.TimeFormat)},
+					})
+				}
+
+				output := &s3.GetObjectOutput{
+					Body:          io.NopCloser(strings.NewReader(content)),
+					ContentType:   aws.String("text/plain"),
+					ContentLength: aws.Int64(int64(len(content))),
+					ETag:          aws.String(`"abc"`),
+					LastModified:  aws.Time(lastModified),
+				}
+
+				switch aws.ToString(params.Range) {
+				case "":
+				case "bytes=2-4":
+					output.Body = io.NopCloser(strings.NewReader(content[2:5]))
+					output.ContentLength = aws.Int64(3)
+					output.ContentRange = aws.String("bytes 2-4/10")
+				default:
+					return nil, s3ResponseError(http.StatusRequestedRangeNotSatisfiable, nil)
+				}
+
+				return output, nil
+			},
+		}, "test-bucket", 0),
+		logger:       &logger,
+		cacheControl: "public, max-age=31536000, immutable",
+	}
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/test-file", nil)
+		req.SetPathValue("file_id", "test-file")
+		req.Header = header
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("full download", func(t *testing.T) {
+		w := get(http.Header{})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, content, w.Body.String())
+		require.Equal(t, `"abc"`, w.Header().Get("ETag"))
+		require.Equal(t, "Sat, 01 Mar 2025 12:00:00 GMT", w.Header().Get("Last-Modified"))
+		require.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+		require.Equal(t, "10", w.Header().Get("Content-Length"))
+		require.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	})
+
+	t.Run("if-none-match", func(t *testing.T) {
+		w := get(http.Header{"If-None-Match": {`"abc"`}})
+		require.Equal(t, http.StatusNotModified, w.Code)
+		require.Empty(t, w.Body.String())
+		require.Equal(t, `"abc"`, w.Header().Get("ETag"))
+		require.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+
+		w = get(http.Header{"If-None-Match": {`"other"`}})
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("if-modified-since", func(t *testing.T) {
+		w := get(http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}})
+		require.Equal(t, http.StatusNotModified, w.Code)
+
+		w = get(http.Header{"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// Ignored with If-None-Match
+		w = get(http.Header{
+			"If-None-Match":     {`"other"`},
+			"If-Modified-Since": {lastModified.Format(http.TimeFormat)},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Nil(t, input.IfModifiedSince)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		w := get(http.Header{"Range": {"bytes=2-4"}})
+		require.Equal(t, http.StatusPartialContent, w.Code)
+		require.Equal(t, "234", w.Body.String())
+		require.Equal(t, "bytes 2-4/10", w.Header().Get("Content-Range"))
+		require.Equal(t, "3", w.Header().Get("Content-Length"))
+
+		w = get(http.Header{"Range": {"bytes=20-30"}})
+		require.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+
+		// Multiple ranges and If-Range get the full file
+		w = get(http.Header{"Range": {"bytes=0-1,4-5"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Nil(t, input.Range)
+
+		w = get(http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"abc"`}})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, content, w.Body.String())
+	})
+}
+
+type mockPresigner struct {
+	get storage.Object
+	put storage.PutInput
+	ttl time.Duration
+}
+
+func (m *mockPresigner) PresignGet(ctx context.Context, object storage.Object, ttl time.Duration) (string, error) {
+	m.get = object
+	m.ttl = ttl
+
+	return "https://bucket.s3.amazonaws.com/" + object.Key + "?X-Amz-Signature=abc", nil
+}
+
+func (m *mockPresigner) PresignPut(ctx context.Context, input storage.PutInput, ttl time.Duration) (storage.PresignedRequest, error) {
+	m.put = input
+	m.ttl = ttl
+
+	header := http.Header{
+		"Host":           {"bucket.s3.amazonaws.com"},
+		"Content-Length": {strconv.FormatInt(input.Size, 10)},
+		"Content-Type":   {input.ContentType},
+	}
+	for key, value := range input.Metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+
+	return storage.PresignedRequest{
+		URL:    "https://bucket.s3.amazonaws.com/" + input.Key + "?X-Amz-Signature=abc",
+		Method: http.MethodPut,
+		Header: header,
+	}, nil
+}
+
+func TestFileDownloadHandler_PresignedRedirect(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	store := storage.NewMemory(time.Hour)
+
+	for _, object := range []storage.PutInput{
+		{Key: "test-file/thumb", ContentType: "image/jpeg", ExpireAt: time.Now().Add(time.Hour)},
+		{Key: "expired-file/thumb", ContentType: "image/jpeg", ExpireAt: time.Now().Add(-time.Minute)},
+		{
+			Key:                "page-file/thumb",
+			ContentType:        "text/html",
+			ContentDisposition: `inline; filename="page.html"`,
+			ExpireAt:           time.Now().Add(time.Hour),
+		},
+	} {
+		object.Body = strings.NewReader("thumbnail")
+		object.Size = 9
+
+		_, err := store.Put(context.Background(), object)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name            string
+		fileID          string
+		wantStatus      int
+		wantLocation    string
+		wantDisposition string
+	}{
+		{
+			name:         "redirect",
+			fileID:       "test-file",
+			wantStatus:   http.StatusFound,
+			wantLocation: "https://bucket.s3.amazonaws.com/test-file/thumb?X-Amz-Signature=abc",
+		},
+		{
+			name:            "unsafe content type",
+			fileID:          "page-file",
+			wantStatus:      http.StatusFound,
+			wantLocation:    "https://bucket.s3.amazonaws.com/page-file/thumb?X-Amz-Signature=abc",
+			wantDisposition: `attachment; filename="page.html"`,
+		},
+		{name: "expired", fileID: "expired-file", wantStatus: http.StatusGone},
+		{name: "missing", fileID: "missing-file", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			presigner := &mockPresigner{}
+			handler := &FileDownloadHandler{
+				storage:    store,
+				logger:     &logger,
+				presigner:  presigner,
+				presignTTL: 5 * time.Minute,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/files/"+tt.fileID+"?variant=thumb", nil)
+			req.SetPathValue("file_id", tt.fileID)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantLocation == "" {
+				require.Empty(t, presigner.get.Key, "not presigned")
+				return
+			}
+
+			require.Equal(t, tt.wantLocation, w.Header().Get("Location"))
+			require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			require.Equal(t, tt.fileID+"/thumb", presigner.get.Key)
+			require.Equal(t, tt.wantDisposition, presigner.get.ContentDisposition)
+			require.Equal(t, 5*time.Minute, presigner.ttl)
+		})
+	}
+}
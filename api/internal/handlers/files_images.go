@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/images"
+)
+
+const (
+	// variantThumb is the variant query value for thumbnails
+	variantThumb = "thumb"
+)
+
+// WithImageProcessing re-encodes image uploads with the processor, removing
+// metadata and downscaling them, and stores a thumbnail variant.
+func WithImageProcessing(processor *images.Processor) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.images = processor
+	}
+}
+
+// thumbnailKey returns the S3 key of the thumbnail variant of a file
+func thumbnailKey(fileID string) string {
+	return fileID + "/" + variantThumb
+}
+
+// variantKey returns the S3 key of the variant of a file, false if the variant
+// is unknown. An empty variant is the original file.
+func variantKey(fileID string, variant string) (string, bool) {
+	switch variant {
+	case "":
+		return fileID, true
+	case variantThumb:
+		return thumbnailKey(fileID), true
+	default:
+		return "", false
+	}
+}
+
+// storeImage processes and stores an uploaded image. Returns true if the
+// image was stored.
+func (h *FileUploadHandler) storeImage(
+	w http.ResponseWriter,
+	r *http.Request,
+	file multipart.File,
+	fileHeader *multipart.FileHeader,
+	fileKey string,
+	expireAt time.Time,
+) bool {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		h.logger.Debug().Err(err).Msg("Error reading file")
+
+		apierror.Write(w, r, apierror.InvalidRequest("", "Error retrieving file").WithParam("file"))
+		return false
+	}
+
+	result, err := h.images.Process(data)
+	if err != nil {
+		h.logger.Debug().Err(err).Msg("Error processing image")
+
+		switch {
+		case errors.Is(err, images.ErrTooManyPixels):
+			apierror.Write(w, r, apierror.InvalidRequest("image_too_large", "Image dimensions too large").WithParam("file"))
+		case errors.Is(err, images.ErrUnsupportedFormat):
+			apierror.Write(w, r, apierror.InvalidRequest(
+				"unsupported_image_format",
+				"Unsupported image format, use JPEG, PNG, GIF or WebP",
+			).WithParam("file"))
+		default:
+			h.logger.Error().Err(err).Msg("Failed to process image")
+			apierror.Write(w, r, apierror.Internal("Error processing image"))
+		}
+
+		return false
+	}
+
+	// Extension of the canonical format
+	filename := strings.TrimSuffix(fileHeader.Filename, filepath.Ext(fileHeader.Filename)) + ".jpg"
+
+	// The thumbnail is stored first so the file lists it as a variant only
+	// once it exists
+	ctx := r.Context()
+	if _, err := h.storeFile(
+		ctx,
+		thumbnailKey(fileKey),
+		bytes.NewReader(result.Thumbnail),
+		int64(len(result.Thumbnail)),
+		contentHash(result.Thumbnail),
+		images.ContentType,
+		filename,
+		nil,
+		expireAt,
+	); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to upload thumbnail to S3")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
+	}
+
+	response, err := h.storeFile(
+		ctx,
+		fileKey,
+		bytes.NewReader(result.Image),
+		int64(len(result.Image)),
+		contentHash(result.Image),
+		images.ContentType,
+		filename,
+		[]string{variantThumb},
+		expireAt,
+	)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to upload file to S3")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
+	}
+
+	if err := h.indexFile(ctx, fileKey, expireAt); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to index file owner")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
+	}
+
+	h.logger.Debug().
+		Str("key", fileKey).
+		Int("width", result.Width).
+		Int("height", result.Height).
+		Int("original_bytes", len(data)).
+		Int("bytes", len(result.Image)).
+		Msg("Image processed")
+
+	writeFileUploadResponse(w, response)
+	return true
+}
@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFileListLimit = 20
+	maxFileListLimit     = 100
+
+	// Object metadata keys, S3 returns metadata keys in lower case
+	metadataOwner    = "owner"
+	metadataFilename = "filename"
+	metadataVariants = "variants"
+
+	// ownerIndexPrefix is the key prefix of the per owner file index
+	ownerIndexPrefix = "owners/"
+)
+
+// FileListResponse is the response for listing files
+type FileListResponse struct {
+	Object  string               `json:"object"`
+	Data    []FileUploadResponse `json:"data"`
+	HasMore bool                 `json:"has_more"`
+}
+
+// FileDeletedResponse is the response for a deleted file
+type FileDeletedResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+var (
+	// errFileNotFound is returned for missing files and files of other owners
+	errFileNotFound = errors.New("file not found")
+	// errFileExpired is returned for expired files that are not deleted yet
+	errFileExpired = errors.New("file expired")
+)
+
+// FilesHandler serves file metadata, and lists and deletes the files of the
+// owner in the request context.
+type FilesHandler struct {
+	storage   storage.Storage
+	publicURL string
+	logger    *zerolog.Logger
+
+	// access is optional, file URLs are not signed if nil
+	access *FileAccess
+}
+
+// FilesOption configures optional behavior of the files handler
+type FilesOption func(*FilesHandler)
+
+// WithFileMetadataAccess signs the file URLs of responses, and checks the
+// metadata request like downloads
+func WithFileMetadataAccess(access *FileAccess) FilesOption {
+	return func(h *FilesHandler) {
+		h.access = access
+	}
+}
+
+// NewFilesHandler creates a new FilesHandler for the files in the storage.
+func NewFilesHandler(
+	store storage.Storage,
+	publicURL string,
+	baseLogger *zerolog.Logger,
+	opts ...FilesOption,
+) *FilesHandler {
+	logger := baseLogger.With().
+		Str("handler", "FilesHandler").
+		Logger()
+
+	h := &FilesHandler{
+		storage:   store,
+		publicURL: publicURL,
+		logger:    &logger,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// Metadata handles GET /v1/files/{file_id}/metadata. Like downloads, the
+// metadata is available to anyone with the file URL, or only the owner in
+// owner only mode.
+func (h *FilesHandler) Metadata(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("file_id")
+	if !validFileID(fileID) {
+		apierror.Write(w, r, apierror.NotFound("file not found"))
+		return
+	}
+
+	if err := h.access.authorize(r.Context(), h.storage, fileID, r.URL.Query()); err != nil {
+		if accessErr := fileAccessError(err); accessErr != nil {
+			apierror.Write(w, r, accessErr)
+			return
+		}
+
+		h.writeFileError(w, r, err)
+		return
+	}
+
+	file, _, err := h.headFile(r.Context(), fileID)
+	if err != nil {
+		h.writeFileError(w, r, err)
+		return
+	}
+
+	writeFileJSON(w, http.StatusOK, file)
+}
+
+// List handles GET /v1/files, oldest first. The limit query parameter sets
+// the page size and after is the ID of the last file of the previous page.
+func (h *FilesHandler) List(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultFileListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxFileListLimit {
+			apierror.Write(w, r, apierror.InvalidRequest(
+				"",
+				"limit must be between 1 and "+strconv.Itoa(maxFileListLimit),
+			).WithParam("limit"))
+			return
+		}
+	}
+
+	prefix := ownerIndexKey(owner, "")
+	input := storage.ListInput{
+		Prefix: prefix,
+		// One more than the limit to know if there are more
+		Limit: limit + 1,
+	}
+	if after := r.URL.Query().Get("after"); after != "" {
+		input.StartAfter = prefix + after
+	}
+
+	ctx := r.Context()
+	keys, err := h.storage.List(ctx, input)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("error listing files")
+		apierror.Write(w, r, apierror.Internal("error listing files"))
+		return
+	}
+
+	response := FileListResponse{
+		Object:  "list",
+		Data:    []FileUploadResponse{},
+		HasMore: len(keys) > limit,
+	}
+
+	for _, key := range keys[:min(len(keys), limit)] {
+		fileID := strings.TrimPrefix(key, prefix)
+
+		file, _, err := h.headFile(ctx, fileID)
+		if err != nil {
+			// Expired files may still be in the index
+			if errors.Is(err, errFileNotFound) || errors.Is(err, errFileExpired) {
+				continue
+			}
+
+			h.logger.Error().Err(err).Str("file_id", fileID).Msg("error reading file metadata")
+			apierror.Write(w, r, apierror.Internal("error listing files"))
+			return
+		}
+
+		response.Data = append(response.Data, file)
+	}
+
+	writeFileJSON(w, http.StatusOK, response)
+}
+
+// Delete handles DELETE /v1/files/{file_id}, deleting the file and its
+// variants. Files of other owners are not found.
+func (h *FilesHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	fileID := r.PathValue("file_id")
+	if !validFileID(fileID) {
+		apierror.Write(w, r, apierror.NotFound("file not found"))
+		return
+	}
+
+	ctx := r.Context()
+	_, fileOwner, err := h.headFile(ctx, fileID)
+	if err != nil {
+		h.writeFileError(w, r, err)
+		return
+	}
+
+	if fileOwner != owner {
+		apierror.Write(w, r, apierror.NotFound("file not found"))
+		return
+	}
+
+	// Variants are deleted even if not listed in the metadata, deleting
+	// missing keys succeeds
+	if err := h.storage.Delete(
+		ctx,
+		fileID,
+		thumbnailKey(fileID),
+		textKey(fileID),
+		ownerIndexKey(owner, fileID),
+	); err != nil {
+		h.logger.Error().Err(err).Str("file_id", fileID).Msg("error deleting file")
+		apierror.Write(w, r, apierror.Internal("error deleting file"))
+		return
+	}
+
+	h.logger.Debug().Str("file_id", fileID).Msg("File deleted")
+
+	writeFileJSON(w, http.StatusOK, FileDeletedResponse{
+		ID:      fileID,
+		Object:  "file.deleted",
+		Deleted: true,
+	})
+}
+
+// headFile returns the file response and owner from the object metadata.
+// Missing files return errFileNotFound and expired files errFileExpired.
+func (h *FilesHandler) headFile(ctx context.Context, fileID string) (FileUploadResponse, string, error) {
+	object, err := h.storage.Head(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, storage.ErrExpired) {
+			return FileUploadResponse{}, "", errFileExpired
+		}
+
+		if errors.Is(err, storage.ErrNotFound) {
+			return FileUploadResponse{}, "", errFileNotFound
+		}
+
+		return FileUploadResponse{}, "", err
+	}
+
+	owner, filename, variants := parseFileMetadata(object.Metadata)
+
+	// The ULID has the upload time, the object may be written later
+	createdAt := object.LastModified
+	if id, err := ulid.ParseStrict(fileID); err == nil {
+		createdAt = ulid.Time(id.Time())
+	}
+
+	file := newFileResponse(
+		h.publicURL,
+		fileID,
+		object.Size,
+		createdAt.UTC(),
+		object.ExpireAt,
+		filename,
+		variants,
+		h.access.sign(fileID),
+	)
+
+	return file, owner, nil
+}
+
+func (h *FilesHandler) writeFileError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errFileNotFound) {
+		apierror.Write(w, r, apierror.NotFound("file not found"))
+		return
+	}
+
+	if errors.Is(err, errFileExpired) {
+		apierror.Write(w, r, apierror.Gone("file_expired", "file has expired"))
+		return
+	}
+
+	h.logger.Error().Err(err).Msg("error reading file metadata")
+	apierror.Write(w, r, apierror.Internal("error reading file"))
+}
+
+// newFileResponse returns the file response with the URLs of the file and its
+// variants. The signature query parameters are added to all URLs.
+func newFileResponse(
+	publicURL string,
+	fileID string,
+	size int64,
+	createdAt time.Time,
+	expireAt time.Time,
+	filename string,
+	variants []string,
+	signature url.Values,
+) FileUploadResponse {
+	fileURL := fmt.Sprintf("%s/v1/files/%s", publicURL, fileID)
+	response := FileUploadResponse{
+		ID:        fileID,
+		Filename:  filename,
+		URL:       signedURL(fileURL, signature),
+		Bytes:     size,
+		CreatedAt: createdAt,
+		ExpireAt:  expireAt,
+	}
+
+	if slices.Contains(variants, variantThumb) {
+		query := url.Values{"variant": {variantThumb}}
+		for key, values := range signature {
+			query[key] = values
+		}
+
+		response.ThumbnailURL = fileURL + "?" + query.Encode()
+	}
+
+	if slices.Contains(variants, variantText) {
+		response.TextURL = signedURL(fileURL+"/"+variantText, signature)
+	}
+
+	return response
+}
+
+// newFileMetadata returns the S3 object metadata of a file. Values are escaped
+// as S3 metadata only supports ASCII.
+func newFileMetadata(owner string, filename string, variants []string) map[string]string {
+	metadata := map[string]string{
+		metadataFilename: url.QueryEscape(filename),
+	}
+
+	if owner != "" {
+		metadata[metadataOwner] = url.QueryEscape(owner)
+	}
+
+	if len(variants) > 0 {
+		metadata[metadataVariants] = strings.Join(variants, ",")
+	}
+
+	return metadata
+}
+
+// parseFileMetadata returns the owner, filename and variants from the S3
+// object metadata. Files uploaded before metadata was recorded have none.
+func parseFileMetadata(metadata map[string]string) (owner string, filename string, variants []string) {
+	owner, _ = url.QueryUnescape(metadata[metadataOwner])
+	filename, _ = url.QueryUnescape(metadata[metadataFilename])
+
+	if value := metadata[metadataVariants]; value != "" {
+		variants = strings.Split(value, ",")
+	}
+
+	return owner, filename, variants
+}
+
+// ownerIndexKey returns the S3 key of the index entry of the file of the
+// owner
+func ownerIndexKey(owner string, fileID string) string {
+	return ownerIndexPrefix + ownerHash(owner) + "/" + fileID
+}
+
+// IsFileKey returns true if the key is stored by the file handlers: a file
+// or its variants, named by the ULID file ID, an owner index entry, a staged
+// direct or multipart upload, or a deduplicated blob. Used so the sweeper
+// does not delete objects of other applications in a shared bucket.
+func IsFileKey(key string) bool {
+	for _, prefix := range []string{ownerIndexPrefix, stagingPrefix, multipartPrefix} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	if storage.IsDedupKey(key) {
+		return true
+	}
+
+	fileID, _, _ := strings.Cut(key, "/")
+	_, err := ulid.ParseStrict(fileID)
+	return err == nil
+}
+
+// ownerHash returns the owner for use in S3 keys, hashed as it may contain
+// session IDs
+func ownerHash(owner string) string {
+	hash := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(hash[:])
+}
+
+// validFileID returns true if the file ID is not empty and is not the key of
+// a variant or index entry
+func validFileID(fileID string) bool {
+	return fileID != "" && !strings.Contains(fileID, "/")
+}
+
+func writeFileJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// storedData returns the body of the stored object
+func storedData(t *testing.T, store storage.Storage, key string) string {
+	t.Helper()
+
+	reader, err := store.Get(context.Background(), storage.GetInput{Key: key})
+	require.NoError(t, err)
+	defer reader.Body.Close()
+
+	data, err := io.ReadAll(reader.Body)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+// isStored returns true if the object is stored and not expired
+func isStored(store storage.Storage, key string) bool {
+	_, err := store.Head(context.Background(), key)
+	return err == nil
+}
+
+func TestFilesHandler(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	bucket := storage.NewMemory(0)
+
+	uploads := &FileUploadHandler{
+		storage:      bucket,
+		publicURL:    "http://example.com",
+		logger:       &logger,
+		textMaxBytes: 1024,
+	}
+	files := &FilesHandler{
+		storage:   bucket,
+		publicURL: "http://example.com",
+		logger:    &logger,
+	}
+
+	withOwner := func(req *http.Request, owner string) *http.Request {
+		return req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+	}
+
+	upload := func(owner string, filename string) FileUploadResponse {
+		w := httptest.NewRecorder()
+		req := createMultipartRequest(t, "file", filename, []byte("some notes"), "text/plain")
+		uploads.ServeHTTP(w, withOwner(req, owner))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response
+	}
+
+	list := func(owner string, query string) FileListResponse {
+		w := httptest.NewRecorder()
+		files.List(w, withOwner(httptest.NewRequest(http.MethodGet, "/files"+query, nil), owner))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response FileListResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response
+	}
+
+	first := upload("session:alice", "notes ü.txt")
+	second := upload("session:alice", "todo.md")
+	other := upload("user:bob", "bob.txt")
+
+	t.Run("upload records owner and filename", func(t *testing.T) {
+		require.Equal(t, "notes ü.txt", first.Filename)
+
+		object, err := bucket.Head(context.Background(), first.ID)
+		require.NoError(t, err)
+
+		metadata := object.Metadata
+		require.Equal(t, "session%3Aalice", metadata["owner"])
+		require.Equal(t, "notes+%C3%BC.txt", metadata["filename"])
+		require.Equal(t, "text", metadata["variants"])
+		require.True(t, isStored(bucket, ownerIndexKey("session:alice", first.ID)))
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+first.ID+"/metadata", nil)
+		req.SetPathValue("file_id", first.ID)
+		w := httptest.NewRecorder()
+		files.Metadata(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		require.Equal(t, first.ID, response.ID)
+		require.Equal(t, first.URL, response.URL)
+		require.Equal(t, first.TextURL, response.TextURL)
+		require.Equal(t, "notes ü.txt", response.Filename)
+		require.Equal(t, int64(len("some notes")), response.Bytes)
+		require.WithinDuration(t, first.CreatedAt, response.CreatedAt, time.Second)
+
+		req = httptest.NewRequest(http.MethodGet, "/files/missing/metadata", nil)
+		req.SetPathValue("file_id", "missing")
+		w = httptest.NewRecorder()
+		files.Metadata(w, req)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("list by owner", func(t *testing.T) {
+		response := list("session:alice", "")
+		require.Equal(t, "list", response.Object)
+		require.False(t, response.HasMore)
+		require.Len(t, response.Data, 2)
+		require.Equal(t, first.ID, response.Data[0].ID)
+		require.Equal(t, second.ID, response.Data[1].ID)
+
+		response = list("session:alice", "?limit=1")
+		require.True(t, response.HasMore)
+		require.Len(t, response.Data, 1)
+		require.Equal(t, first.ID, response.Data[0].ID)
+
+		response = list("session:alice", "?limit=1&after="+first.ID)
+		require.False(t, response.HasMore)
+		require.Len(t, response.Data, 1)
+		require.Equal(t, second.ID, response.Data[0].ID)
+
+		response = list("user:bob", "")
+		require.Len(t, response.Data, 1)
+		require.Equal(t, other.ID, response.Data[0].ID)
+
+		w := httptest.NewRecorder()
+		files.List(w, withOwner(httptest.NewRequest(http.MethodGet, "/files?limit=0", nil), "user:bob"))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		deleteFile := func(owner string, fileID string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodDelete, "/files/"+fileID, nil)
+			req.SetPathValue("file_id", fileID)
+			w := httptest.NewRecorder()
+			files.Delete(w, withOwner(req, owner))
+			return w
+		}
+
+		w := deleteFile("user:bob", first.ID)
+		require.Equal(t, http.StatusNotFound, w.Code, "files of other owners are not found")
+		require.True(t, isStored(bucket, first.ID))
+
+		w = deleteFile("session:alice", first.ID)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, `{"id": "`+first.ID+`", "object": "file.deleted", "deleted": true}`, w.Body.String())
+		require.False(t, isStored(bucket, first.ID))
+		require.False(t, isStored(bucket, textKey(first.ID)))
+		require.False(t, isStored(bucket, ownerIndexKey("session:alice", first.ID)))
+
+		w = deleteFile("session:alice", first.ID)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		response := list("session:alice", "")
+		require.Len(t, response.Data, 1)
+		require.Equal(t, second.ID, response.Data[0].ID)
+	})
+}
+
+func TestIsFileKey(t *testing.T) {
+	fileID := "01JQ8ZP4X3K5N2M7Q9R6T8V0W1"
+
+	for _, key := range []string{
+		fileID,
+		thumbnailKey(fileID),
+		textKey(fileID),
+		ownerIndexKey("session:alice", fileID),
+		stagingPrefix + "abc/" + fileID,
+		multipartPrefix + "abc/" + fileID,
+		"blobs/abc/refs",
+	} {
+		require.True(t, IsFileKey(key), key)
+	}
+
+	for _, key := range []string{"backups/db.sql", "index.html", "not-a-ulid/thumb", "leases/other"} {
+		require.False(t, IsFileKey(key), key)
+	}
+}
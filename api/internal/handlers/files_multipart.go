@@ -0,0 +1,686 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// multipartPrefix is the key prefix of multipart uploads before completion
+	multipartPrefix = "multipart/"
+	// minPartBytes is the min size of all parts except the last
+	minPartBytes = storage.MinPartSize
+	// maxPartNumber is the S3 max number of parts of an upload
+	maxPartNumber = 10000
+	// metadataDeclaredBytes is the session metadata key of the size declared
+	// when the upload was created
+	metadataDeclaredBytes = "declared-bytes"
+)
+
+// MultipartUploadConfig is the configuration of chunked uploads
+type MultipartUploadConfig struct {
+	// MaxBytes is the max size of uploaded files
+	MaxBytes int64
+	// MaxPartBytes is the max size of each part
+	MaxPartBytes int64
+	// AbandonAfter is how long uploads can be incomplete before they are
+	// aborted by the cleanup
+	AbandonAfter time.Duration
+}
+
+// MultipartUploadResponse is the state of a chunked upload. Parts are
+// uploaded with PUT /v1/files/multipart/{id}/parts/{part_number} and the
+// upload is completed with POST /v1/files/multipart/{id}/complete.
+type MultipartUploadResponse struct {
+	ID       string `json:"id"`
+	Object   string `json:"object"`
+	UploadID string `json:"upload_id"`
+	// MinPartBytes is the min size of all parts except the last
+	MinPartBytes int64     `json:"min_part_bytes"`
+	MaxPartBytes int64     `json:"max_part_bytes"`
+	ExpireAt     time.Time `json:"expire_at"`
+	// Parts are the uploaded parts, uploads are resumed by uploading the
+	// missing parts
+	Parts []MultipartUploadPart `json:"parts"`
+}
+
+// MultipartUploadPart is an uploaded part of a chunked upload
+type MultipartUploadPart struct {
+	PartNumber int32 `json:"part_number"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// MultipartUploadAbortedResponse is the response for an aborted upload
+type MultipartUploadAbortedResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Aborted bool   `json:"aborted"`
+}
+
+// MultipartUploadHandler uploads large files in parts with the multipart
+// uploads of the storage. Parts are streamed to the storage and can be
+// uploaded again after network errors. Completed files up to the upload
+// handler limit are processed like regular uploads, larger files are
+// validated and scanned but not processed.
+type MultipartUploadHandler struct {
+	multipart storage.Multipart
+	publicURL string
+	config    MultipartUploadConfig
+	uploads   *FileUploadHandler
+	logger    *zerolog.Logger
+}
+
+// NewMultipartUploadHandler creates a new MultipartUploadHandler, parts are
+// uploaded to the storage of the upload handler and completed uploads are
+// stored with the upload handler. Returns an error if the storage does not
+// support multipart uploads.
+func NewMultipartUploadHandler(
+	publicURL string,
+	multipartConfig MultipartUploadConfig,
+	uploads *FileUploadHandler,
+	baseLogger *zerolog.Logger,
+) (*MultipartUploadHandler, error) {
+	logger := baseLogger.With().
+		Str("handler", "MultipartUploadHandler").
+		Logger()
+
+	multipart, ok := uploads.storage.(storage.Multipart)
+	if !ok {
+		return nil, errors.New("storage does not support multipart uploads")
+	}
+
+	return &MultipartUploadHandler{
+		multipart: multipart,
+		publicURL: publicURL,
+		config:    multipartConfig,
+		uploads:   uploads,
+		logger:    &logger,
+	}, nil
+}
+
+// Create handles POST /v1/files/multipart, starting a chunked upload of a
+// file with the size and content type of the request. The uploaded parts are
+// limited to the declared size.
+func (h *MultipartUploadHandler) Create(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var req DirectUploadRequest
+	if !decodeJSONRequest(w, r, &req, maxUploadRequestSize) {
+		return
+	}
+
+	if e := validateUploadRequest(req, h.config.MaxBytes, h.uploads); e != nil {
+		apierror.Write(w, r, e)
+		return
+	}
+
+	fileID := ulid.Make().String()
+	initiated := time.Now()
+	expireAt := initiated.Add(h.config.AbandonAfter)
+
+	// The session limits the parts to the declared size, it expires with the
+	// upload
+	if _, err := h.uploads.storage.Put(r.Context(), storage.PutInput{
+		Key:         multipartSessionKey(owner, fileID),
+		Body:        bytes.NewReader(nil),
+		ContentType: "application/octet-stream",
+		Metadata:    map[string]string{metadataDeclaredBytes: strconv.FormatInt(req.Bytes, 10)},
+		ExpireAt:    expireAt,
+	}); err != nil {
+		h.logger.Error().Err(err).Msg("error storing multipart upload session")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error creating upload"))
+		return
+	}
+
+	// The completed upload also expires with the upload, so the sweeper
+	// deletes it if it is not deleted on completion
+	uploadID, err := h.multipart.CreateMultipartUpload(r.Context(), storage.PutInput{
+		Key:         multipartKey(owner, fileID),
+		ContentType: req.ContentType,
+		Metadata:    newFileMetadata(owner, req.Filename, nil),
+		ExpireAt:    expireAt,
+	})
+	if err != nil {
+		h.logger.Error().Err(err).Msg("error creating multipart upload")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error creating upload"))
+		return
+	}
+
+	h.logger.Debug().
+		Str("file_id", fileID).
+		Str("content_type", req.ContentType).
+		Int64("bytes", req.Bytes).
+		Msg("Multipart upload created")
+
+	writeFileJSON(w, http.StatusCreated, h.newResponse(fileID, uploadID, initiated, nil))
+}
+
+// UploadPart handles PUT /v1/files/multipart/{file_id}/parts/{part_number}.
+// The part is spooled to disk and uploaded to the storage, parts uploaded
+// again replace the previous upload of the part.
+func (h *MultipartUploadHandler) UploadPart(w http.ResponseWriter, r *http.Request) {
+	owner, fileID, uploadID, ok := h.uploadParams(w, r)
+	if !ok {
+		return
+	}
+
+	partNumber, err := strconv.ParseInt(r.PathValue("part_number"), 10, 32)
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"",
+			fmt.Sprintf("part_number must be between 1 and %d", maxPartNumber),
+		).WithParam("part_number"))
+		return
+	}
+
+	if r.ContentLength < 0 {
+		apierror.Write(w, r, apierror.New(http.StatusLengthRequired, apierror.TypeInvalidRequest, "", "Content-Length is required"))
+		return
+	}
+
+	if r.ContentLength == 0 || r.ContentLength > h.config.MaxPartBytes {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"file_too_large",
+			fmt.Sprintf("parts must be between 1 and %d bytes", h.config.MaxPartBytes),
+		))
+		return
+	}
+
+	// Parts uploaded again replace the previous upload of the part. Concurrent
+	// parts can exceed the declared size, it is checked again on completion.
+	key := multipartKey(owner, fileID)
+	declared, err := h.declaredBytes(r.Context(), owner, fileID)
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	parts, err := h.multipart.ListParts(r.Context(), key, uploadID)
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	uploaded := r.ContentLength
+	for _, part := range parts {
+		if part.PartNumber != int32(partNumber) {
+			uploaded += part.Size
+		}
+	}
+
+	if uploaded > declared {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"file_too_large",
+			fmt.Sprintf("uploaded parts exceed the declared %d bytes", declared),
+		))
+		return
+	}
+
+	// The SDK requires seekable bodies without TLS, the part is spooled to
+	// disk instead of memory
+	part, err := spoolPart(http.MaxBytesReader(w, r.Body, h.config.MaxPartBytes), r.ContentLength)
+	if err != nil {
+		h.logger.Debug().Err(err).Str("file_id", fileID).Msg("Error reading part")
+		apierror.Write(w, r, apierror.InvalidRequest("", "error reading part, upload the part again"))
+		return
+	}
+	defer part.Close()
+
+	uploadedPart, err := h.multipart.UploadPart(r.Context(), storage.UploadPartInput{
+		Key:        key,
+		UploadID:   uploadID,
+		PartNumber: int32(partNumber),
+		Body:       part,
+		Size:       r.ContentLength,
+	})
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	writeFileJSON(w, http.StatusOK, struct {
+		MultipartUploadPart
+		ETag string `json:"etag"`
+	}{
+		MultipartUploadPart: MultipartUploadPart{
+			PartNumber: uploadedPart.PartNumber,
+			Bytes:      uploadedPart.Size,
+		},
+		ETag: uploadedPart.ETag,
+	})
+}
+
+// Status handles GET /v1/files/multipart/{file_id}, returning the uploaded
+// parts to resume an interrupted upload
+func (h *MultipartUploadHandler) Status(w http.ResponseWriter, r *http.Request) {
+	owner, fileID, uploadID, ok := h.uploadParams(w, r)
+	if !ok {
+		return
+	}
+
+	parts, err := h.multipart.ListParts(r.Context(), multipartKey(owner, fileID), uploadID)
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	uploaded := make([]MultipartUploadPart, 0, len(parts))
+	for _, part := range parts {
+		uploaded = append(uploaded, MultipartUploadPart{
+			PartNumber: part.PartNumber,
+			Bytes:      part.Size,
+		})
+	}
+
+	// The upload is created with the file ID
+	var initiated time.Time
+	if id, err := ulid.ParseStrict(fileID); err == nil {
+		initiated = ulid.Time(id.Time())
+	}
+
+	writeFileJSON(w, http.StatusOK, h.newResponse(fileID, uploadID, initiated, uploaded))
+}
+
+// Complete handles POST /v1/files/multipart/{file_id}/complete, assembling
+// the uploaded parts in order of their part numbers and storing the file.
+// Rejected files are deleted, the client must upload again.
+func (h *MultipartUploadHandler) Complete(w http.ResponseWriter, r *http.Request) {
+	owner, fileID, uploadID, ok := h.uploadParams(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	key := multipartKey(owner, fileID)
+
+	declared, err := h.declaredBytes(ctx, owner, fileID)
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	parts, err := h.multipart.ListParts(ctx, key, uploadID)
+	if err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	if len(parts) == 0 {
+		apierror.Write(w, r, apierror.InvalidRequest("", "no parts uploaded"))
+		return
+	}
+
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+
+	// Parts can be uploaded again, the upload stays open to fix the parts
+	if size > declared {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"file_too_large",
+			fmt.Sprintf("uploaded parts exceed the declared %d bytes", declared),
+		))
+		return
+	}
+
+	if _, err := h.multipart.CompleteMultipartUpload(ctx, key, uploadID, parts); err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	defer h.uploads.deleteStaged(key, multipartSessionKey(owner, fileID))
+
+	object, err := h.uploads.storage.Get(ctx, storage.GetInput{Key: key})
+	if err != nil {
+		h.logger.Error().Err(err).Str("file_id", fileID).Msg("error reading multipart upload")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error reading upload"))
+		return
+	}
+	defer object.Body.Close()
+
+	// Files small enough for a single request are processed like uploads
+	if size <= h.uploads.maxSize() {
+		h.uploads.storeObject(w, r, object, fileID)
+		return
+	}
+
+	h.storeLarge(w, r, object, key, fileID, size)
+}
+
+// Abort handles DELETE /v1/files/multipart/{file_id}, discarding the uploaded
+// parts
+func (h *MultipartUploadHandler) Abort(w http.ResponseWriter, r *http.Request) {
+	owner, fileID, uploadID, ok := h.uploadParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.multipart.AbortMultipartUpload(r.Context(), multipartKey(owner, fileID), uploadID); err != nil {
+		h.writeMultipartError(w, r, err, fileID)
+		return
+	}
+
+	h.uploads.deleteStaged(multipartSessionKey(owner, fileID))
+
+	h.logger.Debug().Str("file_id", fileID).Msg("Multipart upload aborted")
+
+	writeFileJSON(w, http.StatusOK, MultipartUploadAbortedResponse{
+		ID:      fileID,
+		Object:  "file.multipart_upload",
+		Aborted: true,
+	})
+}
+
+// RunCleanup aborts abandoned uploads every interval until the context is
+// canceled. Parts of incomplete uploads are stored until they are aborted.
+func (h *MultipartUploadHandler) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			aborted, err := h.cleanupAbandoned(ctx, time.Now())
+			if err != nil {
+				h.logger.Error().Err(err).Msg("error cleaning up abandoned multipart uploads")
+			}
+
+			if aborted > 0 {
+				h.logger.Info().Int("aborted", aborted).Msg("Aborted abandoned multipart uploads")
+			}
+		}
+	}
+}
+
+// cleanupAbandoned aborts uploads started before now minus AbandonAfter and
+// returns the number of aborted uploads
+func (h *MultipartUploadHandler) cleanupAbandoned(ctx context.Context, now time.Time) (int, error) {
+	cutoff := now.Add(-h.config.AbandonAfter)
+	uploads, err := h.multipart.ListMultipartUploads(ctx, multipartPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	aborted := 0
+	for _, upload := range uploads {
+		if !upload.Initiated.Before(cutoff) {
+			continue
+		}
+
+		if err := h.multipart.AbortMultipartUpload(ctx, upload.Key, upload.UploadID); err != nil {
+			if errors.Is(err, storage.ErrUploadNotFound) {
+				continue
+			}
+
+			return aborted, err
+		}
+
+		aborted++
+	}
+
+	return aborted, nil
+}
+
+// storeLarge validates and scans a completed upload larger than the upload
+// handler limit and copies it to the file key with the storage. Large files
+// are not held in memory, so images are not processed and text is not
+// extracted.
+func (h *MultipartUploadHandler) storeLarge(
+	w http.ResponseWriter,
+	r *http.Request,
+	object *storage.Reader,
+	key string,
+	fileID string,
+	size int64,
+) {
+	ctx := r.Context()
+	owner, filename, _ := parseFileMetadata(object.Metadata)
+
+	contentType, err := detectContentType(&objectReaderAt{
+		ctx:     ctx,
+		storage: h.uploads.storage,
+		key:     key,
+	}, size, filename)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Error detecting content type")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "Error reading upload"))
+		return
+	}
+
+	if !h.uploads.isAllowedContentType(contentType) {
+		apierror.Write(w, r, apierror.InvalidRequest("unsupported_file_type", "File type not allowed").WithParam("file"))
+		return
+	}
+
+	// Images are always processed to strip their metadata
+	if h.uploads.images != nil && strings.HasPrefix(contentType, "image/") {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"file_too_large",
+			fmt.Sprintf("images must be at most %d bytes", h.uploads.maxSize()),
+		).WithParam("file"))
+		return
+	}
+
+	// The file is read once to scan and hash it, storages that deduplicate
+	// content reference an existing copy instead of copying it
+	hash := sha256.New()
+	body := io.TeeReader(object.Body, hash)
+	if h.uploads.scanner != nil {
+		if ok := h.uploads.scanFile(w, r, body, fileID); !ok {
+			return
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		h.logger.Error().Err(err).Str("file_id", fileID).Msg("Error reading multipart upload")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "Error reading upload"))
+		return
+	}
+
+	expireAt := retentionExpireAt(h.uploads.retention.Uploads)
+	stored, err := h.uploads.storage.Copy(ctx, storage.CopyInput{
+		SourceKey:          key,
+		Key:                fileID,
+		ContentType:        contentType,
+		ContentDisposition: contentDisposition(filename, contentType),
+		Metadata:           newFileMetadata(owner, filename, nil),
+		ExpireAt:           expireAt,
+		ContentSHA256:      hex.EncodeToString(hash.Sum(nil)),
+	})
+	if err != nil {
+		h.logger.Error().Err(err).Str("file_id", fileID).Msg("Failed to copy multipart upload")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return
+	}
+
+	if err := h.uploads.indexFile(ctx, fileID, expireAt); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to index file owner")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return
+	}
+
+	writeFileUploadResponse(w, newFileResponse(
+		h.publicURL,
+		fileID,
+		size,
+		stored.LastModified,
+		stored.ExpireAt,
+		filename,
+		nil,
+		h.uploads.access.sign(fileID),
+	))
+}
+
+// uploadParams returns the owner, file ID and upload ID of a request to an
+// existing upload and writes an error response if they are missing
+func (h *MultipartUploadHandler) uploadParams(w http.ResponseWriter, r *http.Request) (string, string, string, bool) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return "", "", "", false
+	}
+
+	fileID := r.PathValue("file_id")
+	if !validFileID(fileID) {
+		apierror.Write(w, r, apierror.NotFound("upload not found"))
+		return "", "", "", false
+	}
+
+	uploadID := r.URL.Query().Get("upload_id")
+	if uploadID == "" {
+		apierror.Write(w, r, apierror.InvalidRequest("", "upload_id is required").WithParam("upload_id"))
+		return "", "", "", false
+	}
+
+	return owner, fileID, uploadID, true
+}
+
+func (h *MultipartUploadHandler) newResponse(
+	fileID string,
+	uploadID string,
+	initiated time.Time,
+	parts []MultipartUploadPart,
+) MultipartUploadResponse {
+	if parts == nil {
+		parts = []MultipartUploadPart{}
+	}
+
+	return MultipartUploadResponse{
+		ID:           fileID,
+		Object:       "file.multipart_upload",
+		UploadID:     uploadID,
+		MinPartBytes: minPartBytes,
+		MaxPartBytes: h.config.MaxPartBytes,
+		ExpireAt:     initiated.Add(h.config.AbandonAfter).UTC(),
+		Parts:        parts,
+	}
+}
+
+// writeMultipartError writes the error response of a failed multipart
+// request. Uploads of other owners are not found as the key includes the
+// owner.
+func (h *MultipartUploadHandler) writeMultipartError(w http.ResponseWriter, r *http.Request, err error, fileID string) {
+	if errors.Is(err, storage.ErrUploadNotFound) || errors.Is(err, storage.ErrNotFound) {
+		apierror.Write(w, r, apierror.NotFound("upload not found"))
+		return
+	}
+
+	if errors.Is(err, storage.ErrInvalidParts) {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"invalid_parts",
+			fmt.Sprintf("all parts except the last must be at least %d bytes", minPartBytes),
+		))
+		return
+	}
+
+	h.logger.Error().Err(err).Str("file_id", fileID).Msg("multipart upload error")
+	apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "error uploading file"))
+}
+
+// declaredBytes returns the size declared when the upload of the owner was
+// created. Returns storage.ErrNotFound for unknown and abandoned uploads.
+func (h *MultipartUploadHandler) declaredBytes(ctx context.Context, owner string, fileID string) (int64, error) {
+	session, err := h.uploads.storage.Head(ctx, multipartSessionKey(owner, fileID))
+	if err != nil {
+		return 0, err
+	}
+
+	declared, err := strconv.ParseInt(session.Metadata[metadataDeclaredBytes], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid multipart upload session of %s: %w", fileID, err)
+	}
+
+	return declared, nil
+}
+
+// multipartKey returns the storage key of a multipart upload of the owner before
+// it is completed
+func multipartKey(owner string, fileID string) string {
+	return multipartPrefix + ownerHash(owner) + "/" + fileID
+}
+
+// multipartSessionKey returns the storage key of the session of a multipart
+// upload of the owner, with the declared size
+func multipartSessionKey(owner string, fileID string) string {
+	return multipartKey(owner, fileID) + "/session"
+}
+
+// spoolPart copies the part to a temporary file that is removed on Close.
+// Returns an error if the body is not exactly size bytes.
+func spoolPart(body io.Reader, size int64) (*spooledPart, error) {
+	file, err := os.CreateTemp("", "kavachat-part-*")
+	if err != nil {
+		return nil, err
+	}
+
+	part := &spooledPart{file}
+	written, err := io.Copy(file, body)
+	if err == nil && written != size {
+		err = fmt.Errorf("read %d of %d bytes", written, size)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+
+	return part, nil
+}
+
+// spooledPart is a part spooled to a temporary file
+type spooledPart struct {
+	*os.File
+}
+
+func (p *spooledPart) Close() error {
+	err := p.File.Close()
+	os.Remove(p.Name())
+	return err
+}
+
+// objectReaderAt reads ranges of a stored object, used to detect the content
+// type of objects too large to read into memory
+type objectReaderAt struct {
+	ctx     context.Context
+	storage storage.Storage
+	key     string
+}
+
+func (o *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	object, err := o.storage.Get(o.ctx, storage.GetInput{
+		Key:   o.key,
+		Range: fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer object.Body.Close()
+
+	return io.ReadFull(object.Body, p)
+}
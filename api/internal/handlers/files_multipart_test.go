@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/scanner"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipartUploadHandler(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	ctx := context.Background()
+	bucket := storage.NewMemory(0)
+
+	uploads := &FileUploadHandler{
+		storage:      bucket,
+		publicURL:    "http://example.com",
+		logger:       &logger,
+		textMaxBytes: 1024,
+		maxFileSize:  16,
+	}
+	WithAllowedContentTypes([]string{"text/plain", "application/pdf"})(uploads)
+
+	handler, err := NewMultipartUploadHandler(
+		"http://example.com",
+		MultipartUploadConfig{
+			MaxBytes:     64,
+			MaxPartBytes: 10,
+			AbandonAfter: time.Hour,
+		},
+		uploads,
+		&logger,
+	)
+	require.NoError(t, err)
+
+	uploadIDs := func() []string {
+		incomplete, err := bucket.ListMultipartUploads(ctx, multipartPrefix)
+		require.NoError(t, err)
+
+		ids := []string{}
+		for _, upload := range incomplete {
+			ids = append(ids, upload.UploadID)
+		}
+		return ids
+	}
+
+	request := func(method string, owner string, target string, body io.Reader) *http.Request {
+		req := httptest.NewRequest(method, target, body)
+		return req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+	}
+
+	create := func(owner string, body string) MultipartUploadResponse {
+		w := httptest.NewRecorder()
+		handler.Create(w, request(http.MethodPost, owner, "/files/multipart", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response MultipartUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return response
+	}
+
+	uploadPart := func(owner string, upload MultipartUploadResponse, partNumber string, content string) *httptest.ResponseRecorder {
+		req := request(http.MethodPut, owner, "/files/multipart/"+upload.ID+"/parts/"+partNumber+"?upload_id="+upload.UploadID, strings.NewReader(content))
+		req.SetPathValue("file_id", upload.ID)
+		req.SetPathValue("part_number", partNumber)
+
+		w := httptest.NewRecorder()
+		handler.UploadPart(w, req)
+		return w
+	}
+
+	call := func(fn http.HandlerFunc, method string, owner string, upload MultipartUploadResponse) *httptest.ResponseRecorder {
+		req := request(method, owner, "/files/multipart/"+upload.ID+"?upload_id="+upload.UploadID, nil)
+		req.SetPathValue("file_id", upload.ID)
+
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w
+	}
+
+	t.Run("resume and complete", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 15}`)
+		require.Equal(t, "file.multipart_upload", upload.Object)
+		require.Equal(t, int64(10), upload.MaxPartBytes)
+		require.Empty(t, upload.Parts)
+		require.WithinDuration(t, time.Now().Add(time.Hour), upload.ExpireAt, time.Second)
+		require.Contains(t, uploadIDs(), upload.UploadID)
+
+		w := uploadPart("session:alice", upload, "2", "notes")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		// Status lists the parts to upload after a network error
+		w = call(handler.Status, http.MethodGet, "session:alice", upload)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var status MultipartUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+		require.Equal(t, []MultipartUploadPart{{PartNumber: 2, Bytes: 5}}, status.Parts)
+
+		w = uploadPart("session:alice", upload, "1", "some more ")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = call(handler.Complete, http.MethodPost, "user:bob", upload)
+		require.Equal(t, http.StatusNotFound, w.Code, "uploads of other owners are not found")
+
+		w = call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var file FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&file))
+		require.Equal(t, upload.ID, file.ID)
+		require.Equal(t, "notes.txt", file.Filename)
+		require.Equal(t, int64(15), file.Bytes)
+		require.NotEmpty(t, file.TextURL, "files up to the upload limit are processed")
+
+		require.Equal(t, "some more notes", storedData(t, bucket, upload.ID))
+		require.True(t, isStored(bucket, ownerIndexKey("session:alice", upload.ID)))
+		require.False(t, isStored(bucket, multipartKey("session:alice", upload.ID)), "staged upload is deleted")
+		require.False(t, isStored(bucket, multipartSessionKey("session:alice", upload.ID)))
+	})
+
+	t.Run("parts are limited to the declared size", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 15}`)
+
+		w := uploadPart("session:alice", upload, "1", "0123456789")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = uploadPart("session:alice", upload, "2", "0123456789")
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		require.Contains(t, w.Body.String(), "file_too_large")
+		parts, err := bucket.ListParts(ctx, multipartKey("session:alice", upload.ID), upload.UploadID)
+		require.NoError(t, err)
+		require.Len(t, parts, 1, "rejected parts are not uploaded")
+
+		// Parts uploaded again replace the previous upload of the part
+		w = uploadPart("session:alice", upload, "1", "01234")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = uploadPart("session:alice", upload, "2", "0123456789")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		w = uploadPart("user:bob", upload, "3", "0")
+		require.Equal(t, http.StatusNotFound, w.Code, "uploads of other owners are not found")
+
+		w = call(handler.Abort, http.MethodDelete, "session:alice", upload)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.False(t, isStored(bucket, multipartSessionKey("session:alice", upload.ID)))
+	})
+
+	t.Run("large files are copied without processing", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "big.txt", "content_type": "text/plain", "bytes": 25}`)
+		for i, part := range []string{"0123456789", "0123456789", "01234"} {
+			w := uploadPart("session:alice", upload, strconv.Itoa(i+1), part)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+
+		w := call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var file FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&file))
+		require.Equal(t, int64(25), file.Bytes)
+		require.Empty(t, file.TextURL)
+
+		object, err := bucket.Head(ctx, upload.ID)
+		require.NoError(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", object.ContentType)
+		require.Equal(t, `inline; filename="big.txt"`, object.ContentDisposition)
+		require.Equal(t, "session%3Aalice", object.Metadata["owner"])
+		require.Equal(t, "0123456789012345678901234", storedData(t, bucket, upload.ID))
+		require.True(t, isStored(bucket, ownerIndexKey("session:alice", upload.ID)))
+		require.False(t, isStored(bucket, multipartKey("session:alice", upload.ID)))
+	})
+
+	t.Run("large files are deduplicated", func(t *testing.T) {
+		dedup := storage.NewDedup(bucket, 0)
+		uploads.storage, handler.multipart = dedup, dedup
+		defer func() { uploads.storage, handler.multipart = bucket, bucket }()
+
+		var fileIDs []string
+		for range 2 {
+			upload := create("session:alice", `{"filename": "big.txt", "content_type": "text/plain", "bytes": 20}`)
+			uploadPart("session:alice", upload, "1", "abcdefghij")
+			uploadPart("session:alice", upload, "2", "klmnopqrst")
+
+			w := call(handler.Complete, http.MethodPost, "session:alice", upload)
+			require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+			fileIDs = append(fileIDs, upload.ID)
+		}
+
+		keys, err := bucket.List(ctx, storage.ListInput{})
+		require.NoError(t, err)
+
+		var blobs []string
+		for _, key := range keys {
+			if storage.IsDedupKey(key) && !strings.HasSuffix(key, "/refs") {
+				blobs = append(blobs, key)
+			}
+		}
+		require.Len(t, blobs, 1, "the second upload references the first copy")
+		require.Equal(t, "abcdefghijklmnopqrst", storedData(t, bucket, blobs[0]))
+
+		for _, fileID := range fileIDs {
+			reader, err := uploads.storage.Get(context.Background(), storage.GetInput{Key: fileID})
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(reader.Body)
+			require.NoError(t, err)
+			require.Equal(t, "abcdefghijklmnopqrst", string(data))
+		}
+	})
+
+	t.Run("large files are validated and scanned", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "page.txt", "content_type": "text/plain", "bytes": 20}`)
+		uploadPart("session:alice", upload, "1", "<html><bo")
+		uploadPart("session:alice", upload, "2", "dy></body>")
+
+		w := call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		require.False(t, isStored(bucket, upload.ID))
+		require.False(t, isStored(bucket, multipartKey("session:alice", upload.ID)))
+
+		scan := &mockScanner{verdict: scanner.Verdict{Signature: "Eicar-Signature"}}
+		uploads.scanner = scan
+		defer func() { uploads.scanner = nil }()
+
+		upload = create("session:alice", `{"filename": "eicar.txt", "content_type": "text/plain", "bytes": 20}`)
+		uploadPart("session:alice", upload, "1", "0123456789")
+		uploadPart("session:alice", upload, "2", "0123456789")
+
+		w = call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		require.Contains(t, w.Body.String(), "file_rejected")
+		require.Equal(t, []byte("01234567890123456789"), scan.scanned, "the whole file is scanned")
+		require.False(t, isStored(bucket, upload.ID))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10}`)
+		uploadPart("session:alice", upload, "1", "some notes")
+
+		w := call(handler.Abort, http.MethodDelete, "session:alice", upload)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NotContains(t, uploadIDs(), upload.UploadID)
+
+		w = call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, body := range []string{
+			`{"filename": "notes.txt", "content_type": "text/plain", "bytes": 65}`,
+			`{"filename": "page.html", "content_type": "text/html", "bytes": 10}`,
+		} {
+			w := httptest.NewRecorder()
+			handler.Create(w, request(http.MethodPost, "session:alice", "/files/multipart", strings.NewReader(body)))
+			require.Equal(t, http.StatusBadRequest, w.Code, body)
+		}
+
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10}`)
+
+		w := uploadPart("session:alice", upload, "0", "some notes")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = uploadPart("session:alice", upload, "1", "more than ten bytes")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = call(handler.Complete, http.MethodPost, "session:alice", upload)
+		require.Equal(t, http.StatusBadRequest, w.Code, "no parts uploaded")
+
+		upload.UploadID = ""
+		w = call(handler.Status, http.MethodGet, "session:alice", upload)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("cleanup aborts abandoned uploads", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10}`)
+
+		aborted, err := handler.cleanupAbandoned(ctx, time.Now())
+		require.NoError(t, err)
+		require.Zero(t, aborted)
+		require.Contains(t, uploadIDs(), upload.UploadID)
+
+		aborted, err = handler.cleanupAbandoned(ctx, time.Now().Add(2*time.Hour))
+		require.NoError(t, err)
+		require.Positive(t, aborted)
+		require.Empty(t, uploadIDs())
+	})
+
+	t.Run("completed uploads expire with the upload", func(t *testing.T) {
+		upload := create("session:alice", `{"filename": "notes.txt", "content_type": "text/plain", "bytes": 10}`)
+		uploadPart("session:alice", upload, "1", "some notes")
+
+		// Staged objects left behind by a failed completion are swept
+		key := multipartKey("session:alice", upload.ID)
+		parts, err := bucket.ListParts(ctx, key, upload.UploadID)
+		require.NoError(t, err)
+
+		object, err := bucket.CompleteMultipartUpload(ctx, key, upload.UploadID, parts)
+		require.NoError(t, err)
+		require.WithinDuration(t, upload.ExpireAt, object.ExpireAt, time.Second)
+	})
+
+	t.Run("storage without multipart uploads", func(t *testing.T) {
+		local, err := storage.NewLocal(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		_, err = NewMultipartUploadHandler("http://example.com", MultipartUploadConfig{}, &FileUploadHandler{storage: local}, &logger)
+		require.Error(t, err)
+	})
+}
+
+func TestSpoolPart(t *testing.T) {
+	part, err := spoolPart(bytes.NewReader([]byte("some notes")), 10)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	require.Equal(t, "some notes", string(data))
+
+	name := part.Name()
+	require.NoError(t, part.Close())
+	require.NoFileExists(t, name)
+
+	_, err = spoolPart(bytes.NewReader([]byte("short")), 10)
+	require.Error(t, err)
+}
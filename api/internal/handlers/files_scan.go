@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/scanner"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithScanner scans uploads for malware before they are stored. If failOpen
+// is true, files are stored when the scanner is unavailable, otherwise the
+// upload is rejected.
+func WithScanner(s scanner.Scanner, failOpen bool) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.scanner = s
+		h.scanFailOpen = failOpen
+	}
+}
+
+// scanFile scans the uploaded file and writes an error response if it is
+// infected, or if the scanner is unavailable and fails closed. Returns true if
+// the file should be stored.
+func (h *FileUploadHandler) scanFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	body io.Reader,
+	fileKey string,
+) bool {
+	ctx, span := trace.SpanFromContext(r.Context()).
+		TracerProvider().
+		Tracer("file_upload").
+		Start(r.Context(), "file.scan")
+	defer span.End()
+
+	start := time.Now()
+	verdict, err := h.scanner.Scan(ctx, body)
+	duration := time.Since(start)
+
+	span.SetAttributes(attribute.Int64("scan_ms", duration.Milliseconds()))
+	logger := h.logger.With().
+		Str("key", fileKey).
+		Dur("scan_duration", duration).
+		Logger()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(attribute.String("scan_verdict", "unavailable"))
+
+		if h.scanFailOpen {
+			logger.Warn().Err(err).Msg("malware scanner unavailable, storing file (fail open)")
+			return true
+		}
+
+		logger.Error().Err(err).Msg("malware scanner unavailable, rejecting file (fail closed)")
+		span.SetStatus(codes.Error, "scanner unavailable")
+
+		apierror.Write(w, r, apierror.Unavailable(
+			"scanner_unavailable",
+			"File scanning is temporarily unavailable, please try again later",
+		))
+		return false
+	}
+
+	if verdict.Clean {
+		logger.Debug().Str("scan_verdict", "clean").Msg("File scanned")
+		span.SetAttributes(attribute.String("scan_verdict", "clean"))
+
+		return true
+	}
+
+	logger.Warn().
+		Str("scan_verdict", "infected").
+		Str("signature", verdict.Signature).
+		Msg("Malware detected in upload")
+
+	span.SetAttributes(
+		attribute.String("scan_verdict", "infected"),
+		attribute.String("scan_signature", verdict.Signature),
+	)
+
+	apierror.Write(w, r, apierror.InvalidRequest("file_rejected", "File rejected by malware scan").WithParam("file"))
+	return false
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/extract"
+)
+
+const (
+	// variantText is the key suffix of the extracted text of a document
+	variantText = "text"
+
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// WithTextExtraction extracts the text of document uploads, at most maxBytes,
+// and stores it with the file
+func WithTextExtraction(maxBytes int) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.textMaxBytes = maxBytes
+	}
+}
+
+// textKey returns the S3 key of the extracted text of a file
+func textKey(fileID string) string {
+	return fileID + "/" + variantText
+}
+
+// storeText extracts and stores the text of a document upload before the file
+// itself, returning true if the text variant was stored. The upload does not
+// fail if the file has no text.
+func (h *FileUploadHandler) storeText(
+	r *http.Request,
+	file multipart.File,
+	fileHeader *multipart.FileHeader,
+	contentType string,
+	fileKey string,
+	expireAt time.Time,
+) bool {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, fileHeader.Size))
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", fileKey).Msg("Error reading file for text extraction")
+		return false
+	}
+
+	text, err := extract.Text(data, contentType, h.textMaxBytes)
+	if err != nil {
+		h.logger.Warn().
+			Err(err).
+			Str("key", fileKey).
+			Str("content_type", contentType).
+			Msg("Error extracting text")
+		return false
+	}
+
+	if text == "" {
+		return false
+	}
+
+	if _, err := h.storeFile(
+		r.Context(),
+		textKey(fileKey),
+		bytes.NewReader([]byte(text)),
+		int64(len(text)),
+		contentHash([]byte(text)),
+		contentTypeText,
+		fileHeader.Filename+".txt",
+		nil,
+		expireAt,
+	); err != nil {
+		h.logger.Error().Err(err).Str("key", fileKey).Msg("Failed to upload extracted text to S3")
+		return false
+	}
+
+	h.logger.Debug().
+		Str("key", fileKey).
+		Int("text_bytes", len(text)).
+		Msg("Text extracted")
+
+	return true
+}
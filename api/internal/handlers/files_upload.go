@@ -1,194 +1,476 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
-	"regexp"
+	"net/textproto"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/extract"
+	"github.com/kava-labs/kavachat/api/internal/images"
+	"github.com/kava-labs/kavachat/api/internal/scanner"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
 	"github.com/oklog/ulid/v2"
 	"github.com/rs/zerolog"
 )
 
 const (
-	maxFileSize = 10 * 1024 * 1024 // 10MB
+	// defaultMaxFileSize is the max size of uploads in a single request
+	defaultMaxFileSize = 10 * 1024 * 1024 // 10MB
+	// maxFormMemory is the max size of multipart forms kept in memory, larger
+	// files are buffered on disk
+	maxFormMemory = 10 * 1024 * 1024 // 10MB
 )
 
-// expireDateRegex is a regular expression to extract the expiry-date from the
-// x-amz-expiration response header from S3.
-var expireDateRegex = regexp.MustCompile(`expiry-date="([^"]+)"`)
-
 // FileUploadResponse is the response format for a successful file upload.
 type FileUploadResponse struct {
-	ID        string    `json:"id"`
+	ID string `json:"id"`
+	// Filename is the original filename of the upload
+	Filename  string    `json:"filename,omitempty"`
 	URL       string    `json:"url"`
 	Bytes     int64     `json:"bytes"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpireAt  time.Time `json:"expire_at"`
+	// ThumbnailURL is set for processed image uploads
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	// TextURL is set for documents with extracted text
+	TextURL string `json:"text_url,omitempty"`
 }
 
-// S3Uploader implements the PutObject method from the AWS SDK.
-type S3Uploader interface {
-	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+// FileUploadHandler is a HTTP handler for file uploads to the file storage.
+type FileUploadHandler struct {
+	storage   storage.Storage
+	publicURL string
+	logger    *zerolog.Logger
+
+	// images is optional, images are stored unchanged if nil
+	images *images.Processor
+	// allowedContentTypes is optional, all content types are allowed if nil
+	allowedContentTypes map[string]bool
+	// scanner is optional, files are not scanned if nil
+	scanner      scanner.Scanner
+	scanFailOpen bool
+	// textMaxBytes is the max size of extracted text, text is not extracted
+	// if 0
+	textMaxBytes int
+	// maxFileSize is the max size of uploads in a single request, the default
+	// if 0
+	maxFileSize int64
+	// retention is how long files are kept per upload type
+	retention FileRetention
+	// access is optional, file URLs are not signed if nil
+	access *FileAccess
 }
 
-// FileUploadHandler is a HTTP handler for file uploads to S3.
-type FileUploadHandler struct {
-	s3Client   S3Uploader
-	bucketName string
-	publicURL  string
-	logger     *zerolog.Logger
+// FileRetention is how long files are kept per upload type before they
+// expire. The TTL of the storage is used for types with no retention.
+type FileRetention struct {
+	// Uploads are files uploaded by clients, in a single request, directly or
+	// with multipart uploads
+	Uploads time.Duration
+	// GeneratedImages are images of image generation responses
+	GeneratedImages time.Duration
+}
+
+// FileUploadOption configures optional behavior of the file upload handler
+type FileUploadOption func(*FileUploadHandler)
+
+// WithMaxFileSize sets the max size of uploads in a single request, files are
+// processed in memory
+func WithMaxFileSize(maxBytes int64) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.maxFileSize = maxBytes
+	}
+}
+
+// WithRetention sets how long files are kept per upload type. Variants and
+// the owner index entry of a file expire with the file.
+func WithRetention(retention FileRetention) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.retention = retention
+	}
+}
+
+// WithSignedFileURLs signs the file URLs of upload responses so they expire
+func WithSignedFileURLs(access *FileAccess) FileUploadOption {
+	return func(h *FileUploadHandler) {
+		h.access = access
+	}
 }
 
-// NewFileUploadHandler creates a new FileUploadHandler with the given bucket name,
+// NewFileUploadHandler creates a new FileUploadHandler storing files in the
+// storage
 func NewFileUploadHandler(
-	bucketName string,
-	s3PathStyleRequests bool,
+	store storage.Storage,
 	publicURL string,
 	baseLogger *zerolog.Logger,
+	opts ...FileUploadOption,
 ) *FileUploadHandler {
 	logger := baseLogger.With().
 		Str("handler", "FileUploadHandler").
 		Logger()
 
-	// Load AWS config from environment
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		panic(fmt.Sprintf("unable to load AWS SDK config: %v", err))
+	h := &FileUploadHandler{
+		storage:   store,
+		publicURL: publicURL,
+		logger:    &logger,
 	}
 
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = s3PathStyleRequests
-	})
-
-	return &FileUploadHandler{
-		s3Client:   client,
-		bucketName: bucketName,
-		publicURL:  publicURL,
-		logger:     &logger,
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 // ServeHTTP implements the http.Handler interface for the FileUploadHandler.
 func (h *FileUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		apierror.Write(w, r, apierror.MethodNotAllowed())
 		return
 	}
 
 	// Limit request size
-	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxSize())
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(maxFileSize); err != nil {
-		h.logger.Debug().Err(err).Msg("Error parsing multipart form")
+	// The file is hashed while it is read from the form
+	file, fileHeader, contentSHA256, err := readFormFile(r)
+	if err != nil {
+		h.logger.Debug().Err(err).Msg("Error reading multipart form")
+
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			apierror.Write(w, r, apierror.RequestTooLarge("File too large").WithParam("file"))
+		case errors.Is(err, http.ErrMissingFile):
+			apierror.Write(w, r, apierror.InvalidRequest("", "Error retrieving file").WithParam("file"))
+		default:
+			apierror.Write(w, r, apierror.InvalidRequest("", "Error parsing multipart form"))
+		}
 
-		http.Error(w, "File too large", http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
+
+	// Generate unique filename using ULID, shorter than UUID
+	h.storeUpload(w, r, file, fileHeader, contentSHA256, ulid.Make().String())
+}
 
-	file, fileHeader, err := r.FormFile("file")
+// readFormFile reads the file field of the multipart form and returns it
+// buffered with bufferFile. Other fields are ignored.
+func readFormFile(r *http.Request) (multipart.File, *multipart.FileHeader, string, error) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		h.logger.Debug().Err(err).Msg("Error retrieving file from form")
+		return nil, nil, "", err
+	}
 
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
-		return
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, "", http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+
+		file, size, contentSHA256, err := bufferFile(part)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		return file, &multipart.FileHeader{
+			Filename: part.FileName(),
+			Header:   part.Header,
+			Size:     size,
+		}, contentSHA256, nil
 	}
-	defer file.Close()
+}
 
-	// Generate unique filename using ULID, shorter than UUID
-	fileKey := ulid.Make().String()
-	fileContentType := fileHeader.Header.Get("Content-Type")
-	fileContentDisposition := fmt.Sprintf("inline; filename=\"%s\"", fileHeader.Filename)
+// bufferFile reads the body and returns it with its size and hex SHA-256,
+// hashed in the same pass. Files up to maxFormMemory are kept in memory,
+// larger files are buffered in a temporary file that is removed when the
+// file is closed.
+func bufferFile(body io.Reader) (multipart.File, int64, string, error) {
+	hash := sha256.New()
+	body = io.TeeReader(body, hash)
 
-	h.logger.Debug().
-		Str("key", fileKey).
-		Str("content_type", fileContentType).
-		Str("content_disposition", fileContentDisposition).
-		Msg("File uploaded successfully")
-
-	// Upload to S3
-	ctx := r.Context()
-	putResponse, err := h.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(h.bucketName),
-		Key:         aws.String(fileKey),
-		Body:        file,
-		ContentType: aws.String(fileContentType),
-		// Inline for client side display
-		ContentDisposition: aws.String(fileContentDisposition),
-	})
+	var buf bytes.Buffer
+	size, err := io.CopyN(&buf, body, maxFormMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, 0, "", err
+	}
+
+	if size <= maxFormMemory {
+		return stagedFile{bytes.NewReader(buf.Bytes())}, size, hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
 	if err != nil {
-		h.logger.Error().Err(err).Msg("Failed to upload file to S3")
-		http.Error(w, "Error uploading file", http.StatusInternalServerError)
-		return
+		return nil, 0, "", err
 	}
 
-	expireAt, err := ExtractExpireAt(putResponse.Expiration)
+	file := tempFile{tmp}
+	size, err = io.Copy(tmp, io.MultiReader(&buf, body))
 	if err != nil {
-		expirationStr := ""
-		if putResponse.Expiration != nil {
-			expirationStr = *putResponse.Expiration
+		file.Close()
+		return nil, 0, "", err
+	}
+
+	return file, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// tempFile is an upload buffered in a temporary file, removed on close
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+
+	return err
+}
+
+// storeUpload validates, processes and stores the uploaded file with the key
+// and writes the response. Returns true if the file was stored.
+func (h *FileUploadHandler) storeUpload(
+	w http.ResponseWriter,
+	r *http.Request,
+	file multipart.File,
+	fileHeader *multipart.FileHeader,
+	contentSHA256 string,
+	fileKey string,
+) bool {
+	// The client content type is not trusted, it is detected from the content
+	contentType, err := detectContentType(file, fileHeader.Size, fileHeader.Filename)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Error detecting content type")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
+	}
+
+	if !h.isAllowedContentType(contentType) {
+		h.logger.Debug().
+			Str("content_type", contentType).
+			Str("client_content_type", fileHeader.Header.Get("Content-Type")).
+			Msg("File type not allowed")
+
+		apierror.Write(w, r, apierror.InvalidRequest("unsupported_file_type", "File type not allowed").WithParam("file"))
+		return false
+	}
+
+	// The original file is scanned, before any processing
+	if h.scanner != nil {
+		if ok := h.scanFile(w, r, io.NewSectionReader(file, 0, fileHeader.Size), fileKey); !ok {
+			return false
+		}
+	}
+
+	expireAt := retentionExpireAt(h.retention.Uploads)
+	if h.images != nil && strings.HasPrefix(contentType, "image/") {
+		return h.storeImage(w, r, file, fileHeader, fileKey, expireAt)
+	}
+
+	// Variants are stored before the file that lists them
+	var variants []string
+	if h.textMaxBytes > 0 && extract.Supported(contentType) {
+		if h.storeText(r, file, fileHeader, contentType, fileKey, expireAt) {
+			variants = append(variants, variantText)
 		}
+	}
 
-		h.logger.
-			Warn().
-			Err(err).
-			Str("key", fileKey).
-			Str("x-amz-expiration", expirationStr).
-			Msg("Failed to extract expiration date from S3 response")
+	response, err := h.storeFile(
+		r.Context(),
+		fileKey,
+		io.NewSectionReader(file, 0, fileHeader.Size),
+		fileHeader.Size,
+		contentSHA256,
+		contentType,
+		fileHeader.Filename,
+		variants,
+		expireAt,
+	)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to store file")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
+	}
 
-		// TODO: Actually delete instead of just setting expiration response
-		expireAt = time.Now().Add(24 * time.Hour)
+	if err := h.indexFile(r.Context(), fileKey, expireAt); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to index file owner")
+		apierror.Write(w, r, apierror.Internal("Error uploading file"))
+		return false
 	}
 
-	// Calculate file size from header
-	size := fileHeader.Size
+	writeFileUploadResponse(w, response)
+	return true
+}
 
-	now := time.Now()
-	response := FileUploadResponse{
-		ID:        fileKey,
-		URL:       fmt.Sprintf("%s/v1/files/%s", h.publicURL, fileKey),
-		Bytes:     size,
-		CreatedAt: now,
-		// TODO: Configurable expiration & actually delete them in process
-		ExpireAt: expireAt,
+// storeObject validates, processes and stores a file uploaded to the storage
+// outside of the request, e.g. a direct upload, and writes the response. The
+// object is buffered like form uploads. Returns true if the file was stored.
+func (h *FileUploadHandler) storeObject(
+	w http.ResponseWriter,
+	r *http.Request,
+	object *storage.Reader,
+	fileKey string,
+) bool {
+	maxSize := h.maxSize()
+	file, size, contentSHA256, err := bufferFile(io.LimitReader(object.Body, maxSize+1))
+	if err != nil {
+		h.logger.Error().Err(err).Str("key", fileKey).Msg("Error reading uploaded object")
+		apierror.Write(w, r, apierror.Unavailable("storage_unavailable", "Error reading upload"))
+		return false
 	}
+	defer file.Close()
+
+	if size > maxSize {
+		apierror.Write(w, r, apierror.RequestTooLarge("File too large").WithParam("file"))
+		return false
+	}
+
+	_, filename, _ := parseFileMetadata(object.Metadata)
+	fileHeader := &multipart.FileHeader{
+		Filename: filename,
+		Size:     size,
+		Header: textproto.MIMEHeader{
+			"Content-Type": {object.ContentType},
+		},
+	}
+
+	return h.storeUpload(w, r, file, fileHeader, contentSHA256, fileKey)
+}
 
+// deleteStaged deletes the staged upload. Abandoned uploads expire with the
+// storage TTL and are deleted by the sweeper, staging keys are file keys.
+func (h *FileUploadHandler) deleteStaged(keys ...string) {
+	// Not canceled with the request as the file was already processed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := h.storage.Delete(ctx, keys...); err != nil {
+		h.logger.Warn().Err(err).Strs("keys", keys).Msg("error deleting staged upload")
+	}
+}
+
+// maxSize returns the max size of uploads in a single request
+func (h *FileUploadHandler) maxSize() int64 {
+	if h.maxFileSize > 0 {
+		return h.maxFileSize
+	}
+
+	return defaultMaxFileSize
+}
+
+// isAllowedContentType returns true if uploads with the detected content type
+// are allowed
+func (h *FileUploadHandler) isAllowedContentType(contentType string) bool {
+	return h.allowedContentTypes == nil || h.allowedContentTypes[mediaType(contentType)]
+}
+
+// writeFileUploadResponse writes the created file response
+func writeFileUploadResponse(w http.ResponseWriter, response FileUploadResponse) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
 
-// ExtractExpireAt extracts the expiration date from the x-amz-expiration
-// response header from S3 PutObject API response.
-func ExtractExpireAt(responseExpiration *string) (time.Time, error) {
-	if responseExpiration == nil {
-		return time.Time{}, fmt.Errorf("response expiration is nil")
-	}
+// storeFile stores a file with the key and returns its public URL and
+// expiration date. The owner of the request, filename and stored variants of
+// the file are recorded as object metadata. The file expires at expireAt, or
+// after the storage TTL if zero. contentSHA256 is the hex SHA-256 of the body,
+// storages that deduplicate content store it under its hash.
+func (h *FileUploadHandler) storeFile(
+	ctx context.Context,
+	fileKey string,
+	body io.Reader,
+	size int64,
+	contentSHA256 string,
+	contentType string,
+	filename string,
+	variants []string,
+	expireAt time.Time,
+) (FileUploadResponse, error) {
+	fileContentDisposition := contentDisposition(filename, contentType)
 
-	// expiry-date="Fri, 23 Dec 2012 00:00:00 GMT", rule-id="1"
-	if *responseExpiration == "" || strings.Contains(*responseExpiration, "NotImplemented") {
-		return time.Time{}, errors.New("response expiration is empty or NotImplemented")
+	h.logger.Debug().
+		Str("key", fileKey).
+		Str("content_type", contentType).
+		Str("content_disposition", fileContentDisposition).
+		Msg("Uploading file")
+
+	object, err := h.storage.Put(ctx, storage.PutInput{
+		Key:         fileKey,
+		Body:        body,
+		Size:        size,
+		ContentType: contentType,
+		// Inline for client side display if safe to render
+		ContentDisposition: fileContentDisposition,
+		Metadata:           newFileMetadata(types.OwnerFromContext(ctx), filename, variants),
+		ExpireAt:           expireAt,
+		ContentSHA256:      contentSHA256,
+	})
+	if err != nil {
+		return FileUploadResponse{}, err
 	}
 
-	matches := expireDateRegex.FindStringSubmatch(*responseExpiration)
-	if len(matches) < 2 {
-		return time.Time{}, errors.New("no expiry-date found in response")
+	return newFileResponse(
+		h.publicURL,
+		fileKey,
+		size,
+		object.LastModified,
+		object.ExpireAt,
+		filename,
+		variants,
+		h.access.sign(fileKey),
+	), nil
+}
+
+// contentHash returns the hex SHA-256 of the data
+func contentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// indexFile adds the file to the index of files of the request owner, used to
+// list files. The entry expires with the file. Files without an owner are not
+// indexed.
+func (h *FileUploadHandler) indexFile(ctx context.Context, fileKey string, expireAt time.Time) error {
+	owner := types.OwnerFromContext(ctx)
+	if owner == "" {
+		return nil
 	}
 
-	expiryDate := matches[1]
-	expireAt, err := time.Parse(time.RFC1123, expiryDate)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("error parsing expiry date: %w", err)
+	_, err := h.storage.Put(ctx, storage.PutInput{
+		Key:         ownerIndexKey(owner, fileKey),
+		Body:        bytes.NewReader(nil),
+		ContentType: "application/octet-stream",
+		ExpireAt:    expireAt,
+	})
+	return err
+}
+
+// retentionExpireAt returns the expiration of a file stored now with the
+// retention, zero for the storage TTL if there is no retention
+func retentionExpireAt(retention time.Duration) time.Time {
+	if retention <= 0 {
+		return time.Time{}
 	}
 
-	// Convert to UTC
-	return expireAt.UTC(), nil
+	return time.Now().Add(retention).UTC()
 }
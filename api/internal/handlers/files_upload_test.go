@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -14,15 +16,20 @@ import (
 	"testing"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
+	"github.com/kava-labs/kavachat/api/internal/images"
+	"github.com/kava-labs/kavachat/api/internal/scanner"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 type mockS3Client struct {
+	storage.S3Client
+
 	putObjectFn func(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	getObjectFn func(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 }
@@ -93,13 +100,12 @@ func TestImageUploadHandler(t *testing.T) {
 		}
 
 		handler := &FileUploadHandler{
-			s3Client:   mock,
-			bucketName: "test-bucket",
-			publicURL:  "http://example.com",
-			logger:     &logger,
+			storage:   storage.NewS3(mock, "test-bucket", 0),
+			publicURL: "http://example.com",
+			logger:    &logger,
 		}
 
-		fileContent := []byte("test image content")
+		fileContent := []byte("\xFF\xD8\xFFtest image content")
 		contentType := "image/jpeg"
 		req := createMultipartRequest(t, "file", "test.jpg", fileContent, contentType)
 		w := httptest.NewRecorder()
@@ -150,14 +156,15 @@ func TestImageUploadHandler(t *testing.T) {
 			logger: &logger,
 		}
 
-		largeContent := bytes.Repeat([]byte("a"), maxFileSize+1)
+		largeContent := bytes.Repeat([]byte("a"), defaultMaxFileSize+1)
 		req := createMultipartRequest(t, "file", "large.jpg", largeContent, "image/jpeg")
 		w := httptest.NewRecorder()
 
 		handler.ServeHTTP(w, req)
 
-		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
 		assert.Contains(t, w.Body.String(), "File too large")
+		assert.Contains(t, w.Body.String(), `"code":"request_too_large"`)
 	})
 
 	t.Run("missing file", func(t *testing.T) {
@@ -194,9 +201,8 @@ func TestImageUploadHandler(t *testing.T) {
 		}
 
 		handler := &FileUploadHandler{
-			s3Client:   mock,
-			bucketName: "test-bucket",
-			logger:     &logger,
+			storage: storage.NewS3(mock, "test-bucket", 0),
+			logger:  &logger,
 		}
 
 		req := createMultipartRequest(t, "file", "test.jpg", []byte("test content"), "image/jpeg")
@@ -208,16 +214,51 @@ func TestImageUploadHandler(t *testing.T) {
 		assert.Contains(t, w.Body.String(), "Error uploading file")
 	})
 
-	t.Run("different content types", func(t *testing.T) {
-		contentTypes := []string{
-			"image/png",
-			"application/pdf",
-			"text/plain",
-			"application/octet-stream",
+	t.Run("detected content types", func(t *testing.T) {
+		tests := []struct {
+			name                string
+			fileName            string
+			content             []byte
+			clientContentType   string
+			expectedContentType string
+			expectedDisposition string
+		}{
+			{
+				name:                "png",
+				fileName:            "image.png",
+				content:             []byte("\x89PNG\r\n\x1a\nimage"),
+				clientContentType:   "image/png",
+				expectedContentType: "image/png",
+				expectedDisposition: `inline; filename="image.png"`,
+			},
+			{
+				name:                "pdf",
+				fileName:            "doc.pdf",
+				content:             []byte("%PDF-1.4 document"),
+				clientContentType:   "application/pdf",
+				expectedContentType: "application/pdf",
+				expectedDisposition: `attachment; filename="doc.pdf"`,
+			},
+			{
+				name:                "html claimed as image",
+				fileName:            "image.png",
+				content:             []byte("<html><script>alert(1)</script></html>"),
+				clientContentType:   "image/png",
+				expectedContentType: "text/html; charset=utf-8",
+				expectedDisposition: `attachment; filename="image.png"`,
+			},
+			{
+				name:                "markdown by extension",
+				fileName:            "notes.md",
+				content:             []byte("# Notes"),
+				clientContentType:   "application/octet-stream",
+				expectedContentType: "text/markdown; charset=utf-8",
+				expectedDisposition: `inline; filename="notes.md"`,
+			},
 		}
 
-		for _, contentType := range contentTypes {
-			t.Run(contentType, func(t *testing.T) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
 				var capturedInput *s3.PutObjectInput
 
 				mock := &mockS3Client{
@@ -228,14 +269,12 @@ func TestImageUploadHandler(t *testing.T) {
 				}
 
 				handler := &FileUploadHandler{
-					s3Client:   mock,
-					bucketName: "test-bucket",
-					publicURL:  "http://example.com",
-					logger:     &logger,
+					storage:   storage.NewS3(mock, "test-bucket", 0),
+					publicURL: "http://example.com",
+					logger:    &logger,
 				}
 
-				fileContent := []byte("test content")
-				req := createMultipartRequest(t, "file", "test-file", fileContent, contentType)
+				req := createMultipartRequest(t, "file", tt.fileName, tt.content, tt.clientContentType)
 				w := httptest.NewRecorder()
 
 				handler.ServeHTTP(w, req)
@@ -243,67 +282,372 @@ func TestImageUploadHandler(t *testing.T) {
 				assert.Equal(t, http.StatusCreated, w.Code)
 				require.NotNil(t, capturedInput)
 				require.NotNil(t, capturedInput.ContentType)
-				assert.Equal(t, contentType, *capturedInput.ContentType)
+				assert.Equal(t, tt.expectedContentType, *capturedInput.ContentType)
+				assert.Equal(t, tt.expectedDisposition, *capturedInput.ContentDisposition)
 			})
 		}
 	})
+
+	t.Run("content type not allowed", func(t *testing.T) {
+		handler := &FileUploadHandler{
+			logger: &logger,
+		}
+		WithAllowedContentTypes([]string{"image/png", "text/plain"})(handler)
+
+		req := createMultipartRequest(t, "file", "page.html", []byte("<html></html>"), "text/plain")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported_file_type")
+	})
 }
 
-func TestExtractExpireAt(t *testing.T) {
+func TestFileUploadHandler_Retention(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	store := storage.NewMemory(24 * time.Hour)
+
+	handler := &FileUploadHandler{
+		storage:      store,
+		publicURL:    "http://example.com",
+		logger:       &logger,
+		textMaxBytes: 1024,
+		retention:    FileRetention{Uploads: time.Hour},
+	}
+
+	req := createMultipartRequest(t, "file", "notes.txt", []byte("some notes"), "text/plain")
+	req = req.WithContext(types.AddOwnerToContext(req.Context(), "session:alice"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var response FileUploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	require.WithinDuration(t, time.Now().Add(time.Hour), response.ExpireAt, time.Minute)
+
+	// The variants and index entry expire with the file
+	for _, key := range []string{response.ID, textKey(response.ID), ownerIndexKey("session:alice", response.ID)} {
+		object, err := store.Head(context.Background(), key)
+		require.NoError(t, err)
+		require.Equal(t, response.ExpireAt, object.ExpireAt, key)
+	}
+}
+
+func TestFileUploadHandler_Dedup(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	memory := storage.NewMemory(24 * time.Hour)
+	store := storage.NewDedup(memory, 24*time.Hour)
+
+	uploads := &FileUploadHandler{storage: store, publicURL: "http://example.com", logger: &logger}
+	downloads := &FileDownloadHandler{storage: store, logger: &logger}
+
+	upload := func(filename string) FileUploadResponse {
+		t.Helper()
+
+		req := createMultipartRequest(t, "file", filename, []byte("%PDF-1.4 report"), "application/pdf")
+		w := httptest.NewRecorder()
+		uploads.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+		var response FileUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+		return response
+	}
+
+	first := upload("first.pdf")
+	second := upload("second.pdf")
+	require.NotEqual(t, first.ID, second.ID, "each upload gets its own file ID")
+
+	blobs, err := memory.List(context.Background(), storage.ListInput{Prefix: "blobs/"})
+	require.NoError(t, err)
+	require.Len(t, blobs, 2, "one blob generation and its references")
+
+	// Files keep their own filename
+	for _, file := range []FileUploadResponse{first, second} {
+		w := httptest.NewRecorder()
+		downloads.ServeHTTP(w, fileRequest(t, file.URL, file.ID, ""))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "%PDF-1.4 report", w.Body.String())
+		require.Contains(t, w.Header().Get("Content-Disposition"), file.Filename)
+	}
+}
+
+func TestImageUploadHandler_ImageProcessing(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	processor, err := images.NewProcessor(images.Config{
+		MaxDimension:       64,
+		MaxPixels:          1000 * 1000,
+		ThumbnailDimension: 16,
+		JPEGQuality:        85,
+	})
+	require.NoError(t, err)
+
+	var pngBuf bytes.Buffer
+	require.NoError(t, png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 128, 32))))
+
 	tests := []struct {
-		name               string
-		responseExpiration *string
-		expectedTime       time.Time
-		expectedError      error
+		name           string
+		fileName       string
+		content        []byte
+		contentType    string
+		expectedStatus int
+		expectedKeys   []string
 	}{
 		{
-			name:               "valid expiration date, converted to UTC",
-			responseExpiration: aws.String(`expiry-date="Fri, 23 Dec 2012 00:00:00 GMT", rule-id="1"`),
-			expectedTime:       time.Date(2012, time.December, 23, 0, 0, 0, 0, time.UTC),
-			expectedError:      nil,
+			name:           "image is re-encoded with thumbnail",
+			fileName:       "photo.png",
+			content:        pngBuf.Bytes(),
+			contentType:    "image/png",
+			expectedStatus: http.StatusCreated,
+			expectedKeys:   []string{"/thumb", ""},
 		},
 		{
-			name:               "nil expiration date",
-			responseExpiration: nil,
-			expectedTime:       time.Time{},
-			expectedError:      fmt.Errorf("response expiration is nil"),
+			name:           "other files are stored unchanged",
+			fileName:       "notes.txt",
+			content:        []byte("some notes"),
+			contentType:    "text/plain",
+			expectedStatus: http.StatusCreated,
+			expectedKeys:   []string{""},
 		},
 		{
-			name:               "empty expiration date",
-			responseExpiration: aws.String(""),
-			expectedTime:       time.Time{},
-			expectedError:      errors.New("response expiration is empty or NotImplemented"),
+			name:           "invalid image",
+			fileName:       "photo.png",
+			content:        []byte("\x89PNG\r\n\x1a\ntruncated"),
+			contentType:    "image/png",
+			expectedStatus: http.StatusBadRequest,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []*s3.PutObjectInput
+			var bodies [][]byte
+
+			handler := &FileUploadHandler{
+				storage: storage.NewS3(&mockS3Client{
+					putObjectFn: func(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+						body, _ := io.ReadAll(input.Body)
+						inputs = append(inputs, input)
+						bodies = append(bodies, body)
+						return &s3.PutObjectOutput{}, nil
+					},
+				}, "test-bucket", 0),
+				publicURL: "http://example.com",
+				logger:    &logger,
+				images:    processor,
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, createMultipartRequest(t, "file", tt.fileName, tt.content, tt.contentType))
+			require.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			require.Len(t, inputs, len(tt.expectedKeys))
+
+			if tt.expectedStatus != http.StatusCreated {
+				return
+			}
+
+			var response FileUploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+			for i, suffix := range tt.expectedKeys {
+				require.Equal(t, response.ID+suffix, *inputs[i].Key)
+			}
+
+			if len(tt.expectedKeys) == 1 {
+				require.Empty(t, response.ThumbnailURL)
+				require.Equal(t, tt.content, bodies[0])
+				require.Equal(t, "text/plain; charset=utf-8", *inputs[0].ContentType)
+				return
+			}
+
+			require.Equal(t, response.URL+"?variant=thumb", response.ThumbnailURL)
+			require.Equal(t, "inline; filename=\"photo.jpg\"", *inputs[1].ContentDisposition)
+			require.Equal(t, "thumb", inputs[1].Metadata["variants"])
+
+			for i, width := range []int{16, 64} {
+				require.Equal(t, "image/jpeg", *inputs[i].ContentType)
+
+				imageConfig, format, err := image.DecodeConfig(bytes.NewReader(bodies[i]))
+				require.NoError(t, err)
+				require.Equal(t, "jpeg", format)
+				require.Equal(t, width, imageConfig.Width)
+			}
+		})
+	}
+}
+
+func TestImageUploadHandler_TextExtraction(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	tests := []struct {
+		name         string
+		fileName     string
+		content      []byte
+		expectedText string
+	}{
+		{
+			name:         "markdown text is stored",
+			fileName:     "notes.md",
+			content:      []byte("# Notes\n\nSome notes\n"),
+			expectedText: "# Notes\n\nSome notes",
+		},
+		{
+			name:     "images have no text",
+			fileName: "photo.jpg",
+			content:  []byte("\xFF\xD8\xFFtest image content"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := map[string][]byte{}
+			contentTypes := map[string]string{}
+
+			handler := &FileUploadHandler{
+				storage: storage.NewS3(&mockS3Client{
+					putObjectFn: func(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+						body, _ := io.ReadAll(input.Body)
+						stored[*input.Key] = body
+						contentTypes[*input.Key] = *input.ContentType
+						return &s3.PutObjectOutput{}, nil
+					},
+				}, "test-bucket", 0),
+				publicURL:    "http://example.com",
+				logger:       &logger,
+				textMaxBytes: 1024,
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, createMultipartRequest(t, "file", tt.fileName, tt.content, "application/octet-stream"))
+			require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+			var response FileUploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+			if tt.expectedText == "" {
+				require.Empty(t, response.TextURL)
+				require.Len(t, stored, 1)
+				return
+			}
+
+			require.Equal(t, response.URL+"/text", response.TextURL)
+			require.Equal(t, tt.expectedText, string(stored[response.ID+"/text"]))
+			require.Equal(t, "text/plain; charset=utf-8", contentTypes[response.ID+"/text"])
+		})
+	}
+}
+
+type mockScanner struct {
+	verdict scanner.Verdict
+	err     error
+	scanned []byte
+}
+
+func (m *mockScanner) Scan(ctx context.Context, r io.Reader) (scanner.Verdict, error) {
+	m.scanned, _ = io.ReadAll(r)
+	return m.verdict, m.err
+}
+
+func TestImageUploadHandler_Scanner(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	tests := []struct {
+		name           string
+		scanner        *mockScanner
+		failOpen       bool
+		expectedStatus int
+		expectedStored bool
+	}{
 		{
-			name:               "not implemented expiration date",
-			responseExpiration: aws.String("NotImplemented"),
-			expectedTime:       time.Time{},
-			expectedError:      errors.New("response expiration is empty or NotImplemented"),
+			name:           "clean",
+			scanner:        &mockScanner{verdict: scanner.Verdict{Clean: true}},
+			expectedStatus: http.StatusCreated,
+			expectedStored: true,
 		},
 		{
-			name:               "invalid expiration date format",
-			responseExpiration: aws.String(`expiry-date="invalid-date", rule-id="1"`),
-			expectedTime:       time.Time{},
-			expectedError:      fmt.Errorf("error parsing expiry date: parsing time \"invalid-date\" as \"Mon, 02 Jan 2006 15:04:05 MST\": cannot parse \"invalid-date\" as \"Mon\""),
+			name:           "infected",
+			scanner:        &mockScanner{verdict: scanner.Verdict{Signature: "Eicar-Test-Signature"}},
+			expectedStatus: http.StatusBadRequest,
 		},
 		{
-			name:               "missing expiry-date",
-			responseExpiration: aws.String(`rule-id="1"`),
-			expectedTime:       time.Time{},
-			expectedError:      errors.New("no expiry-date found in response"),
+			name:           "unavailable fail closed",
+			scanner:        &mockScanner{err: errors.New("connection refused")},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:           "unavailable fail open",
+			scanner:        &mockScanner{err: errors.New("connection refused")},
+			failOpen:       true,
+			expectedStatus: http.StatusCreated,
+			expectedStored: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			expireAt, err := ExtractExpireAt(tt.responseExpiration)
-			if tt.expectedError != nil {
-				require.Error(t, err)
-				assert.Equal(t, tt.expectedError.Error(), err.Error())
-			} else {
-				require.NoError(t, err)
-				assert.Equal(t, tt.expectedTime, expireAt)
+			stored := false
+			handler := &FileUploadHandler{
+				storage: storage.NewS3(&mockS3Client{
+					putObjectFn: func(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+						stored = true
+						return &s3.PutObjectOutput{}, nil
+					},
+				}, "test-bucket", 0),
+				publicURL: "http://example.com",
+				logger:    &logger,
 			}
+			WithScanner(tt.scanner, tt.failOpen)(handler)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, createMultipartRequest(t, "file", "notes.txt", []byte("file content"), "text/plain"))
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Equal(t, tt.expectedStored, stored)
+			assert.Equal(t, []byte("file content"), tt.scanner.scanned)
 		})
 	}
 }
+
+func TestReadFormFile(t *testing.T) {
+	read := func(t *testing.T, content []byte) (multipart.File, *multipart.FileHeader, string) {
+		t.Helper()
+
+		file, header, contentSHA256, err := readFormFile(createMultipartRequest(t, "file", "data.bin", content, "application/octet-stream"))
+		require.NoError(t, err)
+		t.Cleanup(func() { file.Close() })
+
+		return file, header, contentSHA256
+	}
+
+	t.Run("small files are kept in memory", func(t *testing.T) {
+		file, header, contentSHA256 := read(t, []byte("hello"))
+		require.IsType(t, stagedFile{}, file)
+		require.Equal(t, "data.bin", header.Filename)
+		require.Equal(t, int64(5), header.Size)
+		require.Equal(t, contentHash([]byte("hello")), contentSHA256)
+	})
+
+	t.Run("large files are buffered on disk", func(t *testing.T) {
+		content := bytes.Repeat([]byte("a"), maxFormMemory+1)
+		file, header, contentSHA256 := read(t, content)
+		require.Equal(t, int64(len(content)), header.Size)
+		require.Equal(t, contentHash(content), contentSHA256)
+
+		data, err := io.ReadAll(io.NewSectionReader(file, 0, header.Size))
+		require.NoError(t, err)
+		require.Equal(t, content, data)
+
+		tmp, ok := file.(tempFile)
+		require.True(t, ok)
+		require.NoError(t, file.Close())
+		require.NoFileExists(t, tmp.Name())
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, _, _, err := readFormFile(createMultipartRequest(t, "other", "data.bin", []byte("hello"), "text/plain"))
+		require.ErrorIs(t, err, http.ErrMissingFile)
+	})
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// heartbeatComment is the SSE comment sent to keep idle connections open
+const heartbeatComment = "keep-alive"
+
+// heartbeatWriter is a wrapper around http.ResponseWriter that writes SSE
+// comment lines when nothing has been written for the heartbeat interval. This
+// keeps load balancers from dropping idle connections while slow models, e.g.
+// reasoning models, have not produced any output yet.
+//
+// Heartbeats are written directly to the underlying ResponseWriter so they are
+// not counted by the TimeToFirstByteResponseWriter wrapping this writer.
+type heartbeatWriter struct {
+	http.ResponseWriter
+
+	mu sync.Mutex
+	// committed is true once the response status code has been written,
+	// either by a heartbeat or by writeHeaderOnce
+	committed bool
+	// heartbeatCommitted is true if the first heartbeat wrote the status code
+	// before the upstream response was received
+	heartbeatCommitted bool
+	// atEventBoundary is true if the last write ended an SSE event, heartbeats
+	// are only written between events to not corrupt partial events
+	atEventBoundary bool
+	lastWrite       time.Time
+	heartbeats      int
+	stopped         bool
+	done            chan struct{}
+}
+
+// newHeartbeatWriter creates a heartbeatWriter and starts sending heartbeats
+// at the given interval until Stop is called
+func newHeartbeatWriter(w http.ResponseWriter, interval time.Duration) *heartbeatWriter {
+	hw := &heartbeatWriter{
+		ResponseWriter:  w,
+		atEventBoundary: true,
+		lastWrite:       time.Now(),
+		done:            make(chan struct{}),
+	}
+
+	go hw.run(interval)
+
+	return hw
+}
+
+func (hw *heartbeatWriter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hw.done:
+			return
+		case <-ticker.C:
+			hw.heartbeat(interval)
+		}
+	}
+}
+
+// heartbeat writes a comment line if the connection has been idle for the
+// interval
+func (hw *heartbeatWriter) heartbeat(interval time.Duration) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if hw.stopped || !hw.atEventBoundary || time.Since(hw.lastWrite) < interval {
+		return
+	}
+
+	// First heartbeat commits to a successful event stream response, the
+	// upstream status code can no longer be forwarded after this.
+	if !hw.committed {
+		header := hw.ResponseWriter.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Access-Control-Allow-Origin", "*")
+		hw.ResponseWriter.WriteHeader(http.StatusOK)
+
+		hw.committed = true
+		hw.heartbeatCommitted = true
+	}
+
+	if _, err := sse.WriteComment(hw.ResponseWriter, heartbeatComment); err != nil {
+		// Client is gone, the handler will notice on its next write
+		return
+	}
+
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	hw.heartbeats++
+	hw.lastWrite = time.Now()
+}
+
+// writeHeaderOnce sets the headers and writes the status code if a heartbeat
+// has not already done so. Returns false if the response was already committed
+// by a heartbeat, in which case the status code and headers are discarded.
+func (hw *heartbeatWriter) writeHeaderOnce(statusCode int, header http.Header) bool {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if hw.committed {
+		return false
+	}
+
+	for key, values := range header {
+		hw.ResponseWriter.Header()[key] = values
+	}
+	hw.ResponseWriter.WriteHeader(statusCode)
+	hw.committed = true
+
+	return true
+}
+
+// WriteHeader writes the status code if a heartbeat has not already done so
+func (hw *heartbeatWriter) WriteHeader(statusCode int) {
+	hw.writeHeaderOnce(statusCode, nil)
+}
+
+// Write writes to the underlying ResponseWriter and resets the idle timer
+func (hw *heartbeatWriter) Write(b []byte) (int, error) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	hw.committed = true
+
+	n, err := hw.ResponseWriter.Write(b)
+	if n > 0 {
+		hw.lastWrite = time.Now()
+		hw.atEventBoundary = bytes.HasSuffix(b[:n], []byte("\n\n"))
+	}
+
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if supported
+func (hw *heartbeatWriter) Flush() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Stop stops sending heartbeats, must be called before the handler returns.
+// Returns the number of heartbeats sent.
+func (hw *heartbeatWriter) Stop() int {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if !hw.stopped {
+		hw.stopped = true
+		close(hw.done)
+	}
+
+	return hw.heartbeats
+}
+
+// HeartbeatCommitted returns true if a heartbeat committed the response status
+// before the upstream response headers were written
+func (hw *heartbeatWriter) HeartbeatCommitted() bool {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	return hw.heartbeatCommitted
+}
+
+// isStreamingRequest returns true if the request body has stream set to true
+func isStreamingRequest(bodyBytes []byte) bool {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		return false
+	}
+
+	return body.GetBool("stream")
+}
+
+// writeErrorEvent writes an OpenAI error response body as an SSE data event,
+// used when the response status code was already committed
+func writeErrorEvent(w io.Writer, body []byte) {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err != nil {
+		data, _ := json.Marshal(apierror.Internal("invalid error response").Response(""))
+		sse.WriteData(w, data)
+		return
+	}
+
+	sse.WriteData(w, compacted.Bytes())
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProxyHandler_Heartbeat(t *testing.T) {
+	logger := log.Logger
+
+	tests := []struct {
+		name             string
+		requestBody      string
+		upstreamStatus   int
+		upstreamBody     string
+		expectedCode     int
+		expectHeartbeats bool
+		expectedBody     string
+	}{
+		{
+			name:             "heartbeats before first byte",
+			requestBody:      `{"model":"o3-mini","stream":true}`,
+			upstreamStatus:   http.StatusOK,
+			upstreamBody:     "data: {\"choices\":[]}\n\ndata: [DONE]\n\n",
+			expectedCode:     http.StatusOK,
+			expectHeartbeats: true,
+			expectedBody:     "data: {\"choices\":[]}\n\ndata: [DONE]\n\n",
+		},
+		{
+			name:             "upstream error after heartbeat is sent as event",
+			requestBody:      `{"model":"o3-mini","stream":true}`,
+			upstreamStatus:   http.StatusTooManyRequests,
+			upstreamBody:     "{\n  \"error\": {\"message\": \"rate limited\"}\n}",
+			expectedCode:     http.StatusOK,
+			expectHeartbeats: true,
+			expectedBody:     "data: {\"error\":{\"message\":\"rate limited\"}}\n\n",
+		},
+		{
+			name:             "no heartbeats for non-streaming requests",
+			requestBody:      `{"model":"o3-mini"}`,
+			upstreamStatus:   http.StatusOK,
+			upstreamBody:     `{"choices":[]}`,
+			expectedCode:     http.StatusOK,
+			expectHeartbeats: false,
+			expectedBody:     `{"choices":[]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Slow to respond, e.g. reasoning model
+				time.Sleep(150 * time.Millisecond)
+
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(tt.upstreamStatus)
+				w.Write([]byte(tt.upstreamBody))
+			}))
+			defer server.Close()
+
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{
+						Name:          "backend",
+						BaseURL:       server.URL,
+						APIKey:        "api-key",
+						AllowedModels: []string{"o3-mini"},
+					},
+				},
+				&logger,
+				"/chat/completions",
+				WithHeartbeat(20*time.Millisecond),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", bytes.NewBufferString(tt.requestBody))
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "o3-mini"))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedCode, rr.Code)
+
+			body := rr.Body.String()
+			if tt.expectHeartbeats {
+				require.True(t, strings.HasPrefix(body, ": keep-alive\n\n"), "body should start with heartbeat: %q", body)
+				assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+			} else {
+				assert.NotContains(t, body, "keep-alive")
+			}
+
+			assert.Equal(t, tt.expectedBody, strings.ReplaceAll(body, ": keep-alive\n\n", ""))
+		})
+	}
+}
+
+func TestHeartbeatWriter_OnlyBetweenEvents(t *testing.T) {
+	rr := httptest.NewRecorder()
+	hw := newHeartbeatWriter(rr, 10*time.Millisecond)
+
+	require.True(t, hw.writeHeaderOnce(http.StatusOK, http.Header{"Content-Type": {"text/event-stream"}}))
+
+	// Partial event, heartbeats must not be inserted
+	_, err := hw.Write([]byte("data: {\"partial\""))
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = hw.Write([]byte("}\n\n"))
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	heartbeats := hw.Stop()
+
+	require.False(t, hw.HeartbeatCommitted())
+	require.Greater(t, heartbeats, 0)
+	require.True(t, strings.HasPrefix(rr.Body.String(), "data: {\"partial\"}\n\n: keep-alive\n\n"))
+}
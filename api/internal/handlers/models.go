@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 	"github.com/kava-labs/kavachat/api/internal/config"
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/packages/pagination"
@@ -45,7 +46,7 @@ func (h mergedModelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		)
 		if err != nil {
 			h.logger.Error(fmt.Errorf("error fetching models from backend: %w", err).Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Write(w, r, apierror.Upstream(err))
 			return
 		}
 
@@ -56,7 +57,7 @@ func (h mergedModelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Decode response
 		if err := json.NewDecoder(reqModels.Body).Decode(&modelsPage); err != nil {
 			h.logger.Error(fmt.Errorf("error decoding models from backend: %w", err).Error())
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Write(w, r, apierror.Upstream(err))
 			return
 		}
 
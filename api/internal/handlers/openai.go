@@ -7,12 +7,21 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/guardrails"
+	"github.com/kava-labs/kavachat/api/internal/hedging"
 	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/moderation"
 	"github.com/kava-labs/kavachat/api/internal/otel"
+	"github.com/kava-labs/kavachat/api/internal/prompts"
+	"github.com/kava-labs/kavachat/api/internal/streams"
+	"github.com/kava-labs/kavachat/api/internal/tools"
 	"github.com/kava-labs/kavachat/api/internal/types"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
@@ -32,6 +41,8 @@ type TimeToFirstByteResponseWriter struct {
 	model        string
 	backend      string
 	bytesWritten int64
+	// onFirstByte is optional, called with the TTFB on the first write
+	onFirstByte func(ttfb time.Duration)
 }
 
 // NewTimeToFirstByteResponseWriter creates a new TimeToFirstByteResponseWriter
@@ -71,6 +82,10 @@ func (w *TimeToFirstByteResponseWriter) Write(b []byte) (int, error) {
 			)
 		}
 
+		if w.onFirstByte != nil {
+			w.onFirstByte(ttfb)
+		}
+
 		if w.tracer != nil {
 			// Create a child span for the TTFB
 			_, w.ResponseSpan = w.tracer.Start(w.ctx, "proxy.response")
@@ -116,6 +131,84 @@ type openaiProxyHandler struct {
 	backends config.OpenAIBackends
 	logger   *zerolog.Logger
 	endpoint string
+
+	// moderator is optional, requests are not moderated if nil
+	moderator *moderation.Client
+	// guardrails is optional, streamed responses are not inspected if nil
+	guardrails *guardrails.Rules
+	// heartbeatInterval is the idle interval after which SSE comments are
+	// sent on streaming requests, 0 to disable
+	heartbeatInterval time.Duration
+	// streams is optional, streams are not resumable if nil
+	streams *streams.Registry
+	// hedger is optional, requests are not hedged if nil
+	hedger *hedging.Hedger
+	// tools is optional, requests with server_tools are rejected if nil
+	tools *tools.Executor
+	// conversations is optional, requests with conversation_id are rejected
+	// if nil
+	conversations conversations.Store
+	// systemPrompts is optional, client messages are forwarded unchanged if
+	// nil
+	systemPrompts *prompts.Prompts
+	// defaultLocale is the template locale when the request has none
+	defaultLocale string
+	// imageUploads is optional, generated images are not stored if nil
+	imageUploads *FileUploadHandler
+	// imageClient downloads generated images from provider URLs
+	imageClient *http.Client
+	// inliner is optional, uploaded file URLs are forwarded unchanged if nil
+	inliner *fileInliner
+	// fileTexts is optional, file content parts are forwarded unchanged if
+	// nil
+	fileTexts *FileDownloadHandler
+	// fileTextMaxTokens is the token budget of the text of each file
+	fileTextMaxTokens int
+}
+
+// OpenAIProxyOption configures optional behavior of the OpenAI proxy handler
+type OpenAIProxyOption func(*openaiProxyHandler)
+
+// WithModeration checks the latest user message or image prompt with the
+// moderation client before forwarding requests, rejecting flagged requests.
+func WithModeration(moderator *moderation.Client) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.moderator = moderator
+	}
+}
+
+// WithGuardrails inspects streamed chat completion responses and ends the
+// stream with a content_filter finish reason when a rule trips.
+func WithGuardrails(rules guardrails.Rules) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.guardrails = &rules
+	}
+}
+
+// WithHeartbeat sends SSE comment lines on streaming requests when nothing has
+// been written to the client for the given interval.
+func WithHeartbeat(interval time.Duration) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.heartbeatInterval = interval
+	}
+}
+
+// WithResumableStreams buffers streamed chat completions in the registry so
+// clients can reconnect with Last-Event-ID. The upstream request continues
+// independently of the client connection.
+func WithResumableStreams(registry *streams.Registry) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.streams = registry
+	}
+}
+
+// WithHedging sends requests for hedged models to the hedge backend as well
+// when the primary backend has not produced the first byte within the hedge
+// delay, using whichever responds first.
+func WithHedging(hedger *hedging.Hedger) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.hedger = hedger
+	}
 }
 
 // NewOpenAIProxyHandler creates a new handler that proxies requests to the OpenAI API
@@ -123,17 +216,24 @@ func NewOpenAIProxyHandler(
 	backends config.OpenAIBackends,
 	baseLogger *zerolog.Logger,
 	endpoint string,
+	opts ...OpenAIProxyOption,
 ) http.Handler {
 	logger := baseLogger.With().
 		Str("handler", "openai_proxy").
 		Str("endpoint", endpoint).
 		Logger()
 
-	return openaiProxyHandler{
+	h := openaiProxyHandler{
 		backends: backends,
 		logger:   &logger,
 		endpoint: endpoint,
 	}
+
+	for _, opt := range opts {
+		opt(&h)
+	}
+
+	return h
 }
 
 // ServeHTTP forwards the request to the OpenAI API
@@ -151,9 +251,8 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !found {
 		h.logger.Error().Msgf("error finding backend for model: %s", model)
 
-		// Not OpenAI compatible, backend should be found in the middleware
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		// Backend should be found in the middleware
+		apierror.Write(w, r, apierror.Internal("no backend available for the model"))
 
 		return
 	}
@@ -163,7 +262,6 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		model, backend.Name,
 	)
 
-	client := backend.GetClient()
 	ctx = types.AddBackendToContext(ctx, backend.Name)
 	ctx = types.AddModelToContext(ctx, model)
 
@@ -176,28 +274,145 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, err = io.ReadAll(r.Body)
 		if err != nil {
 			h.logger.Error().Err(err).Msg("error reading request body for proxy")
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Write(w, r, apierror.InvalidRequest("", "can't read body"))
 			return
 		}
 		r.Body.Close()
 	}
 
+	// Stored conversation messages are added before moderation so the
+	// assembled request is checked
+	var turn *conversationTurn
+	if h.isChatCompletions() {
+		var ok bool
+		bodyBytes, turn, ok = h.prepareConversation(w, r.WithContext(ctx), bodyBytes)
+		if !ok {
+			return
+		}
+
+		// After the conversation so stored system messages follow the policy
+		if h.systemPrompts != nil {
+			bodyBytes, ok = h.applySystemPrompt(w, r.WithContext(ctx), bodyBytes, model, proxySpan)
+			if !ok {
+				return
+			}
+		}
+
+		// Stored conversation messages also reference uploaded files
+		if h.inliner != nil {
+			bodyBytes, ok = h.inlineFiles(w, r.WithContext(ctx), bodyBytes, proxySpan)
+			if !ok {
+				return
+			}
+		}
+
+		if h.fileTexts != nil {
+			bodyBytes, ok = h.expandFileParts(w, r.WithContext(ctx), bodyBytes, proxySpan)
+			if !ok {
+				return
+			}
+		}
+	}
+
+	if h.moderator != nil {
+		if allowed := h.moderateRequest(w, r.WithContext(ctx), proxySpan, bodyBytes); !allowed {
+			return
+		}
+	}
+
+	// Tool loop requests are handled separately as they make multiple
+	// backend requests
+	if h.isChatCompletions() && isServerToolsRequest(bodyBytes) {
+		h.serveServerTools(w, r.WithContext(ctx), tracer, backend, model, bodyBytes, turn, proxySpan)
+		return
+	}
+
+	streaming := isStreamingRequest(bodyBytes)
+
+	// Backends that only support non-streaming responses get a non-streaming
+	// request, the response is converted to a stream for the client
+	simulateStream := streaming && h.isChatCompletions() && backend.SimulatesStreaming(model)
+	includeUsage := false
+	if simulateStream {
+		var err error
+		bodyBytes, includeUsage, err = nonStreamingRequestBody(bodyBytes)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("error converting request body for simulated streaming")
+			apierror.Write(w, r, apierror.InvalidRequest(
+				"",
+				"We could not parse the JSON body of your request.",
+			))
+			return
+		}
+
+		proxySpan.SetAttributes(attribute.Bool("simulated_stream", true))
+	}
+
+	// Resumable streams continue upstream independently of the client
+	// connection, detached is set once the stream goroutine owns the upstream
+	// response
+	upstreamCtx := ctx
+	cancelUpstream := func() {}
+	detached := false
+
+	var stream *streams.Stream
+	if h.streams != nil && streaming && h.isChatCompletions() {
+		var err error
+		stream, err = h.streams.Create(types.OwnerFromContext(ctx))
+		if err != nil {
+			// Not fatal, continue without resumable stream
+			h.logger.Error().Err(err).Msg("error creating resumable stream")
+		} else {
+			upstreamCtx, cancelUpstream = context.WithTimeout(
+				context.WithoutCancel(ctx),
+				h.streams.MaxDuration(),
+			)
+
+			defer func() {
+				if !detached {
+					cancelUpstream()
+					stream.Finish()
+				}
+			}()
+
+			// Set before heartbeats can commit the response headers
+			w.Header().Set(StreamIDHeader, stream.ID)
+			w.Header().Add("Access-Control-Expose-Headers", StreamIDHeader)
+			proxySpan.SetAttributes(attribute.String("stream_id", stream.ID))
+		}
+	}
+
+	// Heartbeats are written below the TTFB writer so they are not recorded as
+	// the first byte from the backend
+	var heartbeat *heartbeatWriter
+	var out http.ResponseWriter = w
+	if h.heartbeatInterval > 0 && streaming {
+		heartbeat = newHeartbeatWriter(w, h.heartbeatInterval)
+		out = heartbeat
+
+		defer func() {
+			proxySpan.SetAttributes(attribute.Int("heartbeats", heartbeat.Stop()))
+		}()
+	}
+
 	// This creates a child span for the TTFB
 	responseWriter := NewTimeToFirstByteResponseWriter(
 		ctx,
-		w,
+		out,
 		tracer,
 		model,
 		backend.Name,
 	)
 	defer responseWriter.End()
 
-	// Forward request
-	apiResponse, err := client.DoRequest(
-		ctx,
+	// Forward request, the response may be from the hedge backend
+	apiResponse, responseBackend, err := h.forwardRequest(
+		upstreamCtx,
 		r.Method,
-		h.endpoint,
-		bytes.NewReader(bodyBytes),
+		backend,
+		model,
+		bodyBytes,
+		proxySpan,
 	)
 	if err != nil {
 		// Check if error is specifically due to client disconnection
@@ -222,14 +437,46 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			backend.Name, err.Error(),
 		)
 
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(err)
-
 		proxySpan.SetStatus(codes.Error, "request forwarding error")
 		proxySpan.RecordError(err)
+
+		writeProxyError(out, r, heartbeat, apierror.Upstream(err))
 		return
 	}
-	defer apiResponse.Body.Close()
+	defer func() {
+		if !detached {
+			apiResponse.Body.Close()
+		}
+	}()
+
+	if h.hedger != nil && backend.HedgesModel(model) && responseBackend == backend {
+		// Samples are for the primary backend, hedge wins are recorded when
+		// forwarding as the primary TTFB is unknown
+		key := hedgeKey(backend.Name, model)
+		responseWriter.onFirstByte = func(ttfb time.Duration) {
+			h.hedger.Observe(key, ttfb)
+		}
+	}
+
+	backend = responseBackend
+	responseWriter.backend = backend.Name
+
+	if simulateStream {
+		if err := simulateStreamResponse(apiResponse, includeUsage); err != nil {
+			h.logger.Error().Err(err).Str("backend", backend.Name).Msg("error simulating stream")
+
+			proxySpan.SetStatus(codes.Error, "simulated stream error")
+			proxySpan.RecordError(err)
+
+			writeProxyError(out, r, heartbeat, apierror.New(
+				http.StatusBadGateway,
+				apierror.TypeServer,
+				apierror.CodeUpstreamError,
+				"invalid response from backend",
+			))
+			return
+		}
+	}
 
 	h.logger.Debug().
 		Str("http_proto", apiResponse.Proto).
@@ -237,15 +484,110 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Str("backend", backend.Name).
 		Msg("response from backend")
 
+	// Upstream errors that are not JSON are wrapped in an OpenAI error
+	requestID := types.RequestIDFromContext(ctx)
+	var errorBody []byte
+	if apiResponse.StatusCode >= http.StatusBadRequest {
+		errorBody, err = apierror.ReadUpstreamBody(apiResponse, requestID)
+		if err != nil {
+			h.logger.Error().Err(err).Str("backend", backend.Name).Msg("error reading upstream error response")
+
+			writeProxyError(out, r, heartbeat, apierror.Upstream(err))
+			return
+		}
+	}
+
+	// Generated images are stored before the response is sent so the client
+	// only gets the file URLs
+	if h.shouldStoreImages(apiResponse) {
+		body, err := io.ReadAll(io.LimitReader(apiResponse.Body, maxImagesResponseSize+1))
+		apiResponse.Body.Close()
+		if err == nil && len(body) > maxImagesResponseSize {
+			err = errors.New("images response too large")
+		}
+		if err != nil {
+			h.logger.Error().Err(err).Str("backend", backend.Name).Msg("error reading images response")
+
+			writeProxyError(out, r, heartbeat, apierror.Upstream(err))
+			return
+		}
+
+		apiResponse.Body = io.NopCloser(bytes.NewReader(h.storeGeneratedImages(ctx, body, proxySpan)))
+	}
+
 	// Response headers
-	w.Header().Set("Content-Type", apiResponse.Header.Get("Content-Type"))
-	w.Header().Set("Transfer-Encoding", "identity")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	header := http.Header{}
+	header.Set("Content-Type", apiResponse.Header.Get("Content-Type"))
+	header.Set("Transfer-Encoding", "identity")
+	header.Set("Access-Control-Allow-Origin", "*")
+
+	if heartbeat != nil {
+		// A heartbeat already sent a 200 event stream response, upstream
+		// errors must be sent as an event instead
+		if !heartbeat.writeHeaderOnce(apiResponse.StatusCode, header) &&
+			apiResponse.StatusCode != http.StatusOK {
+			if errorBody == nil {
+				errorBody = apierror.UpstreamResponseBody(apiResponse.StatusCode, nil, requestID)
+			}
+			writeErrorEvent(responseWriter, errorBody)
 
-	w.WriteHeader(apiResponse.StatusCode)
+			return
+		}
+	} else {
+		for key, values := range header {
+			w.Header()[key] = values
+		}
 
-	// Forward response body, straight copy from response which includes streaming
-	bytesWritten, err := io.Copy(responseWriter, apiResponse.Body)
+		w.WriteHeader(apiResponse.StatusCode)
+	}
+
+	// The reply is recorded as sent to the client, after guardrails
+	var recorder *replyRecorder
+	if turn != nil && apiResponse.StatusCode == http.StatusOK {
+		recorder = newReplyRecorder(apiResponse)
+	}
+
+	if stream != nil && apiResponse.StatusCode == http.StatusOK {
+		detached = true
+		go h.bufferStream(ctx, stream, apiResponse, cancelUpstream, turn, recorder)
+
+		err := writeStreamEvents(ctx, responseWriter, stream, 0)
+		if err != nil {
+			h.logger.Info().
+				Err(err).
+				Str("stream_id", stream.ID).
+				Msg("client stopped receiving resumable stream, upstream continues")
+		}
+
+		return
+	}
+
+	// Forward response body, straight copy from response which includes
+	// streaming, unless the stream needs to be inspected
+	var output io.Writer = responseWriter
+	if recorder != nil {
+		output = io.MultiWriter(responseWriter, recorder)
+	}
+
+	var bytesWritten int64
+	if h.shouldInspectStream(apiResponse) {
+		var result guardrails.Result
+		result, err = h.guardrails.Inspect(output, apiResponse.Body)
+		bytesWritten = result.BytesWritten
+
+		if result.Violation != nil {
+			h.logger.Info().
+				Str("rule", result.Violation.Rule).
+				Msg("response stream terminated by guardrail")
+
+			proxySpan.SetAttributes(
+				attribute.String("guardrail_rule", result.Violation.Rule),
+				attribute.String("finish_reason", guardrails.FinishReasonContentFilter),
+			)
+		}
+	} else {
+		bytesWritten, err = io.Copy(output, apiResponse.Body)
+	}
 	if err != nil {
 		// Check if error is specifically due to client disconnection
 		if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
@@ -269,8 +611,179 @@ func (h openaiProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		proxySpan.RecordError(err)
 	}
 
+	if recorder != nil && err == nil {
+		h.saveConversationTurn(ctx, turn, recorder)
+	}
+
 	proxySpan.SetAttributes(attribute.Int64("response_bytes", bytesWritten))
 	h.logger.Debug().
 		Int64("bytes_written", bytesWritten).
 		Msg("request forwarded successfully")
 }
+
+// writeProxyError writes the error response, or an error event if a heartbeat
+// already committed the response as a 200 event stream
+func writeProxyError(
+	w http.ResponseWriter,
+	r *http.Request,
+	heartbeat *heartbeatWriter,
+	e *apierror.Error,
+) {
+	if heartbeat != nil {
+		heartbeat.Stop()
+
+		if heartbeat.HeartbeatCommitted() {
+			data, _ := json.Marshal(e.Response(types.RequestIDFromContext(r.Context())))
+			writeErrorEvent(w, data)
+			return
+		}
+	}
+
+	apierror.Write(w, r, e)
+}
+
+// forwardRequest sends the request to the backend. Requests for hedged models
+// are also sent to the hedge backend if the backend has not produced the first
+// byte within the hedge delay, the backend that responded first is returned.
+func (h openaiProxyHandler) forwardRequest(
+	ctx context.Context,
+	method string,
+	backend *config.OpenAIBackend,
+	model string,
+	body []byte,
+	span trace.Span,
+) (*http.Response, *config.OpenAIBackend, error) {
+	doRequest := func(b *config.OpenAIBackend) hedging.Attempt {
+		return func(ctx context.Context) (*http.Response, error) {
+			ctx = types.AddBackendToContext(ctx, b.Name)
+			return b.GetClient().DoRequest(ctx, method, h.endpoint, bytes.NewReader(body))
+		}
+	}
+
+	if h.hedger == nil || !backend.HedgesModel(model) {
+		res, err := doRequest(backend)(ctx)
+		return res, backend, err
+	}
+
+	// Existence is checked when validating the config
+	secondary, found := h.backends.GetBackendByName(backend.HedgeBackend)
+	if !found {
+		h.logger.Error().Msgf("hedge backend %s not found, request not hedged", backend.HedgeBackend)
+
+		res, err := doRequest(backend)(ctx)
+		return res, backend, err
+	}
+
+	delay := h.hedger.Delay(hedgeKey(backend.Name, model))
+	result, err := hedging.Do(ctx, delay, doRequest(backend), doRequest(secondary))
+
+	span.SetAttributes(
+		attribute.Bool("hedged", result.Hedged),
+		attribute.Int64("hedge_delay_ms", delay.Milliseconds()),
+	)
+
+	attrs := []attribute.KeyValue{
+		attribute.String("model", model),
+		attribute.String("backend", backend.Name),
+		attribute.String("hedge_backend", secondary.Name),
+	}
+
+	if result.Hedged && otel.GlobalMetrics != nil {
+		otel.GlobalMetrics.RecordHedgeIssued(ctx, attrs...)
+	}
+
+	if !result.Secondary {
+		return result.Response, backend, err
+	}
+
+	h.logger.Debug().Msgf(
+		"hedge backend %s responded before backend %s for model '%s'",
+		secondary.Name, backend.Name, model,
+	)
+
+	// The primary was slower than the hedge, a censored sample of at least its
+	// TTFB keeps slow primaries in the percentile. Without it only the fast
+	// primaries are sampled and the delay drifts down.
+	h.hedger.Observe(hedgeKey(backend.Name, model), result.Elapsed)
+
+	span.SetAttributes(attribute.String("hedge_winner", secondary.Name))
+	if otel.GlobalMetrics != nil {
+		otel.GlobalMetrics.RecordHedgeWon(ctx, attrs...)
+	}
+
+	return result.Response, secondary, err
+}
+
+// hedgeKey is the hedger key for the time to first byte of a model on a
+// backend
+func hedgeKey(backend, model string) string {
+	return backend + "/" + model
+}
+
+// shouldInspectStream returns true if guardrails are enabled and the response
+// is a successful chat completion stream
+func (h openaiProxyHandler) shouldInspectStream(res *http.Response) bool {
+	return h.guardrails != nil &&
+		h.isChatCompletions() &&
+		res.StatusCode == http.StatusOK &&
+		isEventStream(res)
+}
+
+// isEventStream returns true if the response is an SSE stream
+func isEventStream(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// isChatCompletions returns true if the handler proxies chat completions
+func (h openaiProxyHandler) isChatCompletions() bool {
+	return strings.HasSuffix(h.endpoint, "/chat/completions")
+}
+
+// bufferStream copies the upstream response of a resumable stream into the
+// stream buffer until the upstream is done, independent of the client
+// connection. The conversation turn is stored if the request continues a
+// conversation.
+func (h openaiProxyHandler) bufferStream(
+	ctx context.Context,
+	stream *streams.Stream,
+	apiResponse *http.Response,
+	cancelUpstream context.CancelFunc,
+	turn *conversationTurn,
+	recorder *replyRecorder,
+) {
+	defer cancelUpstream()
+	defer apiResponse.Body.Close()
+	defer stream.Finish()
+
+	var out io.Writer = stream
+	if recorder != nil {
+		out = io.MultiWriter(stream, recorder)
+	}
+
+	var err error
+	if h.shouldInspectStream(apiResponse) {
+		var result guardrails.Result
+		result, err = h.guardrails.Inspect(out, apiResponse.Body)
+
+		if result.Violation != nil {
+			h.logger.Info().
+				Str("stream_id", stream.ID).
+				Str("rule", result.Violation.Rule).
+				Msg("response stream terminated by guardrail")
+		}
+	} else {
+		_, err = io.Copy(out, apiResponse.Body)
+	}
+
+	if err != nil {
+		h.logger.Error().
+			Err(err).
+			Str("stream_id", stream.ID).
+			Msg("error reading upstream response for resumable stream")
+		return
+	}
+
+	if recorder != nil {
+		h.saveConversationTurn(ctx, turn, recorder)
+	}
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// conversationIDField is the chat completion request field with the ID of the
+// conversation to continue, it is removed before the request is forwarded
+const conversationIDField = "conversation_id"
+
+// maxConversationReplySize is the maximum response size recorded for a
+// conversation reply, larger replies are not stored
+const maxConversationReplySize = 8 * 1024 * 1024 // 8MB
+
+// conversationSaveTimeout limits storing a reply, which happens after the
+// client may have disconnected
+const conversationSaveTimeout = 10 * time.Second
+
+// WithConversations allows chat completion requests to continue a stored
+// conversation with conversation_id. The stored messages are sent before the
+// request messages, and the request messages and the reply are stored when
+// the response completes.
+func WithConversations(store conversations.Store) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.conversations = store
+	}
+}
+
+// conversationTurn is a chat completion request that continues a conversation
+type conversationTurn struct {
+	owner string
+	id    string
+	// messages are the new messages of the request, stored with the reply
+	messages []types.Message
+}
+
+// prepareConversation adds the stored messages of the conversation to a chat
+// completion request with conversation_id. Returns the new body and the turn,
+// or a nil turn if the request does not reference a conversation. An error
+// response is written if false is returned.
+func (h openaiProxyHandler) prepareConversation(
+	w http.ResponseWriter,
+	r *http.Request,
+	bodyBytes []byte,
+) ([]byte, *conversationTurn, bool) {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		// Invalid bodies are rejected by the backend
+		return bodyBytes, nil, true
+	}
+
+	if _, ok := body[conversationIDField]; !ok {
+		return bodyBytes, nil, true
+	}
+
+	id := body.GetString(conversationIDField)
+	if id == "" {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"",
+			"conversation_id must be a string",
+		).WithParam(conversationIDField))
+		return nil, nil, false
+	}
+
+	if h.conversations == nil {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"",
+			"conversations are not enabled",
+		).WithParam(conversationIDField))
+		return nil, nil, false
+	}
+
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	conversation, err := h.conversations.Get(r.Context(), owner, id)
+	if err != nil {
+		if errors.Is(err, conversations.ErrNotFound) {
+			apierror.Write(w, r, apierror.NotFound("conversation not found").WithParam(conversationIDField))
+			return nil, nil, false
+		}
+
+		h.logger.Error().Err(err).Str("conversation_id", id).Msg("error getting conversation")
+		apierror.Write(w, r, apierror.Internal("error accessing conversation"))
+		return nil, nil, false
+	}
+
+	messages, err := body.Messages()
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("messages"))
+		return nil, nil, false
+	}
+
+	// Leading system messages of the request stay first and are not stored,
+	// they are sent by the client with every request
+	instructions := 0
+	for instructions < len(messages) && isInstructionMessage(messages[instructions]) {
+		instructions++
+	}
+
+	assembled := append([]types.Message{}, messages[:instructions]...)
+	assembled = append(assembled, conversation.ChatMessages()...)
+	assembled = append(assembled, messages[instructions:]...)
+
+	delete(body, conversationIDField)
+	if err := body.SetMessages(assembled); err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, nil, false
+	}
+
+	newBody, err := body.Bytes()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, nil, false
+	}
+
+	return newBody, &conversationTurn{
+		owner:    owner,
+		id:       id,
+		messages: messages[instructions:],
+	}, true
+}
+
+// saveConversationTurn stores the request messages and the recorded reply if
+// the response completed
+func (h openaiProxyHandler) saveConversationTurn(
+	ctx context.Context,
+	turn *conversationTurn,
+	recorder *replyRecorder,
+) {
+	reply, ok := recorder.Message()
+	if !ok {
+		h.logger.Info().
+			Str("conversation_id", turn.id).
+			Msg("conversation reply did not complete, not stored")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), conversationSaveTimeout)
+	defer cancel()
+
+	messages := append(append([]types.Message{}, turn.messages...), reply)
+	if err := h.conversations.AppendMessages(
+		ctx,
+		turn.owner,
+		turn.id,
+		conversations.NewMessages(messages),
+	); err != nil {
+		h.logger.Error().Err(err).Str("conversation_id", turn.id).Msg("error storing conversation reply")
+	}
+}
+
+func isInstructionMessage(message types.Message) bool {
+	role := message.Role()
+	return role == "system" || role == "developer"
+}
+
+// replyRecorder records the response written to the client to store the
+// assistant reply
+type replyRecorder struct {
+	streaming bool
+	buf       bytes.Buffer
+	overflow  bool
+}
+
+func newReplyRecorder(res *http.Response) *replyRecorder {
+	return &replyRecorder{
+		streaming: isEventStream(res),
+	}
+}
+
+// Write implements io.Writer, it never fails so it can be used with
+// io.MultiWriter
+func (r *replyRecorder) Write(p []byte) (int, error) {
+	if r.overflow || r.buf.Len()+len(p) > maxConversationReplySize {
+		r.overflow = true
+		r.buf.Reset()
+		return len(p), nil
+	}
+
+	return r.buf.Write(p)
+}
+
+// Message returns the assistant message of the first choice, false if the
+// response is incomplete or too large
+func (r *replyRecorder) Message() (types.Message, bool) {
+	if r.overflow {
+		return nil, false
+	}
+
+	var message types.CompletionMessage
+	if r.streaming {
+		var ok bool
+		message, ok = assembleStreamMessage(&r.buf)
+		if !ok {
+			return nil, false
+		}
+	} else {
+		var completion types.ChatCompletion
+		if err := json.Unmarshal(r.buf.Bytes(), &completion); err != nil || len(completion.Choices) == 0 {
+			return nil, false
+		}
+
+		message = completion.Choices[0].Message
+	}
+
+	reply, err := newAssistantMessage(message)
+	if err != nil {
+		return nil, false
+	}
+
+	return reply, true
+}
+
+// assembleStreamMessage joins the deltas of the first choice of a stream,
+// false if the stream did not end with [DONE]
+func assembleStreamMessage(stream io.Reader) (types.CompletionMessage, bool) {
+	message := types.CompletionMessage{Role: "assistant"}
+	var content, refusal bytes.Buffer
+	hasContent := false
+
+	reader := sse.NewReader(stream)
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			return types.CompletionMessage{}, false
+		}
+
+		if event.IsDone() {
+			break
+		}
+
+		// Tool and heartbeat events are not part of the message
+		if event.Comment || event.Event != "" {
+			continue
+		}
+
+		var chunk types.ChatCompletionChunk
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			continue
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+
+			if choice.Delta.Content != nil {
+				hasContent = true
+				content.WriteString(*choice.Delta.Content)
+			}
+
+			if choice.Delta.Refusal != nil {
+				refusal.WriteString(*choice.Delta.Refusal)
+			}
+
+			for _, call := range choice.Delta.ToolCalls {
+				for len(message.ToolCalls) <= call.Index {
+					message.ToolCalls = append(message.ToolCalls, types.ToolCall{})
+				}
+
+				toolCall := &message.ToolCalls[call.Index]
+				if call.ID != "" {
+					toolCall.ID = call.ID
+				}
+				if call.Type != "" {
+					toolCall.Type = call.Type
+				}
+				if call.Function.Name != "" {
+					toolCall.Function.Name = call.Function.Name
+				}
+				toolCall.Function.Arguments += call.Function.Arguments
+			}
+		}
+	}
+
+	if hasContent {
+		text := content.String()
+		message.Content = &text
+	}
+
+	if refusal.Len() > 0 {
+		text := refusal.String()
+		message.Refusal = &text
+	}
+
+	return message, true
+}
+
+// newAssistantMessage converts an assistant completion message to a request
+// message. Reasoning content is dropped as backends do not accept it in
+// requests.
+func newAssistantMessage(message types.CompletionMessage) (types.Message, error) {
+	data, err := json.Marshal(struct {
+		Role      string           `json:"role"`
+		Content   *string          `json:"content"`
+		Refusal   *string          `json:"refusal,omitempty"`
+		ToolCalls []types.ToolCall `json:"tool_calls,omitempty"`
+	}{
+		Role:      "assistant",
+		Content:   message.Content,
+		Refusal:   message.Refusal,
+		ToolCalls: message.ToolCalls,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var m types.Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/conversations"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProxyHandler_Conversation(t *testing.T) {
+	const owner = "session:owner"
+
+	tests := []struct {
+		name        string
+		contentType string
+		response    string
+		stream      bool
+	}{
+		{
+			name:        "non-streaming",
+			contentType: "application/json",
+			response:    toolLoopAnswer,
+		},
+		{
+			name:        "streaming",
+			contentType: "text/event-stream",
+			response: strings.Join([]string{
+				`data: {"id":"c","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`data: {"id":"c","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Do"},"finish_reason":null}]}`,
+				`data: {"id":"c","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"ne"},"finish_reason":"stop"}]}`,
+				`data: [DONE]`,
+			}, "\n\n") + "\n\n",
+			stream: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamBody types.RequestBody
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				upstreamBody, _ = types.ParseRequestBody(data)
+
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			store := conversations.NewMemoryStore()
+			conversation := conversations.New(owner, "Test")
+			conversation.Messages = conversations.NewMessages([]types.Message{
+				types.NewTextMessage("user", "Hi"),
+				types.NewTextMessage("assistant", "Hello!"),
+			})
+			require.NoError(t, store.Create(context.Background(), conversation))
+
+			logger := log.Logger
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{Name: "openai", BaseURL: server.URL, APIKey: "api-key", AllowedModels: []string{"gpt-4o"}},
+				},
+				&logger,
+				"/chat/completions",
+				WithConversations(store),
+			)
+
+			body, _ := json.Marshal(map[string]any{
+				"model":           "gpt-4o",
+				"stream":          tt.stream,
+				"conversation_id": conversation.ID,
+				"messages": []types.Message{
+					types.NewTextMessage("system", "Be brief"),
+					types.NewTextMessage("user", "Finish"),
+				},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(string(body)))
+			ctx := context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o")
+			ctx = types.AddOwnerToContext(ctx, owner)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req.WithContext(ctx))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			// Stored messages are after the system message
+			require.NotContains(t, upstreamBody, conversationIDField)
+			messages, err := upstreamBody.Messages()
+			require.NoError(t, err)
+			require.Len(t, messages, 4)
+			require.Equal(t, "system", messages[0].Role())
+			require.Equal(t, "Hi", messages[1].Text())
+			require.Equal(t, "Hello!", messages[2].Text())
+			require.Equal(t, "Finish", messages[3].Text())
+
+			// The new user message and the reply are stored
+			stored, err := store.Get(context.Background(), owner, conversation.ID)
+			require.NoError(t, err)
+			require.Len(t, stored.Messages, 4)
+			require.Equal(t, "Finish", stored.Messages[2].Message.Text())
+			require.Equal(t, "assistant", stored.Messages[3].Message.Role())
+			require.Equal(t, "Done", stored.Messages[3].Message.Text())
+		})
+	}
+
+	t.Run("unknown conversation", func(t *testing.T) {
+		logger := log.Logger
+		handler := NewOpenAIProxyHandler(
+			config.OpenAIBackends{
+				{Name: "openai", BaseURL: "http://localhost:0", APIKey: "api-key", AllowedModels: []string{"gpt-4o"}},
+			},
+			&logger,
+			"/chat/completions",
+			WithConversations(conversations.NewMemoryStore()),
+		)
+
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/chat/completions",
+			strings.NewReader(`{"model": "gpt-4o", "conversation_id": "missing", "messages": []}`),
+		)
+		ctx := context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o")
+		ctx = types.AddOwnerToContext(ctx, owner)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(ctx))
+		require.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/extract"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// bytesPerToken is the estimated number of text bytes per token used for the
+// file text budget
+const bytesPerToken = 4
+
+// errFileText is a file part that cannot be expanded due to the request
+var errFileText = errors.New("invalid file")
+
+// WithFileText expands file content parts of chat completion requests into
+// text parts with the text extracted from the uploaded file, truncated to
+// maxTokens per file.
+func WithFileText(downloads *FileDownloadHandler, maxTokens int) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.fileTexts = downloads
+		h.fileTextMaxTokens = maxTokens
+	}
+}
+
+// expandFileParts returns the request body with file parts replaced by the
+// extracted file text. An error response is written if false is returned.
+func (h openaiProxyHandler) expandFileParts(
+	w http.ResponseWriter,
+	r *http.Request,
+	bodyBytes []byte,
+	proxySpan trace.Span,
+) ([]byte, bool) {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		// Invalid bodies are rejected by the backend
+		return bodyBytes, true
+	}
+
+	messages, err := body.Messages()
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("messages"))
+		return nil, false
+	}
+
+	expanded := 0
+	truncated := 0
+	for _, message := range messages {
+		parts, ok := message.ContentParts()
+		if !ok {
+			continue
+		}
+
+		changed := false
+		for i, part := range parts {
+			if part.Type() != "file" {
+				continue
+			}
+
+			fileID, filename := part.File()
+			text, cut, err := h.fileText(r.Context(), fileID)
+			if err != nil {
+				if errors.Is(err, errFileText) {
+					apierror.Write(w, r, apierror.InvalidRequest("invalid_file", err.Error()).WithParam("messages"))
+					return nil, false
+				}
+
+				h.logger.Error().Err(err).Str("file_id", fileID).Msg("error retrieving file text")
+				apierror.Write(w, r, apierror.Internal("error retrieving file"))
+				return nil, false
+			}
+
+			if filename == "" {
+				filename = fileID
+			}
+
+			content := fmt.Sprintf("Contents of file %s:\n\n%s", filename, text)
+			if cut {
+				content += "\n\n[File truncated]"
+				truncated++
+			}
+
+			parts[i] = types.NewTextContentPart(content)
+			changed = true
+			expanded++
+		}
+
+		if changed {
+			if err := message.SetContentParts(parts); err != nil {
+				apierror.Write(w, r, apierror.Internal("error building backend request"))
+				return nil, false
+			}
+		}
+	}
+
+	if expanded == 0 {
+		return bodyBytes, true
+	}
+
+	proxySpan.SetAttributes(
+		attribute.Int("expanded_files", expanded),
+		attribute.Int("truncated_files", truncated),
+	)
+
+	if err := body.SetMessages(messages); err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	newBody, err := body.Bytes()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	return newBody, true
+}
+
+// fileText returns the extracted text of the file truncated to the token
+// budget, and whether it was truncated. Errors for invalid or missing files,
+// and files of other owners in owner only mode, wrap errFileText.
+func (h openaiProxyHandler) fileText(ctx context.Context, fileID string) (string, bool, error) {
+	if fileID == "" || strings.Contains(fileID, "/") {
+		return "", false, fmt.Errorf("%w: invalid file_id", errFileText)
+	}
+
+	// File parts have no URL to sign, only the owner is checked
+	if err := h.fileTexts.access.authorizeOwner(ctx, h.fileTexts.storage, fileID); err != nil {
+		if fileAccessError(err) != nil {
+			return "", false, fmt.Errorf("%w: file %s not found or has no text", errFileText, fileID)
+		}
+
+		return "", false, err
+	}
+
+	object, err := h.fileTexts.storage.Get(ctx, storage.GetInput{Key: textKey(fileID)})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return "", false, fmt.Errorf("%w: file %s not found or has no text", errFileText, fileID)
+		}
+
+		return "", false, err
+	}
+	defer object.Body.Close()
+
+	maxBytes := h.fileTextMaxTokens * bytesPerToken
+	data, err := io.ReadAll(io.LimitReader(object.Body, int64(maxBytes)+1))
+	if err != nil {
+		return "", false, err
+	}
+
+	text, cut := extract.Truncate(string(data), maxBytes)
+	return text, cut, nil
+}
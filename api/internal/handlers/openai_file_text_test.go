@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProxyHandler_FileText(t *testing.T) {
+	texts := map[string]string{
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W1/text": "Quarterly report",
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W2/text": strings.Repeat("a", 100),
+	}
+
+	logger := zerolog.Nop()
+	downloads := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Client{
+			getObjectFn: func(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				text, ok := texts[*input.Key]
+				if !ok {
+					return nil, &s3types.NoSuchKey{}
+				}
+
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(text))}, nil
+			},
+		}, "test-bucket", 0),
+		logger: &logger,
+	}
+
+	tests := []struct {
+		name           string
+		file           string
+		expectedStatus int
+		expectedText   string
+	}{
+		{
+			name:           "file text",
+			file:           `{"file_id": "01JQ8ZP4X3K5N2M7Q9R6T8V0W1", "filename": "report.pdf"}`,
+			expectedStatus: http.StatusOK,
+			expectedText:   "Contents of file report.pdf:\n\nQuarterly report",
+		},
+		{
+			name:           "truncated to token budget",
+			file:           `{"file_id": "01JQ8ZP4X3K5N2M7Q9R6T8V0W2"}`,
+			expectedStatus: http.StatusOK,
+			expectedText:   "Contents of file 01JQ8ZP4X3K5N2M7Q9R6T8V0W2:\n\n" + strings.Repeat("a", 40) + "\n\n[File truncated]",
+		},
+		{
+			name:           "file without text",
+			file:           `{"file_id": "01JQ8ZP4X3K5N2M7Q9R6T8V0W0"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid file id",
+			file:           `{"file_id": "01JQ8ZP4X3K5N2M7Q9R6T8V0W1/thumb"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamBody types.RequestBody
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				upstreamBody, _ = types.ParseRequestBody(data)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(toolLoopAnswer))
+			}))
+			defer server.Close()
+
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{Name: "openai", BaseURL: server.URL, APIKey: "api-key", AllowedModels: []string{"gpt-4o"}},
+				},
+				&logger,
+				"/chat/completions",
+				WithFileText(downloads, 10),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{
+				"model": "gpt-4o",
+				"messages": [{"role": "user", "content": [
+					{"type": "text", "text": "Summarize this"},
+					{"type": "file", "file": `+tt.file+`}
+				]}]
+			}`))
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			require.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+
+			if tt.expectedStatus != http.StatusOK {
+				require.Nil(t, upstreamBody, "request should not be forwarded")
+				return
+			}
+
+			messages, err := upstreamBody.Messages()
+			require.NoError(t, err)
+			parts, ok := messages[0].ContentParts()
+			require.True(t, ok)
+			require.Len(t, parts, 2)
+			require.Equal(t, "Summarize this", parts[0].Text())
+			require.Equal(t, "text", parts[1].Type())
+			require.Equal(t, tt.expectedText, parts[1].Text())
+		})
+	}
+}
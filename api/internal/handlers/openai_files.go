@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InlineFilesConfig are the limits for files inlined as data URLs
+type InlineFilesConfig struct {
+	// PublicURL is the public URL of this API, file URLs are
+	// PublicURL/v1/files/{id}
+	PublicURL string
+	// MaxBytes is the max size of each inlined file
+	MaxBytes int64
+	// MaxTotalBytes is the max size of all inlined files of a request
+	MaxTotalBytes int64
+	// ContentTypes are the allowed file content types, e.g. image/png
+	ContentTypes []string
+}
+
+// fileInliner replaces image URLs of uploaded files with data URLs
+type fileInliner struct {
+	downloads *FileDownloadHandler
+	cfg       InlineFilesConfig
+}
+
+// errInlineFile is a file that cannot be inlined due to the request
+var errInlineFile = errors.New("invalid image_url")
+
+// inlineFileRef is an uploaded file referenced by an image URL
+type inlineFileRef struct {
+	fileID string
+	// key is the S3 key of the file or its variant
+	key string
+	// query has the signature of the URL
+	query url.Values
+}
+
+// WithInlineFiles replaces image_url parts of chat completion requests that
+// point to uploaded files with base64 data URLs, so backends do not need to
+// reach the file URL.
+func WithInlineFiles(downloads *FileDownloadHandler, cfg InlineFilesConfig) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.inliner = &fileInliner{
+			downloads: downloads,
+			cfg:       cfg,
+		}
+	}
+}
+
+// inlineFiles returns the request body with uploaded file URLs replaced by
+// data URLs. An error response is written if false is returned.
+func (h openaiProxyHandler) inlineFiles(
+	w http.ResponseWriter,
+	r *http.Request,
+	bodyBytes []byte,
+	proxySpan trace.Span,
+) ([]byte, bool) {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		// Invalid bodies are rejected by the backend
+		return bodyBytes, true
+	}
+
+	messages, err := body.Messages()
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("messages"))
+		return nil, false
+	}
+
+	inlined := 0
+	var totalBytes int64
+	for _, message := range messages {
+		parts, ok := message.ContentParts()
+		if !ok {
+			continue
+		}
+
+		changed := false
+		for _, part := range parts {
+			if part.Type() != "image_url" {
+				continue
+			}
+
+			ref, ok := h.inliner.fileRef(part.ImageURL())
+			if !ok {
+				continue
+			}
+
+			dataURL, size, err := h.inliner.dataURL(r.Context(), ref, h.inliner.cfg.MaxTotalBytes-totalBytes)
+			if err != nil {
+				if errors.Is(err, errInlineFile) {
+					apierror.Write(w, r, apierror.InvalidRequest("invalid_image_url", err.Error()).WithParam("messages"))
+					return nil, false
+				}
+
+				h.logger.Error().Err(err).Str("file_key", ref.key).Msg("error inlining file")
+				apierror.Write(w, r, apierror.Internal("error retrieving file"))
+				return nil, false
+			}
+
+			if err := part.SetImageURL(dataURL); err != nil {
+				apierror.Write(w, r, apierror.Internal("error building backend request"))
+				return nil, false
+			}
+
+			changed = true
+			inlined++
+			totalBytes += size
+		}
+
+		if changed {
+			if err := message.SetContentParts(parts); err != nil {
+				apierror.Write(w, r, apierror.Internal("error building backend request"))
+				return nil, false
+			}
+		}
+	}
+
+	if inlined == 0 {
+		return bodyBytes, true
+	}
+
+	proxySpan.SetAttributes(
+		attribute.Int("inlined_files", inlined),
+		attribute.Int64("inlined_bytes", totalBytes),
+	)
+
+	if err := body.SetMessages(messages); err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	newBody, err := body.Bytes()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	return newBody, true
+}
+
+// fileRef returns the file if the URL points to the files route of this API
+func (i *fileInliner) fileRef(rawURL string) (inlineFileRef, bool) {
+	prefix := strings.TrimSuffix(i.cfg.PublicURL, "/") + "/v1/files/"
+	if !strings.HasPrefix(rawURL, prefix) {
+		return inlineFileRef{}, false
+	}
+
+	fileID := strings.TrimPrefix(rawURL, prefix)
+	fileID, _, _ = strings.Cut(fileID, "#")
+	fileID, rawQuery, _ := strings.Cut(fileID, "?")
+	if fileID == "" || strings.Contains(fileID, "/") {
+		return inlineFileRef{}, false
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return inlineFileRef{}, false
+	}
+
+	key, ok := variantKey(fileID, query.Get("variant"))
+	if !ok {
+		return inlineFileRef{}, false
+	}
+
+	return inlineFileRef{fileID: fileID, key: key, query: query}, true
+}
+
+// dataURL returns the file as a base64 data URL and the file size. Errors for
+// missing, too large or disallowed files, and files the request cannot read,
+// wrap errInlineFile.
+func (i *fileInliner) dataURL(ctx context.Context, ref inlineFileRef, remainingBytes int64) (string, int64, error) {
+	maxBytes := min(i.cfg.MaxBytes, remainingBytes)
+	fileKey := ref.key
+
+	// Inlined files are checked like downloads by the client
+	if err := i.downloads.access.authorize(ctx, i.downloads.storage, ref.fileID, ref.query); err != nil {
+		if fileAccessError(err) != nil {
+			return "", 0, fmt.Errorf("%w: file %s: %w", errInlineFile, ref.fileID, err)
+		}
+
+		return "", 0, err
+	}
+
+	object, err := i.downloads.storage.Get(ctx, storage.GetInput{Key: fileKey})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return "", 0, fmt.Errorf("%w: file %s not found", errInlineFile, fileKey)
+		}
+
+		return "", 0, err
+	}
+	defer object.Body.Close()
+
+	contentType, _, _ := mime.ParseMediaType(object.ContentType)
+	if !slices.Contains(i.cfg.ContentTypes, contentType) {
+		return "", 0, fmt.Errorf("%w: file %s has unsupported content type", errInlineFile, fileKey)
+	}
+
+	if object.Length > maxBytes {
+		return "", 0, fmt.Errorf("%w: file %s is too large", errInlineFile, fileKey)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(object.Body, maxBytes+1))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if int64(len(data)) > maxBytes {
+		return "", 0, fmt.Errorf("%w: file %s is too large", errInlineFile, fileKey)
+	}
+
+	// The stored content type is from the client, check the content matches
+	if detected, _, _ := mime.ParseMediaType(http.DetectContentType(data)); detected != contentType {
+		return "", 0, fmt.Errorf("%w: file %s content does not match its content type", errInlineFile, fileKey)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	return "data:" + contentType + ";base64," + encoded, int64(len(data)), nil
+}
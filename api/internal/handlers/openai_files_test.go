@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProxyHandler_InlineFiles(t *testing.T) {
+	pngData := []byte("\x89PNG\r\n\x1a\nimage data")
+
+	objects := map[string]struct {
+		contentType string
+		data        []byte
+	}{
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W1": {contentType: "image/png", data: pngData},
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W2": {contentType: "application/pdf", data: []byte("%PDF-1.4")},
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W3": {contentType: "image/png", data: []byte("<html>not an image</html>")},
+		"01JQ8ZP4X3K5N2M7Q9R6T8V0W4": {contentType: "image/png", data: append(pngData, bytes.Repeat([]byte("a"), 100)...)},
+	}
+
+	logger := zerolog.Nop()
+	downloads := &FileDownloadHandler{
+		storage: storage.NewS3(&mockS3Client{
+			getObjectFn: func(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				object, ok := objects[*input.Key]
+				if !ok {
+					return nil, &s3types.NoSuchKey{}
+				}
+
+				return &s3.GetObjectOutput{
+					Body:          io.NopCloser(bytes.NewReader(object.data)),
+					ContentType:   aws.String(object.contentType),
+					ContentLength: aws.Int64(int64(len(object.data))),
+				}, nil
+			},
+		}, "test-bucket", 0),
+		logger: &logger,
+	}
+
+	tests := []struct {
+		name           string
+		imageURL       string
+		expectedStatus int
+		expectedURL    string
+	}{
+		{
+			name:           "own file",
+			imageURL:       "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W1",
+			expectedStatus: http.StatusOK,
+			expectedURL:    "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData),
+		},
+		{
+			name:           "external url",
+			imageURL:       "https://example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W1",
+			expectedStatus: http.StatusOK,
+			expectedURL:    "https://example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W1",
+		},
+		{
+			name:           "missing file",
+			imageURL:       "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W0",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "disallowed content type",
+			imageURL:       "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W2",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "content does not match content type",
+			imageURL:       "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W3",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "too large",
+			imageURL:       "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W4",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamBody types.RequestBody
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				upstreamBody, _ = types.ParseRequestBody(data)
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(toolLoopAnswer))
+			}))
+			defer server.Close()
+
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{Name: "openai", BaseURL: server.URL, APIKey: "api-key", AllowedModels: []string{"gpt-4o"}},
+				},
+				&logger,
+				"/chat/completions",
+				WithInlineFiles(downloads, InlineFilesConfig{
+					PublicURL:     "https://api.example.com",
+					MaxBytes:      64,
+					MaxTotalBytes: 128,
+					ContentTypes:  []string{"image/png", "image/jpeg"},
+				}),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{
+				"model": "gpt-4o",
+				"messages": [{"role": "user", "content": [
+					{"type": "text", "text": "What is this?"},
+					{"type": "image_url", "image_url": {"url": "`+tt.imageURL+`", "detail": "low"}}
+				]}]
+			}`))
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			require.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+
+			if tt.expectedStatus != http.StatusOK {
+				require.Nil(t, upstreamBody, "request should not be forwarded")
+				return
+			}
+
+			messages, err := upstreamBody.Messages()
+			require.NoError(t, err)
+			parts, ok := messages[0].ContentParts()
+			require.True(t, ok)
+			require.Len(t, parts, 2)
+			require.Equal(t, "What is this?", parts[0].Text())
+			require.Equal(t, tt.expectedURL, parts[1].ImageURL())
+			require.JSONEq(t, `{"url": "`+tt.expectedURL+`", "detail": "low"}`, string(parts[1]["image_url"]))
+		})
+	}
+
+	t.Run("storage error", func(t *testing.T) {
+		failing := &FileDownloadHandler{
+			storage: storage.NewS3(&mockS3Client{
+				getObjectFn: func(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					return nil, errors.New("connection refused")
+				},
+			}, "test-bucket", 0),
+			logger: &logger,
+		}
+
+		handler := NewOpenAIProxyHandler(
+			config.OpenAIBackends{
+				{Name: "openai", BaseURL: "http://localhost:0", APIKey: "api-key", AllowedModels: []string{"gpt-4o"}},
+			},
+			&logger,
+			"/chat/completions",
+			WithInlineFiles(failing, InlineFilesConfig{
+				PublicURL:     "https://api.example.com",
+				MaxBytes:      64,
+				MaxTotalBytes: 128,
+				ContentTypes:  []string{"image/png"},
+			}),
+		)
+
+		req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{
+			"model": "gpt-4o",
+			"messages": [{"role": "user", "content": [
+				{"type": "image_url", "image_url": {"url": "https://api.example.com/v1/files/01JQ8ZP4X3K5N2M7Q9R6T8V0W1"}}
+			]}]
+		}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+	})
+}
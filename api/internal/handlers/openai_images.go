@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxGeneratedImageSize is the max size of a generated image to store
+	maxGeneratedImageSize = 20 * 1024 * 1024 // 20MB
+	// maxImagesResponseSize is the max size of an images response to rewrite,
+	// b64_json responses contain the encoded images
+	maxImagesResponseSize = 128 * 1024 * 1024 // 128MB
+	// imageDownloadTimeout is the timeout to download each provider image URL
+	imageDownloadTimeout = 30 * time.Second
+)
+
+// WithGeneratedImageStorage stores generated images with the file upload
+// handler and replaces the short-lived provider URLs in image generation
+// responses with file URLs.
+func WithGeneratedImageStorage(uploads *FileUploadHandler) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.imageUploads = uploads
+		h.imageClient = &http.Client{Timeout: imageDownloadTimeout}
+	}
+}
+
+// isImageGenerations returns true if the handler proxies image generations
+func (h openaiProxyHandler) isImageGenerations() bool {
+	return strings.HasSuffix(h.endpoint, "/images/generations")
+}
+
+// shouldStoreImages returns true if generated images of the response should be
+// stored
+func (h openaiProxyHandler) shouldStoreImages(res *http.Response) bool {
+	return h.imageUploads != nil &&
+		h.isImageGenerations() &&
+		res.StatusCode == http.StatusOK &&
+		strings.HasPrefix(res.Header.Get("Content-Type"), "application/json")
+}
+
+// storeGeneratedImages stores each image of the response body and replaces
+// the url fields with file URLs. b64_json images are kept and a url is added.
+// The original body is returned if any image could not be stored, so the
+// client still gets the provider URLs.
+func (h openaiProxyHandler) storeGeneratedImages(
+	ctx context.Context,
+	body []byte,
+	proxySpan trace.Span,
+) []byte {
+	rewritten, stored, err := h.rewriteImagesResponse(ctx, body)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("error storing generated images, returning provider URLs")
+
+		proxySpan.SetAttributes(attribute.String("stored_images_error", err.Error()))
+		return body
+	}
+
+	proxySpan.SetAttributes(attribute.Int("stored_images", stored))
+	return rewritten
+}
+
+// rewriteImagesResponse returns the images response with the url of each
+// stored image and the number of images stored. Unknown fields are kept.
+func (h openaiProxyHandler) rewriteImagesResponse(
+	ctx context.Context,
+	body []byte,
+) ([]byte, int, error) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, 0, fmt.Errorf("invalid images response: %w", err)
+	}
+
+	var data []map[string]json.RawMessage
+	if err := json.Unmarshal(response["data"], &data); err != nil {
+		return nil, 0, fmt.Errorf("invalid images response data: %w", err)
+	}
+
+	for i, image := range data {
+		file, err := h.storeGeneratedImage(ctx, image)
+		if err != nil {
+			return nil, 0, fmt.Errorf("image %d: %w", i, err)
+		}
+
+		image["url"], _ = json.Marshal(file.URL)
+		image["expire_at"], _ = json.Marshal(file.ExpireAt)
+	}
+
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	response["data"] = dataBytes
+
+	rewritten, err := json.Marshal(response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rewritten, len(data), nil
+}
+
+// storeGeneratedImage downloads or decodes a single image of the response and
+// stores it
+func (h openaiProxyHandler) storeGeneratedImage(
+	ctx context.Context,
+	image map[string]json.RawMessage,
+) (FileUploadResponse, error) {
+	var b64JSON, url string
+	if raw, ok := image["b64_json"]; ok {
+		if err := json.Unmarshal(raw, &b64JSON); err != nil {
+			return FileUploadResponse{}, fmt.Errorf("invalid b64_json: %w", err)
+		}
+	}
+	if raw, ok := image["url"]; ok {
+		if err := json.Unmarshal(raw, &url); err != nil {
+			return FileUploadResponse{}, fmt.Errorf("invalid url: %w", err)
+		}
+	}
+
+	var data []byte
+	var contentType string
+	switch {
+	case b64JSON != "":
+		var err error
+		data, err = base64.StdEncoding.DecodeString(b64JSON)
+		if err != nil {
+			return FileUploadResponse{}, fmt.Errorf("invalid b64_json: %w", err)
+		}
+
+		if len(data) > maxGeneratedImageSize {
+			return FileUploadResponse{}, errors.New("image too large")
+		}
+	case url != "":
+		var err error
+		data, contentType, err = h.downloadImage(ctx, url)
+		if err != nil {
+			return FileUploadResponse{}, err
+		}
+	default:
+		return FileUploadResponse{}, errors.New("no url or b64_json")
+	}
+
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+
+	if !strings.HasPrefix(contentType, "image/") {
+		return FileUploadResponse{}, fmt.Errorf("unexpected content type %s", contentType)
+	}
+
+	fileKey := ulid.Make().String()
+	expireAt := retentionExpireAt(h.imageUploads.retention.GeneratedImages)
+	file, err := h.imageUploads.storeFile(
+		ctx,
+		fileKey,
+		bytes.NewReader(data),
+		int64(len(data)),
+		contentHash(data),
+		contentType,
+		"generated-image",
+		nil,
+		expireAt,
+	)
+	if err != nil {
+		return FileUploadResponse{}, err
+	}
+
+	if err := h.imageUploads.indexFile(ctx, fileKey, expireAt); err != nil {
+		return FileUploadResponse{}, err
+	}
+
+	return file, nil
+}
+
+// downloadImage returns the image at the provider URL and its content type
+func (h openaiProxyHandler) downloadImage(ctx context.Context, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid url: %w", err)
+	}
+
+	res, err := h.imageClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading image: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error downloading image: status %d", res.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxGeneratedImageSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("error downloading image: %w", err)
+	}
+
+	if len(data) > maxGeneratedImageSize {
+		return nil, "", errors.New("image too large")
+	}
+
+	return data, res.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/storage"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIProxyHandler_GeneratedImageStorage(t *testing.T) {
+	pngData := []byte("\x89PNG\r\n\x1a\nimage data")
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.png" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngData)
+	}))
+	defer provider.Close()
+
+	tests := []struct {
+		name         string
+		data         string
+		expectStored bool
+	}{
+		{
+			name:         "provider url",
+			data:         `[{"url": "` + provider.URL + `/image.png", "revised_prompt": "A cat"}]`,
+			expectStored: true,
+		},
+		{
+			name:         "b64_json",
+			data:         `[{"b64_json": "` + base64.StdEncoding.EncodeToString(pngData) + `"}]`,
+			expectStored: true,
+		},
+		{
+			name:         "expired provider url",
+			data:         `[{"url": "` + provider.URL + `/expired.png"}]`,
+			expectStored: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamResponse := `{"created": 1, "data": ` + tt.data + `}`
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(upstreamResponse))
+			}))
+			defer server.Close()
+
+			var stored []*s3.PutObjectInput
+			var storedData [][]byte
+			logger := zerolog.Nop()
+			uploads := &FileUploadHandler{
+				storage: storage.NewS3(&mockS3Client{
+					putObjectFn: func(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+						data, _ := io.ReadAll(input.Body)
+						stored = append(stored, input)
+						storedData = append(storedData, data)
+
+						expiration := `expiry-date="Fri, 23 Dec 2022 00:00:00 GMT", rule-id="test-rule"`
+						return &s3.PutObjectOutput{Expiration: &expiration}, nil
+					},
+					getObjectFn: func(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+						return nil, errors.New("not implemented")
+					},
+				}, "test-bucket", 0),
+				publicURL: "http://example.com",
+				logger:    &logger,
+			}
+
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{Name: "openai", BaseURL: server.URL, APIKey: "api-key", AllowedModels: []string{"dall-e-3"}},
+				},
+				&logger,
+				"/images/generations",
+				WithGeneratedImageStorage(uploads),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/images/generations", strings.NewReader(`{"model": "dall-e-3", "prompt": "A cat"}`))
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "dall-e-3"))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			if !tt.expectStored {
+				// Provider URLs are returned unchanged
+				require.JSONEq(t, upstreamResponse, rr.Body.String())
+				return
+			}
+
+			require.Len(t, stored, 1)
+			require.Equal(t, "test-bucket", *stored[0].Bucket)
+			require.Equal(t, "image/png", *stored[0].ContentType)
+			require.Equal(t, pngData, storedData[0])
+
+			var response struct {
+				Created int64 `json:"created"`
+				Data    []struct {
+					URL           string    `json:"url"`
+					B64JSON       string    `json:"b64_json"`
+					RevisedPrompt string    `json:"revised_prompt"`
+					ExpireAt      time.Time `json:"expire_at"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+			require.Equal(t, int64(1), response.Created)
+			require.Len(t, response.Data, 1)
+			require.Equal(t, "http://example.com/v1/files/"+*stored[0].Key, response.Data[0].URL)
+			require.Equal(t, time.Date(2022, time.December, 23, 0, 0, 0, 0, time.UTC), response.Data[0].ExpireAt)
+
+			if tt.name == "provider url" {
+				require.Equal(t, "A cat", response.Data[0].RevisedPrompt)
+			} else {
+				require.NotEmpty(t, response.Data[0].B64JSON)
+			}
+		})
+	}
+}
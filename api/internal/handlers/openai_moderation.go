@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// moderationInput returns the text to moderate for the given endpoint: the
+// latest user message for chat completions or the prompt for image
+// generations. An empty string is returned if there is nothing to moderate.
+func moderationInput(endpoint string, bodyBytes []byte) string {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case strings.HasSuffix(endpoint, "/chat/completions"):
+		messages, err := body.Messages()
+		if err != nil {
+			return ""
+		}
+
+		message, ok := types.LastUserMessage(messages)
+		if !ok {
+			return ""
+		}
+
+		return message.Text()
+	case strings.HasSuffix(endpoint, "/images/generations"):
+		return body.GetString("prompt")
+	default:
+		return ""
+	}
+}
+
+// moderateRequest checks the request with the moderation backend and writes an
+// error response if the request is flagged, or if the moderation backend is
+// unavailable and the moderator fails closed. Returns true if the request
+// should be forwarded.
+func (h openaiProxyHandler) moderateRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+	proxySpan trace.Span,
+	bodyBytes []byte,
+) bool {
+	input := moderationInput(h.endpoint, bodyBytes)
+	if input == "" {
+		return true
+	}
+
+	start := time.Now()
+	verdict, err := h.moderator.Moderate(r.Context(), input)
+	proxySpan.SetAttributes(
+		attribute.Int64("moderation_ms", time.Since(start).Milliseconds()),
+	)
+
+	if err != nil {
+		proxySpan.RecordError(err)
+
+		if h.moderator.FailOpen() {
+			h.logger.Warn().Err(err).Msg("moderation unavailable, allowing request (fail open)")
+			proxySpan.SetAttributes(attribute.String("moderation_result", "unavailable"))
+
+			return true
+		}
+
+		h.logger.Error().Err(err).Msg("moderation unavailable, rejecting request (fail closed)")
+		proxySpan.SetAttributes(attribute.String("moderation_result", "unavailable"))
+		proxySpan.SetStatus(codes.Error, "moderation unavailable")
+
+		apierror.Write(w, r, apierror.Unavailable(
+			"moderation_unavailable",
+			"content moderation is temporarily unavailable, please try again later",
+		))
+
+		return false
+	}
+
+	if !verdict.Flagged {
+		proxySpan.SetAttributes(attribute.String("moderation_result", "allowed"))
+		return true
+	}
+
+	h.logger.Info().
+		Strs("categories", verdict.Categories).
+		Msg("request flagged by moderation")
+
+	proxySpan.SetAttributes(
+		attribute.String("moderation_result", "flagged"),
+		attribute.StringSlice("moderation_categories", verdict.Categories),
+	)
+
+	apierror.Write(w, r, apierror.InvalidRequest(
+		"content_policy_violation",
+		"Your request was rejected as a result of our safety system.",
+	))
+
+	return false
+}
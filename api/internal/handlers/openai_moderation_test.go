@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/moderation"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModerationInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		body     string
+		want     string
+	}{
+		{
+			name:     "chat latest user message",
+			endpoint: "/chat/completions",
+			body: `{"model": "gpt-4o", "messages": [
+				{"role": "user", "content": "first"},
+				{"role": "assistant", "content": "reply"},
+				{"role": "user", "content": "second"}
+			]}`,
+			want: "second",
+		},
+		{
+			name:     "chat content parts",
+			endpoint: "/chat/completions",
+			body: `{"model": "gpt-4o", "messages": [
+				{"role": "user", "content": [
+					{"type": "text", "text": "describe"},
+					{"type": "image_url", "image_url": {"url": "https://example.com/a.png"}},
+					{"type": "text", "text": "this image"}
+				]}
+			]}`,
+			want: "describe\nthis image",
+		},
+		{
+			name:     "chat without user message",
+			endpoint: "/chat/completions",
+			body:     `{"model": "gpt-4o", "messages": [{"role": "system", "content": "hi"}]}`,
+			want:     "",
+		},
+		{
+			name:     "image prompt",
+			endpoint: "/images/generations",
+			body:     `{"model": "dall-e-3", "prompt": "a cat"}`,
+			want:     "a cat",
+		},
+		{
+			name:     "invalid json",
+			endpoint: "/chat/completions",
+			body:     `{`,
+			want:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, moderationInput(tt.endpoint, []byte(tt.body)))
+		})
+	}
+}
+
+func TestOpenAIProxyHandler_Moderation(t *testing.T) {
+	logger := log.Logger
+
+	tests := []struct {
+		name                string
+		moderationStatus    int
+		moderationBody      string
+		failOpen            bool
+		expectedCode        int
+		expectedErrorCode   string
+		expectedBackendHits int32
+	}{
+		{
+			name:                "allowed",
+			moderationStatus:    http.StatusOK,
+			moderationBody:      `{"results": [{"flagged": false, "categories": {"violence": false}}]}`,
+			expectedCode:        http.StatusOK,
+			expectedBackendHits: 1,
+		},
+		{
+			name:                "flagged",
+			moderationStatus:    http.StatusOK,
+			moderationBody:      `{"results": [{"flagged": true, "categories": {"violence": true}}]}`,
+			expectedCode:        http.StatusBadRequest,
+			expectedErrorCode:   "content_policy_violation",
+			expectedBackendHits: 0,
+		},
+		{
+			name:                "unavailable fail closed",
+			moderationStatus:    http.StatusInternalServerError,
+			moderationBody:      `{}`,
+			expectedCode:        http.StatusServiceUnavailable,
+			expectedBackendHits: 0,
+		},
+		{
+			name:                "unavailable fail open",
+			moderationStatus:    http.StatusInternalServerError,
+			moderationBody:      `{}`,
+			failOpen:            true,
+			expectedCode:        http.StatusOK,
+			expectedBackendHits: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moderationServer := createMockServer(tt.moderationBody, tt.moderationStatus)
+			defer moderationServer.Close()
+
+			var backendHits atomic.Int32
+			backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				backendHits.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"result": "success"}`))
+			}))
+			defer backendServer.Close()
+
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{
+						Name:          "backend",
+						BaseURL:       backendServer.URL,
+						APIKey:        "api-key",
+						AllowedModels: []string{"gpt-4o"},
+					},
+				},
+				&logger,
+				"/chat/completions",
+				WithModeration(moderation.NewClient(moderation.Config{
+					BaseURL:  moderationServer.URL,
+					Model:    "omni-moderation-latest",
+					FailOpen: tt.failOpen,
+				})),
+			)
+
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"/chat/completions",
+				bytes.NewBufferString(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hello"}]}`),
+			)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedCode, rr.Code)
+			assert.Equal(t, tt.expectedBackendHits, backendHits.Load())
+
+			if tt.expectedErrorCode != "" {
+				var errRes types.ErrorResponse
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &errRes))
+				require.NotNil(t, errRes.ErrorBody.Code)
+				assert.Equal(t, tt.expectedErrorCode, *errRes.ErrorBody.Code)
+			}
+		})
+	}
+}
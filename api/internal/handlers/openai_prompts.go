@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/prompts"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// validLocale is a BCP 47 language tag, e.g. en or pt-BR
+var validLocale = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// WithSystemPrompts adds the system prompt template of the requested model to
+// chat completion requests, applying the template policy to client system
+// messages. The locale is from the Accept-Language header, or defaultLocale.
+func WithSystemPrompts(p *prompts.Prompts, defaultLocale string) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.systemPrompts = p
+		h.defaultLocale = defaultLocale
+	}
+}
+
+// applySystemPrompt returns the request body with the system prompt for the
+// model. An error response is written if false is returned.
+func (h openaiProxyHandler) applySystemPrompt(
+	w http.ResponseWriter,
+	r *http.Request,
+	bodyBytes []byte,
+	model string,
+	proxySpan trace.Span,
+) ([]byte, bool) {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		// Invalid bodies are rejected by the backend
+		return bodyBytes, true
+	}
+
+	messages, err := body.Messages()
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("messages"))
+		return nil, false
+	}
+
+	messages, policy, err := h.systemPrompts.Apply(messages, prompts.Vars{
+		Date:   time.Now().UTC().Format(time.DateOnly),
+		Locale: requestLocale(r, h.defaultLocale),
+		Model:  model,
+	})
+	if err != nil {
+		h.logger.Error().Err(err).Str("model", model).Msg("error applying system prompt")
+		apierror.Write(w, r, apierror.Internal("error applying system prompt"))
+		return nil, false
+	}
+
+	if policy == "" {
+		return bodyBytes, true
+	}
+
+	proxySpan.SetAttributes(attribute.String("system_prompt_policy", string(policy)))
+
+	if err := body.SetMessages(messages); err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	newBody, err := body.Bytes()
+	if err != nil {
+		apierror.Write(w, r, apierror.Internal("error building backend request"))
+		return nil, false
+	}
+
+	return newBody, true
+}
+
+// requestLocale returns the first language of the Accept-Language header, or
+// the default if there is none
+func requestLocale(r *http.Request, defaultLocale string) string {
+	first, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	locale, _, _ := strings.Cut(strings.TrimSpace(first), ";")
+
+	// Also rejects the * wildcard
+	if !validLocale.MatchString(locale) {
+		return defaultLocale
+	}
+
+	return locale
+}
@@ -5,12 +5,19 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/guardrails"
+	"github.com/kava-labs/kavachat/api/internal/hedging"
 	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/types"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createMockServer(responseBody string, statusCode int) *httptest.Server {
@@ -74,7 +81,7 @@ func TestOpenAIProxyHandler_MultipleBackends(t *testing.T) {
 		{
 			"Invalid Model gpt-5",
 			"gpt-5",
-			``,
+			`{"error": {"message": "no backend available for the model", "type": "server_error", "param": null, "code": null}}`,
 			http.StatusInternalServerError,
 		},
 	}
@@ -135,3 +142,260 @@ func TestOpenAIProxyHandler_BackendError(t *testing.T) {
 	assert.Equal(t, backendResponseCode, rr.Code, "response code should match upstream backend")
 	assert.JSONEq(t, backendResponseBody, rr.Body.String(), "response body should match upstream backend")
 }
+
+func TestOpenAIProxyHandler_Guardrails(t *testing.T) {
+	logger := log.Logger
+
+	chunk := func(content string) string {
+		return `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"` + content + `"},"finish_reason":null}]}` + "\n\n"
+	}
+
+	streamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(chunk("Hello") + chunk(" there, how are you?") + chunk(" forbidden") + chunk(" world") + "data: [DONE]\n\n"))
+	}))
+	defer streamServer.Close()
+
+	rules, err := guardrails.NewRules([]string{"forbidden"}, nil, 0)
+	require.NoError(t, err)
+
+	handler := NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:          "backend",
+				BaseURL:       streamServer.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+		WithGuardrails(rules),
+	)
+
+	req := httptest.NewRequest("POST", "/chat/completions", bytes.NewBufferString(`{"model":"gpt-4o","stream":true}`))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), chunk("Hello"))
+	assert.NotContains(t, rr.Body.String(), "how are you", "held back until the blocked term can be completed")
+	assert.NotContains(t, rr.Body.String(), "forbidden")
+	assert.NotContains(t, rr.Body.String(), "world")
+	assert.Contains(t, rr.Body.String(), `"finish_reason":"content_filter"`)
+	assert.True(t, strings.HasSuffix(rr.Body.String(), "data: [DONE]\n\n"))
+}
+
+func TestOpenAIProxyHandler_Hedging(t *testing.T) {
+	logger := log.Logger
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": "primary"}`))
+	}))
+	defer primary.Close()
+
+	secondary := createMockServer(`{"result": "secondary"}`, http.StatusOK)
+	defer secondary.Close()
+
+	hedger := hedging.New(hedging.Config{
+		Percentile:   95,
+		InitialDelay: 20 * time.Millisecond,
+		MaxDelay:     time.Second,
+		WindowSize:   10,
+		MinSamples:   1,
+	})
+
+	handler := NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:          "primary",
+				BaseURL:       primary.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o"},
+				HedgedModels:  []string{"gpt-4o"},
+				HedgeBackend:  "secondary",
+			},
+			{
+				Name:          "secondary",
+				BaseURL:       secondary.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o-mini"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+		WithHedging(hedger),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Less(t, time.Since(start), time.Second, "should not wait for the slow primary")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"result": "secondary"}`, rr.Body.String())
+	assert.GreaterOrEqual(t, hedger.Delay(hedgeKey("primary", "gpt-4o")), 20*time.Millisecond, "hedge wins are censored primary samples")
+}
+
+func TestOpenAIProxyHandler_HedgingSlowPrimaries(t *testing.T) {
+	logger := log.Logger
+
+	var slow atomic.Bool
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": "primary"}`))
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": "secondary"}`))
+	}))
+	defer secondary.Close()
+
+	hedger := hedging.New(hedging.Config{
+		Percentile:   95,
+		InitialDelay: time.Second,
+		MinDelay:     10 * time.Millisecond,
+		MaxDelay:     time.Second,
+		WindowSize:   10,
+		MinSamples:   5,
+	})
+
+	handler := NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:          "primary",
+				BaseURL:       primary.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o"},
+				HedgedModels:  []string{"gpt-4o"},
+				HedgeBackend:  "secondary",
+			},
+			{
+				Name:          "secondary",
+				BaseURL:       secondary.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o-mini"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+		WithHedging(hedger),
+	)
+
+	send := func() string {
+		req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		return rr.Body.String()
+	}
+
+	key := hedgeKey("primary", "gpt-4o")
+
+	// Fast primaries bring the delay down to the min delay
+	for range 5 {
+		assert.JSONEq(t, `{"result": "primary"}`, send())
+	}
+	require.Less(t, hedger.Delay(key), 20*time.Millisecond)
+
+	// Sustained slow primaries are hedged, the censored samples raise the
+	// delay above the time the hedge took to win instead of keeping it at
+	// the fast samples
+	slow.Store(true)
+	for range 5 {
+		assert.JSONEq(t, `{"result": "secondary"}`, send())
+	}
+	assert.GreaterOrEqual(t, hedger.Delay(key), 20*time.Millisecond)
+}
+
+func TestOpenAIProxyHandler_ErrorEnvelope(t *testing.T) {
+	logger := log.Logger
+
+	htmlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html><body>503 Service Unavailable</body></html>"))
+	}))
+	defer htmlServer.Close()
+
+	// Closed server for connection errors
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+
+	tests := []struct {
+		name         string
+		baseURL      string
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			name:         "non-JSON upstream error is wrapped",
+			baseURL:      htmlServer.URL,
+			expectedCode: http.StatusServiceUnavailable,
+			expectedBody: `{"error": {"message": "Service Unavailable", "type": "server_error", "param": null, "code": "upstream_error", "request_id": "req-1"}}`,
+		},
+		{
+			name:         "connection error is a bad gateway",
+			baseURL:      closedServer.URL,
+			expectedCode: http.StatusBadGateway,
+			expectedBody: `{"error": {"message": "error communicating with the backend", "type": "server_error", "param": null, "code": "upstream_error", "request_id": "req-1"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewOpenAIProxyHandler(
+				config.OpenAIBackends{
+					{
+						Name:          "backend",
+						BaseURL:       tt.baseURL,
+						APIKey:        "api-key",
+						AllowedModels: []string{"gpt-4o"},
+					},
+				},
+				&logger,
+				"/chat/completions",
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+			ctx := context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o")
+			ctx = types.AddRequestIDToContext(ctx, "req-1")
+			req = req.WithContext(ctx)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedCode, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			assert.JSONEq(t, tt.expectedBody, rr.Body.String())
+		})
+	}
+}
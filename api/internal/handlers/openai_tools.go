@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/guardrails"
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/tools"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serverToolsField is the request body field that enables server-side tool
+// execution, it is removed before the request is forwarded
+const serverToolsField = "server_tools"
+
+// Named SSE events for tool calls executed by the server, sent to streaming
+// clients before the final answer
+const (
+	toolCallEvent   = "tool_call"
+	toolResultEvent = "tool_result"
+)
+
+// toolEvent is the data of a tool_call or tool_result event
+type toolEvent struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"`
+	// Result fields
+	Content    string `json:"content,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+}
+
+// WithServerTools executes the tool calls of chat completion requests with
+// server_tools set, re-invoking the backend with the results until the model
+// gives a final answer.
+func WithServerTools(executor *tools.Executor) OpenAIProxyOption {
+	return func(h *openaiProxyHandler) {
+		h.tools = executor
+	}
+}
+
+// isServerToolsRequest returns true if the request body enables server tools
+func isServerToolsRequest(bodyBytes []byte) bool {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		return false
+	}
+
+	return body.GetBool(serverToolsField)
+}
+
+// serveServerTools runs the tool loop for a chat completion request. Each
+// round is a non-streaming backend request, streaming clients receive tool
+// events as the tools run and the final answer as a stream.
+func (h openaiProxyHandler) serveServerTools(
+	w http.ResponseWriter,
+	r *http.Request,
+	tracer trace.Tracer,
+	backend *config.OpenAIBackend,
+	model string,
+	bodyBytes []byte,
+	turn *conversationTurn,
+	proxySpan trace.Span,
+) {
+	ctx := r.Context()
+
+	if h.tools == nil || len(h.tools.Definitions(model)) == 0 {
+		apierror.Write(w, r, apierror.InvalidRequest(
+			"",
+			"server tools are not available for this model",
+		).WithParam(serverToolsField))
+		return
+	}
+
+	invalidBody := apierror.InvalidRequest("", "We could not parse the JSON body of your request.")
+
+	streaming := isStreamingRequest(bodyBytes)
+	includeUsage := false
+	if streaming {
+		var err error
+		bodyBytes, includeUsage, err = nonStreamingRequestBody(bodyBytes)
+		if err != nil {
+			apierror.Write(w, r, invalidBody)
+			return
+		}
+	}
+
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		apierror.Write(w, r, invalidBody)
+		return
+	}
+	delete(body, serverToolsField)
+
+	if err := addToolDefinitions(body, h.tools.Definitions(model)); err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("tools"))
+		return
+	}
+
+	messages, err := body.Messages()
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidRequest("", err.Error()).WithParam("messages"))
+		return
+	}
+
+	proxySpan.SetAttributes(attribute.Bool("server_tools", true))
+
+	responseWriter := NewTimeToFirstByteResponseWriter(ctx, w, tracer, model, backend.Name)
+	defer responseWriter.End()
+
+	requestID := types.RequestIDFromContext(ctx)
+
+	// Tool events commit a 200 event stream response, later errors are sent
+	// as an error event
+	eventsStarted := false
+	startEvents := func() {
+		if eventsStarted {
+			return
+		}
+		eventsStarted = true
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	writeError := func(e *apierror.Error) {
+		if eventsStarted {
+			data, _ := json.Marshal(e.Response(requestID))
+			writeErrorEvent(responseWriter, data)
+			return
+		}
+
+		apierror.Write(w, r, e)
+	}
+
+	toolRounds := 0
+	defer func() {
+		proxySpan.SetAttributes(attribute.Int("tool_rounds", toolRounds))
+	}()
+
+	for {
+		if toolRounds == h.tools.MaxIterations() {
+			// Out of tool rounds, the model must answer with the results
+			// so far
+			if err := body.Set("tool_choice", "none"); err != nil {
+				writeError(apierror.Internal("error building backend request"))
+				return
+			}
+		}
+
+		if err := body.SetMessages(messages); err != nil {
+			writeError(apierror.Internal("error building backend request"))
+			return
+		}
+
+		requestBytes, err := body.Bytes()
+		if err != nil {
+			writeError(apierror.Internal("error building backend request"))
+			return
+		}
+
+		res, err := backend.GetClient().DoRequest(ctx, r.Method, h.endpoint, bytes.NewReader(requestBytes))
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				h.logger.Info().Msgf(
+					"request to backend %s was cancelled (might be client disconnection)",
+					backend.Name,
+				)
+				return
+			}
+
+			h.logger.Error().Msgf(
+				"error forwarding tool request to backend %s: %s",
+				backend.Name, err.Error(),
+			)
+
+			proxySpan.SetStatus(codes.Error, "request forwarding error")
+			proxySpan.RecordError(err)
+
+			writeError(apierror.Upstream(err))
+			return
+		}
+
+		if res.StatusCode != http.StatusOK {
+			errorBody, err := apierror.ReadUpstreamBody(res, requestID)
+			if err != nil {
+				writeError(apierror.Upstream(err))
+				return
+			}
+
+			if eventsStarted {
+				writeErrorEvent(responseWriter, errorBody)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(res.StatusCode)
+			responseWriter.Write(errorBody)
+			return
+		}
+
+		completionBytes, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			writeError(apierror.Upstream(err))
+			return
+		}
+
+		var completion types.ChatCompletion
+		if err := json.Unmarshal(completionBytes, &completion); err != nil {
+			h.logger.Error().Err(err).Str("backend", backend.Name).Msg("error decoding chat completion for tool loop")
+
+			writeError(apierror.New(
+				http.StatusBadGateway,
+				apierror.TypeServer,
+				apierror.CodeUpstreamError,
+				"invalid response from backend",
+			))
+			return
+		}
+
+		calls, ok := h.serverToolCalls(completion, model)
+		if !ok || toolRounds == h.tools.MaxIterations() {
+			recorder := &replyRecorder{streaming: streaming}
+			out := io.MultiWriter(responseWriter, recorder)
+
+			if streaming {
+				startEvents()
+				err = h.writeToolLoopStream(out, completion, includeUsage)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.WriteHeader(http.StatusOK)
+				_, err = out.Write(completionBytes)
+			}
+
+			if err == nil && turn != nil {
+				h.saveConversationTurn(ctx, turn, recorder)
+			}
+			return
+		}
+
+		toolRounds++
+
+		assistantMessage, err := newAssistantMessage(completion.Choices[0].Message)
+		if err != nil {
+			writeError(apierror.Internal("error building backend request"))
+			return
+		}
+		messages = append(messages, assistantMessage)
+
+		for _, call := range calls {
+			if streaming {
+				startEvents()
+				writeToolEvent(responseWriter, toolCallEvent, toolEvent{
+					ID:        call.ID,
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				})
+			}
+
+			result := h.tools.Execute(ctx, model, tools.Call{
+				ID:        call.ID,
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			})
+
+			if result.Err != nil {
+				h.logger.Info().
+					Err(result.Err).
+					Str("tool", call.Function.Name).
+					Msg("tool execution failed")
+			}
+
+			if streaming {
+				durationMs := result.Duration.Milliseconds()
+				event := toolEvent{
+					ID:         call.ID,
+					Name:       call.Function.Name,
+					Content:    result.Content,
+					DurationMs: &durationMs,
+				}
+				if result.Err != nil {
+					event.Error = result.Err.Error()
+				}
+
+				writeToolEvent(responseWriter, toolResultEvent, event)
+			}
+
+			messages = append(messages, types.NewToolMessage(call.ID, result.ModelContent()))
+		}
+	}
+}
+
+// serverToolCalls returns the tool calls of the completion if every call is a
+// server tool the model may use. If the model answered or called a client
+// tool, false is returned and the completion is given to the client.
+func (h openaiProxyHandler) serverToolCalls(
+	completion types.ChatCompletion,
+	model string,
+) ([]types.ToolCall, bool) {
+	// Only a single choice can be continued
+	if len(completion.Choices) != 1 {
+		return nil, false
+	}
+
+	calls := completion.Choices[0].Message.ToolCalls
+	if len(calls) == 0 {
+		return nil, false
+	}
+
+	for _, call := range calls {
+		if !h.tools.Allowed(model, call.Function.Name) {
+			return nil, false
+		}
+	}
+
+	return calls, true
+}
+
+// writeToolLoopStream writes the final completion of the tool loop as a
+// stream, inspected by the guardrails if enabled
+func (h openaiProxyHandler) writeToolLoopStream(
+	w io.Writer,
+	completion types.ChatCompletion,
+	includeUsage bool,
+) error {
+	var stream bytes.Buffer
+	if err := writeSimulatedStream(&stream, completion, includeUsage); err != nil {
+		h.logger.Error().Err(err).Msg("error writing tool loop stream")
+		return err
+	}
+
+	var err error
+	if h.guardrails != nil {
+		var result guardrails.Result
+		result, err = h.guardrails.Inspect(w, &stream)
+		if result.Violation != nil {
+			h.logger.Info().
+				Str("rule", result.Violation.Rule).
+				Msg("response stream terminated by guardrail")
+		}
+	} else {
+		_, err = io.Copy(w, &stream)
+	}
+
+	if err != nil {
+		h.logger.Info().Err(err).Msg("error writing tool loop stream to client")
+	}
+
+	return err
+}
+
+// addToolDefinitions adds the server tool definitions to the tools of the
+// request. Client tools with the same name as a server tool are rejected.
+func addToolDefinitions(body types.RequestBody, definitions []tools.Definition) error {
+	var requestTools []json.RawMessage
+	if raw, ok := body["tools"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &requestTools); err != nil {
+			return errors.New("tools must be an array")
+		}
+	}
+
+	serverNames := make(map[string]struct{}, len(definitions))
+	for _, definition := range definitions {
+		serverNames[definition.Function.Name] = struct{}{}
+	}
+
+	for _, raw := range requestTools {
+		var tool tools.Definition
+		if err := json.Unmarshal(raw, &tool); err != nil {
+			continue
+		}
+
+		if _, exists := serverNames[tool.Function.Name]; exists {
+			return fmt.Errorf("tool %s conflicts with a server tool", tool.Function.Name)
+		}
+	}
+
+	for _, definition := range definitions {
+		raw, err := json.Marshal(definition)
+		if err != nil {
+			return err
+		}
+
+		requestTools = append(requestTools, raw)
+	}
+
+	return body.Set("tools", requestTools)
+}
+
+// writeToolEvent writes a named tool event
+func writeToolEvent(w io.Writer, event string, data toolEvent) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	sse.WriteEvent(w, event, encoded)
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/tools"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/require"
+)
+
+// echoTool returns its arguments
+type echoTool struct{}
+
+func (echoTool) Name() string                { return "echo" }
+func (echoTool) Description() string         { return "Echo the arguments" }
+func (echoTool) Parameters() json.RawMessage { return json.RawMessage(`{"type":"object"}`) }
+func (echoTool) Execute(_ context.Context, arguments json.RawMessage) (string, error) {
+	return "echo: " + string(arguments), nil
+}
+
+func toolCallCompletion(id, name, arguments string) string {
+	return fmt.Sprintf(`{
+		"id": "chatcmpl-1",
+		"object": "chat.completion",
+		"created": 1700000000,
+		"model": "gpt-4o",
+		"choices": [{
+			"index": 0,
+			"message": {
+				"role": "assistant",
+				"content": null,
+				"tool_calls": [{"id": %q, "type": "function", "function": {"name": %q, "arguments": %q}}]
+			},
+			"finish_reason": "tool_calls"
+		}]
+	}`, id, name, arguments)
+}
+
+const toolLoopAnswer = `{
+	"id": "chatcmpl-2",
+	"object": "chat.completion",
+	"created": 1700000000,
+	"model": "gpt-4o",
+	"choices": [{
+		"index": 0,
+		"message": {"role": "assistant", "content": "Done"},
+		"finish_reason": "stop"
+	}]
+}`
+
+// toolLoopBackend responds with the given responses in order and records the
+// request bodies
+type toolLoopBackend struct {
+	mu        sync.Mutex
+	responses []string
+	requests  []types.RequestBody
+}
+
+func (b *toolLoopBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, _ := io.ReadAll(r.Body)
+	body, _ := types.ParseRequestBody(data)
+	b.requests = append(b.requests, body)
+
+	response := b.responses[min(len(b.requests), len(b.responses))-1]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(response))
+}
+
+func newToolLoopHandler(t *testing.T, serverURL string, maxIterations int) http.Handler {
+	t.Helper()
+
+	registry, err := tools.NewRegistry(echoTool{})
+	require.NoError(t, err)
+
+	executor, err := tools.NewExecutor(registry, tools.ExecutorConfig{
+		ModelTools:    map[string][]string{"gpt-4o": {"echo"}},
+		Timeout:       time.Second,
+		MaxIterations: maxIterations,
+	})
+	require.NoError(t, err)
+
+	logger := log.Logger
+
+	return NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:          "openai",
+				BaseURL:       serverURL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o", "gpt-4o-mini"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+		WithServerTools(executor),
+	)
+}
+
+func toolLoopRequest(model, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/chat/completions", strings.NewReader(body))
+	return req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, model))
+}
+
+func TestOpenAIProxyHandler_ServerTools(t *testing.T) {
+	t.Run("executes tool calls until final answer", func(t *testing.T) {
+		backend := &toolLoopBackend{
+			responses: []string{toolCallCompletion("call_1", "echo", `{"a":1}`), toolLoopAnswer},
+		}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 3).ServeHTTP(rr, toolLoopRequest("gpt-4o", `{
+			"model": "gpt-4o",
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "echo this"}]
+		}`))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.JSONEq(t, toolLoopAnswer, rr.Body.String())
+		require.Len(t, backend.requests, 2)
+
+		first := backend.requests[0]
+		require.NotContains(t, first, serverToolsField, "server_tools should not be forwarded")
+		require.JSONEq(t, `[{
+			"type": "function",
+			"function": {"name": "echo", "description": "Echo the arguments", "parameters": {"type": "object"}}
+		}]`, string(first["tools"]))
+
+		messages, err := backend.requests[1].Messages()
+		require.NoError(t, err)
+		require.Len(t, messages, 3)
+		require.Equal(t, "assistant", messages[1].Role())
+		require.JSONEq(t, `{"role": "tool", "tool_call_id": "call_1", "content": "echo: {\"a\":1}"}`, mustJSON(t, messages[2]))
+	})
+
+	t.Run("streams tool events and final answer", func(t *testing.T) {
+		backend := &toolLoopBackend{
+			responses: []string{toolCallCompletion("call_1", "echo", `{}`), toolLoopAnswer},
+		}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 3).ServeHTTP(rr, toolLoopRequest("gpt-4o", `{
+			"model": "gpt-4o",
+			"stream": true,
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "echo this"}]
+		}`))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+		require.Equal(t, "false", string(backend.requests[0]["stream"]))
+
+		stream := rr.Body.String()
+		require.True(t, strings.HasSuffix(stream, "data: [DONE]\n\n"))
+
+		reader := sse.NewReader(strings.NewReader(stream))
+
+		event, err := reader.Next()
+		require.NoError(t, err)
+		require.Equal(t, toolCallEvent, event.Event)
+		require.JSONEq(t, `{"id": "call_1", "name": "echo", "arguments": "{}"}`, event.Data)
+
+		event, err = reader.Next()
+		require.NoError(t, err)
+		require.Equal(t, toolResultEvent, event.Event)
+
+		var result toolEvent
+		require.NoError(t, json.Unmarshal([]byte(event.Data), &result))
+		require.Equal(t, "echo: {}", result.Content)
+		require.NotNil(t, result.DurationMs)
+
+		// The final answer follows as a regular stream
+		event, err = reader.Next()
+		require.NoError(t, err)
+		require.Empty(t, event.Event)
+
+		var chunk types.ChatCompletionChunk
+		require.NoError(t, json.Unmarshal([]byte(event.Data), &chunk))
+		require.Equal(t, "chatcmpl-2", chunk.ID)
+	})
+
+	t.Run("client tool calls are returned to the client", func(t *testing.T) {
+		clientCall := toolCallCompletion("call_1", "get_weather", `{}`)
+		backend := &toolLoopBackend{responses: []string{clientCall}}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 3).ServeHTTP(rr, toolLoopRequest("gpt-4o", `{
+			"model": "gpt-4o",
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "weather?"}],
+			"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}]
+		}`))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.JSONEq(t, clientCall, rr.Body.String())
+		require.Len(t, backend.requests, 1)
+
+		var requestTools []tools.Definition
+		require.NoError(t, json.Unmarshal(backend.requests[0]["tools"], &requestTools))
+		require.Len(t, requestTools, 2, "client and server tools should be advertised")
+	})
+
+	t.Run("max iterations forces a final answer", func(t *testing.T) {
+		backend := &toolLoopBackend{
+			responses: []string{toolCallCompletion("call_1", "echo", `{}`)},
+		}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 2).ServeHTTP(rr, toolLoopRequest("gpt-4o", `{
+			"model": "gpt-4o",
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "loop"}]
+		}`))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Len(t, backend.requests, 3)
+		require.NotContains(t, backend.requests[1], "tool_choice")
+		require.Equal(t, `"none"`, string(backend.requests[2]["tool_choice"]))
+	})
+
+	t.Run("model without server tools", func(t *testing.T) {
+		backend := &toolLoopBackend{responses: []string{toolLoopAnswer}}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 3).ServeHTTP(rr, toolLoopRequest("gpt-4o-mini", `{
+			"model": "gpt-4o-mini",
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "hi"}]
+		}`))
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Contains(t, rr.Body.String(), `"param":"server_tools"`)
+		require.Empty(t, backend.requests)
+	})
+
+	t.Run("client tool conflicts with server tool", func(t *testing.T) {
+		backend := &toolLoopBackend{responses: []string{toolLoopAnswer}}
+		server := httptest.NewServer(backend)
+		defer server.Close()
+
+		rr := httptest.NewRecorder()
+		newToolLoopHandler(t, server.URL, 3).ServeHTTP(rr, toolLoopRequest("gpt-4o", `{
+			"model": "gpt-4o",
+			"server_tools": true,
+			"messages": [{"role": "user", "content": "hi"}],
+			"tools": [{"type": "function", "function": {"name": "echo", "parameters": {}}}]
+		}`))
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Contains(t, rr.Body.String(), "tool echo conflicts with a server tool")
+	})
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return string(data)
+}
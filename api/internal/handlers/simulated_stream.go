@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// simulatedChunkSize is the number of runes of content in each simulated
+// stream chunk
+const simulatedChunkSize = 32
+
+// nonStreamingRequestBody converts a streaming chat completion request body to
+// a non-streaming one for backends that do not support streaming. Returns the
+// new body and whether the client requested usage in the stream.
+func nonStreamingRequestBody(bodyBytes []byte) ([]byte, bool, error) {
+	body, err := types.ParseRequestBody(bodyBytes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var streamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+	if raw, ok := body["stream_options"]; ok {
+		// Ignore invalid stream options, the backend would reject them anyways
+		_ = json.Unmarshal(raw, &streamOptions)
+	}
+
+	// stream_options is only allowed when streaming
+	delete(body, "stream_options")
+	if err := body.Set("stream", false); err != nil {
+		return nil, false, err
+	}
+
+	newBody, err := body.Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return newBody, streamOptions.IncludeUsage, nil
+}
+
+// simulateStreamResponse replaces the body of a successful non-streaming chat
+// completion response with an equivalent SSE stream, so clients that requested
+// streaming can use the same code path for every backend. Error responses are
+// left unchanged.
+func simulateStreamResponse(res *http.Response, includeUsage bool) error {
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var completion types.ChatCompletion
+	if err := json.NewDecoder(res.Body).Decode(&completion); err != nil {
+		return fmt.Errorf("failed to decode chat completion for simulated stream: %w", err)
+	}
+	res.Body.Close()
+
+	var stream bytes.Buffer
+	if err := writeSimulatedStream(&stream, completion, includeUsage); err != nil {
+		return err
+	}
+
+	res.Body = io.NopCloser(&stream)
+	res.ContentLength = int64(stream.Len())
+	res.Header.Set("Content-Type", "text/event-stream")
+	res.Header.Del("Content-Length")
+
+	return nil
+}
+
+// writeSimulatedStream writes the chat completion as stream chunks in the same
+// order as a streaming backend: a role chunk, content chunks, tool call chunks
+// and a finish reason chunk for each choice, followed by a usage chunk if
+// requested and [DONE].
+func writeSimulatedStream(w io.Writer, completion types.ChatCompletion, includeUsage bool) error {
+	writeChunk := func(choices []types.ChunkChoice, usage json.RawMessage) error {
+		data, err := json.Marshal(types.ChatCompletionChunk{
+			ID:                completion.ID,
+			Object:            "chat.completion.chunk",
+			Created:           completion.Created,
+			Model:             completion.Model,
+			SystemFingerprint: completion.SystemFingerprint,
+			Choices:           choices,
+			Usage:             usage,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode simulated chunk: %w", err)
+		}
+
+		_, err = sse.WriteData(w, data)
+		return err
+	}
+
+	writeDelta := func(index int, delta types.ChunkDelta) error {
+		return writeChunk([]types.ChunkChoice{{Index: index, Delta: delta}}, nil)
+	}
+
+	for _, choice := range completion.Choices {
+		message := choice.Message
+		empty := ""
+
+		role := message.Role
+		if role == "" {
+			role = "assistant"
+		}
+
+		if err := writeDelta(choice.Index, types.ChunkDelta{Role: role, Content: &empty}); err != nil {
+			return err
+		}
+
+		if message.ReasoningContent != nil {
+			for _, part := range splitRunes(*message.ReasoningContent, simulatedChunkSize) {
+				if err := writeDelta(choice.Index, types.ChunkDelta{ReasoningContent: &part}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if message.Content != nil {
+			for _, part := range splitRunes(*message.Content, simulatedChunkSize) {
+				if err := writeDelta(choice.Index, types.ChunkDelta{Content: &part}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if message.Refusal != nil {
+			if err := writeDelta(choice.Index, types.ChunkDelta{Refusal: message.Refusal}); err != nil {
+				return err
+			}
+		}
+
+		for i, toolCall := range message.ToolCalls {
+			// First chunk has the ID and name, then the arguments
+			header := types.ChunkToolCall{
+				Index: i,
+				ID:    toolCall.ID,
+				Type:  toolCall.Type,
+				Function: types.ToolCallFunction{
+					Name: toolCall.Function.Name,
+				},
+			}
+			if err := writeDelta(choice.Index, types.ChunkDelta{ToolCalls: []types.ChunkToolCall{header}}); err != nil {
+				return err
+			}
+
+			arguments := types.ChunkToolCall{
+				Index: i,
+				Function: types.ToolCallFunction{
+					Arguments: toolCall.Function.Arguments,
+				},
+			}
+			if err := writeDelta(choice.Index, types.ChunkDelta{ToolCalls: []types.ChunkToolCall{arguments}}); err != nil {
+				return err
+			}
+		}
+
+		finishReason := choice.FinishReason
+		if err := writeChunk([]types.ChunkChoice{{
+			Index:        choice.Index,
+			FinishReason: &finishReason,
+		}}, nil); err != nil {
+			return err
+		}
+	}
+
+	if includeUsage && len(completion.Usage) > 0 {
+		if err := writeChunk([]types.ChunkChoice{}, completion.Usage); err != nil {
+			return err
+		}
+	}
+
+	_, err := sse.WriteDone(w)
+	return err
+}
+
+// splitRunes splits s into parts of at most size runes
+func splitRunes(s string, size int) []string {
+	runes := []rune(s)
+
+	var parts []string
+	for len(runes) > 0 {
+		n := min(size, len(runes))
+		parts = append(parts, string(runes[:n]))
+		runes = runes[n:]
+	}
+
+	return parts
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const simulatedCompletionResponse = `{
+	"id": "chatcmpl-1",
+	"object": "chat.completion",
+	"created": 1700000000,
+	"model": "qwen2.5-vl-7b-instruct",
+	"choices": [{
+		"index": 0,
+		"message": {
+			"role": "assistant",
+			"content": "The weather in Paris is sunny and warm today, around 25 degrees.",
+			"tool_calls": [{
+				"id": "call_1",
+				"type": "function",
+				"function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}
+			}]
+		},
+		"finish_reason": "tool_calls"
+	}],
+	"usage": {"prompt_tokens": 10, "completion_tokens": 20, "total_tokens": 30}
+}`
+
+// readChunks reads all chunks from a stream, failing if it does not end with
+// [DONE]
+func readChunks(t *testing.T, stream io.Reader) []types.ChatCompletionChunk {
+	t.Helper()
+
+	reader := sse.NewReader(stream)
+
+	var chunks []types.ChatCompletionChunk
+	for {
+		event, err := reader.Next()
+		require.NoError(t, err, "stream should end with [DONE]")
+
+		if event.IsDone() {
+			_, err := reader.Next()
+			require.ErrorIs(t, err, io.EOF)
+
+			return chunks
+		}
+
+		var chunk types.ChatCompletionChunk
+		require.NoError(t, json.Unmarshal([]byte(event.Data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestNonStreamingRequestBody(t *testing.T) {
+	body, includeUsage, err := nonStreamingRequestBody(
+		[]byte(`{"model":"m","stream":true,"stream_options":{"include_usage":true},"temperature":0.5}`),
+	)
+	require.NoError(t, err)
+	require.True(t, includeUsage)
+	require.JSONEq(t, `{"model":"m","stream":false,"temperature":0.5}`, string(body))
+}
+
+func TestWriteSimulatedStream(t *testing.T) {
+	var completion types.ChatCompletion
+	require.NoError(t, json.Unmarshal([]byte(simulatedCompletionResponse), &completion))
+
+	var stream bytes.Buffer
+	require.NoError(t, writeSimulatedStream(&stream, completion, true))
+
+	chunks := readChunks(t, &stream)
+
+	// role, 2 content, 2 tool call, finish, usage
+	require.Len(t, chunks, 7)
+
+	for _, chunk := range chunks {
+		require.Equal(t, "chatcmpl-1", chunk.ID)
+		require.Equal(t, "chat.completion.chunk", chunk.Object)
+		require.Equal(t, "qwen2.5-vl-7b-instruct", chunk.Model)
+	}
+
+	require.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+
+	content := *chunks[1].Choices[0].Delta.Content + *chunks[2].Choices[0].Delta.Content
+	require.Equal(t, "The weather in Paris is sunny and warm today, around 25 degrees.", content)
+
+	require.Equal(t, "call_1", chunks[3].Choices[0].Delta.ToolCalls[0].ID)
+	require.Equal(t, "get_weather", chunks[3].Choices[0].Delta.ToolCalls[0].Function.Name)
+	require.Equal(t, `{"city":"Paris"}`, chunks[4].Choices[0].Delta.ToolCalls[0].Function.Arguments)
+
+	require.Equal(t, "tool_calls", *chunks[5].Choices[0].FinishReason)
+
+	require.Empty(t, chunks[6].Choices)
+	require.JSONEq(t, `{"prompt_tokens": 10, "completion_tokens": 20, "total_tokens": 30}`, string(chunks[6].Usage))
+}
+
+func TestOpenAIProxyHandler_SimulatedStreaming(t *testing.T) {
+	logger := log.Logger
+
+	var upstreamBody map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&upstreamBody))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(simulatedCompletionResponse))
+	}))
+	defer server.Close()
+
+	handler := NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:                     "self-hosted",
+				BaseURL:                  server.URL,
+				APIKey:                   "api-key",
+				AllowedModels:            []string{"qwen2.5-vl-7b-instruct"},
+				SimulatedStreamingModels: []string{"qwen2.5-vl-7b-instruct"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+	)
+
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/chat/completions",
+		strings.NewReader(`{"model":"qwen2.5-vl-7b-instruct","stream":true}`),
+	)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "qwen2.5-vl-7b-instruct"))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+	assert.Equal(t, false, upstreamBody["stream"], "upstream request should not stream")
+
+	// No usage chunk without stream_options.include_usage
+	chunks := readChunks(t, rr.Body)
+	require.Len(t, chunks, 6)
+}
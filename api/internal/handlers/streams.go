@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/streams"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+)
+
+// StreamIDHeader is the response header with the ID of a resumable stream
+const StreamIDHeader = "X-Stream-ID"
+
+// writeStreamEvents writes the events of the stream after lastID to w, tagged
+// with id fields, and continues with live events until the stream finishes or
+// the context is cancelled.
+func writeStreamEvents(
+	ctx context.Context,
+	w io.Writer,
+	stream *streams.Stream,
+	lastID int,
+) error {
+	for {
+		events, done, updated, err := stream.EventsAfter(lastID)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			// Single write per event so heartbeats are not inserted within
+			tagged := append([]byte(fmt.Sprintf("id: %d\n", event.ID)), event.Raw...)
+			if _, err := w.Write(tagged); err != nil {
+				return err
+			}
+
+			lastID = event.ID
+		}
+
+		if len(events) > 0 {
+			continue
+		}
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// StreamResumeHandler is a HTTP handler that lets clients reconnect to a
+// resumable stream and receive the events after Last-Event-ID.
+type StreamResumeHandler struct {
+	registry *streams.Registry
+	logger   *zerolog.Logger
+}
+
+// NewStreamResumeHandler creates a new StreamResumeHandler
+func NewStreamResumeHandler(
+	registry *streams.Registry,
+	baseLogger *zerolog.Logger,
+) *StreamResumeHandler {
+	logger := baseLogger.With().
+		Str("handler", "StreamResumeHandler").
+		Logger()
+
+	return &StreamResumeHandler{
+		registry: registry,
+		logger:   &logger,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface for the StreamResumeHandler.
+func (h *StreamResumeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, r, apierror.MethodNotAllowed())
+		return
+	}
+
+	streamID := r.PathValue("stream_id")
+
+	// EventSource sends Last-Event-ID on reconnect, query param for clients
+	// that cannot set headers
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	lastID := 0
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.Atoi(lastEventID)
+		if err != nil || lastID < 0 {
+			apierror.Write(w, r, apierror.InvalidRequest("", "invalid Last-Event-ID"))
+			return
+		}
+	}
+
+	// Streams of other owners are not found
+	stream, ok := h.registry.Get(streamID)
+	if !ok || (stream.Owner != "" && stream.Owner != types.OwnerFromContext(r.Context())) {
+		apierror.Write(w, r, apierror.NotFound("stream not found or expired"))
+		return
+	}
+
+	// Check before committing to a stream response
+	if _, _, _, err := stream.EventsAfter(lastID); err != nil {
+		apierror.Write(w, r, apierror.New(
+			http.StatusGone,
+			apierror.TypeInvalidRequest,
+			"events_unavailable",
+			"requested events are no longer available",
+		))
+		return
+	}
+
+	h.logger.Debug().
+		Str("stream_id", streamID).
+		Int("last_event_id", lastID).
+		Msg("resuming stream")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	err := writeStreamEvents(r.Context(), &flushWriter{w}, stream, lastID)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		h.logger.Info().Err(err).Str("stream_id", streamID).Msg("resumed stream ended early")
+	}
+}
+
+// flushWriter flushes after each write to prevent buffering of SSE events
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/config"
+	"github.com/kava-labs/kavachat/api/internal/middleware"
+	"github.com/kava-labs/kavachat/api/internal/streams"
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const resumableStreamBody = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+	"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\" world\"}}]}\n\n" +
+	"data: [DONE]\n\n"
+
+func TestOpenAIProxyHandler_ResumableStream(t *testing.T) {
+	logger := log.Logger
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(resumableStreamBody))
+	}))
+	defer server.Close()
+
+	registry := streams.NewRegistry(streams.RegistryConfig{
+		TTL:         time.Minute,
+		MaxDuration: time.Minute,
+	})
+
+	handler := NewOpenAIProxyHandler(
+		config.OpenAIBackends{
+			{
+				Name:          "openai",
+				BaseURL:       server.URL,
+				APIKey:        "api-key",
+				AllowedModels: []string{"gpt-4o"},
+			},
+		},
+		&logger,
+		"/chat/completions",
+		WithResumableStreams(registry),
+	)
+
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","stream":true}`),
+	)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o"))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	streamID := rr.Header().Get(StreamIDHeader)
+	require.NotEmpty(t, streamID)
+	assert.Contains(t, rr.Header().Get("Access-Control-Expose-Headers"), StreamIDHeader)
+
+	body := rr.Body.String()
+	assert.True(t, strings.HasPrefix(body, "id: 1\ndata: "), "events should be tagged with IDs")
+	assert.Contains(t, body, "id: 3\ndata: [DONE]\n\n")
+
+	resumeHandler := NewStreamResumeHandler(registry, &logger)
+
+	t.Run("resume after last event ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/streams/"+streamID, nil)
+		req.SetPathValue("stream_id", streamID)
+		req.Header.Set("Last-Event-ID", "2")
+
+		rr := httptest.NewRecorder()
+		resumeHandler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+		assert.Equal(t, "id: 3\ndata: [DONE]\n\n", rr.Body.String())
+	})
+
+	t.Run("resume with query parameter", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/streams/"+streamID+"?last_event_id=0", nil)
+		req.SetPathValue("stream_id", streamID)
+
+		rr := httptest.NewRecorder()
+		resumeHandler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, body, rr.Body.String(), "full replay should match original stream")
+	})
+
+	t.Run("invalid last event ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/streams/"+streamID, nil)
+		req.SetPathValue("stream_id", streamID)
+		req.Header.Set("Last-Event-ID", "abc")
+
+		rr := httptest.NewRecorder()
+		resumeHandler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("unknown stream", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/streams/unknown", nil)
+		req.SetPathValue("stream_id", "unknown")
+
+		rr := httptest.NewRecorder()
+		resumeHandler.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("other owner", func(t *testing.T) {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/chat/completions",
+			strings.NewReader(`{"model":"gpt-4o","stream":true}`),
+		)
+		ctx := context.WithValue(req.Context(), middleware.CTX_REQ_MODEL_KEY, "gpt-4o")
+		req = req.WithContext(types.AddOwnerToContext(ctx, "user:alice"))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		ownedID := rr.Header().Get(StreamIDHeader)
+		require.NotEmpty(t, ownedID)
+
+		resume := func(owner string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/v1/streams/"+ownedID+"?last_event_id=0", nil)
+			req.SetPathValue("stream_id", ownedID)
+			if owner != "" {
+				req = req.WithContext(types.AddOwnerToContext(req.Context(), owner))
+			}
+
+			rr := httptest.NewRecorder()
+			resumeHandler.ServeHTTP(rr, req)
+
+			return rr
+		}
+
+		assert.Equal(t, http.StatusNotFound, resume("user:bob").Code)
+		assert.Equal(t, http.StatusNotFound, resume("").Code)
+		assert.Equal(t, http.StatusOK, resume("user:alice").Code)
+	})
+}
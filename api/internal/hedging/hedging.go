@@ -0,0 +1,279 @@
+package hedging
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Config is the configuration for a Hedger
+type Config struct {
+	// Percentile of recent time to first byte samples used as the hedge
+	// delay, e.g. 95
+	Percentile float64
+	// InitialDelay is used until there are MinSamples samples
+	InitialDelay time.Duration
+	// MinDelay and MaxDelay bound the percentile delay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MinSamples is the number of samples required before the percentile is
+	// used
+	MinSamples int
+	// WindowSize is the number of most recent samples kept per key
+	WindowSize int
+}
+
+// Hedger tracks time to first byte per key and races requests against a
+// secondary when the primary is slower than the hedge delay
+type Hedger struct {
+	config Config
+
+	mu      sync.Mutex
+	samples map[string]*window
+}
+
+// New creates a new Hedger
+func New(config Config) *Hedger {
+	return &Hedger{
+		config:  config,
+		samples: make(map[string]*window),
+	}
+}
+
+// Observe records a time to first byte sample for the key
+func (h *Hedger) Observe(key string, ttfb time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w, ok := h.samples[key]
+	if !ok {
+		w = &window{values: make([]time.Duration, 0, h.config.WindowSize)}
+		h.samples[key] = w
+	}
+
+	w.add(ttfb, h.config.WindowSize)
+}
+
+// Delay returns the hedge delay for the key, the configured percentile of the
+// recent samples bounded by the min and max delay
+func (h *Hedger) Delay(key string) time.Duration {
+	h.mu.Lock()
+	w, ok := h.samples[key]
+
+	var sorted []time.Duration
+	if ok && len(w.values) >= h.config.MinSamples && len(w.values) > 0 {
+		sorted = slices.Clone(w.values)
+	}
+	h.mu.Unlock()
+
+	if sorted == nil {
+		return h.config.InitialDelay
+	}
+
+	slices.Sort(sorted)
+
+	// Nearest rank percentile
+	rank := int(math.Ceil(h.config.Percentile / 100 * float64(len(sorted))))
+	rank = min(max(rank, 1), len(sorted))
+
+	return min(max(sorted[rank-1], h.config.MinDelay), h.config.MaxDelay)
+}
+
+// window is a ring buffer of the most recent samples
+type window struct {
+	values []time.Duration
+	next   int
+}
+
+func (w *window) add(value time.Duration, size int) {
+	if len(w.values) < size {
+		w.values = append(w.values, value)
+		return
+	}
+
+	w.values[w.next] = value
+	w.next = (w.next + 1) % size
+}
+
+// Attempt performs a request with the given context
+type Attempt func(ctx context.Context) (*http.Response, error)
+
+// Result is the outcome of Do
+type Result struct {
+	// Response is the response of the winning attempt
+	Response *http.Response
+	// Secondary is true if the secondary attempt won
+	Secondary bool
+	// Hedged is true if the secondary attempt was started
+	Hedged bool
+	// Elapsed is the time from the start of the primary attempt until the
+	// winning attempt produced its first byte. If the secondary won, the
+	// primary time to first byte is at least Elapsed.
+	Elapsed time.Duration
+}
+
+type outcome struct {
+	secondary bool
+	res       *http.Response
+	err       error
+	cancel    context.CancelFunc
+}
+
+// ok returns true if the attempt produced a successful response
+func (o outcome) ok() bool {
+	return o.err == nil && o.res.StatusCode == http.StatusOK
+}
+
+// discard closes the response of an attempt that was not used
+func (o outcome) discard() {
+	if o.res != nil {
+		o.res.Body.Close()
+	}
+
+	o.cancel()
+}
+
+// Do performs the primary attempt and, if it has not produced the first byte
+// of a successful response after delay, also the secondary attempt. The first
+// attempt with a successful response body wins and the other is cancelled.
+// Failed attempts only win if the other attempt also fails, the primary
+// failure is preferred. A primary failure before the delay is returned without
+// hedging.
+//
+// The context of the winning attempt is cancelled when its response body is
+// closed.
+func Do(ctx context.Context, delay time.Duration, primary, secondary Attempt) (Result, error) {
+	outcomes := make(chan outcome, 2)
+
+	start := func(attempt Attempt, isSecondary bool) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+
+		go func() {
+			res, err := attempt(attemptCtx)
+			if err == nil {
+				res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+
+				if res.StatusCode == http.StatusOK {
+					// Wait for the first byte of the body, headers alone may
+					// arrive long before the first token
+					err = peekBody(res)
+					if err != nil {
+						res.Body.Close()
+						res = nil
+					}
+				}
+			}
+
+			outcomes <- outcome{secondary: isSecondary, res: res, err: err, cancel: cancel}
+		}()
+	}
+
+	begin := time.Now()
+	start(primary, false)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	hedged := false
+	var failures []outcome
+
+	for {
+		select {
+		case <-timer.C:
+			hedged = true
+			pending++
+			start(secondary, true)
+			continue
+		case o := <-outcomes:
+			pending--
+
+			if o.ok() {
+				// Clean up the losing attempt in the background
+				go drain(outcomes, pending, failures)
+
+				return Result{
+					Response:  o.res,
+					Secondary: o.secondary,
+					Hedged:    hedged,
+					Elapsed:   time.Since(begin),
+				}, nil
+			}
+
+			failures = append(failures, o)
+			if pending > 0 {
+				continue
+			}
+
+			// Also when the primary failed before the hedge delay, failures
+			// are not retried on the secondary
+			return failed(failures, hedged)
+		}
+	}
+}
+
+// failed returns the preferred failure and discards the others
+func failed(failures []outcome, hedged bool) (Result, error) {
+	chosen := 0
+	for i, o := range failures {
+		if !o.secondary {
+			chosen = i
+		}
+	}
+
+	for i, o := range failures {
+		if i != chosen {
+			o.discard()
+		}
+	}
+
+	o := failures[chosen]
+	return Result{Response: o.res, Secondary: o.secondary, Hedged: hedged}, o.err
+}
+
+// drain discards the failures and the pending attempts
+func drain(outcomes <-chan outcome, pending int, failures []outcome) {
+	for _, o := range failures {
+		o.discard()
+	}
+
+	for range pending {
+		o := <-outcomes
+		o.discard()
+	}
+}
+
+// peekBody reads the first byte of the response body without consuming it.
+// An empty body is not an error.
+func peekBody(res *http.Response) error {
+	reader := bufio.NewReader(res.Body)
+	if _, err := reader.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	res.Body = &struct {
+		io.Reader
+		io.Closer
+	}{reader, res.Body}
+
+	return nil
+}
+
+// cancelOnClose cancels the attempt context when the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+
+	return err
+}
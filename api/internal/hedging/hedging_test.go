@@ -0,0 +1,154 @@
+package hedging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedger_Delay(t *testing.T) {
+	hedger := New(Config{
+		Percentile:   90,
+		InitialDelay: time.Second,
+		MinDelay:     5 * time.Millisecond,
+		MaxDelay:     80 * time.Millisecond,
+		MinSamples:   5,
+		WindowSize:   10,
+	})
+
+	require.Equal(t, time.Second, hedger.Delay("a"), "initial delay without samples")
+
+	for i := 1; i <= 10; i++ {
+		hedger.Observe("a", time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, 9*time.Millisecond, hedger.Delay("a"))
+	require.Equal(t, time.Second, hedger.Delay("b"), "keys are tracked separately")
+
+	// Window only keeps the latest samples
+	for range 10 {
+		hedger.Observe("a", time.Second)
+	}
+	require.Equal(t, 80*time.Millisecond, hedger.Delay("a"), "bounded by max delay")
+
+	for range 10 {
+		hedger.Observe("a", time.Millisecond)
+	}
+	require.Equal(t, 5*time.Millisecond, hedger.Delay("a"), "bounded by min delay")
+}
+
+// respond returns an attempt that responds after the delay with the body
+func respond(delay time.Duration, status int, body string) Attempt {
+	return func(ctx context.Context) (*http.Response, error) {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("primary before delay", func(t *testing.T) {
+		secondaryCalled := false
+		secondary := func(ctx context.Context) (*http.Response, error) {
+			secondaryCalled = true
+			return nil, errors.New("unexpected")
+		}
+
+		result, err := Do(ctx, 50*time.Millisecond, respond(0, http.StatusOK, "primary"), secondary)
+		require.NoError(t, err)
+		require.False(t, result.Hedged)
+		require.False(t, result.Secondary)
+		require.Equal(t, "primary", readBody(t, result.Response))
+		require.False(t, secondaryCalled)
+	})
+
+	t.Run("secondary wins", func(t *testing.T) {
+		result, err := Do(
+			ctx,
+			10*time.Millisecond,
+			respond(time.Second, http.StatusOK, "primary"),
+			respond(0, http.StatusOK, "secondary"),
+		)
+		require.NoError(t, err)
+		require.True(t, result.Hedged)
+		require.True(t, result.Secondary)
+		require.GreaterOrEqual(t, result.Elapsed, 10*time.Millisecond)
+		require.Less(t, result.Elapsed, time.Second)
+		require.Equal(t, "secondary", readBody(t, result.Response))
+	})
+
+	t.Run("primary wins after hedge", func(t *testing.T) {
+		result, err := Do(
+			ctx,
+			10*time.Millisecond,
+			respond(20*time.Millisecond, http.StatusOK, "primary"),
+			respond(time.Second, http.StatusOK, "secondary"),
+		)
+		require.NoError(t, err)
+		require.True(t, result.Hedged)
+		require.False(t, result.Secondary)
+		require.Equal(t, "primary", readBody(t, result.Response))
+	})
+
+	t.Run("failed secondary does not win", func(t *testing.T) {
+		result, err := Do(
+			ctx,
+			10*time.Millisecond,
+			respond(50*time.Millisecond, http.StatusOK, "primary"),
+			respond(0, http.StatusInternalServerError, "error"),
+		)
+		require.NoError(t, err)
+		require.True(t, result.Hedged)
+		require.False(t, result.Secondary)
+		require.Equal(t, "primary", readBody(t, result.Response))
+	})
+
+	t.Run("both fail returns primary failure", func(t *testing.T) {
+		result, err := Do(
+			ctx,
+			10*time.Millisecond,
+			respond(30*time.Millisecond, http.StatusBadGateway, "primary error"),
+			respond(0, http.StatusInternalServerError, "secondary error"),
+		)
+		require.NoError(t, err)
+		require.True(t, result.Hedged)
+		require.False(t, result.Secondary)
+		require.Equal(t, http.StatusBadGateway, result.Response.StatusCode)
+		require.Equal(t, "primary error", readBody(t, result.Response))
+	})
+
+	t.Run("primary error before delay is not hedged", func(t *testing.T) {
+		primary := func(ctx context.Context) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}
+
+		result, err := Do(ctx, 50*time.Millisecond, primary, respond(0, http.StatusOK, "secondary"))
+		require.ErrorContains(t, err, "connection refused")
+		require.False(t, result.Hedged)
+	})
+}
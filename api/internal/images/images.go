@@ -0,0 +1,153 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	"github.com/gen2brain/heic"
+	"golang.org/x/image/draw"
+
+	// Registered decoders of supported formats
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+func init() {
+	// The decoder registers the heic brand, photos with image sequences such
+	// as iPhone bursts use heix
+	image.RegisterFormat("heic", "????ftypheix", heic.Decode, heic.DecodeConfig)
+}
+
+// ContentType is the content type of processed images
+const ContentType = "image/jpeg"
+
+var (
+	// ErrUnsupportedFormat is returned for images that cannot be decoded
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	// ErrTooManyPixels is returned for images over the pixel limit, checked
+	// before decoding to prevent decompression bombs
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+// Config are the image processing limits
+type Config struct {
+	// MaxDimension is the max width and height, larger images are downscaled
+	MaxDimension int
+	// MaxPixels is the max width * height of images that are decoded
+	MaxPixels int
+	// ThumbnailDimension is the max width and height of thumbnails
+	ThumbnailDimension int
+	// JPEGQuality is the quality of encoded images, 1 to 100
+	JPEGQuality int
+}
+
+// Result is a processed image and its thumbnail
+type Result struct {
+	Image     []byte
+	Thumbnail []byte
+	Width     int
+	Height    int
+}
+
+// Processor re-encodes images, removing metadata such as EXIF and GPS data
+type Processor struct {
+	cfg Config
+}
+
+// NewProcessor creates a new Processor
+func NewProcessor(cfg Config) (*Processor, error) {
+	if cfg.MaxDimension <= 0 || cfg.ThumbnailDimension <= 0 || cfg.MaxPixels <= 0 {
+		return nil, errors.New("image limits must be greater than 0")
+	}
+
+	if cfg.JPEGQuality < 1 || cfg.JPEGQuality > 100 {
+		return nil, errors.New("JPEG quality must be between 1 and 100")
+	}
+
+	return &Processor{cfg: cfg}, nil
+}
+
+// Process decodes the image, applies the EXIF orientation, downscales it to
+// the max dimension and encodes it with a thumbnail as JPEG. Metadata is not
+// kept. Only the first frame of animated images is kept.
+func (p *Processor) Process(data []byte) (Result, error) {
+	imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	}
+
+	if imageConfig.Width <= 0 ||
+		imageConfig.Height <= 0 ||
+		imageConfig.Width > p.cfg.MaxPixels/imageConfig.Height {
+		return Result{}, ErrTooManyPixels
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %w", ErrUnsupportedFormat, err)
+	}
+
+	img = applyOrientation(img, exifOrientation(data))
+	img = resize(img, p.cfg.MaxDimension)
+
+	encoded, err := p.encode(img)
+	if err != nil {
+		return Result{}, err
+	}
+
+	thumbnail, err := p.encode(resize(img, p.cfg.ThumbnailDimension))
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Image:     encoded,
+		Thumbnail: thumbnail,
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+	}, nil
+}
+
+// encode encodes the image as JPEG, transparent pixels are drawn on white
+func (p *Processor) encode(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	opaque := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(opaque, opaque.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(opaque, opaque.Bounds(), img, bounds.Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, opaque, &jpeg.Options{Quality: p.cfg.JPEGQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// resize downscales the image so the width and height are at most
+// maxDimension, keeping the aspect ratio. Smaller images are not changed.
+func resize(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxDimension && height <= maxDimension {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*maxDimension/width)
+		width = maxDimension
+	} else {
+		width = max(1, width*maxDimension/height)
+		height = maxDimension
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+
+	return resized
+}
@@ -0,0 +1,156 @@
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+
+	return buf.Bytes()
+}
+
+// jpegWithOrientation returns a JPEG with an Exif segment with the orientation
+func jpegWithOrientation(t *testing.T, width, height int, orientation uint16) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil))
+
+	// Big endian TIFF with a single IFD entry
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	processor, err := NewProcessor(Config{
+		MaxDimension:       100,
+		MaxPixels:          1000 * 1000,
+		ThumbnailDimension: 20,
+		JPEGQuality:        85,
+	})
+	require.NoError(t, err)
+
+	t.Run("downscales and converts to JPEG", func(t *testing.T) {
+		result, err := processor.Process(encodePNG(t, 200, 50))
+		require.NoError(t, err)
+		require.Equal(t, 100, result.Width)
+		require.Equal(t, 25, result.Height)
+
+		imageConfig, format, err := image.DecodeConfig(bytes.NewReader(result.Image))
+		require.NoError(t, err)
+		require.Equal(t, "jpeg", format)
+		require.Equal(t, 100, imageConfig.Width)
+
+		thumbConfig, format, err := image.DecodeConfig(bytes.NewReader(result.Thumbnail))
+		require.NoError(t, err)
+		require.Equal(t, "jpeg", format)
+		require.Equal(t, 20, thumbConfig.Width)
+		require.Equal(t, 5, thumbConfig.Height)
+	})
+
+	t.Run("small images keep their size", func(t *testing.T) {
+		result, err := processor.Process(encodePNG(t, 10, 8))
+		require.NoError(t, err)
+		require.Equal(t, 10, result.Width)
+		require.Equal(t, 8, result.Height)
+	})
+
+	t.Run("applies EXIF orientation and strips metadata", func(t *testing.T) {
+		data := jpegWithOrientation(t, 40, 10, 6)
+		require.Equal(t, 6, exifOrientation(data))
+
+		result, err := processor.Process(data)
+		require.NoError(t, err)
+		require.Equal(t, 10, result.Width)
+		require.Equal(t, 40, result.Height)
+
+		require.Equal(t, 1, exifOrientation(result.Image))
+		require.NotContains(t, string(result.Image), "Exif")
+	})
+
+	t.Run("too many pixels", func(t *testing.T) {
+		_, err := processor.Process(encodePNG(t, 1001, 1000))
+		require.ErrorIs(t, err, ErrTooManyPixels)
+	})
+
+	t.Run("heic", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/photo.heic")
+		require.NoError(t, err)
+
+		result, err := processor.Process(data)
+		require.NoError(t, err)
+		require.Equal(t, 100, result.Width)
+		require.Equal(t, 100, result.Height)
+
+		_, format, err := image.DecodeConfig(bytes.NewReader(result.Image))
+		require.NoError(t, err)
+		require.Equal(t, "jpeg", format)
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		_, err := processor.Process([]byte("\x00\x00\x00\x18ftypavif"))
+		require.ErrorIs(t, err, ErrUnsupportedFormat)
+	})
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2x1 image, red then blue
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{R: 255, A: 255}
+	blue := color.RGBA{B: 255, A: 255}
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		first       color.RGBA
+	}{
+		{orientation: 1, width: 2, height: 1, first: red},
+		{orientation: 2, width: 2, height: 1, first: blue},
+		{orientation: 3, width: 2, height: 1, first: blue},
+		{orientation: 6, width: 1, height: 2, first: red},
+		{orientation: 8, width: 1, height: 2, first: blue},
+	}
+
+	for _, tt := range tests {
+		result := applyOrientation(img, tt.orientation)
+		require.Equal(t, tt.width, result.Bounds().Dx(), "orientation %d", tt.orientation)
+		require.Equal(t, tt.height, result.Bounds().Dy(), "orientation %d", tt.orientation)
+		require.Equal(t, tt.first, color.RGBAModel.Convert(result.At(0, 0)), "orientation %d", tt.orientation)
+	}
+}
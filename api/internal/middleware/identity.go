@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// SessionIDHeader is the request and response header with the anonymous
+// session ID
+const SessionIDHeader = "X-Session-ID"
+
+// validSessionID requires session IDs to be long enough to not be guessable,
+// as they are the only credential of anonymous sessions
+var validSessionID = regexp.MustCompile(`^[A-Za-z0-9_-]{32,128}$`)
+
+// IdentityConfig is the configuration of the identity middleware
+type IdentityConfig struct {
+	// UserHeader is the header with the authenticated user ID set by a trusted
+	// authentication proxy, empty if there is none. Clients must not be able
+	// to set it directly.
+	UserHeader string
+	// APIKeys are the API keys of clients, sent as a Bearer token. Requests
+	// with one of them are owned by the key. Other keys are ignored, as
+	// OpenAI clients send a key even if the API does not require one.
+	APIKeys []string
+}
+
+// IdentityMiddleware adds the owner of the request to the context. Requests
+// with the user header are owned by the authenticated user, requests with a
+// configured API key by the hash of the key, and other requests by the
+// anonymous session in the X-Session-ID header. A new session ID is created
+// and returned in the response header if there is none.
+func IdentityMiddleware(config IdentityConfig) func(http.Handler) http.Handler {
+	// Keys are only kept as hashes, the owner does not contain the key
+	apiKeys := make(map[string]bool, len(config.APIKeys))
+	for _, key := range config.APIKeys {
+		apiKeys[apiKeyHash(key)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.UserHeader != "" {
+				if user := r.Header.Get(config.UserHeader); user != "" {
+					ctx := types.AddOwnerToContext(r.Context(), "user:"+user)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			if key, ok := bearerToken(r); ok && apiKeys[apiKeyHash(key)] {
+				ctx := types.AddOwnerToContext(r.Context(), "key:"+apiKeyHash(key))
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			sessionID := r.Header.Get(SessionIDHeader)
+			if !validSessionID.MatchString(sessionID) {
+				var err error
+				sessionID, err = newSessionID()
+				if err != nil {
+					apierror.Write(w, r, apierror.Internal("error creating session"))
+					return
+				}
+			}
+
+			w.Header().Set(SessionIDHeader, sessionID)
+			w.Header().Add("Access-Control-Expose-Headers", SessionIDHeader)
+
+			ctx := types.AddOwnerToContext(r.Context(), "session:"+sessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// newSessionID creates a random 256 bit session ID
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	return token, true
+}
+
+// apiKeyHash returns the hex SHA-256 hash of the API key
+func apiKeyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityMiddleware(t *testing.T) {
+	validSession := strings.Repeat("a", 43)
+
+	tests := []struct {
+		name          string
+		headers       map[string]string
+		expectedOwner string
+		newSession    bool
+	}{
+		{
+			name:          "authenticated user",
+			headers:       map[string]string{"X-Authenticated-User": "alice", SessionIDHeader: validSession},
+			expectedOwner: "user:alice",
+		},
+		{
+			name:          "API key",
+			headers:       map[string]string{"Authorization": "Bearer client-key", SessionIDHeader: validSession},
+			expectedOwner: "key:" + apiKeyHash("client-key"),
+		},
+		{
+			name:          "authenticated user before API key",
+			headers:       map[string]string{"X-Authenticated-User": "alice", "Authorization": "Bearer client-key"},
+			expectedOwner: "user:alice",
+		},
+		{
+			name:          "unknown API key uses the session",
+			headers:       map[string]string{"Authorization": "Bearer other-key", SessionIDHeader: validSession},
+			expectedOwner: "session:" + validSession,
+		},
+		{
+			name:          "existing session",
+			headers:       map[string]string{SessionIDHeader: validSession},
+			expectedOwner: "session:" + validSession,
+		},
+		{
+			name:       "missing session is created",
+			headers:    map[string]string{},
+			newSession: true,
+		},
+		{
+			name:       "short session ID is replaced",
+			headers:    map[string]string{SessionIDHeader: "guessable"},
+			newSession: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var owner string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				owner = types.OwnerFromContext(r.Context())
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			rr := httptest.NewRecorder()
+			IdentityMiddleware(IdentityConfig{
+				UserHeader: "X-Authenticated-User",
+				APIKeys:    []string{"client-key"},
+			})(next).ServeHTTP(rr, req)
+
+			if !tt.newSession {
+				require.Equal(t, tt.expectedOwner, owner)
+				return
+			}
+
+			sessionID := rr.Header().Get(SessionIDHeader)
+			require.Regexp(t, validSessionID, sessionID)
+			require.NotEqual(t, tt.headers[SessionIDHeader], sessionID)
+			require.Equal(t, "session:"+sessionID, owner)
+		})
+	}
+}
@@ -1,20 +1,13 @@
 package middleware
 
 import (
-	"encoding/json"
 	"net/http"
 
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 	"github.com/kava-labs/kavachat/api/internal/config"
-	"github.com/kava-labs/kavachat/api/internal/types"
-	"github.com/openai/openai-go"
 	"github.com/rs/zerolog"
 )
 
-// ErrorResponse is the response body for an error
-type ErrorResponse struct {
-	ErrorBody *openai.Error `json:"error"`
-}
-
 // ModelAllowlistMiddleware is a middleware that checks if the model field in
 // the request body is allowed, in both ChatCompletion and ImageGeneration
 // requests.
@@ -33,15 +26,10 @@ func ModelAllowlistMiddleware(
 			if model == nil {
 				logger.Debug().Msg("model field is nil")
 
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-
-				json.NewEncoder(w).Encode(types.ErrorResponse{
-					ErrorBody: &openai.Error{
-						Message: "you must provide a model parameter",
-						Type:    "invalid_request_error",
-					},
-				})
+				apierror.Write(w, r, apierror.InvalidRequest(
+					"missing_required_parameter",
+					"you must provide a model parameter",
+				).WithParam("model"))
 
 				return
 			}
@@ -52,15 +40,10 @@ func ModelAllowlistMiddleware(
 			if !ok {
 				logger.Debug().Msgf("model field is not a string: %v", model)
 
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-
-				json.NewEncoder(w).Encode(types.ErrorResponse{
-					ErrorBody: &openai.Error{
-						Message: "We could not parse the JSON body of your request. (HINT: This likely means you aren't using your HTTP library correctly. The OpenAI API expects a JSON payload, but what was sent was not valid JSON. If you have trouble figuring out how to fix this, please contact us through our help center at help.openai.com.)",
-						Type:    "invalid_request_error",
-					},
-				})
+				apierror.Write(w, r, apierror.InvalidRequest(
+					"",
+					"We could not parse the JSON body of your request. (HINT: This likely means you aren't using your HTTP library correctly. The OpenAI API expects a JSON payload, but what was sent was not valid JSON. If you have trouble figuring out how to fix this, please contact us through our help center at help.openai.com.)",
+				))
 
 				return
 			}
@@ -69,15 +52,10 @@ func ModelAllowlistMiddleware(
 			if modelStr == "" {
 				logger.Debug().Msg("model field is empty")
 
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-
-				json.NewEncoder(w).Encode(types.ErrorResponse{
-					ErrorBody: &openai.Error{
-						Message: "you must provide a model parameter",
-						Type:    "invalid_request_error",
-					},
-				})
+				apierror.Write(w, r, apierror.InvalidRequest(
+					"missing_required_parameter",
+					"you must provide a model parameter",
+				).WithParam("model"))
 
 				return
 			}
@@ -88,15 +66,10 @@ func ModelAllowlistMiddleware(
 				logger.Debug().Msgf("model is not supported by any backend: %s", model)
 
 				// Respond with matching openai error
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-
-				json.NewEncoder(w).Encode(types.ErrorResponse{
-					ErrorBody: &openai.Error{
-						Message: "invalid model ID",
-						Type:    "invalid_request_error",
-					},
-				})
+				apierror.Write(w, r, apierror.InvalidRequest(
+					"model_not_found",
+					"invalid model ID",
+				).WithParam("model"))
 
 				return
 			}
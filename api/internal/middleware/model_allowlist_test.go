@@ -10,7 +10,6 @@ import (
 
 	"github.com/kava-labs/kavachat/api/internal/config"
 	"github.com/kava-labs/kavachat/api/internal/types"
-	"github.com/openai/openai-go"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/require"
 )
@@ -42,9 +41,11 @@ func TestModelAllowlistMiddleware(t *testing.T) {
 			modelValue:     nil,
 			expectedStatus: http.StatusBadRequest,
 			expectedBody: types.ErrorResponse{
-				ErrorBody: &openai.Error{
+				ErrorBody: &types.Error{
 					Message: "you must provide a model parameter",
 					Type:    "invalid_request_error",
+					Param:   ptr("model"),
+					Code:    ptr("missing_required_parameter"),
 				},
 			},
 		},
@@ -53,9 +54,11 @@ func TestModelAllowlistMiddleware(t *testing.T) {
 			modelValue:     "",
 			expectedStatus: http.StatusBadRequest,
 			expectedBody: types.ErrorResponse{
-				ErrorBody: &openai.Error{
+				ErrorBody: &types.Error{
 					Message: "you must provide a model parameter",
 					Type:    "invalid_request_error",
+					Param:   ptr("model"),
+					Code:    ptr("missing_required_parameter"),
 				},
 			},
 		},
@@ -64,7 +67,7 @@ func TestModelAllowlistMiddleware(t *testing.T) {
 			modelValue:     123,
 			expectedStatus: http.StatusBadRequest,
 			expectedBody: types.ErrorResponse{
-				ErrorBody: &openai.Error{
+				ErrorBody: &types.Error{
 					Message: "We could not parse the JSON body of your request. (HINT: This likely means you aren't using your HTTP library correctly. The OpenAI API expects a JSON payload, but what was sent was not valid JSON. If you have trouble figuring out how to fix this, please contact us through our help center at help.openai.com.)",
 					Type:    "invalid_request_error",
 				},
@@ -75,9 +78,11 @@ func TestModelAllowlistMiddleware(t *testing.T) {
 			modelValue:     "invalid_model",
 			expectedStatus: http.StatusBadRequest,
 			expectedBody: types.ErrorResponse{
-				ErrorBody: &openai.Error{
+				ErrorBody: &types.Error{
 					Message: "invalid model ID",
 					Type:    "invalid_request_error",
+					Param:   ptr("model"),
+					Code:    ptr("model_not_found"),
 				},
 			},
 		},
@@ -128,7 +133,14 @@ func TestModelAllowlistMiddleware(t *testing.T) {
 				require.NoError(t, err, "response body should be JSON")
 
 				require.Equal(t, tt.expectedBody.ErrorBody.Message, responseBody.ErrorBody.Message)
+				require.Equal(t, tt.expectedBody.ErrorBody.Type, responseBody.ErrorBody.Type)
+				require.Equal(t, tt.expectedBody.ErrorBody.Param, responseBody.ErrorBody.Param)
+				require.Equal(t, tt.expectedBody.ErrorBody.Code, responseBody.ErrorBody.Code)
 			}
 		})
 	}
 }
+
+func ptr(s string) *string {
+	return &s
+}
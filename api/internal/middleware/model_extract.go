@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
 
-	"github.com/kava-labs/kavachat/api/internal/types"
-	"github.com/openai/openai-go"
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -48,7 +48,14 @@ func ExtractModelMiddleware(baseLogger *zerolog.Logger) func(next http.Handler)
 			bodyBytes, err := io.ReadAll(r.Body)
 			if err != nil {
 				log.Printf("Error reading body: %v", err)
-				http.Error(w, "can't read body", http.StatusBadRequest)
+
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					apierror.Write(w, r, apierror.RequestTooLarge("request body is too large"))
+					return
+				}
+
+				apierror.Write(w, r, apierror.InvalidRequest("", "can't read body"))
 				return
 			}
 
@@ -67,16 +74,11 @@ func ExtractModelMiddleware(baseLogger *zerolog.Logger) func(next http.Handler)
 				jsonSpan.SetStatus(codes.Error, "json decode error")
 				jsonSpan.RecordError(err)
 
-				// Respond with openai error
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusBadRequest)
-
-				json.NewEncoder(w).Encode(types.ErrorResponse{
-					ErrorBody: &openai.Error{
-						Message: "invalid model ID",
-						Type:    "invalid_request_error",
-					},
-				})
+				// Respond with the same error as the allowlist
+				apierror.Write(w, r, apierror.InvalidRequest(
+					"model_not_found",
+					"invalid model ID",
+				).WithParam("model"))
 
 				jsonSpan.End()
 				return
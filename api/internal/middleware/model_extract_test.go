@@ -78,6 +78,12 @@ func TestExtractModelMiddleware(t *testing.T) {
 
 			// Check the response status code
 			require.Equal(t, tt.expectedStatus, rr.Code)
+
+			// Same error as the model allowlist
+			if tt.expectedStatus == http.StatusBadRequest {
+				require.Contains(t, rr.Body.String(), `"param":"model"`)
+				require.Contains(t, rr.Body.String(), `"code":"model_not_found"`)
+			}
 		})
 	}
 }
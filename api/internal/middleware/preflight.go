@@ -1,20 +1,41 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 // PreflightMiddleware is a middleware that handles preflight requests, allowing
 // CORS requests to be made to the API.
 func PreflightMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			w.Header().Set("Access-Control-Max-Age", "3600")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	return PreflightMiddlewareForMethods(http.MethodPost)(next)
+}
+
+// PreflightMiddlewareForMethods handles preflight requests for routes that
+// allow the given methods, OPTIONS is always allowed.
+func PreflightMiddlewareForMethods(methods ...string) func(http.Handler) http.Handler {
+	return PreflightMiddlewareWithHeaders(methods)
+}
+
+// PreflightMiddlewareWithHeaders handles preflight requests like
+// PreflightMiddlewareForMethods, also listing the headers in
+// Access-Control-Allow-Headers for clients that do not support the wildcard.
+func PreflightMiddlewareWithHeaders(methods []string, headers ...string) func(http.Handler) http.Handler {
+	allowMethods := strings.Join(append(methods, http.MethodOptions), ", ")
+	allowHeaders := strings.Join(append([]string{"*"}, headers...), ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				w.Header().Set("Access-Control-Max-Age", "3600")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflightMiddlewareWithHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := PreflightMiddlewareWithHeaders([]string{http.MethodGet}, "Last-Event-ID")(next)
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/streams/abc", nil)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "last-event-id")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "*, Last-Event-ID", w.Header().Get("Access-Control-Allow-Headers"))
+
+	// Other methods are passed to the handler
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/streams/abc", nil))
+	require.Equal(t, http.StatusTeapot, w.Code)
+
+	// Without headers only the wildcard is allowed
+	w = httptest.NewRecorder()
+	PreflightMiddlewareForMethods(http.MethodPost)(next).ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/", nil))
+	require.Equal(t, "*", w.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "POST, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+}
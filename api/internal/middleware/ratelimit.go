@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
 )
 
 // Default rate limit exceeded message
@@ -79,8 +81,7 @@ func NewRateLimiter(config RateLimiterConfig) func(http.Handler) http.Handler {
 
 			// Check if the rate limit has been exceeded
 			if data.count > config.MaxRequests {
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte(defaultRateLimitMessage))
+				apierror.Write(w, r, apierror.RateLimited(defaultRateLimitMessage))
 				return
 			}
 
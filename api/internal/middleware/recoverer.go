@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/kava-labs/kavachat/api/internal/apierror"
+	"github.com/rs/zerolog"
+)
+
+// RecovererMiddleware is a middleware that recovers from panics, logs the
+// stack trace and responds with a 500 OpenAI error.
+func RecovererMiddleware(baseLogger *zerolog.Logger) func(next http.Handler) http.Handler {
+	logger := baseLogger.With().Str("middleware", "recoverer").Logger()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+
+				// Used by the http server to abort a response, must not be
+				// recovered
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				logger.Error().
+					Interface("panic", rec).
+					Bytes("stack", debug.Stack()).
+					Msg("recovered from panic")
+
+				// Connection upgrades can not be written to
+				if r.Header.Get("Connection") != "Upgrade" {
+					apierror.Write(w, r, apierror.Internal("internal server error"))
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/oklog/ulid/v2"
+)
+
+// RequestIDHeader is the request and response header with the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits client provided request IDs to safe characters, as
+// they are logged and returned in responses
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestIDMiddleware is a middleware that adds a request ID to the request
+// context and the response headers. A valid X-Request-ID header from the client
+// is used, otherwise a new ID is generated.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = ulid.Make().String()
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		w.Header().Add("Access-Control-Expose-Headers", RequestIDHeader)
+
+		ctx := types.AddRequestIDToContext(r.Context(), requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestID      string
+		expectProvided bool
+	}{
+		{
+			name:           "client request ID is used",
+			requestID:      "client-id_1.2",
+			expectProvided: true,
+		},
+		{
+			name:           "missing request ID is generated",
+			requestID:      "",
+			expectProvided: false,
+		},
+		{
+			name:           "invalid request ID is replaced",
+			requestID:      "bad id\nwith newline",
+			expectProvided: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctxRequestID string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxRequestID = types.RequestIDFromContext(r.Context())
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+
+			rr := httptest.NewRecorder()
+			RequestIDMiddleware(next).ServeHTTP(rr, req)
+
+			responseID := rr.Header().Get(RequestIDHeader)
+			require.NotEmpty(t, responseID)
+			require.Equal(t, responseID, ctxRequestID, "context and header should match")
+
+			if tt.expectProvided {
+				require.Equal(t, tt.requestID, responseID)
+			} else {
+				require.NotEqual(t, tt.requestID, responseID)
+			}
+		})
+	}
+}
+
+func TestRecovererMiddleware(t *testing.T) {
+	logger := zerolog.Nop()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	rr := httptest.NewRecorder()
+	RecovererMiddleware(&logger)(next).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.JSONEq(t, `{"error": {"message": "internal server error", "type": "server_error", "param": null, "code": null}}`, rr.Body.String())
+}
@@ -0,0 +1,172 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// maxErrorBodySize is the maximum number of bytes read from an error response
+// from the moderation backend for logging.
+const maxErrorBodySize = 4096
+
+// Config is the configuration for a moderation Client
+type Config struct {
+	// BaseURL of an OpenAI compatible API, /moderations is appended
+	BaseURL string
+	APIKey  string
+	Model   string
+
+	// Thresholds overrides the flagged decision of the backend for specific
+	// categories. A category is flagged when its score is greater than or
+	// equal to the threshold.
+	Thresholds map[string]float64
+
+	// FailOpen allows requests through when the moderation backend is
+	// unavailable instead of rejecting them.
+	FailOpen bool
+
+	// Timeout for each moderation request
+	Timeout time.Duration
+}
+
+// Verdict is the outcome of moderating an input
+type Verdict struct {
+	Flagged bool
+	// Categories contains the flagged categories, sorted
+	Categories []string
+}
+
+// result is a single result in the moderation response
+type result struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+// moderationResponse is the response body of the /moderations endpoint
+type moderationResponse struct {
+	ID      string   `json:"id"`
+	Model   string   `json:"model"`
+	Results []result `json:"results"`
+}
+
+// Client calls an OpenAI compatible /moderations endpoint
+type Client struct {
+	config Config
+	client *http.Client
+}
+
+// NewClient creates a new moderation Client with the given config
+func NewClient(config Config) *Client {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	return &Client{
+		config: config,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   config.Timeout,
+		},
+	}
+}
+
+// FailOpen returns true if requests should be allowed when the moderation
+// backend is unavailable
+func (c *Client) FailOpen() bool {
+	return c.config.FailOpen
+}
+
+// Moderate sends the input to the moderation backend and returns the verdict
+// after applying the configured category thresholds. An error is returned if
+// the moderation backend is unavailable or returns an invalid response.
+func (c *Client) Moderate(ctx context.Context, input string) (Verdict, error) {
+	reqBody, err := json.Marshal(map[string]string{
+		"model": c.config.Model,
+		"input": input,
+	})
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to encode moderation request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		c.config.BaseURL+"/moderations",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to create moderation request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.APIKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("moderation request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		return Verdict{}, fmt.Errorf(
+			"moderation backend returned status %d: %s",
+			res.StatusCode, string(body),
+		)
+	}
+
+	var modRes moderationResponse
+	if err := json.NewDecoder(res.Body).Decode(&modRes); err != nil {
+		return Verdict{}, fmt.Errorf("failed to decode moderation response: %w", err)
+	}
+
+	if len(modRes.Results) == 0 {
+		return Verdict{}, fmt.Errorf("moderation response has no results")
+	}
+
+	return c.verdict(modRes.Results), nil
+}
+
+// verdict combines the results into a single Verdict, applying thresholds
+func (c *Client) verdict(results []result) Verdict {
+	flagged := make(map[string]struct{})
+
+	for _, res := range results {
+		for category, isFlagged := range res.Categories {
+			// Threshold takes precedence over the backend decision
+			if _, ok := c.config.Thresholds[category]; ok {
+				continue
+			}
+
+			if isFlagged {
+				flagged[category] = struct{}{}
+			}
+		}
+
+		for category, threshold := range c.config.Thresholds {
+			score, ok := res.CategoryScores[category]
+			if ok && score >= threshold {
+				flagged[category] = struct{}{}
+			}
+		}
+	}
+
+	categories := make([]string, 0, len(flagged))
+	for category := range flagged {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	return Verdict{
+		Flagged:    len(categories) > 0,
+		Categories: categories,
+	}
+}
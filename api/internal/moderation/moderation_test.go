@@ -0,0 +1,132 @@
+package moderation_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/moderation"
+	"github.com/stretchr/testify/require"
+)
+
+func newModerationServer(t *testing.T, statusCode int, responseBody string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/moderations", r.URL.Path)
+		require.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, "omni-moderation-latest", body["model"])
+		require.Equal(t, "some input", body["input"])
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write([]byte(responseBody))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+const flaggedViolenceResponse = `{
+	"id": "modr-123",
+	"model": "omni-moderation-latest",
+	"results": [{
+		"flagged": true,
+		"categories": {"violence": true, "harassment": false},
+		"category_scores": {"violence": 0.62, "harassment": 0.31}
+	}]
+}`
+
+func TestClient_Moderate(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		responseBody string
+		thresholds   map[string]float64
+		wantVerdict  moderation.Verdict
+		wantErr      bool
+	}{
+		{
+			name:         "flagged by backend",
+			statusCode:   http.StatusOK,
+			responseBody: flaggedViolenceResponse,
+			wantVerdict: moderation.Verdict{
+				Flagged:    true,
+				Categories: []string{"violence"},
+			},
+		},
+		{
+			name:         "threshold above score overrides backend flag",
+			statusCode:   http.StatusOK,
+			responseBody: flaggedViolenceResponse,
+			thresholds:   map[string]float64{"violence": 0.9},
+			wantVerdict: moderation.Verdict{
+				Flagged:    false,
+				Categories: []string{},
+			},
+		},
+		{
+			name:         "threshold below score flags unflagged category",
+			statusCode:   http.StatusOK,
+			responseBody: flaggedViolenceResponse,
+			thresholds:   map[string]float64{"harassment": 0.3},
+			wantVerdict: moderation.Verdict{
+				Flagged:    true,
+				Categories: []string{"harassment", "violence"},
+			},
+		},
+		{
+			name:         "backend error",
+			statusCode:   http.StatusServiceUnavailable,
+			responseBody: `{"error": {"message": "unavailable"}}`,
+			wantErr:      true,
+		},
+		{
+			name:         "empty results",
+			statusCode:   http.StatusOK,
+			responseBody: `{"id": "modr-123", "results": []}`,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newModerationServer(t, tt.statusCode, tt.responseBody)
+
+			client := moderation.NewClient(moderation.Config{
+				BaseURL:    server.URL + "/v1/",
+				APIKey:     "test-key",
+				Model:      "omni-moderation-latest",
+				Thresholds: tt.thresholds,
+			})
+
+			verdict, err := client.Moderate(context.Background(), "some input")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.wantVerdict, verdict)
+		})
+	}
+}
+
+func TestClient_Moderate_Unavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client := moderation.NewClient(moderation.Config{
+		BaseURL:  server.URL,
+		FailOpen: true,
+	})
+
+	_, err := client.Moderate(context.Background(), "some input")
+	require.Error(t, err)
+	require.True(t, client.FailOpen())
+}
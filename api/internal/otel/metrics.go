@@ -12,6 +12,11 @@ import (
 type Metrics struct {
 	meter         metric.Meter
 	ttfbHistogram metric.Float64Histogram
+	hedgesIssued  metric.Int64Counter
+	hedgesWon     metric.Int64Counter
+	filesExpired  metric.Int64Counter
+	bytesExpired  metric.Int64Counter
+	bytesDeduped  metric.Int64Counter
 }
 
 // NewMetrics creates and registers a new Metrics instrumentation
@@ -27,9 +32,56 @@ func NewMetrics() (*Metrics, error) {
 		return nil, err
 	}
 
+	hedgesIssued, err := meter.Int64Counter(
+		"proxy_hedges_issued",
+		metric.WithDescription("Number of hedged requests sent to a secondary backend"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	hedgesWon, err := meter.Int64Counter(
+		"proxy_hedges_won",
+		metric.WithDescription("Number of hedged requests where the secondary backend responded first"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	filesExpired, err := meter.Int64Counter(
+		"storage_expired_files_deleted",
+		metric.WithDescription("Number of expired files deleted by the sweeper"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bytesExpired, err := meter.Int64Counter(
+		"storage_expired_bytes_deleted",
+		metric.WithDescription("Size of expired files deleted by the sweeper"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bytesDeduped, err := meter.Int64Counter(
+		"storage_deduplicated_bytes",
+		metric.WithDescription("Size of uploaded files that reference an existing blob instead of storing a copy"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Metrics{
 		meter:         meter,
 		ttfbHistogram: ttfbHistogram,
+		hedgesIssued:  hedgesIssued,
+		hedgesWon:     hedgesWon,
+		filesExpired:  filesExpired,
+		bytesExpired:  bytesExpired,
+		bytesDeduped:  bytesDeduped,
 	}, nil
 }
 
@@ -37,3 +89,26 @@ func NewMetrics() (*Metrics, error) {
 func (m *Metrics) RecordTTFB(ctx context.Context, ttfbMs float64, attrs ...attribute.KeyValue) {
 	m.ttfbHistogram.Record(ctx, ttfbMs, metric.WithAttributes(attrs...))
 }
+
+// RecordHedgeIssued records a hedged request sent to a secondary backend
+func (m *Metrics) RecordHedgeIssued(ctx context.Context, attrs ...attribute.KeyValue) {
+	m.hedgesIssued.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+// RecordHedgeWon records a hedged request won by the secondary backend
+func (m *Metrics) RecordHedgeWon(ctx context.Context, attrs ...attribute.KeyValue) {
+	m.hedgesWon.Add(ctx, 1, metric.WithAttributes(attrs...))
+}
+
+// RecordExpiredFilesDeleted records expired files deleted by the sweeper and
+// their total size
+func (m *Metrics) RecordExpiredFilesDeleted(ctx context.Context, files int64, bytes int64, attrs ...attribute.KeyValue) {
+	m.filesExpired.Add(ctx, files, metric.WithAttributes(attrs...))
+	m.bytesExpired.Add(ctx, bytes, metric.WithAttributes(attrs...))
+}
+
+// RecordDeduplicatedBytes records the size of a file stored as a reference to
+// an existing blob
+func (m *Metrics) RecordDeduplicatedBytes(ctx context.Context, bytes int64, attrs ...attribute.KeyValue) {
+	m.bytesDeduped.Add(ctx, bytes, metric.WithAttributes(attrs...))
+}
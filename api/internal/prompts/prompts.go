@@ -0,0 +1,185 @@
+package prompts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+)
+
+// Policy is what happens to system messages from the client
+type Policy string
+
+const (
+	// PolicyKeep keeps client system messages after the system prompt
+	PolicyKeep Policy = "keep"
+	// PolicyAppend merges client system messages into the system prompt
+	PolicyAppend Policy = "append"
+	// PolicyReplace removes client system messages
+	PolicyReplace Policy = "replace"
+)
+
+// Vars are the variables available in templates, e.g. {{.Date}}
+type Vars struct {
+	// Date is the current UTC date, e.g. 2025-01-02
+	Date string
+	// Locale is the user locale, e.g. en-US
+	Locale string
+	// Model is the requested model name
+	Model string
+}
+
+// Config is the prompt templates file format
+type Config struct {
+	// Default is used for models without a template, optional
+	Default *PromptConfig `json:"default"`
+	// Models are templates for specific model names
+	Models map[string]PromptConfig `json:"models"`
+}
+
+// PromptConfig is a system prompt template and the policy for client system
+// messages
+type PromptConfig struct {
+	Template string `json:"template"`
+	// Policy defaults to keep
+	Policy Policy `json:"policy"`
+}
+
+// prompt is a parsed prompt template
+type prompt struct {
+	template *template.Template
+	policy   Policy
+}
+
+// Prompts are the system prompt templates for each model
+type Prompts struct {
+	defaultPrompt *prompt
+	models        map[string]*prompt
+}
+
+// Load reads prompt templates from a JSON file
+func Load(path string) (*Prompts, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompts file: %w", err)
+	}
+
+	var cfg Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode prompts file: %w", err)
+	}
+
+	return New(cfg)
+}
+
+// New parses the prompt templates, checking they can be executed
+func New(cfg Config) (*Prompts, error) {
+	p := &Prompts{
+		models: make(map[string]*prompt),
+	}
+
+	if cfg.Default != nil {
+		parsed, err := parsePrompt("default", *cfg.Default)
+		if err != nil {
+			return nil, err
+		}
+
+		p.defaultPrompt = parsed
+	}
+
+	for model, promptConfig := range cfg.Models {
+		parsed, err := parsePrompt(model, promptConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		p.models[model] = parsed
+	}
+
+	return p, nil
+}
+
+func parsePrompt(name string, cfg PromptConfig) (*prompt, error) {
+	policy := cfg.Policy
+	if policy == "" {
+		policy = PolicyKeep
+	}
+
+	switch policy {
+	case PolicyKeep, PolicyAppend, PolicyReplace:
+	default:
+		return nil, fmt.Errorf("prompt %s has invalid policy '%s'", name, policy)
+	}
+
+	if strings.TrimSpace(cfg.Template) == "" {
+		return nil, fmt.Errorf("prompt %s has an empty template", name)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("prompt %s has invalid template: %w", name, err)
+	}
+
+	// Unknown variables are only found when executing
+	if err := tmpl.Execute(&bytes.Buffer{}, Vars{}); err != nil {
+		return nil, fmt.Errorf("prompt %s has invalid template: %w", name, err)
+	}
+
+	return &prompt{
+		template: tmpl,
+		policy:   policy,
+	}, nil
+}
+
+// Apply adds the system prompt for the model to the messages, applying the
+// policy to client system and developer messages. Returns the messages
+// unchanged and an empty policy if there is no prompt for the model.
+func (p *Prompts) Apply(messages []types.Message, vars Vars) ([]types.Message, Policy, error) {
+	selected, ok := p.models[vars.Model]
+	if !ok {
+		selected = p.defaultPrompt
+	}
+
+	if selected == nil {
+		return messages, "", nil
+	}
+
+	var text strings.Builder
+	if err := selected.template.Execute(&text, vars); err != nil {
+		return nil, "", fmt.Errorf("failed to execute prompt template: %w", err)
+	}
+
+	var clientInstructions []string
+	result := make([]types.Message, 0, len(messages)+1)
+	result = append(result, types.Message{})
+
+	for _, message := range messages {
+		role := message.Role()
+		if role != "system" && role != "developer" {
+			result = append(result, message)
+			continue
+		}
+
+		switch selected.policy {
+		case PolicyKeep:
+			result = append(result, message)
+		case PolicyAppend:
+			if instruction := strings.TrimSpace(message.Text()); instruction != "" {
+				clientInstructions = append(clientInstructions, instruction)
+			}
+		case PolicyReplace:
+			// Dropped
+		}
+	}
+
+	systemPrompt := strings.Join(append([]string{text.String()}, clientInstructions...), "\n\n")
+	result[0] = types.NewTextMessage("system", systemPrompt)
+
+	return result, selected.policy, nil
+}
@@ -0,0 +1,116 @@
+package prompts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	prompts, err := New(Config{
+		Default: &PromptConfig{
+			Template: "You are Kava AI. Today is {{.Date}}. Reply in {{.Locale}}.",
+		},
+		Models: map[string]PromptConfig{
+			"gpt-4o":      {Template: "You are {{.Model}}.", Policy: PolicyAppend},
+			"deepseek-r1": {Template: "Safety preamble.", Policy: PolicyReplace},
+		},
+	})
+	require.NoError(t, err)
+
+	vars := Vars{Date: "2025-01-02", Locale: "de-DE"}
+	messages := []types.Message{
+		types.NewTextMessage("system", "Client prompt"),
+		types.NewTextMessage("user", "Hi"),
+		types.NewTextMessage("developer", "Be brief"),
+	}
+
+	tests := []struct {
+		name           string
+		model          string
+		expectedPolicy Policy
+		expected       []types.Message
+	}{
+		{
+			name:           "default template keeps client system messages",
+			model:          "other-model",
+			expectedPolicy: PolicyKeep,
+			expected: []types.Message{
+				types.NewTextMessage("system", "You are Kava AI. Today is 2025-01-02. Reply in de-DE."),
+				types.NewTextMessage("system", "Client prompt"),
+				types.NewTextMessage("user", "Hi"),
+				types.NewTextMessage("developer", "Be brief"),
+			},
+		},
+		{
+			name:           "append merges client system messages",
+			model:          "gpt-4o",
+			expectedPolicy: PolicyAppend,
+			expected: []types.Message{
+				types.NewTextMessage("system", "You are gpt-4o.\n\nClient prompt\n\nBe brief"),
+				types.NewTextMessage("user", "Hi"),
+			},
+		},
+		{
+			name:           "replace removes client system messages",
+			model:          "deepseek-r1",
+			expectedPolicy: PolicyReplace,
+			expected: []types.Message{
+				types.NewTextMessage("system", "Safety preamble."),
+				types.NewTextMessage("user", "Hi"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars := vars
+			vars.Model = tt.model
+
+			result, policy, err := prompts.Apply(messages, vars)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedPolicy, policy)
+			require.Equal(t, tt.expected, result)
+		})
+	}
+
+	t.Run("no template for model", func(t *testing.T) {
+		noDefault, err := New(Config{Models: map[string]PromptConfig{"gpt-4o": {Template: "x"}}})
+		require.NoError(t, err)
+
+		result, policy, err := noDefault.Apply(messages, Vars{Model: "other-model"})
+		require.NoError(t, err)
+		require.Empty(t, policy)
+		require.Equal(t, messages, result)
+	})
+}
+
+func TestNew_Invalid(t *testing.T) {
+	_, err := New(Config{Default: &PromptConfig{Template: "Hello {{.Unknown}}"}})
+	require.ErrorContains(t, err, "prompt default has invalid template")
+
+	_, err = New(Config{Models: map[string]PromptConfig{"gpt-4o": {Template: "x", Policy: "merge"}}})
+	require.EqualError(t, err, "prompt gpt-4o has invalid policy 'merge'")
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"default": {"template": "Today is {{.Date}}", "policy": "replace"}
+	}`), 0o600))
+
+	prompts, err := Load(path)
+	require.NoError(t, err)
+
+	result, policy, err := prompts.Apply(nil, Vars{Date: "2025-01-02"})
+	require.NoError(t, err)
+	require.Equal(t, PolicyReplace, policy)
+	require.Equal(t, []types.Message{types.NewTextMessage("system", "Today is 2025-01-02")}, result)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"defaults": {}}`), 0o600))
+	_, err = Load(path)
+	require.ErrorContains(t, err, "unknown field")
+}
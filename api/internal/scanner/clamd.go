@@ -0,0 +1,181 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of each INSTREAM chunk, below the clamd
+// StreamMaxLength default
+const clamdChunkSize = 64 * 1024
+
+// ClamdConfig is the configuration for a ClamdScanner
+type ClamdConfig struct {
+	// Address of clamd, unix:///path/to/clamd.sock or tcp://host:port
+	Address string
+	// Timeout for each scan, including connecting
+	Timeout time.Duration
+}
+
+// ClamdScanner scans files with the clamd INSTREAM command
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+var _ Scanner = (*ClamdScanner)(nil)
+
+// NewClamdScanner creates a new ClamdScanner with the given config
+func NewClamdScanner(cfg ClamdConfig) (*ClamdScanner, error) {
+	network, address, err := parseClamdAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("clamd timeout must be positive")
+	}
+
+	return &ClamdScanner{
+		network: network,
+		address: address,
+		timeout: cfg.Timeout,
+	}, nil
+}
+
+// parseClamdAddress returns the network and address of a unix:// or tcp://
+// clamd address
+func parseClamdAddress(rawAddress string) (string, string, error) {
+	u, err := url.Parse(rawAddress)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid clamd address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", errors.New("clamd unix address requires a socket path")
+		}
+
+		return "unix", u.Path, nil
+	case "tcp":
+		if u.Host == "" {
+			return "", "", errors.New("clamd tcp address requires a host and port")
+		}
+
+		return "tcp", u.Host, nil
+	default:
+		return "", "", fmt.Errorf("clamd address scheme must be unix or tcp, got '%s'", u.Scheme)
+	}
+}
+
+// Scan streams the file to clamd and returns the verdict
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return Verdict{}, fmt.Errorf("failed to set clamd deadline: %w", err)
+	}
+
+	// Null terminated command
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Verdict{}, fmt.Errorf("failed to send clamd command: %w", err)
+	}
+
+	if err := writeChunks(conn, r); err != nil {
+		// clamd closes the connection when the stream is too large, the
+		// reply has the reason
+		if reply, readErr := readReply(conn); readErr == nil {
+			return Verdict{}, fmt.Errorf("clamd error: %s", reply)
+		}
+
+		return Verdict{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	return parseReply(reply)
+}
+
+// writeChunks writes the file as length prefixed chunks, followed by a zero
+// length chunk
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := w.Write(size); err != nil {
+				return fmt.Errorf("failed to send chunk to clamd: %w", err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to send chunk to clamd: %w", err)
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := w.Write(size); err != nil {
+		return fmt.Errorf("failed to end clamd stream: %w", err)
+	}
+
+	return nil
+}
+
+// readReply reads the null terminated reply
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply returns the verdict of a reply, e.g. "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func parseReply(reply string) (Verdict, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case result == "OK":
+		return Verdict{Clean: true}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{
+			Clean:     false,
+			Signature: strings.TrimSuffix(result, " FOUND"),
+		}, nil
+	default:
+		return Verdict{}, fmt.Errorf("clamd error: %s", reply)
+	}
+}
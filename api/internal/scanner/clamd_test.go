@@ -0,0 +1,139 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd accepts INSTREAM commands and replies with FOUND if the stream
+// contains the signature
+func fakeClamd(t *testing.T, network, address string, signature string) {
+	t.Helper()
+
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+
+				command, err := reader.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, reader, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(data.String(), signature) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+
+				conn.Write([]byte("stream: OK\x00"))
+			}()
+		}
+	}()
+}
+
+func TestClamdScanner(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", socket, "EICAR")
+
+	scanner, err := NewClamdScanner(ClamdConfig{Address: "unix://" + socket, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+
+	t.Run("clean", func(t *testing.T) {
+		// Larger than a chunk
+		verdict, err := scanner.Scan(context.Background(), bytes.NewReader(bytes.Repeat([]byte("a"), clamdChunkSize*2+10)))
+		require.NoError(t, err)
+		require.True(t, verdict.Clean)
+	})
+
+	t.Run("infected", func(t *testing.T) {
+		verdict, err := scanner.Scan(context.Background(), strings.NewReader("X5O!P%@AP EICAR test file"))
+		require.NoError(t, err)
+		require.False(t, verdict.Clean)
+		require.Equal(t, "Eicar-Test-Signature", verdict.Signature)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		verdict, err := scanner.Scan(context.Background(), strings.NewReader(""))
+		require.NoError(t, err)
+		require.True(t, verdict.Clean)
+	})
+}
+
+func TestClamdScanner_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	fakeClamd(t, "tcp", address, "EICAR")
+
+	scanner, err := NewClamdScanner(ClamdConfig{Address: "tcp://" + address, Timeout: 5 * time.Second})
+	require.NoError(t, err)
+
+	verdict, err := scanner.Scan(context.Background(), strings.NewReader("EICAR"))
+	require.NoError(t, err)
+	require.False(t, verdict.Clean)
+}
+
+func TestClamdScanner_Unavailable(t *testing.T) {
+	scanner, err := NewClamdScanner(ClamdConfig{
+		Address: "unix://" + filepath.Join(t.TempDir(), "missing.sock"),
+		Timeout: time.Second,
+	})
+	require.NoError(t, err)
+
+	_, err = scanner.Scan(context.Background(), strings.NewReader("data"))
+	require.ErrorContains(t, err, "failed to connect to clamd")
+}
+
+func TestParseReply(t *testing.T) {
+	verdict, err := parseReply("stream: OK")
+	require.NoError(t, err)
+	require.True(t, verdict.Clean)
+
+	_, err = parseReply("INSTREAM size limit exceeded. ERROR")
+	require.EqualError(t, err, "clamd error: INSTREAM size limit exceeded. ERROR")
+}
+
+func TestNewClamdScanner_InvalidAddress(t *testing.T) {
+	_, err := NewClamdScanner(ClamdConfig{Address: "http://localhost:3310", Timeout: time.Second})
+	require.EqualError(t, err, "clamd address scheme must be unix or tcp, got 'http'")
+
+	_, err = NewClamdScanner(ClamdConfig{Address: "tcp://", Timeout: time.Second})
+	require.EqualError(t, err, "clamd tcp address requires a host and port")
+}
@@ -0,0 +1,20 @@
+package scanner
+
+import (
+	"context"
+	"io"
+)
+
+// Verdict is the outcome of scanning a file
+type Verdict struct {
+	Clean bool
+	// Signature is the name of the detected malware if not clean
+	Signature string
+}
+
+// Scanner scans files for malware before they are stored
+type Scanner interface {
+	// Scan reads the file and returns the verdict. An error is returned if
+	// the file could not be scanned, e.g. the scanner is unavailable.
+	Scan(ctx context.Context, r io.Reader) (Verdict, error)
+}
@@ -0,0 +1,132 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DoneData is the data of the final event in an OpenAI stream
+const DoneData = "[DONE]"
+
+// Event is a single server-sent event
+type Event struct {
+	ID    string
+	Event string
+	// Data is the data lines of the event joined by newlines
+	Data string
+	// Comment is true if the event only contains comment lines
+	Comment bool
+
+	// Raw is the original bytes of the event including the terminating blank
+	// line, used to forward the event unchanged.
+	Raw []byte
+}
+
+// IsDone returns true if the event is the final [DONE] event of an OpenAI
+// stream
+func (e Event) IsDone() bool {
+	return e.Data == DoneData
+}
+
+// Reader reads server-sent events from a stream
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader creates a new Reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next reads the next event from the stream. io.EOF is returned when the
+// stream ends without a partial event. If the stream ends in the middle of an
+// event, the partial event is returned with io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Event, error) {
+	var (
+		event     Event
+		raw       bytes.Buffer
+		dataLines [][]byte
+		hasFields bool
+	)
+
+	for {
+		line, err := r.r.ReadBytes('\n')
+		raw.Write(line)
+
+		if err != nil {
+			if err == io.EOF {
+				if raw.Len() == 0 {
+					return Event{}, io.EOF
+				}
+
+				err = io.ErrUnexpectedEOF
+			}
+
+			event.Raw = raw.Bytes()
+			event.Data = string(bytes.Join(dataLines, []byte("\n")))
+
+			return event, err
+		}
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+
+		// Blank line dispatches the event
+		if len(trimmed) == 0 {
+			// Skip leading blank lines between events
+			if raw.Len() == len(line) {
+				raw.Reset()
+				continue
+			}
+
+			event.Raw = raw.Bytes()
+			event.Data = string(bytes.Join(dataLines, []byte("\n")))
+			event.Comment = !hasFields
+
+			return event, nil
+		}
+
+		if trimmed[0] == ':' {
+			continue
+		}
+
+		hasFields = true
+
+		field, value, _ := bytes.Cut(trimmed, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+
+		switch string(field) {
+		case "data":
+			dataLines = append(dataLines, value)
+		case "id":
+			event.ID = string(value)
+		case "event":
+			event.Event = string(value)
+		}
+	}
+}
+
+// WriteData writes a data only event
+func WriteData(w io.Writer, data []byte) (int, error) {
+	return fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// WriteEvent writes a named event, clients that only handle data only events
+// ignore it
+func WriteEvent(w io.Writer, event string, data []byte) (int, error) {
+	return fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// WriteDone writes the final [DONE] event of an OpenAI stream
+func WriteDone(w io.Writer) (int, error) {
+	return WriteData(w, []byte(DoneData))
+}
+
+// WriteComment writes a comment line, ignored by clients and commonly used to
+// keep idle connections open
+func WriteComment(w io.Writer, comment string) (int, error) {
+	return fmt.Fprintf(w, ": %s\n\n", comment)
+}
@@ -0,0 +1,78 @@
+package sse_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/kava-labs/kavachat/api/internal/sse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_Next(t *testing.T) {
+	stream := strings.Join([]string{
+		"data: {\"a\":1}\n\n",
+		": keep-alive\n\n",
+		"id: 5\nevent: message\ndata: line1\ndata: line2\n\n",
+		"data: {\"b\":2}\r\n\r\n",
+		"data: [DONE]\n\n",
+	}, "")
+
+	reader := sse.NewReader(strings.NewReader(stream))
+
+	event, err := reader.Next()
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, event.Data)
+	require.Equal(t, "data: {\"a\":1}\n\n", string(event.Raw))
+	require.False(t, event.Comment)
+
+	event, err = reader.Next()
+	require.NoError(t, err)
+	require.True(t, event.Comment)
+	require.Equal(t, ": keep-alive\n\n", string(event.Raw))
+
+	event, err = reader.Next()
+	require.NoError(t, err)
+	require.Equal(t, "5", event.ID)
+	require.Equal(t, "message", event.Event)
+	require.Equal(t, "line1\nline2", event.Data)
+
+	event, err = reader.Next()
+	require.NoError(t, err)
+	require.Equal(t, `{"b":2}`, event.Data)
+	require.Equal(t, "data: {\"b\":2}\r\n\r\n", string(event.Raw))
+
+	event, err = reader.Next()
+	require.NoError(t, err)
+	require.True(t, event.IsDone())
+
+	_, err = reader.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestReader_Next_PartialEvent(t *testing.T) {
+	reader := sse.NewReader(strings.NewReader("data: partial"))
+
+	event, err := reader.Next()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, "data: partial", string(event.Raw))
+}
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+
+	_, err := sse.WriteData(&buf, []byte(`{"a":1}`))
+	require.NoError(t, err)
+
+	_, err = sse.WriteComment(&buf, "keep-alive")
+	require.NoError(t, err)
+
+	_, err = sse.WriteEvent(&buf, "tool_call", []byte(`{"b":2}`))
+	require.NoError(t, err)
+
+	_, err = sse.WriteDone(&buf)
+	require.NoError(t, err)
+
+	require.Equal(t, "data: {\"a\":1}\n\n: keep-alive\n\nevent: tool_call\ndata: {\"b\":2}\n\ndata: [DONE]\n\n", buf.String())
+}
@@ -0,0 +1,698 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/otel"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// dedupBlobPrefix is the key prefix of deduplicated bodies. Blobs are
+	// stored at blobs/{sha256}/{generation} with the references of all
+	// generations at blobs/{sha256}/refs.
+	dedupBlobPrefix = "blobs/"
+	dedupRefsName   = "refs"
+
+	// Pointer metadata keys with the blob of the object
+	metadataDedupBlob = "dedup-blob"
+	metadataDedupSize = "dedup-size"
+	metadataDedupETag = "dedup-etag"
+
+	// dedupMaxAttempts is the number of conditional writes of the references
+	// before concurrent updates fail the request
+	dedupMaxAttempts = 10
+)
+
+// Dedup is a Storage that stores bodies with a content hash once. Objects
+// with a PutInput.ContentSHA256 are stored as empty pointer objects that
+// reference a blob with the body, other objects are stored unchanged.
+//
+// The references of the blobs of a hash are counted in a refs object updated
+// with conditional puts. A blob is deleted when the last object referencing
+// it is deleted, including expired objects deleted by the Sweeper. Blobs
+// expire at twice the retention of the object that created them, so they
+// outlive every object that references them. New objects that would outlive
+// the blob create a new generation of the blob instead. Keys of deduplicated
+// objects must not be reused.
+type Dedup struct {
+	storage Storage
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+var (
+	_ Storage   = (*Dedup)(nil)
+	_ Presigner = (*Dedup)(nil)
+	_ Multipart = (*Dedup)(nil)
+)
+
+// dedupRefs are the objects referencing the blob generations of a hash
+type dedupRefs struct {
+	// Current is the blob referenced by new objects, nil if there is none
+	Current *dedupBlob `json:"current,omitempty"`
+	// Objects are the blob keys referenced by object key
+	Objects map[string]string `json:"objects"`
+}
+
+// dedupBlob is a stored generation of a blob
+type dedupBlob struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// NewDedup creates a Dedup storage storing blobs and pointers in the storage.
+// The TTL is the expiration of objects stored without one, it should be the
+// TTL of the storage.
+func NewDedup(store Storage, ttl time.Duration) *Dedup {
+	return &Dedup{
+		storage: store,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// Put implements Storage. Objects with a content hash reference the current
+// blob of the hash, or a new blob with the body if there is none. The body is
+// only read for new blobs, and must match the hash.
+func (d *Dedup) Put(ctx context.Context, input PutInput) (Object, error) {
+	if input.ContentSHA256 == "" {
+		return d.storage.Put(ctx, input)
+	}
+
+	if hash, err := hex.DecodeString(input.ContentSHA256); err != nil || len(hash) != sha256.Size {
+		return Object{}, fmt.Errorf("invalid content SHA-256 %q", input.ContentSHA256)
+	}
+
+	// Pointers and blobs expire explicitly, the blob expiration depends on
+	// the object expiration
+	now := d.now()
+	input.ExpireAt = expireAt(input, now, d.ttl)
+
+	blob, err := d.acquire(ctx, input.Key, input.ContentSHA256, input.ExpireAt, func() (*dedupBlob, error) {
+		return d.putBlob(ctx, input, now)
+	})
+	if err != nil {
+		return Object{}, err
+	}
+
+	return d.putPointer(ctx, input, blob)
+}
+
+// Copy implements Storage. Copies with a content hash reference the current
+// blob of the hash, or a new blob copied from the source if there is none.
+// Sources that are pointers are copied from their blob.
+func (d *Dedup) Copy(ctx context.Context, input CopyInput) (Object, error) {
+	_, sourceBlobKey, err := d.head(ctx, input.SourceKey)
+	if err != nil {
+		return Object{}, err
+	}
+
+	if sourceBlobKey != "" {
+		input.SourceKey = sourceBlobKey
+	}
+
+	if input.ContentSHA256 == "" {
+		return d.storage.Copy(ctx, input)
+	}
+
+	if hash, err := hex.DecodeString(input.ContentSHA256); err != nil || len(hash) != sha256.Size {
+		return Object{}, fmt.Errorf("invalid content SHA-256 %q", input.ContentSHA256)
+	}
+
+	now := d.now()
+	input.ExpireAt = expireAt(PutInput{ExpireAt: input.ExpireAt}, now, d.ttl)
+
+	blob, err := d.acquire(ctx, input.Key, input.ContentSHA256, input.ExpireAt, func() (*dedupBlob, error) {
+		return d.copyBlob(ctx, input, now)
+	})
+	if err != nil {
+		return Object{}, err
+	}
+
+	return d.putPointer(ctx, PutInput{
+		Key:                input.Key,
+		ContentType:        input.ContentType,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           input.Metadata,
+		ExpireAt:           input.ExpireAt,
+	}, blob)
+}
+
+// putPointer stores the pointer of the input to the acquired blob, releasing
+// the reference if it fails
+func (d *Dedup) putPointer(ctx context.Context, input PutInput, blob dedupBlob) (Object, error) {
+	metadata := maps.Clone(input.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[metadataDedupBlob] = blob.Key
+	metadata[metadataDedupSize] = strconv.FormatInt(blob.Size, 10)
+	metadata[metadataDedupETag] = blob.ETag
+
+	pointer, err := d.storage.Put(ctx, PutInput{
+		Key:                input.Key,
+		Body:               bytes.NewReader(nil),
+		Size:               0,
+		ContentType:        input.ContentType,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           metadata,
+		ExpireAt:           input.ExpireAt,
+		IfMatch:            input.IfMatch,
+		IfNoneMatch:        input.IfNoneMatch,
+	})
+	if err != nil {
+		if _, releaseErr := d.release(ctx, input.Key, blob.Key); releaseErr != nil {
+			err = errors.Join(err, releaseErr)
+		}
+
+		return Object{}, err
+	}
+
+	object, _ := resolvePointer(pointer)
+	return object, nil
+}
+
+// Get implements Storage. Pointers return the body of their blob with the
+// metadata of the pointer, conditions are checked against the blob ETag.
+func (d *Dedup) Get(ctx context.Context, input GetInput) (*Reader, error) {
+	object, blobKey, err := d.head(ctx, input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if blobKey == "" {
+		return d.storage.Get(ctx, input)
+	}
+
+	if err := notModified(object, input); err != nil {
+		return nil, err
+	}
+
+	reader, err := d.storage.Get(ctx, GetInput{Key: blobKey, Range: input.Range})
+	if err != nil {
+		return nil, err
+	}
+
+	reader.Object = object
+	return reader, nil
+}
+
+// Head implements Storage. Pointers have the size and ETag of their blob.
+func (d *Dedup) Head(ctx context.Context, key string) (Object, error) {
+	object, _, err := d.head(ctx, key)
+	return object, err
+}
+
+// Delete implements Storage. The references of deleted pointers are released,
+// and blobs that are no longer referenced are deleted.
+func (d *Dedup) Delete(ctx context.Context, keys ...string) error {
+	_, err := d.deleteBytes(ctx, keys...)
+	return err
+}
+
+// deleteBytes implements bytesDeleter. Pointers are empty, the size of their
+// blob is only counted if it was deleted with the last reference.
+func (d *Dedup) deleteBytes(ctx context.Context, keys ...string) (int64, error) {
+	type pointer struct {
+		blobKey string
+		size    int64
+	}
+
+	var deleted int64
+	pointers := make(map[string]pointer)
+	for _, key := range keys {
+		object, err := d.storage.Head(ctx, key)
+		var expired *ExpiredError
+		if errors.As(err, &expired) {
+			object = expired.Object
+		} else if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			return 0, err
+		}
+
+		deleted += object.Size
+		if resolved, blobKey := resolvePointer(object); blobKey != "" {
+			pointers[key] = pointer{blobKey: blobKey, size: resolved.Size}
+		}
+	}
+
+	// Pointers are deleted first, a failed release leaves a blob that expires
+	// instead of a pointer without a blob
+	if err := d.storage.Delete(ctx, keys...); err != nil {
+		return 0, err
+	}
+
+	for key, pointer := range pointers {
+		blobDeleted, err := d.release(ctx, key, pointer.blobKey)
+		if err != nil {
+			return deleted, err
+		}
+
+		if blobDeleted {
+			deleted += pointer.size
+		}
+	}
+
+	return deleted, nil
+}
+
+// List implements Storage, blobs and references are listed under blobs/
+func (d *Dedup) List(ctx context.Context, input ListInput) ([]string, error) {
+	return d.storage.List(ctx, input)
+}
+
+// PresignGet implements Presigner if the storage does. Pointers are presigned
+// with the key of their blob and the headers of the object, as blobs are
+// stored without a filename.
+func (d *Dedup) PresignGet(ctx context.Context, object Object, ttl time.Duration) (string, error) {
+	presigner, ok := d.storage.(Presigner)
+	if !ok {
+		return "", errors.New("storage does not support presigned URLs")
+	}
+
+	_, blobKey, err := d.head(ctx, object.Key)
+	if err != nil {
+		return "", err
+	}
+
+	if blobKey != "" {
+		object.Key = blobKey
+	}
+
+	return presigner.PresignGet(ctx, object, ttl)
+}
+
+// PresignPut implements Presigner if the storage does. Objects uploaded with
+// the request are not deduplicated.
+func (d *Dedup) PresignPut(ctx context.Context, input PutInput, ttl time.Duration) (PresignedRequest, error) {
+	presigner, ok := d.storage.(Presigner)
+	if !ok {
+		return PresignedRequest{}, errors.New("storage does not support presigned URLs")
+	}
+
+	return presigner.PresignPut(ctx, input, ttl)
+}
+
+// CreateMultipartUpload implements Multipart if the storage does. Completed
+// uploads are stored unchanged, copies with a content hash deduplicate them.
+func (d *Dedup) CreateMultipartUpload(ctx context.Context, input PutInput) (string, error) {
+	multipart, err := d.multipart()
+	if err != nil {
+		return "", err
+	}
+
+	return multipart.CreateMultipartUpload(ctx, input)
+}
+
+// UploadPart implements Multipart if the storage does
+func (d *Dedup) UploadPart(ctx context.Context, input UploadPartInput) (Part, error) {
+	multipart, err := d.multipart()
+	if err != nil {
+		return Part{}, err
+	}
+
+	return multipart.UploadPart(ctx, input)
+}
+
+// ListParts implements Multipart if the storage does
+func (d *Dedup) ListParts(ctx context.Context, key string, uploadID string) ([]Part, error) {
+	multipart, err := d.multipart()
+	if err != nil {
+		return nil, err
+	}
+
+	return multipart.ListParts(ctx, key, uploadID)
+}
+
+// CompleteMultipartUpload implements Multipart if the storage does
+func (d *Dedup) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (Object, error) {
+	multipart, err := d.multipart()
+	if err != nil {
+		return Object{}, err
+	}
+
+	return multipart.CompleteMultipartUpload(ctx, key, uploadID, parts)
+}
+
+// AbortMultipartUpload implements Multipart if the storage does
+func (d *Dedup) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	multipart, err := d.multipart()
+	if err != nil {
+		return err
+	}
+
+	return multipart.AbortMultipartUpload(ctx, key, uploadID)
+}
+
+// ListMultipartUploads implements Multipart if the storage does
+func (d *Dedup) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	multipart, err := d.multipart()
+	if err != nil {
+		return nil, err
+	}
+
+	return multipart.ListMultipartUploads(ctx, prefix)
+}
+
+// multipart returns the wrapped storage if it supports multipart uploads
+func (d *Dedup) multipart() (Multipart, error) {
+	multipart, ok := d.storage.(Multipart)
+	if !ok {
+		return nil, errors.New("storage does not support multipart uploads")
+	}
+
+	return multipart, nil
+}
+
+// head returns the object and the key of its blob, empty if the object is not
+// a pointer. Expired pointers return an *ExpiredError with the resolved
+// object.
+func (d *Dedup) head(ctx context.Context, key string) (Object, string, error) {
+	object, err := d.storage.Head(ctx, key)
+	if err != nil {
+		var expired *ExpiredError
+		if errors.As(err, &expired) {
+			resolved, _ := resolvePointer(expired.Object)
+			return Object{}, "", &ExpiredError{Object: resolved}
+		}
+
+		return Object{}, "", err
+	}
+
+	resolved, blobKey := resolvePointer(object)
+	return resolved, blobKey, nil
+}
+
+// acquire adds a reference from the object key to the current blob of the
+// hash, storing a new blob with the store function if there is none or it
+// expires before the object. Returns the referenced blob.
+func (d *Dedup) acquire(
+	ctx context.Context,
+	key string,
+	hash string,
+	objectExpireAt time.Time,
+	store func() (*dedupBlob, error),
+) (dedupBlob, error) {
+	// The body is stored at most once, a blob stored by a failed attempt is
+	// used by the next attempt
+	var created *dedupBlob
+	for range dedupMaxAttempts {
+		refs, conditions, err := d.readRefs(ctx, hash)
+		if err != nil {
+			return dedupBlob{}, err
+		}
+
+		blob := refs.Current
+		if blob == nil || expiresBefore(blob.ExpireAt, objectExpireAt) {
+			if created == nil {
+				created, err = store()
+				if err != nil {
+					return dedupBlob{}, err
+				}
+			}
+
+			blob = created
+			refs.Current = created
+		}
+
+		refs.Objects[key] = blob.Key
+		if err := d.writeRefs(ctx, hash, refs, conditions); err != nil {
+			if errors.Is(err, ErrPreconditionFailed) {
+				continue
+			}
+
+			return dedupBlob{}, err
+		}
+
+		if created != nil && created.Key != blob.Key {
+			// Another object stored the blob first
+			if err := d.storage.Delete(ctx, created.Key); err != nil {
+				return dedupBlob{}, err
+			}
+		}
+
+		if blob != created && otel.GlobalMetrics != nil {
+			otel.GlobalMetrics.RecordDeduplicatedBytes(ctx, blob.Size)
+		}
+
+		return *blob, nil
+	}
+
+	if created != nil {
+		if err := d.storage.Delete(ctx, created.Key); err != nil {
+			return dedupBlob{}, err
+		}
+	}
+
+	return dedupBlob{}, fmt.Errorf("too many concurrent updates of blob %s: %w", hash, ErrPreconditionFailed)
+}
+
+// release removes the reference from the object key to the blob, deleting the
+// blob if it is no longer referenced. Returns true if the blob was deleted.
+// Missing references are ignored.
+func (d *Dedup) release(ctx context.Context, key string, blobKey string) (bool, error) {
+	hash, _, _ := strings.Cut(strings.TrimPrefix(blobKey, dedupBlobPrefix), "/")
+
+	for range dedupMaxAttempts {
+		refs, conditions, err := d.readRefs(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+
+		if refs.Objects[key] != blobKey {
+			return false, nil
+		}
+
+		delete(refs.Objects, key)
+
+		referenced := false
+		for _, referencedKey := range refs.Objects {
+			if referencedKey == blobKey {
+				referenced = true
+				break
+			}
+		}
+
+		// New objects cannot reference the blob once it is not current
+		if !referenced && refs.Current != nil && refs.Current.Key == blobKey {
+			refs.Current = nil
+		}
+
+		if err := d.writeRefs(ctx, hash, refs, conditions); err != nil {
+			if errors.Is(err, ErrPreconditionFailed) {
+				continue
+			}
+
+			return false, err
+		}
+
+		if referenced {
+			return false, nil
+		}
+
+		// The sweeper may have deleted the expired blob already
+		if _, err := d.storage.Head(ctx, blobKey); err != nil && !errors.Is(err, ErrExpired) {
+			if errors.Is(err, ErrNotFound) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		if err := d.storage.Delete(ctx, blobKey); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, fmt.Errorf("too many concurrent updates of blob %s: %w", hash, ErrPreconditionFailed)
+}
+
+// putBlob stores the body of the input as a new blob generation of its hash.
+// The blob expires at twice the retention of the object, so later objects
+// with the same retention reference it for at least one retention.
+func (d *Dedup) putBlob(ctx context.Context, input PutInput, now time.Time) (*dedupBlob, error) {
+	key := dedupBlobPrefix + input.ContentSHA256 + "/" + ulid.Make().String()
+
+	// The filename of the disposition is from the object that created the
+	// blob, presigned downloads only get the disposition type
+	disposition, _, _ := strings.Cut(input.ContentDisposition, ";")
+
+	hash := sha256.New()
+	object, err := d.storage.Put(ctx, PutInput{
+		Key:                key,
+		Body:               io.TeeReader(input.Body, hash),
+		Size:               input.Size,
+		ContentType:        input.ContentType,
+		ContentDisposition: disposition,
+		ExpireAt:           blobExpireAt(input.ExpireAt, now),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != input.ContentSHA256 {
+		if err := d.storage.Delete(ctx, key); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("body does not match content SHA-256 %s", input.ContentSHA256)
+	}
+
+	return &dedupBlob{
+		Key:      object.Key,
+		Size:     object.Size,
+		ETag:     object.ETag,
+		ExpireAt: object.ExpireAt,
+	}, nil
+}
+
+// copyBlob copies the source of the input to a new blob generation of its
+// hash, like putBlob without reading the body
+func (d *Dedup) copyBlob(ctx context.Context, input CopyInput, now time.Time) (*dedupBlob, error) {
+	disposition, _, _ := strings.Cut(input.ContentDisposition, ";")
+
+	object, err := d.storage.Copy(ctx, CopyInput{
+		SourceKey:          input.SourceKey,
+		Key:                dedupBlobPrefix + input.ContentSHA256 + "/" + ulid.Make().String(),
+		ContentType:        input.ContentType,
+		ContentDisposition: disposition,
+		ExpireAt:           blobExpireAt(input.ExpireAt, now),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dedupBlob{
+		Key:      object.Key,
+		Size:     object.Size,
+		ETag:     object.ETag,
+		ExpireAt: object.ExpireAt,
+	}, nil
+}
+
+// blobExpireAt returns the expiration of a blob created at now for an object
+// expiring at expireAt, twice the retention of the object. Objects without an
+// expiration create blobs without one.
+func blobExpireAt(expireAt time.Time, now time.Time) time.Time {
+	if expireAt.IsZero() {
+		return expireAt
+	}
+
+	return expireAt.Add(expireAt.Sub(now))
+}
+
+// readRefs returns the references of the hash and the conditions to replace
+// them. Expired references are empty, all objects referencing their blobs
+// have expired.
+func (d *Dedup) readRefs(ctx context.Context, hash string) (dedupRefs, PutInput, error) {
+	refs := dedupRefs{Objects: make(map[string]string)}
+
+	reader, err := d.storage.Get(ctx, GetInput{Key: dedupRefsKey(hash)})
+	var expired *ExpiredError
+	switch {
+	case err == nil:
+		defer reader.Body.Close()
+
+		if err := json.NewDecoder(reader.Body).Decode(&refs); err != nil {
+			return dedupRefs{}, PutInput{}, fmt.Errorf("invalid references of blob %s: %w", hash, err)
+		}
+
+		if refs.Objects == nil {
+			refs.Objects = make(map[string]string)
+		}
+
+		return refs, PutInput{IfMatch: reader.ETag, ExpireAt: reader.ExpireAt}, nil
+	case errors.As(err, &expired):
+		return refs, PutInput{IfMatch: expired.Object.ETag}, nil
+	case errors.Is(err, ErrNotFound):
+		return refs, PutInput{IfNoneMatch: "*"}, nil
+	default:
+		return dedupRefs{}, PutInput{}, err
+	}
+}
+
+// writeRefs replaces the references of the hash with a conditional put. The
+// references expire with the current blob, or later if they did before, so
+// they outlive all referenced blobs.
+func (d *Dedup) writeRefs(ctx context.Context, hash string, refs dedupRefs, conditions PutInput) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+
+	refsExpireAt := conditions.ExpireAt
+	if refs.Current != nil && !expiresBefore(refs.Current.ExpireAt, refsExpireAt) {
+		refsExpireAt = refs.Current.ExpireAt
+	}
+
+	_, err = d.storage.Put(ctx, PutInput{
+		Key:         dedupRefsKey(hash),
+		Body:        bytes.NewReader(data),
+		Size:        int64(len(data)),
+		ContentType: "application/json",
+		ExpireAt:    refsExpireAt,
+		IfMatch:     conditions.IfMatch,
+		IfNoneMatch: conditions.IfNoneMatch,
+	})
+	return err
+}
+
+// expiresBefore returns true if an expiration is before the other, zero
+// expirations never expire
+func expiresBefore(expireAt time.Time, other time.Time) bool {
+	if expireAt.IsZero() {
+		return false
+	}
+
+	return other.IsZero() || expireAt.Before(other)
+}
+
+// IsDedupKey returns true if the key is a blob or the references of blobs
+// stored by Dedup
+func IsDedupKey(key string) bool {
+	return strings.HasPrefix(key, dedupBlobPrefix)
+}
+
+// dedupRefsKey returns the key of the references of the blobs of the hash
+func dedupRefsKey(hash string) string {
+	return dedupBlobPrefix + hash + "/" + dedupRefsName
+}
+
+// resolvePointer returns the object with the size and ETag of its blob, and
+// the blob key. Objects that are not pointers are returned unchanged with an
+// empty key.
+func resolvePointer(object Object) (Object, string) {
+	blobKey := object.Metadata[metadataDedupBlob]
+	if blobKey == "" {
+		return object, ""
+	}
+
+	object.Size, _ = strconv.ParseInt(object.Metadata[metadataDedupSize], 10, 64)
+	object.ETag = object.Metadata[metadataDedupETag]
+
+	object.Metadata = maps.Clone(object.Metadata)
+	delete(object.Metadata, metadataDedupBlob)
+	delete(object.Metadata, metadataDedupSize)
+	delete(object.Metadata, metadataDedupETag)
+
+	return object, blobKey
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// contentSHA256 returns the hex SHA-256 of the content
+func contentSHA256(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// presigningMemory is a Memory storage that records presigned downloads
+type presigningMemory struct {
+	*Memory
+	Presigner
+
+	get Object
+}
+
+func (p *presigningMemory) PresignGet(_ context.Context, object Object, _ time.Duration) (string, error) {
+	p.get = object
+	return "https://example.com/" + object.Key, nil
+}
+
+func TestDedupPresignGet(t *testing.T) {
+	ctx := context.Background()
+	inner := &presigningMemory{Memory: NewMemory(0)}
+	store := NewDedup(inner, 0)
+
+	for _, key := range []string{"a", "b"} {
+		_, err := store.Put(ctx, PutInput{
+			Key:                key,
+			Body:               strings.NewReader("hello"),
+			Size:               5,
+			ContentType:        "text/plain",
+			ContentDisposition: `inline; filename="` + key + `.txt"`,
+			ContentSHA256:      contentSHA256("hello"),
+		})
+		require.NoError(t, err)
+	}
+
+	object, err := store.Head(ctx, "b")
+	require.NoError(t, err)
+
+	_, err = store.PresignGet(ctx, object, time.Minute)
+	require.NoError(t, err)
+	require.True(t, IsDedupKey(inner.get.Key), "the blob is presigned")
+	require.Equal(t, `inline; filename="b.txt"`, inner.get.ContentDisposition, "with the headers of the object")
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	inner := NewMemory(0)
+	inner.now = func() time.Time { return now }
+	store := NewDedup(inner, 0)
+	store.now = inner.now
+
+	put := func(key string, content string, expireAt time.Time) Object {
+		t.Helper()
+
+		object, err := store.Put(ctx, PutInput{
+			Key:                key,
+			Body:               strings.NewReader(content),
+			Size:               int64(len(content)),
+			ContentType:        "image/png",
+			ContentDisposition: `inline; filename="` + key + `.png"`,
+			Metadata:           map[string]string{"owner": key},
+			ExpireAt:           expireAt,
+			ContentSHA256:      contentSHA256(content),
+		})
+		require.NoError(t, err)
+
+		return object
+	}
+
+	read := func(input GetInput) (*Reader, string) {
+		t.Helper()
+
+		reader, err := store.Get(ctx, input)
+		require.NoError(t, err)
+		defer reader.Body.Close()
+
+		body, err := io.ReadAll(reader.Body)
+		require.NoError(t, err)
+
+		return reader, string(body)
+	}
+
+	// blobs returns the stored blob generations of the content
+	blobs := func(content string) []string {
+		t.Helper()
+
+		keys, err := inner.List(ctx, ListInput{Prefix: dedupBlobPrefix + contentSHA256(content) + "/"})
+		require.NoError(t, err)
+
+		var generations []string
+		for _, key := range keys {
+			if !strings.HasSuffix(key, "/"+dedupRefsName) {
+				generations = append(generations, key)
+			}
+		}
+
+		return generations
+	}
+
+	t.Run("stored once", func(t *testing.T) {
+		first := put("first", "screenshot", now.Add(time.Hour))
+		second := put("second", "screenshot", now.Add(time.Hour))
+		require.Len(t, blobs("screenshot"), 1)
+
+		require.Equal(t, int64(10), second.Size)
+		require.Equal(t, first.ETag, second.ETag)
+		require.Equal(t, map[string]string{"owner": "second"}, second.Metadata, "blob metadata is not returned")
+
+		reader, body := read(GetInput{Key: "second"})
+		require.Equal(t, "screenshot", body)
+		require.Equal(t, `inline; filename="second.png"`, reader.ContentDisposition)
+		require.Equal(t, map[string]string{"owner": "second"}, reader.Metadata)
+		require.Equal(t, int64(10), reader.Length)
+
+		pointer, err := inner.Head(ctx, "second")
+		require.NoError(t, err)
+		require.Zero(t, pointer.Size, "pointers have no body")
+
+		object, err := store.Head(ctx, "first")
+		require.NoError(t, err)
+		require.Equal(t, int64(10), object.Size)
+		require.Equal(t, first.ETag, object.ETag)
+
+		reader, body = read(GetInput{Key: "first", Range: "bytes=0-5"})
+		require.Equal(t, "screen", body)
+		require.Equal(t, "bytes 0-5/10", reader.ContentRange)
+
+		_, err = store.Get(ctx, GetInput{Key: "first", IfNoneMatch: first.ETag})
+		require.ErrorIs(t, err, ErrNotModified)
+
+		_, err = store.Get(ctx, GetInput{Key: "first", Range: "bytes=20-"})
+		require.ErrorIs(t, err, ErrInvalidRange)
+	})
+
+	t.Run("deleted with the last reference", func(t *testing.T) {
+		require.NoError(t, store.Delete(ctx, "first"))
+		require.Len(t, blobs("screenshot"), 1, "still referenced by second")
+
+		_, body := read(GetInput{Key: "second"})
+		require.Equal(t, "screenshot", body)
+
+		require.NoError(t, store.Delete(ctx, "second", "missing"))
+		require.Empty(t, blobs("screenshot"))
+
+		_, err := store.Get(ctx, GetInput{Key: "second"})
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// Deleting again is ignored
+		require.NoError(t, store.Delete(ctx, "second"))
+	})
+
+	t.Run("new generation for later expiration", func(t *testing.T) {
+		put("early", "diagram", now.Add(time.Hour))
+		put("within", "diagram", now.Add(2*time.Hour))
+		require.Len(t, blobs("diagram"), 1, "the blob expires after twice the retention")
+
+		put("late", "diagram", now.Add(3*time.Hour))
+		generations := blobs("diagram")
+		require.Len(t, generations, 2)
+
+		require.NoError(t, store.Delete(ctx, "early", "within"))
+		require.Len(t, blobs("diagram"), 1, "old generation deleted")
+
+		_, body := read(GetInput{Key: "late"})
+		require.Equal(t, "diagram", body)
+
+		require.NoError(t, store.Delete(ctx, "late"))
+		require.Empty(t, blobs("diagram"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		put("expiring", "photo", now.Add(time.Minute))
+		put("lasting", "photo", now.Add(time.Hour))
+
+		logger := zerolog.Nop()
+		sweeper := NewSweeper(store, time.Minute, func(string) bool { return true }, &logger)
+		sweeper.now = inner.now
+
+		now = now.Add(time.Minute)
+		_, err := store.Get(ctx, GetInput{Key: "expiring"})
+		require.ErrorIs(t, err, ErrExpired)
+
+		// The first generation is only referenced by the expired pointer
+		result, err := sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 1, Bytes: 5}, result)
+		require.Len(t, blobs("photo"), 1, "still referenced by lasting")
+
+		_, body := read(GetInput{Key: "lasting"})
+		require.Equal(t, "photo", body)
+
+		now = now.Add(time.Hour)
+		result, err = sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 1, Bytes: 5}, result, "blob bytes are counted once")
+		require.Empty(t, blobs("photo"))
+	})
+
+	t.Run("expired shared blob", func(t *testing.T) {
+		put("logo-a", "logo", now.Add(time.Minute))
+		put("logo-b", "logo", now.Add(90*time.Second))
+		require.Len(t, blobs("logo"), 1)
+
+		logger := zerolog.Nop()
+		sweeper := NewSweeper(store, time.Minute, func(string) bool { return true }, &logger)
+		sweeper.now = inner.now
+
+		now = now.Add(time.Minute)
+		result, err := sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 1, Bytes: 0}, result, "the blob is still referenced")
+
+		now = now.Add(time.Minute)
+		result, err = sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 2, Bytes: 4}, result, "the expired blob and pointer")
+		require.Empty(t, blobs("logo"))
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		_, err := store.Put(ctx, PutInput{
+			Key:           "tampered",
+			Body:          strings.NewReader("other content"),
+			Size:          13,
+			ExpireAt:      now.Add(time.Hour),
+			ContentSHA256: contentSHA256("content"),
+		})
+		require.Error(t, err)
+		require.Empty(t, blobs("content"))
+
+		_, err = store.Head(ctx, "tampered")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = store.Put(ctx, PutInput{Key: "invalid", Body: strings.NewReader(""), ContentSHA256: "abc"})
+		require.Error(t, err)
+	})
+
+	t.Run("without hash", func(t *testing.T) {
+		_, err := store.Put(ctx, PutInput{
+			Key:      "plain",
+			Body:     strings.NewReader("plain"),
+			Size:     5,
+			ExpireAt: now.Add(time.Hour),
+		})
+		require.NoError(t, err)
+
+		object, err := inner.Head(ctx, "plain")
+		require.NoError(t, err)
+		require.Equal(t, int64(5), object.Size, "stored unchanged")
+
+		require.NoError(t, store.Delete(ctx, "plain"))
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		_, err := inner.Put(ctx, PutInput{Key: "staged", Body: strings.NewReader("recording"), Size: 9})
+		require.NoError(t, err)
+
+		copyStaged := func(key string) Object {
+			t.Helper()
+
+			object, err := store.Copy(ctx, CopyInput{
+				SourceKey:     "staged",
+				Key:           key,
+				ContentType:   "audio/mpeg",
+				ExpireAt:      now.Add(time.Hour),
+				ContentSHA256: contentSHA256("recording"),
+			})
+			require.NoError(t, err)
+
+			return object
+		}
+
+		copied := copyStaged("copied")
+		require.Equal(t, int64(9), copied.Size)
+		require.Len(t, blobs("recording"), 1)
+
+		uploaded := put("uploaded", "recording", now.Add(time.Hour))
+		require.Equal(t, copied.ETag, uploaded.ETag, "uploads reference the copied blob")
+		require.Len(t, blobs("recording"), 1)
+
+		copyStaged("copied-again")
+		require.Len(t, blobs("recording"), 1, "copies reference the existing blob")
+
+		_, body := read(GetInput{Key: "copied-again"})
+		require.Equal(t, "recording", body)
+
+		// Pointers are copied from their blob
+		_, err = store.Copy(ctx, CopyInput{SourceKey: "uploaded", Key: "plain-copy"})
+		require.NoError(t, err)
+
+		object, err := inner.Head(ctx, "plain-copy")
+		require.NoError(t, err)
+		require.Equal(t, int64(9), object.Size, "copies without a hash are stored unchanged")
+
+		require.NoError(t, store.Delete(ctx, "copied", "uploaded", "copied-again", "plain-copy", "staged"))
+		require.Empty(t, blobs("recording"))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				key := fmt.Sprintf("concurrent-%d", i)
+				put(key, "shared", now.Add(time.Hour))
+
+				// Half of the objects are deleted while others are stored
+				if i%2 == 0 {
+					require.NoError(t, store.Delete(ctx, key))
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := 1; i < 20; i += 2 {
+			_, body := read(GetInput{Key: fmt.Sprintf("concurrent-%d", i)})
+			require.Equal(t, "shared", body)
+		}
+
+		for i := 1; i < 20; i += 2 {
+			require.NoError(t, store.Delete(ctx, fmt.Sprintf("concurrent-%d", i)))
+		}
+		require.Empty(t, blobs("shared"))
+	})
+}
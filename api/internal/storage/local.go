@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const localMetadataExt = ".json"
+
+// Local is a Storage in a local directory for development. Keys are escaped
+// to flat file names, with the object metadata in a JSON file next to each
+// object. Conditional puts are only atomic within the process.
+type Local struct {
+	root string
+	ttl  time.Duration
+	now  func() time.Time
+
+	// mu serializes conditional puts
+	mu sync.Mutex
+}
+
+var _ Storage = (*Local)(nil)
+
+// NewLocal creates a Local storage in the directory, creating it if missing.
+// Objects expire after the TTL or never if 0.
+func NewLocal(root string, ttl time.Duration) (*Local, error) {
+	for _, dir := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+	}
+
+	return &Local{
+		root: root,
+		ttl:  ttl,
+		now:  time.Now,
+	}, nil
+}
+
+// Put implements Storage. The object is written to a temporary file and
+// renamed, readers never see a partial object.
+func (l *Local) Put(_ context.Context, input PutInput) (Object, error) {
+	tmp, err := os.CreateTemp(filepath.Join(l.root, "tmp"), "object-*")
+	if err != nil {
+		return Object{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), input.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	now := l.now()
+	object := Object{
+		Key:                input.Key,
+		Size:               size,
+		ContentType:        input.ContentType,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           maps.Clone(input.Metadata),
+		ETag:               `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+		LastModified:       now.UTC(),
+		ExpireAt:           expireAt(input, now, l.ttl),
+	}
+
+	metadata, err := json.Marshal(object)
+	if err != nil {
+		return Object{}, err
+	}
+
+	if input.IfMatch != "" || input.IfNoneMatch != "" {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		existing, err := l.readMetadata(input.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return Object{}, err
+		}
+
+		var existingObject *Object
+		if err == nil {
+			existingObject = &existing
+		}
+
+		if err := preconditionFailed(existingObject, input); err != nil {
+			return Object{}, err
+		}
+	}
+
+	// The metadata is written last as it marks the object as stored
+	if err := os.Rename(tmp.Name(), l.objectPath(input.Key)); err != nil {
+		return Object{}, err
+	}
+
+	if err := writeFileAtomic(filepath.Join(l.root, "tmp"), l.metadataPath(input.Key), metadata); err != nil {
+		return Object{}, err
+	}
+
+	return object, nil
+}
+
+// Copy implements Storage
+func (l *Local) Copy(ctx context.Context, input CopyInput) (Object, error) {
+	return copyObject(ctx, l, input)
+}
+
+// Get implements Storage
+func (l *Local) Get(_ context.Context, input GetInput) (*Reader, error) {
+	object, err := l.head(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(l.objectPath(input.Key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	reader, err := readObject(object, file, input)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Close the file instead of the no-op closer
+	reader.Body = readCloser{Reader: reader.Body, Closer: file}
+	return reader, nil
+}
+
+// Head implements Storage
+func (l *Local) Head(_ context.Context, key string) (Object, error) {
+	return l.head(key)
+}
+
+// Delete implements Storage
+func (l *Local) Delete(_ context.Context, keys ...string) error {
+	for _, key := range keys {
+		for _, path := range []string{l.metadataPath(key), l.objectPath(key)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// List implements Storage
+func (l *Local) List(_ context.Context, input ListInput) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(l.root, "objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), localMetadataExt)
+		if !ok {
+			continue
+		}
+
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return filterKeys(keys, input), nil
+}
+
+// head returns the metadata of the object, or an *ExpiredError if it has
+// expired
+func (l *Local) head(key string) (Object, error) {
+	object, err := l.readMetadata(key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	if object.expired(l.now()) {
+		return Object{}, &ExpiredError{Object: object}
+	}
+
+	return object, nil
+}
+
+// readMetadata reads the metadata file of the object
+func (l *Local) readMetadata(key string) (Object, error) {
+	data, err := os.ReadFile(l.metadataPath(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Object{}, ErrNotFound
+		}
+
+		return Object{}, err
+	}
+
+	var object Object
+	if err := json.Unmarshal(data, &object); err != nil {
+		return Object{}, fmt.Errorf("invalid metadata of %s: %w", key, err)
+	}
+
+	return object, nil
+}
+
+// objectPath returns the file of the object, keys with slashes are escaped
+// to a single file name
+func (l *Local) objectPath(key string) string {
+	return filepath.Join(l.root, "objects", url.PathEscape(key))
+}
+
+func (l *Local) metadataPath(key string) string {
+	return l.objectPath(key) + localMetadataExt
+}
+
+// writeFileAtomic writes the file with a rename from the temporary directory
+func writeFileAtomic(tmpDir string, path string, data []byte) error {
+	tmp, err := os.CreateTemp(tmpDir, "metadata-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Memory is a Storage in memory, objects are lost on restart. Multipart
+// uploads have no min part size.
+type Memory struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	objects map[string]memoryObject
+	uploads map[string]*memoryUpload
+}
+
+type memoryObject struct {
+	object Object
+	data   []byte
+}
+
+// memoryUpload is an incomplete multipart upload
+type memoryUpload struct {
+	input     PutInput
+	initiated time.Time
+	parts     map[int32][]byte
+}
+
+var (
+	_ Storage   = (*Memory)(nil)
+	_ Multipart = (*Memory)(nil)
+)
+
+// NewMemory creates an empty Memory storage, objects expire after the TTL or
+// never if 0
+func NewMemory(ttl time.Duration) *Memory {
+	return &Memory{
+		ttl:     ttl,
+		now:     time.Now,
+		objects: make(map[string]memoryObject),
+		uploads: make(map[string]*memoryUpload),
+	}
+}
+
+// Put implements Storage
+func (m *Memory) Put(_ context.Context, input PutInput) (Object, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return Object{}, err
+	}
+
+	object := newObject(input, data, m.now(), m.ttl)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var existing *Object
+	if stored, ok := m.objects[input.Key]; ok {
+		existing = &stored.object
+	}
+
+	if err := preconditionFailed(existing, input); err != nil {
+		return Object{}, err
+	}
+
+	m.objects[input.Key] = memoryObject{object: object, data: data}
+
+	return object, nil
+}
+
+// Copy implements Storage
+func (m *Memory) Copy(ctx context.Context, input CopyInput) (Object, error) {
+	return copyObject(ctx, m, input)
+}
+
+// Get implements Storage
+func (m *Memory) Get(_ context.Context, input GetInput) (*Reader, error) {
+	stored, err := m.get(input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return readObject(stored.object, bytes.NewReader(stored.data), input)
+}
+
+// Head implements Storage
+func (m *Memory) Head(_ context.Context, key string) (Object, error) {
+	stored, err := m.get(key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	return stored.object, nil
+}
+
+// Delete implements Storage
+func (m *Memory) Delete(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.objects, key)
+	}
+
+	return nil
+}
+
+// List implements Storage
+func (m *Memory) List(_ context.Context, input ListInput) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+
+	return filterKeys(keys, input), nil
+}
+
+// CreateMultipartUpload implements Multipart
+func (m *Memory) CreateMultipartUpload(_ context.Context, input PutInput) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	input.Body = nil
+	uploadID := ulid.Make().String()
+	m.uploads[uploadID] = &memoryUpload{
+		input:     input,
+		initiated: m.now().UTC(),
+		parts:     make(map[int32][]byte),
+	}
+
+	return uploadID, nil
+}
+
+// UploadPart implements Multipart
+func (m *Memory) UploadPart(_ context.Context, input UploadPartInput) (Part, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return Part{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.upload(input.Key, input.UploadID)
+	if err != nil {
+		return Part{}, err
+	}
+
+	upload.parts[input.PartNumber] = data
+	return newPart(input.PartNumber, data), nil
+}
+
+// ListParts implements Multipart
+func (m *Memory) ListParts(_ context.Context, key string, uploadID string) ([]Part, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.upload(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []Part{}
+	for number, data := range upload.parts {
+		parts = append(parts, newPart(number, data))
+	}
+
+	slices.SortFunc(parts, func(a, b Part) int {
+		return cmp.Compare(a.PartNumber, b.PartNumber)
+	})
+
+	return parts, nil
+}
+
+// CompleteMultipartUpload implements Multipart
+func (m *Memory) CompleteMultipartUpload(_ context.Context, key string, uploadID string, parts []Part) (Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.upload(key, uploadID)
+	if err != nil {
+		return Object{}, err
+	}
+
+	var data []byte
+	for i, part := range parts {
+		uploaded, ok := upload.parts[part.PartNumber]
+		if !ok || newPart(part.PartNumber, uploaded).ETag != part.ETag {
+			return Object{}, ErrInvalidParts
+		}
+
+		if i > 0 && part.PartNumber <= parts[i-1].PartNumber {
+			return Object{}, ErrInvalidParts
+		}
+
+		data = append(data, uploaded...)
+	}
+
+	object := newObject(upload.input, data, m.now(), m.ttl)
+	m.objects[key] = memoryObject{object: object, data: data}
+	delete(m.uploads, uploadID)
+
+	return object, nil
+}
+
+// AbortMultipartUpload implements Multipart
+func (m *Memory) AbortMultipartUpload(_ context.Context, key string, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.upload(key, uploadID); err != nil {
+		return err
+	}
+
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+// ListMultipartUploads implements Multipart
+func (m *Memory) ListMultipartUploads(_ context.Context, prefix string) ([]MultipartUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploads := []MultipartUpload{}
+	for uploadID, upload := range m.uploads {
+		if strings.HasPrefix(upload.input.Key, prefix) {
+			uploads = append(uploads, MultipartUpload{
+				Key:       upload.input.Key,
+				UploadID:  uploadID,
+				Initiated: upload.initiated,
+			})
+		}
+	}
+
+	slices.SortFunc(uploads, func(a, b MultipartUpload) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	return uploads, nil
+}
+
+// upload returns the incomplete upload of the key, the lock must be held
+func (m *Memory) upload(key string, uploadID string) (*memoryUpload, error) {
+	upload, ok := m.uploads[uploadID]
+	if !ok || upload.input.Key != key {
+		return nil, ErrUploadNotFound
+	}
+
+	return upload, nil
+}
+
+// newPart returns the part with the data, the ETag is the MD5 of the data
+func newPart(number int32, data []byte) Part {
+	hash := md5.Sum(data)
+
+	return Part{
+		PartNumber: number,
+		Size:       int64(len(data)),
+		ETag:       `"` + hex.EncodeToString(hash[:]) + `"`,
+	}
+}
+
+// get returns the object, or an *ExpiredError if it has expired
+func (m *Memory) get(key string) (memoryObject, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.objects[key]
+	if !ok {
+		return memoryObject{}, ErrNotFound
+	}
+
+	if stored.object.expired(m.now()) {
+		return memoryObject{}, &ExpiredError{Object: stored.object}
+	}
+
+	return stored, nil
+}
+
+// newObject returns the metadata of an object stored at now
+func newObject(input PutInput, data []byte, now time.Time, ttl time.Duration) Object {
+	hash := md5.Sum(data)
+
+	return Object{
+		Key:                input.Key,
+		Size:               int64(len(data)),
+		ContentType:        input.ContentType,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           maps.Clone(input.Metadata),
+		ETag:               `"` + hex.EncodeToString(hash[:]) + `"`,
+		LastModified:       now.UTC(),
+		ExpireAt:           expireAt(input, now, ttl),
+	}
+}
+
+// readObject returns the reader of the object body for the conditions and
+// range of the input
+func readObject(object Object, body io.ReadSeeker, input GetInput) (*Reader, error) {
+	if err := notModified(object, input); err != nil {
+		return nil, err
+	}
+
+	offset, length, ok, err := parseRange(input.Range, object.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return &Reader{
+			Object: object,
+			Body:   io.NopCloser(body),
+			Length: object.Size,
+		}, nil
+	}
+
+	if _, err := body.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		Object:       object,
+		Body:         io.NopCloser(io.LimitReader(body, length)),
+		Length:       length,
+		ContentRange: contentRange(offset, length, object.Size),
+	}, nil
+}
@@ -0,0 +1,667 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// maxDeleteKeys is the max number of keys of a S3 DeleteObjects request
+	maxDeleteKeys = 1000
+	// metadataExpireAt is the object metadata key of the ExpireAt of objects
+	metadataExpireAt = "expire-at"
+)
+
+// expireDateRegex is a regular expression to extract the expiry-date from the
+// x-amz-expiration response header from S3.
+var expireDateRegex = regexp.MustCompile(`expiry-date="([^"]+)"`)
+
+// S3Client implements the S3 object and multipart upload methods from the
+// AWS SDK.
+type S3Client interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+}
+
+// S3Presigner implements the presign methods from the AWS SDK.
+type S3Presigner interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+	PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// S3 is a Storage in a S3 bucket. The ExpireAt of objects is stored as object
+// metadata. Objects stored without one expire after the TTL since they were
+// last modified. Objects expire earlier if a bucket lifecycle rule expires
+// them first.
+type S3 struct {
+	client     S3Client
+	presigner  S3Presigner
+	bucketName string
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+var (
+	_ Storage   = (*S3)(nil)
+	_ Presigner = (*S3)(nil)
+	_ Multipart = (*S3)(nil)
+)
+
+// NewS3 creates a S3 storage with the client, objects expire after the TTL or
+// never if 0. Presigning is not supported.
+func NewS3(client S3Client, bucketName string, ttl time.Duration) *S3 {
+	return &S3{
+		client:     client,
+		bucketName: bucketName,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// NewS3FromConfig creates a S3 storage with the AWS config from the
+// environment
+func NewS3FromConfig(ctx context.Context, bucketName string, s3PathStyleRequests bool, ttl time.Duration) (*S3, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = s3PathStyleRequests
+	})
+
+	storage := NewS3(client, bucketName, ttl)
+	storage.presigner = s3.NewPresignClient(client)
+
+	return storage, nil
+}
+
+// Put implements Storage
+func (s *S3) Put(ctx context.Context, input PutInput) (Object, error) {
+	putInput := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(input.Key),
+		Body:     input.Body,
+		Metadata: S3Metadata(input.Metadata, input.ExpireAt),
+	}
+
+	if input.Size >= 0 {
+		putInput.ContentLength = aws.Int64(input.Size)
+	}
+
+	if input.ContentType != "" {
+		putInput.ContentType = aws.String(input.ContentType)
+	}
+
+	if input.ContentDisposition != "" {
+		putInput.ContentDisposition = aws.String(input.ContentDisposition)
+	}
+
+	if input.IfMatch != "" {
+		putInput.IfMatch = aws.String(input.IfMatch)
+	}
+
+	if input.IfNoneMatch != "" {
+		putInput.IfNoneMatch = aws.String(input.IfNoneMatch)
+	}
+
+	output, err := s.client.PutObject(ctx, putInput)
+	if err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	now := s.now().UTC()
+	return s.newObject(
+		input.Key,
+		input.Size,
+		putInput.ContentType,
+		putInput.ContentDisposition,
+		putInput.Metadata,
+		output.ETag,
+		now,
+		output.Expiration,
+	), nil
+}
+
+// Copy implements Storage with a server side copy, sources must be at most
+// 5GB
+func (s *S3) Copy(ctx context.Context, input CopyInput) (Object, error) {
+	copyInput := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucketName),
+		Key:               aws.String(input.Key),
+		CopySource:        aws.String(s.bucketName + "/" + url.PathEscape(input.SourceKey)),
+		Metadata:          S3Metadata(input.Metadata, input.ExpireAt),
+		MetadataDirective: s3types.MetadataDirectiveReplace,
+	}
+
+	if input.ContentType != "" {
+		copyInput.ContentType = aws.String(input.ContentType)
+	}
+
+	if input.ContentDisposition != "" {
+		copyInput.ContentDisposition = aws.String(input.ContentDisposition)
+	}
+
+	if _, err := s.client.CopyObject(ctx, copyInput); err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	// The copy result has no size
+	return s.Head(ctx, input.Key)
+}
+
+// Get implements Storage. Conditions and ranges are evaluated by S3.
+func (s *S3) Get(ctx context.Context, input GetInput) (*Reader, error) {
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(input.Key),
+	}
+
+	if input.Range != "" {
+		getInput.Range = aws.String(input.Range)
+	}
+
+	if input.IfNoneMatch != "" {
+		getInput.IfNoneMatch = aws.String(input.IfNoneMatch)
+	} else if !input.IfModifiedSince.IsZero() {
+		getInput.IfModifiedSince = aws.Time(input.IfModifiedSince)
+	}
+
+	output, err := s.client.GetObject(ctx, getInput)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	object := s.newObject(
+		input.Key,
+		aws.ToInt64(output.ContentLength),
+		output.ContentType,
+		output.ContentDisposition,
+		output.Metadata,
+		output.ETag,
+		aws.ToTime(output.LastModified),
+		output.Expiration,
+	)
+
+	// The object size of range requests is in the content range
+	contentRange := aws.ToString(output.ContentRange)
+	if _, total, ok := strings.Cut(contentRange, "/"); ok {
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			object.Size = size
+		}
+	}
+
+	if object.expired(s.now()) {
+		output.Body.Close()
+		return nil, &ExpiredError{Object: object}
+	}
+
+	reader := &Reader{
+		Object:       object,
+		Body:         output.Body,
+		Length:       -1,
+		ContentRange: contentRange,
+	}
+
+	if output.ContentLength != nil {
+		reader.Length = *output.ContentLength
+	}
+
+	return reader, nil
+}
+
+// Head implements Storage
+func (s *S3) Head(ctx context.Context, key string) (Object, error) {
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	object := s.newObject(
+		key,
+		aws.ToInt64(output.ContentLength),
+		output.ContentType,
+		output.ContentDisposition,
+		output.Metadata,
+		output.ETag,
+		aws.ToTime(output.LastModified),
+		output.Expiration,
+	)
+
+	if object.expired(s.now()) {
+		return Object{}, &ExpiredError{Object: object}
+	}
+
+	return object, nil
+}
+
+// Delete implements Storage
+func (s *S3) Delete(ctx context.Context, keys ...string) error {
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		var objects []s3types.ObjectIdentifier
+		for _, key := range keys[start:min(start+maxDeleteKeys, len(keys))] {
+			objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		output, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &s3types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s: %s", aws.ToString(output.Errors[0].Key), aws.ToString(output.Errors[0].Message))
+		}
+	}
+
+	return nil
+}
+
+// List implements Storage
+func (s *S3) List(ctx context.Context, input ListInput) ([]string, error) {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		Prefix:  aws.String(input.Prefix),
+		MaxKeys: aws.Int32(1000),
+	}
+
+	if input.Limit > 0 {
+		listInput.MaxKeys = aws.Int32(int32(min(input.Limit, 1000)))
+	}
+
+	if input.StartAfter != "" {
+		listInput.StartAfter = aws.String(input.StartAfter)
+	}
+
+	keys := []string{}
+	for {
+		output, err := s.client.ListObjectsV2(ctx, listInput)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range output.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+
+		if input.Limit > 0 && len(keys) >= input.Limit {
+			return keys[:input.Limit], nil
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			return keys, nil
+		}
+
+		listInput.ContinuationToken = output.NextContinuationToken
+		listInput.StartAfter = nil
+	}
+}
+
+// PresignGet implements Presigner, the headers are signed response overrides
+func (s *S3) PresignGet(ctx context.Context, object Object, ttl time.Duration) (string, error) {
+	if s.presigner == nil {
+		return "", errors.New("presigning is not supported")
+	}
+
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(object.Key),
+	}
+
+	if object.ContentType != "" {
+		getInput.ResponseContentType = aws.String(object.ContentType)
+	}
+
+	if object.ContentDisposition != "" {
+		getInput.ResponseContentDisposition = aws.String(object.ContentDisposition)
+	}
+
+	presigned, err := s.presigner.PresignGetObject(ctx, getInput, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return presigned.URL, nil
+}
+
+// PresignPut implements Presigner
+func (s *S3) PresignPut(ctx context.Context, input PutInput, ttl time.Duration) (PresignedRequest, error) {
+	if s.presigner == nil {
+		return PresignedRequest{}, errors.New("presigning is not supported")
+	}
+
+	putInput := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(input.Key),
+		Metadata: S3Metadata(input.Metadata, input.ExpireAt),
+	}
+
+	if input.Size >= 0 {
+		putInput.ContentLength = aws.Int64(input.Size)
+	}
+
+	if input.ContentType != "" {
+		putInput.ContentType = aws.String(input.ContentType)
+	}
+
+	presigned, err := s.presigner.PresignPutObject(ctx, putInput, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+
+	return PresignedRequest{
+		URL:    presigned.URL,
+		Method: presigned.Method,
+		Header: presigned.SignedHeader,
+	}, nil
+}
+
+// CreateMultipartUpload implements Multipart. The ExpireAt is stored as
+// object metadata of the completed object.
+func (s *S3) CreateMultipartUpload(ctx context.Context, input PutInput) (string, error) {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(input.Key),
+		Metadata: S3Metadata(input.Metadata, input.ExpireAt),
+	}
+
+	if input.ContentType != "" {
+		createInput.ContentType = aws.String(input.ContentType)
+	}
+
+	if input.ContentDisposition != "" {
+		createInput.ContentDisposition = aws.String(input.ContentDisposition)
+	}
+
+	output, err := s.client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return "", s3Error(err)
+	}
+
+	return aws.ToString(output.UploadId), nil
+}
+
+// UploadPart implements Multipart. The SDK requires seekable bodies without
+// TLS.
+func (s *S3) UploadPart(ctx context.Context, input UploadPartInput) (Part, error) {
+	output, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucketName),
+		Key:           aws.String(input.Key),
+		UploadId:      aws.String(input.UploadID),
+		PartNumber:    aws.Int32(input.PartNumber),
+		Body:          input.Body,
+		ContentLength: aws.Int64(input.Size),
+	})
+	if err != nil {
+		return Part{}, s3Error(err)
+	}
+
+	return Part{
+		PartNumber: input.PartNumber,
+		Size:       input.Size,
+		ETag:       aws.ToString(output.ETag),
+	}, nil
+}
+
+// ListParts implements Multipart
+func (s *S3) ListParts(ctx context.Context, key string, uploadID string) ([]Part, error) {
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+
+	parts := []Part{}
+	for {
+		output, err := s.client.ListParts(ctx, input)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+
+		for _, part := range output.Parts {
+			parts = append(parts, Part{
+				PartNumber: aws.ToInt32(part.PartNumber),
+				Size:       aws.ToInt64(part.Size),
+				ETag:       aws.ToString(part.ETag),
+			})
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			return parts, nil
+		}
+
+		input.PartNumberMarker = output.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipartUpload implements Multipart
+func (s *S3) CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (Object, error) {
+	completed := make([]s3types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, s3types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.PartNumber),
+		})
+	}
+
+	if _, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: completed},
+	}); err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	// The completion result has no size
+	return s.Head(ctx, key)
+}
+
+// AbortMultipartUpload implements Multipart
+func (s *S3) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	if _, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}); err != nil {
+		return s3Error(err)
+	}
+
+	return nil
+}
+
+// ListMultipartUploads implements Multipart
+func (s *S3) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	}
+
+	uploads := []MultipartUpload{}
+	for {
+		output, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+
+		for _, upload := range output.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(upload.Key),
+				UploadID:  aws.ToString(upload.UploadId),
+				Initiated: aws.ToTime(upload.Initiated),
+			})
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			return uploads, nil
+		}
+
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// newObject returns the object of a S3 response. The expiration is the
+// earliest of the stored ExpireAt and the x-amz-expiration header, or the TTL
+// after it was last modified.
+func (s *S3) newObject(
+	key string,
+	size int64,
+	contentType *string,
+	contentDisposition *string,
+	metadata map[string]string,
+	etag *string,
+	lastModified time.Time,
+	expiration *string,
+) Object {
+	object := Object{
+		Key:                key,
+		Size:               size,
+		ContentType:        aws.ToString(contentType),
+		ContentDisposition: aws.ToString(contentDisposition),
+		Metadata:           metadata,
+		ETag:               aws.ToString(etag),
+		LastModified:       lastModified,
+	}
+
+	if value, ok := metadata[metadataExpireAt]; ok {
+		object.Metadata = maps.Clone(metadata)
+		delete(object.Metadata, metadataExpireAt)
+
+		if expireAt, err := time.Parse(time.RFC3339, value); err == nil {
+			object.ExpireAt = expireAt.UTC()
+		}
+	} else if s.ttl > 0 && !lastModified.IsZero() {
+		object.ExpireAt = lastModified.Add(s.ttl).UTC()
+	}
+
+	if ruleExpireAt, err := ExtractExpireAt(expiration); err == nil {
+		if object.ExpireAt.IsZero() || ruleExpireAt.Before(object.ExpireAt) {
+			object.ExpireAt = ruleExpireAt
+		}
+	}
+
+	return object
+}
+
+// S3Metadata returns the S3 object metadata of an object with the ExpireAt,
+// for objects written to the bucket directly, e.g. presigned uploads
+func S3Metadata(metadata map[string]string, expireAt time.Time) map[string]string {
+	if expireAt.IsZero() {
+		return metadata
+	}
+
+	metadata = maps.Clone(metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	metadata[metadataExpireAt] = expireAt.UTC().Format(time.RFC3339)
+	return metadata
+}
+
+// s3Error returns the storage error of a failed S3 request. Not modified,
+// precondition failed and unsatisfiable range responses from S3 are returned
+// as errors.
+func s3Error(err error) error {
+	var noSuchKey *s3types.NoSuchKey
+	var notFound *s3types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrNotFound
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchUpload":
+			return ErrUploadNotFound
+		case "EntityTooSmall", "InvalidPart", "InvalidPartOrder":
+			return ErrInvalidParts
+		}
+	}
+
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.HTTPStatusCode() {
+		case http.StatusNotModified:
+			notModified := &NotModifiedError{}
+			if responseErr.Response != nil {
+				header := responseErr.Response.Header
+				notModified.ETag = header.Get("ETag")
+				notModified.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+			}
+
+			return notModified
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			// Conflicts are concurrent conditional writes of the key
+			return ErrPreconditionFailed
+		case http.StatusRequestedRangeNotSatisfiable:
+			return ErrInvalidRange
+		case http.StatusNotFound:
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// ExtractExpireAt extracts the expiration date from the x-amz-expiration
+// response header from S3 PutObject API response.
+func ExtractExpireAt(responseExpiration *string) (time.Time, error) {
+	if responseExpiration == nil {
+		return time.Time{}, fmt.Errorf("response expiration is nil")
+	}
+
+	// expiry-date="Fri, 23 Dec 2012 00:00:00 GMT", rule-id="1"
+	if *responseExpiration == "" || strings.Contains(*responseExpiration, "NotImplemented") {
+		return time.Time{}, errors.New("response expiration is empty or NotImplemented")
+	}
+
+	matches := expireDateRegex.FindStringSubmatch(*responseExpiration)
+	if len(matches) < 2 {
+		return time.Time{}, errors.New("no expiry-date found in response")
+	}
+
+	expiryDate := matches[1]
+	expireAt, err := time.Parse(time.RFC1123, expiryDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error parsing expiry date: %w", err)
+	}
+
+	// Convert to UTC
+	return expireAt.UTC(), nil
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockS3Client struct {
+	S3Client
+
+	getObjectFn func(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+func (m *mockS3Client) GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return m.getObjectFn(ctx, input, opts...)
+}
+
+// s3ResponseError returns the error of the SDK for an S3 response status
+func s3ResponseError(statusCode int, header http.Header) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: statusCode, Header: header}},
+			Err:      errors.New("s3 response error"),
+		},
+	}
+}
+
+func TestS3Get(t *testing.T) {
+	lastModified := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	newS3 := func(output *s3.GetObjectOutput, err error) (*S3, *s3.GetObjectInput) {
+		var captured s3.GetObjectInput
+		store := NewS3(&mockS3Client{
+			getObjectFn: func(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				captured = *input
+				return output, err
+			},
+		}, "test-bucket", time.Hour)
+		store.now = func() time.Time { return lastModified.Add(time.Minute) }
+
+		return store, &captured
+	}
+
+	t.Run("range", func(t *testing.T) {
+		store, input := newS3(&s3.GetObjectOutput{
+			Body:          io.NopCloser(bytes.NewReader([]byte("world"))),
+			ContentLength: aws.Int64(5),
+			ContentRange:  aws.String("bytes 6-10/11"),
+			ContentType:   aws.String("text/plain"),
+			LastModified:  aws.Time(lastModified),
+		}, nil)
+
+		reader, err := store.Get(context.Background(), GetInput{
+			Key:             "file",
+			Range:           "bytes=6-",
+			IfNoneMatch:     `"abc"`,
+			IfModifiedSince: lastModified,
+		})
+		require.NoError(t, err)
+		defer reader.Body.Close()
+
+		require.Equal(t, "test-bucket", aws.ToString(input.Bucket))
+		require.Equal(t, "bytes=6-", aws.ToString(input.Range))
+		require.Equal(t, `"abc"`, aws.ToString(input.IfNoneMatch))
+		// If-Modified-Since is ignored with If-None-Match
+		require.Nil(t, input.IfModifiedSince)
+
+		require.Equal(t, int64(5), reader.Length)
+		require.Equal(t, int64(11), reader.Size)
+		require.Equal(t, "bytes 6-10/11", reader.ContentRange)
+		require.Equal(t, lastModified.Add(time.Hour), reader.ExpireAt)
+	})
+
+	t.Run("stored expiration", func(t *testing.T) {
+		expireAt := lastModified.Add(7 * 24 * time.Hour)
+		store, _ := newS3(&s3.GetObjectOutput{
+			Body:         io.NopCloser(bytes.NewReader(nil)),
+			LastModified: aws.Time(lastModified),
+			Metadata:     S3Metadata(map[string]string{"owner": "alice"}, expireAt),
+		}, nil)
+
+		reader, err := store.Get(context.Background(), GetInput{Key: "file"})
+		require.NoError(t, err)
+		defer reader.Body.Close()
+
+		// The stored expiration is used instead of the TTL
+		require.Equal(t, expireAt, reader.ExpireAt)
+		require.Equal(t, map[string]string{"owner": "alice"}, reader.Metadata)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		store, _ := newS3(&s3.GetObjectOutput{
+			Body:         io.NopCloser(bytes.NewReader(nil)),
+			LastModified: aws.Time(lastModified),
+			Expiration:   aws.String(`expiry-date="Wed, 01 Jan 2025 12:00:00 GMT", rule-id="1"`),
+		}, nil)
+
+		_, err := store.Get(context.Background(), GetInput{Key: "file"})
+		require.ErrorIs(t, err, ErrNotFound)
+		require.ErrorIs(t, err, ErrExpired)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name string
+			err  error
+			want error
+		}{
+			{name: "no such key", err: &s3types.NoSuchKey{}, want: ErrNotFound},
+			{name: "not found status", err: s3ResponseError(http.StatusNotFound, nil), want: ErrNotFound},
+			{name: "not modified", err: s3ResponseError(http.StatusNotModified, nil), want: ErrNotModified},
+			{name: "invalid range", err: s3ResponseError(http.StatusRequestedRangeNotSatisfiable, nil), want: ErrInvalidRange},
+			{name: "precondition failed", err: s3ResponseError(http.StatusPreconditionFailed, nil), want: ErrPreconditionFailed},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store, _ := newS3(nil, tt.err)
+
+				_, err := store.Get(context.Background(), GetInput{Key: "file"})
+				require.ErrorIs(t, err, tt.want)
+			})
+		}
+
+		store, _ := newS3(nil, s3ResponseError(http.StatusNotModified, http.Header{
+			"Etag":          {`"abc"`},
+			"Last-Modified": {lastModified.Format(http.TimeFormat)},
+		}))
+
+		_, err := store.Get(context.Background(), GetInput{Key: "file"})
+
+		var notModified *NotModifiedError
+		require.ErrorAs(t, err, &notModified)
+		require.Equal(t, `"abc"`, notModified.ETag)
+		require.Equal(t, lastModified, notModified.LastModified)
+	})
+}
+
+type mockS3Presigner struct {
+	S3Presigner
+
+	get *s3.GetObjectInput
+}
+
+func (m *mockS3Presigner) PresignGetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	m.get = input
+	return &v4.PresignedHTTPRequest{URL: "https://test-bucket.s3.amazonaws.com/" + aws.ToString(input.Key)}, nil
+}
+
+func TestS3PresignGet(t *testing.T) {
+	presigner := &mockS3Presigner{}
+	store := NewS3(&mockS3Client{}, "test-bucket", time.Hour)
+	store.presigner = presigner
+
+	url, err := store.PresignGet(context.Background(), Object{
+		Key:                "file",
+		ContentType:        "text/html",
+		ContentDisposition: `attachment; filename="page.html"`,
+	}, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "https://test-bucket.s3.amazonaws.com/file", url)
+	require.Equal(t, "text/html", aws.ToString(presigner.get.ResponseContentType))
+	require.Equal(t, `attachment; filename="page.html"`, aws.ToString(presigner.get.ResponseContentDisposition))
+
+	_, err = store.PresignGet(context.Background(), Object{Key: "file"}, time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, presigner.get.ResponseContentType, "stored headers are used")
+	require.Nil(t, presigner.get.ResponseContentDisposition)
+}
+
+func TestExtractExpireAt(t *testing.T) {
+	tests := []struct {
+		name               string
+		responseExpiration *string
+		expectedTime       time.Time
+		expectedError      error
+	}{
+		{
+			name:               "valid expiration date, converted to UTC",
+			responseExpiration: aws.String(`expiry-date="Fri, 23 Dec 2012 00:00:00 GMT", rule-id="1"`),
+			expectedTime:       time.Date(2012, time.December, 23, 0, 0, 0, 0, time.UTC),
+			expectedError:      nil,
+		},
+		{
+			name:               "nil expiration date",
+			responseExpiration: nil,
+			expectedTime:       time.Time{},
+			expectedError:      fmt.Errorf("response expiration is nil"),
+		},
+		{
+			name:               "empty expiration date",
+			responseExpiration: aws.String(""),
+			expectedTime:       time.Time{},
+			expectedError:      errors.New("response expiration is empty or NotImplemented"),
+		},
+		{
+			name:               "not implemented expiration date",
+			responseExpiration: aws.String("NotImplemented"),
+			expectedTime:       time.Time{},
+			expectedError:      errors.New("response expiration is empty or NotImplemented"),
+		},
+		{
+			name:               "invalid expiration date format",
+			responseExpiration: aws.String(`expiry-date="invalid-date", rule-id="1"`),
+			expectedTime:       time.Time{},
+			expectedError:      fmt.Errorf("error parsing expiry date: parsing time \"invalid-date\" as \"Mon, 02 Jan 2006 15:04:05 MST\": cannot parse \"invalid-date\" as \"Mon\""),
+		},
+		{
+			name:               "missing expiry-date",
+			responseExpiration: aws.String(`rule-id="1"`),
+			expectedTime:       time.Time{},
+			expectedError:      errors.New("no expiry-date found in response"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expireAt, err := ExtractExpireAt(tt.responseExpiration)
+			if tt.expectedError != nil {
+				require.Error(t, err)
+				assert.Equal(t, tt.expectedError.Error(), err.Error())
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expectedTime, expireAt)
+			}
+		})
+	}
+}
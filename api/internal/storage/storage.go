@@ -0,0 +1,386 @@
+// Package storage stores uploaded files in S3, a local directory or memory.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for missing and expired objects
+	ErrNotFound = errors.New("object not found")
+	// ErrExpired is returned for expired objects that are not deleted yet,
+	// the error is an *ExpiredError
+	ErrExpired = errors.New("object expired")
+	// ErrPreconditionFailed is returned by conditional puts when the existing
+	// object does not match the condition
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrNotModified is returned by conditional gets of unchanged objects, the
+	// error is a *NotModifiedError
+	ErrNotModified = errors.New("object not modified")
+	// ErrInvalidRange is returned for ranges outside of the object
+	ErrInvalidRange = errors.New("range not satisfiable")
+	// ErrUploadNotFound is returned for unknown, completed and aborted
+	// multipart uploads
+	ErrUploadNotFound = errors.New("multipart upload not found")
+	// ErrInvalidParts is returned when completing a multipart upload with
+	// missing parts, or parts except the last smaller than MinPartSize
+	ErrInvalidParts = errors.New("invalid parts")
+)
+
+// MinPartSize is the min size of all parts of a multipart upload except the
+// last, the S3 limit
+const MinPartSize = 5 * 1024 * 1024 // 5MB
+
+// NotModifiedError is returned by conditional gets of unchanged objects with
+// the validators of the object
+type NotModifiedError struct {
+	ETag         string
+	LastModified time.Time
+}
+
+func (e *NotModifiedError) Error() string {
+	return ErrNotModified.Error()
+}
+
+func (e *NotModifiedError) Is(target error) bool {
+	return target == ErrNotModified
+}
+
+// ExpiredError is returned for expired objects that are not deleted yet with
+// the metadata of the object. It matches both ErrExpired and ErrNotFound, so
+// expired objects are not found unless checked for explicitly.
+type ExpiredError struct {
+	Object Object
+}
+
+func (e *ExpiredError) Error() string {
+	return ErrExpired.Error()
+}
+
+func (e *ExpiredError) Is(target error) bool {
+	return target == ErrExpired || target == ErrNotFound
+}
+
+// Object is the metadata of a stored object
+type Object struct {
+	Key                string            `json:"key"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"content_type,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+	LastModified       time.Time         `json:"last_modified"`
+	// ExpireAt is when the object expires, zero if it does not expire.
+	// Expired objects are not found.
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// expired returns true if the object has expired at now
+func (o Object) expired(now time.Time) bool {
+	return !o.ExpireAt.IsZero() && !now.Before(o.ExpireAt)
+}
+
+// PutInput is an object to store
+type PutInput struct {
+	Key  string
+	Body io.Reader
+	// Size is the size of the body, -1 if unknown
+	Size               int64
+	ContentType        string
+	ContentDisposition string
+	// Metadata keys must be lower case, values ASCII
+	Metadata map[string]string
+	// ExpireAt is stored with the object, the TTL of the storage is used if
+	// zero
+	ExpireAt time.Time
+	// IfMatch only replaces an existing object with the ETag, and IfNoneMatch
+	// "*" only creates a new object. ErrPreconditionFailed is returned
+	// otherwise. Expired objects that are not deleted yet exist.
+	IfMatch     string
+	IfNoneMatch string
+	// ContentSHA256 is the hex SHA-256 of the body, optional. The Dedup
+	// storage stores bodies with a hash once, other storages ignore it.
+	ContentSHA256 string
+}
+
+// CopyInput is a copy of a stored object to a new key. The content type,
+// disposition and metadata of the copy replace those of the source.
+type CopyInput struct {
+	SourceKey          string
+	Key                string
+	ContentType        string
+	ContentDisposition string
+	// Metadata keys must be lower case, values ASCII
+	Metadata map[string]string
+	// ExpireAt is stored with the copy, the TTL of the storage is used if
+	// zero
+	ExpireAt time.Time
+	// ContentSHA256 is the hex SHA-256 of the source body, optional. The Dedup
+	// storage references an existing blob with the hash instead of copying,
+	// the hash is trusted as the source is not read.
+	ContentSHA256 string
+}
+
+// GetInput is a request to read an object
+type GetInput struct {
+	Key string
+	// Range is a single HTTP byte range, e.g. bytes=0-99, empty for the whole
+	// object
+	Range string
+	// IfNoneMatch returns ErrNotModified if the ETag matches
+	IfNoneMatch string
+	// IfModifiedSince returns ErrNotModified if the object was not modified
+	// after the time, ignored with IfNoneMatch
+	IfModifiedSince time.Time
+}
+
+// Reader is the body of an object, it must be closed
+type Reader struct {
+	Object
+	Body io.ReadCloser
+	// Length is the size of the body, -1 if unknown
+	Length int64
+	// ContentRange is set for range requests, e.g. bytes 0-99/1000
+	ContentRange string
+}
+
+// ListInput is a request to list object keys
+type ListInput struct {
+	Prefix string
+	// StartAfter lists keys after the key
+	StartAfter string
+	Limit      int
+}
+
+// Storage stores objects by key. Objects expire at their ExpireAt, or after
+// the TTL of the storage. Expired objects return an *ExpiredError until they
+// are deleted, e.g. by the Sweeper.
+type Storage interface {
+	// Put stores the object, replacing an existing object with the key
+	Put(ctx context.Context, input PutInput) (Object, error)
+	// Copy stores a copy of an object, replacing an existing object with the
+	// key. Expired sources are not found.
+	Copy(ctx context.Context, input CopyInput) (Object, error)
+	// Get returns the object body, or part of it for range requests
+	Get(ctx context.Context, input GetInput) (*Reader, error)
+	Head(ctx context.Context, key string) (Object, error)
+	// Delete deletes the keys, missing keys are ignored
+	Delete(ctx context.Context, keys ...string) error
+	// List returns the keys with the prefix in order, including expired
+	// objects that are not deleted yet
+	List(ctx context.Context, input ListInput) ([]string, error)
+}
+
+// PresignedRequest is a presigned HTTP request to a storage
+type PresignedRequest struct {
+	URL    string
+	Method string
+	// Header are the signed headers the request must be sent with
+	Header http.Header
+}
+
+// Presigner is implemented by storages that can create URLs to download and
+// upload objects directly
+type Presigner interface {
+	// PresignGet returns a URL to download the object with the key. The
+	// content type and disposition of the object, if set, replace the stored
+	// headers in the response.
+	PresignGet(ctx context.Context, object Object, ttl time.Duration) (string, error)
+	// PresignPut returns a request to upload an object with the key, size,
+	// content type and metadata of the input. The body of the input is
+	// ignored.
+	PresignPut(ctx context.Context, input PutInput, ttl time.Duration) (PresignedRequest, error)
+}
+
+// UploadPartInput is a part of a multipart upload
+type UploadPartInput struct {
+	Key      string
+	UploadID string
+	// PartNumber is between 1 and 10000, parts uploaded again replace the
+	// previous upload of the part
+	PartNumber int32
+	Body       io.Reader
+	Size       int64
+}
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	PartNumber int32
+	Size       int64
+	ETag       string
+}
+
+// MultipartUpload is an incomplete multipart upload
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// Multipart is implemented by storages that can store objects uploaded in
+// parts. Parts are stored until the upload is completed or aborted.
+type Multipart interface {
+	// CreateMultipartUpload starts an upload of an object with the key,
+	// content type, disposition, metadata and expiration of the input and
+	// returns the upload ID. The body of the input is ignored.
+	CreateMultipartUpload(ctx context.Context, input PutInput) (string, error)
+	UploadPart(ctx context.Context, input UploadPartInput) (Part, error)
+	// ListParts returns the uploaded parts in order of their part numbers
+	ListParts(ctx context.Context, key string, uploadID string) ([]Part, error)
+	// CompleteMultipartUpload stores the object assembled from the parts in
+	// order and ends the upload
+	CompleteMultipartUpload(ctx context.Context, key string, uploadID string, parts []Part) (Object, error)
+	AbortMultipartUpload(ctx context.Context, key string, uploadID string) error
+	// ListMultipartUploads returns the incomplete uploads of keys with the
+	// prefix
+	ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error)
+}
+
+// copyObject copies the source by reading it and storing its body again, for
+// storages without server side copies
+func copyObject(ctx context.Context, store Storage, input CopyInput) (Object, error) {
+	reader, err := store.Get(ctx, GetInput{Key: input.SourceKey})
+	if err != nil {
+		return Object{}, err
+	}
+	defer reader.Body.Close()
+
+	return store.Put(ctx, PutInput{
+		Key:                input.Key,
+		Body:               reader.Body,
+		Size:               reader.Size,
+		ContentType:        input.ContentType,
+		ContentDisposition: input.ContentDisposition,
+		Metadata:           input.Metadata,
+		ExpireAt:           input.ExpireAt,
+	})
+}
+
+// expireAt returns the expiration of an object stored at now
+func expireAt(input PutInput, now time.Time, ttl time.Duration) time.Time {
+	if !input.ExpireAt.IsZero() {
+		return input.ExpireAt.UTC()
+	}
+
+	if ttl > 0 {
+		return now.Add(ttl).UTC()
+	}
+
+	return time.Time{}
+}
+
+// preconditionFailed returns ErrPreconditionFailed if the conditions of the
+// input do not match the existing object, nil if there is none
+func preconditionFailed(existing *Object, input PutInput) error {
+	if input.IfNoneMatch == "*" && existing != nil {
+		return ErrPreconditionFailed
+	}
+
+	if input.IfMatch != "" && (existing == nil || existing.ETag != input.IfMatch) {
+		return ErrPreconditionFailed
+	}
+
+	return nil
+}
+
+// notModified returns a *NotModifiedError if the conditions of the input
+// match the object
+func notModified(object Object, input GetInput) error {
+	if input.IfNoneMatch != "" {
+		for _, etag := range strings.Split(input.IfNoneMatch, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == "*" || etag == object.ETag {
+				return &NotModifiedError{ETag: object.ETag, LastModified: object.LastModified}
+			}
+		}
+
+		return nil
+	}
+
+	// HTTP dates have second precision
+	if !input.IfModifiedSince.IsZero() && !object.LastModified.Truncate(time.Second).After(input.IfModifiedSince) {
+		return &NotModifiedError{ETag: object.ETag, LastModified: object.LastModified}
+	}
+
+	return nil
+}
+
+// parseRange returns the offset and length of a single HTTP byte range of an
+// object of the size. Returns ErrInvalidRange if the range is outside of the
+// object, and ok false if the range is invalid and the whole object is read.
+func parseRange(rangeHeader string, size int64) (offset int64, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(rangeHeader, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	startValue, endValue, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	// Suffix range, the last bytes
+	if startValue == "" {
+		suffix, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, false, nil
+		}
+
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true, nil
+	}
+
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+
+	end := size - 1
+	if endValue != "" {
+		end, err = strconv.ParseInt(endValue, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, ErrInvalidRange
+	}
+
+	end = min(end, size-1)
+	return start, end - start + 1, true, nil
+}
+
+// contentRange returns the Content-Range header of a range of the object
+func contentRange(offset int64, length int64, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+}
+
+// filterKeys returns the sorted keys matching the list input, up to the limit
+func filterKeys(keys []string, input ListInput) []string {
+	matched := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, input.Prefix) && key > input.StartAfter {
+			matched = append(matched, key)
+		}
+	}
+
+	slices.Sort(matched)
+	if input.Limit > 0 && len(matched) > input.Limit {
+		matched = matched[:input.Limit]
+	}
+
+	return matched
+}
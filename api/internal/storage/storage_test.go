@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testStorage runs the behavior shared by all storages. The clock of the
+// storage is set with setNow.
+func testStorage(t *testing.T, store Storage, setNow func(time.Time)) {
+	ctx := context.Background()
+	now := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	setNow(now)
+
+	put := func(key string, content string) Object {
+		t.Helper()
+
+		object, err := store.Put(ctx, PutInput{
+			Key:                key,
+			Body:               strings.NewReader(content),
+			Size:               int64(len(content)),
+			ContentType:        "text/plain",
+			ContentDisposition: `inline; filename="test.txt"`,
+			Metadata:           map[string]string{"owner": "alice"},
+		})
+		require.NoError(t, err)
+
+		return object
+	}
+
+	read := func(input GetInput) (*Reader, string) {
+		t.Helper()
+
+		reader, err := store.Get(ctx, input)
+		require.NoError(t, err)
+		defer reader.Body.Close()
+
+		body, err := io.ReadAll(reader.Body)
+		require.NoError(t, err)
+
+		return reader, string(body)
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		object := put("files/a", "hello world")
+		require.Equal(t, int64(11), object.Size)
+		require.NotEmpty(t, object.ETag)
+		require.Equal(t, now, object.LastModified)
+		require.Equal(t, now.Add(time.Hour), object.ExpireAt)
+
+		reader, body := read(GetInput{Key: "files/a"})
+		require.Equal(t, "hello world", body)
+		require.Equal(t, int64(11), reader.Length)
+		require.Empty(t, reader.ContentRange)
+		require.Equal(t, "text/plain", reader.ContentType)
+		require.Equal(t, `inline; filename="test.txt"`, reader.ContentDisposition)
+		require.Equal(t, map[string]string{"owner": "alice"}, reader.Metadata)
+		require.Equal(t, object.ETag, reader.ETag)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		reader, body := read(GetInput{Key: "files/a", Range: "bytes=6-"})
+		require.Equal(t, "world", body)
+		require.Equal(t, int64(5), reader.Length)
+		require.Equal(t, "bytes 6-10/11", reader.ContentRange)
+		require.Equal(t, int64(11), reader.Size)
+
+		_, body = read(GetInput{Key: "files/a", Range: "bytes=-3"})
+		require.Equal(t, "rld", body)
+
+		_, err := store.Get(ctx, GetInput{Key: "files/a", Range: "bytes=20-"})
+		require.ErrorIs(t, err, ErrInvalidRange)
+	})
+
+	t.Run("conditional get", func(t *testing.T) {
+		object, err := store.Head(ctx, "files/a")
+		require.NoError(t, err)
+
+		_, err = store.Get(ctx, GetInput{Key: "files/a", IfNoneMatch: object.ETag})
+		require.ErrorIs(t, err, ErrNotModified)
+
+		var notModified *NotModifiedError
+		require.ErrorAs(t, err, &notModified)
+		require.Equal(t, object.ETag, notModified.ETag)
+
+		_, err = store.Get(ctx, GetInput{Key: "files/a", IfModifiedSince: now})
+		require.ErrorIs(t, err, ErrNotModified)
+
+		_, body := read(GetInput{Key: "files/a", IfModifiedSince: now.Add(-time.Minute)})
+		require.Equal(t, "hello world", body)
+	})
+
+	t.Run("head", func(t *testing.T) {
+		object, err := store.Head(ctx, "files/a")
+		require.NoError(t, err)
+		require.Equal(t, int64(11), object.Size)
+		require.Equal(t, "text/plain", object.ContentType)
+
+		_, err = store.Head(ctx, "files/missing")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = store.Get(ctx, GetInput{Key: "files/missing"})
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		object, err := store.Copy(ctx, CopyInput{
+			SourceKey:   "files/a",
+			Key:         "copies/a",
+			ContentType: "text/markdown",
+			Metadata:    map[string]string{"owner": "bob"},
+			ExpireAt:    now.Add(2 * time.Hour),
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(11), object.Size)
+		require.Equal(t, now.Add(2*time.Hour), object.ExpireAt)
+
+		reader, body := read(GetInput{Key: "copies/a"})
+		require.Equal(t, "hello world", body)
+		require.Equal(t, "text/markdown", reader.ContentType)
+		require.Empty(t, reader.ContentDisposition, "the source disposition is replaced")
+		require.Equal(t, map[string]string{"owner": "bob"}, reader.Metadata)
+
+		_, err = store.Copy(ctx, CopyInput{SourceKey: "files/missing", Key: "copies/missing"})
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, store.Delete(ctx, "copies/a"))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		put("files/b", "b")
+		put("files/c", "c")
+		put("other/d", "d")
+
+		keys, err := store.List(ctx, ListInput{Prefix: "files/"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"files/a", "files/b", "files/c"}, keys)
+
+		keys, err = store.List(ctx, ListInput{Prefix: "files/", StartAfter: "files/a", Limit: 1})
+		require.NoError(t, err)
+		require.Equal(t, []string{"files/b"}, keys)
+
+		keys, err = store.List(ctx, ListInput{Prefix: "none/"})
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, store.Delete(ctx, "files/b", "files/c", "files/missing"))
+
+		_, err := store.Head(ctx, "files/b")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		keys, err := store.List(ctx, ListInput{Prefix: "files/"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"files/a"}, keys)
+	})
+
+	t.Run("conditional put", func(t *testing.T) {
+		lease := func(ifMatch string, ifNoneMatch string) (Object, error) {
+			return store.Put(ctx, PutInput{
+				Key:         "leases/test",
+				Body:        strings.NewReader(""),
+				Size:        0,
+				IfMatch:     ifMatch,
+				IfNoneMatch: ifNoneMatch,
+			})
+		}
+
+		_, err := lease(`"missing"`, "")
+		require.ErrorIs(t, err, ErrPreconditionFailed)
+
+		created, err := lease("", "*")
+		require.NoError(t, err)
+
+		_, err = lease("", "*")
+		require.ErrorIs(t, err, ErrPreconditionFailed)
+
+		_, err = lease(`"other"`, "")
+		require.ErrorIs(t, err, ErrPreconditionFailed)
+
+		_, err = lease(created.ETag, "")
+		require.NoError(t, err)
+
+		require.NoError(t, store.Delete(ctx, "leases/test"))
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		object, err := store.Put(ctx, PutInput{
+			Key:      "files/e",
+			Body:     strings.NewReader("e"),
+			Size:     1,
+			ExpireAt: now.Add(2 * time.Hour),
+		})
+		require.NoError(t, err)
+		require.Equal(t, now.Add(2*time.Hour), object.ExpireAt)
+
+		setNow(now.Add(time.Hour - time.Second))
+		_, err = store.Head(ctx, "files/a")
+		require.NoError(t, err)
+
+		setNow(now.Add(time.Hour))
+		_, err = store.Head(ctx, "files/a")
+		require.ErrorIs(t, err, ErrNotFound)
+		require.ErrorIs(t, err, ErrExpired)
+
+		var expired *ExpiredError
+		require.ErrorAs(t, err, &expired)
+		require.Equal(t, int64(11), expired.Object.Size)
+
+		_, err = store.Get(ctx, GetInput{Key: "other/d"})
+		require.ErrorIs(t, err, ErrExpired)
+
+		// Expired objects are listed until they are deleted
+		keys, err := store.List(ctx, ListInput{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"files/a", "files/e", "other/d"}, keys)
+
+		_, err = store.Head(ctx, "files/e")
+		require.NoError(t, err)
+
+		setNow(now.Add(2 * time.Hour))
+		_, err = store.Head(ctx, "files/e")
+		require.ErrorIs(t, err, ErrExpired)
+	})
+}
+
+func TestMemory(t *testing.T) {
+	store := NewMemory(time.Hour)
+	testStorage(t, store, func(now time.Time) {
+		store.now = func() time.Time { return now }
+	})
+}
+
+func TestMemoryMultipart(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory(time.Hour)
+	expireAt := time.Now().Add(time.Minute).UTC()
+
+	uploadID, err := store.CreateMultipartUpload(ctx, PutInput{
+		Key:         "multipart/a",
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"owner": "alice"},
+		ExpireAt:    expireAt,
+	})
+	require.NoError(t, err)
+
+	for number, content := range map[int32]string{2: "world", 1: "hello "} {
+		_, err := store.UploadPart(ctx, UploadPartInput{
+			Key:        "multipart/a",
+			UploadID:   uploadID,
+			PartNumber: number,
+			Body:       strings.NewReader(content),
+			Size:       int64(len(content)),
+		})
+		require.NoError(t, err)
+	}
+
+	parts, err := store.ListParts(ctx, "multipart/a", uploadID)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	require.Equal(t, int32(1), parts[0].PartNumber)
+
+	_, err = store.ListParts(ctx, "multipart/b", uploadID)
+	require.ErrorIs(t, err, ErrUploadNotFound, "uploads are bound to their key")
+
+	uploads, err := store.ListMultipartUploads(ctx, "multipart/")
+	require.NoError(t, err)
+	require.Len(t, uploads, 1)
+	require.Equal(t, uploadID, uploads[0].UploadID)
+
+	_, err = store.CompleteMultipartUpload(ctx, "multipart/a", uploadID, []Part{parts[1], parts[0]})
+	require.ErrorIs(t, err, ErrInvalidParts, "parts must be in order")
+
+	object, err := store.CompleteMultipartUpload(ctx, "multipart/a", uploadID, parts)
+	require.NoError(t, err)
+	require.Equal(t, int64(11), object.Size)
+	require.Equal(t, "text/plain", object.ContentType)
+	require.Equal(t, expireAt, object.ExpireAt)
+
+	reader, err := store.Get(ctx, GetInput{Key: "multipart/a"})
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+
+	require.ErrorIs(t, store.AbortMultipartUpload(ctx, "multipart/a", uploadID), ErrUploadNotFound)
+}
+
+func TestLocal(t *testing.T) {
+	store, err := NewLocal(t.TempDir(), time.Hour)
+	require.NoError(t, err)
+
+	testStorage(t, store, func(now time.Time) {
+		store.now = func() time.Time { return now }
+	})
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		rangeValue string
+		offset     int64
+		length     int64
+		ok         bool
+		err        error
+	}{
+		{name: "empty", rangeValue: ""},
+		{name: "start and end", rangeValue: "bytes=0-4", offset: 0, length: 5, ok: true},
+		{name: "end past size", rangeValue: "bytes=5-100", offset: 5, length: 5, ok: true},
+		{name: "open end", rangeValue: "bytes=3-", offset: 3, length: 7, ok: true},
+		{name: "suffix", rangeValue: "bytes=-4", offset: 6, length: 4, ok: true},
+		{name: "suffix past size", rangeValue: "bytes=-20", offset: 0, length: 10, ok: true},
+		{name: "multiple ranges", rangeValue: "bytes=0-1,3-4"},
+		{name: "other unit", rangeValue: "items=0-1"},
+		{name: "end before start", rangeValue: "bytes=4-2"},
+		{name: "start past size", rangeValue: "bytes=10-", err: ErrInvalidRange},
+		{name: "zero suffix", rangeValue: "bytes=-0", err: ErrInvalidRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			offset, length, ok, err := parseRange(tt.rangeValue, 10)
+			if tt.err != nil {
+				require.True(t, errors.Is(err, tt.err))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.offset, offset)
+			require.Equal(t, tt.length, length)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kava-labs/kavachat/api/internal/otel"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// sweeperLeaseKey is the key of the lease of the sweeper that is running,
+	// only one replica sweeps at a time
+	sweeperLeaseKey = "leases/sweeper"
+	// metadataHolder is the lease metadata key of the holder ID
+	metadataHolder = "holder"
+	// sweepPageSize is the number of keys checked per list request
+	sweepPageSize = 1000
+)
+
+// bytesDeleter is implemented by storages where the size of an object is not
+// the number of bytes freed by deleting it, e.g. Dedup pointers that share a
+// blob. deleteBytes deletes the keys like Delete and returns the freed bytes.
+type bytesDeleter interface {
+	deleteBytes(ctx context.Context, keys ...string) (int64, error)
+}
+
+// SweepResult is the number and total size of the deleted objects of a sweep
+type SweepResult struct {
+	Deleted int64
+	Bytes   int64
+}
+
+// Sweeper deletes expired objects from the storage. Only keys the owned
+// function returns true for are checked, so objects of other applications in
+// a shared bucket are never deleted. Replicas sharing the storage hold a lease
+// object so only one of them sweeps at a time. Deletes are idempotent, so a
+// sweep that outlives its lease is still safe.
+//
+// Listings do not include the expiration of objects, so each object is read
+// with Head once and its expiration is kept in memory. Later sweeps only head
+// the objects that have expired since. Candidates are always checked with
+// Head, so objects are never deleted early. An object that is deleted and
+// created again with an earlier expiration is deleted once the kept one
+// passes.
+type Sweeper struct {
+	storage  Storage
+	owned    func(key string) bool
+	id       string
+	interval time.Duration
+	// leaseTTL is how long the lease is held without renewal, another
+	// replica takes over after the holder stops
+	leaseTTL time.Duration
+	// expiries are the expirations of the objects that had not expired in
+	// the last sweep, zero if they never expire
+	expiries map[string]time.Time
+	now      func() time.Time
+	logger   *zerolog.Logger
+}
+
+// NewSweeper creates a Sweeper for the storage that sweeps the owned keys
+// every interval
+func NewSweeper(
+	store Storage,
+	interval time.Duration,
+	owned func(key string) bool,
+	baseLogger *zerolog.Logger,
+) *Sweeper {
+	id := ulid.Make().String()
+	logger := baseLogger.With().
+		Str("component", "Sweeper").
+		Str("sweeper_id", id).
+		Logger()
+
+	return &Sweeper{
+		storage:  store,
+		owned:    owned,
+		id:       id,
+		interval: interval,
+		leaseTTL: 2 * interval,
+		expiries: make(map[string]time.Time),
+		now:      time.Now,
+		logger:   &logger,
+	}
+}
+
+// Run sweeps every interval while holding the lease until the context is
+// canceled
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leader, err := s.acquireLease(ctx)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Error acquiring sweeper lease")
+				continue
+			}
+
+			if !leader {
+				s.logger.Debug().Msg("Sweeper lease held by another replica")
+				continue
+			}
+
+			result, err := s.sweep(ctx)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Error sweeping expired files")
+			}
+
+			if result.Deleted > 0 {
+				s.logger.Info().
+					Int64("deleted", result.Deleted).
+					Int64("bytes", result.Bytes).
+					Msg("Deleted expired files")
+			}
+		}
+	}
+}
+
+// acquireLease creates, renews or takes over the expired lease with a
+// conditional put. Returns false if another replica holds the lease.
+func (s *Sweeper) acquireLease(ctx context.Context) (bool, error) {
+	input := PutInput{
+		Key:         sweeperLeaseKey,
+		Body:        bytes.NewReader(nil),
+		Size:        0,
+		ContentType: "application/octet-stream",
+		Metadata:    map[string]string{metadataHolder: s.id},
+		ExpireAt:    s.now().Add(s.leaseTTL),
+	}
+
+	lease, err := s.storage.Head(ctx, sweeperLeaseKey)
+	var expired *ExpiredError
+	switch {
+	case err == nil:
+		if lease.Metadata[metadataHolder] != s.id {
+			return false, nil
+		}
+
+		input.IfMatch = lease.ETag
+	case errors.As(err, &expired):
+		input.IfMatch = expired.Object.ETag
+	case errors.Is(err, ErrNotFound):
+		input.IfNoneMatch = "*"
+	default:
+		return false, err
+	}
+
+	if _, err := s.storage.Put(ctx, input); err != nil {
+		// Another replica acquired the lease first
+		if errors.Is(err, ErrPreconditionFailed) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// sweep deletes the expired owned objects, except the lease, and records the
+// deleted count and bytes as metrics
+func (s *Sweeper) sweep(ctx context.Context) (SweepResult, error) {
+	var result SweepResult
+	defer func() {
+		if result.Deleted > 0 && otel.GlobalMetrics != nil {
+			otel.GlobalMetrics.RecordExpiredFilesDeleted(ctx, result.Deleted, result.Bytes)
+		}
+	}()
+
+	// Expirations of objects that are no longer listed are dropped
+	expiries := make(map[string]time.Time, len(s.expiries))
+	now := s.now()
+
+	input := ListInput{Limit: sweepPageSize}
+	for {
+		keys, err := s.storage.List(ctx, input)
+		if err != nil {
+			return result, err
+		}
+
+		var expiredKeys []string
+		var expiredBytes int64
+		for _, key := range keys {
+			if strings.HasPrefix(key, "leases/") || !s.owned(key) {
+				continue
+			}
+
+			// Only objects with an unknown or past expiration are candidates
+			if expireAt, ok := s.expiries[key]; ok && (expireAt.IsZero() || now.Before(expireAt)) {
+				expiries[key] = expireAt
+				continue
+			}
+
+			object, err := s.storage.Head(ctx, key)
+			var expired *ExpiredError
+			if errors.As(err, &expired) {
+				expiredKeys = append(expiredKeys, key)
+				expiredBytes += expired.Object.Size
+				continue
+			}
+
+			if err == nil {
+				expiries[key] = object.ExpireAt
+				continue
+			}
+
+			// Objects deleted since they were listed are skipped
+			if !errors.Is(err, ErrNotFound) {
+				return result, err
+			}
+		}
+
+		if len(expiredKeys) > 0 {
+			// Storages that share bodies between objects report the bytes
+			// they actually deleted
+			if deleter, ok := s.storage.(bytesDeleter); ok {
+				expiredBytes, err = deleter.deleteBytes(ctx, expiredKeys...)
+			} else {
+				err = s.storage.Delete(ctx, expiredKeys...)
+			}
+			if err != nil {
+				return result, err
+			}
+
+			result.Deleted += int64(len(expiredKeys))
+			result.Bytes += expiredBytes
+		}
+
+		if len(keys) < sweepPageSize {
+			s.expiries = expiries
+			return result, nil
+		}
+
+		input.StartAfter = keys[len(keys)-1]
+	}
+}
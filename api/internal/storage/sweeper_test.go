@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	logger := zerolog.Nop()
+	now := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	store := NewMemory(0)
+	store.now = func() time.Time { return now }
+
+	put := func(key string, content string, expireAt time.Time) {
+		t.Helper()
+
+		_, err := store.Put(ctx, PutInput{
+			Key:      key,
+			Body:     strings.NewReader(content),
+			Size:     int64(len(content)),
+			ExpireAt: expireAt,
+		})
+		require.NoError(t, err)
+	}
+
+	newSweeper := func() *Sweeper {
+		sweeper := NewSweeper(store, time.Minute, func(key string) bool {
+			return !strings.HasPrefix(key, "foreign/")
+		}, &logger)
+		sweeper.now = store.now
+		return sweeper
+	}
+
+	t.Run("lease", func(t *testing.T) {
+		first := newSweeper()
+		second := newSweeper()
+
+		leader, err := first.acquireLease(ctx)
+		require.NoError(t, err)
+		require.True(t, leader)
+
+		leader, err = second.acquireLease(ctx)
+		require.NoError(t, err)
+		require.False(t, leader, "lease is held by the first sweeper")
+
+		// Renewed by the holder
+		leader, err = first.acquireLease(ctx)
+		require.NoError(t, err)
+		require.True(t, leader)
+
+		// Taken over after the holder stops renewing
+		now = now.Add(first.leaseTTL)
+		leader, err = second.acquireLease(ctx)
+		require.NoError(t, err)
+		require.True(t, leader)
+
+		leader, err = first.acquireLease(ctx)
+		require.NoError(t, err)
+		require.False(t, leader)
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		put("expired", "12345", now.Add(-time.Second))
+		put("expired/text", "123", now)
+		put("owners/abc/expired", "", now)
+		put("active", "1234", now.Add(time.Hour))
+		put("permanent", "1", time.Time{})
+		put("foreign/expired", "12", now)
+
+		result, err := newSweeper().sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 3, Bytes: 8}, result)
+
+		keys, err := store.List(ctx, ListInput{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"active", "foreign/expired", "leases/sweeper", "permanent"}, keys, "keys that are not owned are kept")
+	})
+
+	t.Run("only objects with a past expiration are read", func(t *testing.T) {
+		heads := &headCounter{Storage: store}
+		sweeper := NewSweeper(heads, time.Minute, func(string) bool { return true }, &logger)
+		sweeper.now = store.now
+
+		put("later", "12", now.Add(2*time.Hour))
+
+		_, err := sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"active", "foreign/expired", "later", "permanent"}, heads.keys)
+
+		heads.keys = nil
+		result, err := sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Zero(t, result.Deleted)
+		require.Empty(t, heads.keys, "expirations are kept from the last sweep")
+
+		now = now.Add(time.Hour)
+		result, err = sweeper.sweep(ctx)
+		require.NoError(t, err)
+		require.Equal(t, SweepResult{Deleted: 1, Bytes: 4}, result)
+		require.Equal(t, []string{"active"}, heads.keys)
+		require.NotContains(t, sweeper.expiries, "active", "deleted objects are dropped")
+	})
+}
+
+// headCounter records the keys read with Head
+type headCounter struct {
+	Storage
+	keys []string
+}
+
+func (h *headCounter) Head(ctx context.Context, key string) (Object, error) {
+	h.keys = append(h.keys, key)
+	return h.Storage.Head(ctx, key)
+}
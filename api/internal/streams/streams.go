@@ -0,0 +1,263 @@
+package streams
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrEventsUnavailable is returned when the requested events were dropped
+// from the buffer because the stream exceeded its maximum buffer size
+var ErrEventsUnavailable = errors.New("requested events are no longer buffered")
+
+// Event is a buffered SSE event
+type Event struct {
+	// ID is the sequence number of the event in the stream, starting at 1
+	ID int
+	// Raw is the original event bytes including the terminating blank line
+	Raw []byte
+}
+
+// Stream buffers the SSE events of a streamed completion so clients can
+// reconnect and receive missed events. Stream implements io.Writer, writes are
+// split into events at blank lines.
+type Stream struct {
+	ID string
+	// Owner is the owner of the request that created the stream, empty if the
+	// request had none. Only the owner can resume the stream.
+	Owner string
+
+	mu       sync.Mutex
+	events   []Event
+	size     int
+	maxBytes int
+	partial  []byte
+	done     bool
+	// updated is closed and replaced whenever events are added or the stream
+	// finishes, to wake up waiting readers
+	updated    chan struct{}
+	finishedAt time.Time
+	nextID     int
+}
+
+// Write buffers complete events from p, partial events are kept until the
+// rest of the event is written
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partial = append(s.partial, p...)
+
+	for {
+		end := eventEnd(s.partial)
+		if end < 0 {
+			break
+		}
+
+		raw := make([]byte, end)
+		copy(raw, s.partial[:end])
+		s.partial = s.partial[end:]
+
+		s.appendLocked(raw)
+	}
+
+	s.notifyLocked()
+
+	return len(p), nil
+}
+
+// Finish marks the stream as complete, any partial event is added as the last
+// event
+func (s *Stream) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return
+	}
+
+	if len(s.partial) > 0 {
+		s.appendLocked(s.partial)
+		s.partial = nil
+	}
+
+	s.done = true
+	s.finishedAt = time.Now()
+	s.notifyLocked()
+}
+
+// EventsAfter returns the buffered events after the given event ID, whether
+// the stream is finished, and a channel that is closed when there are new
+// events. ErrEventsUnavailable is returned if events after lastID were
+// dropped from the buffer.
+func (s *Stream) EventsAfter(lastID int) ([]Event, bool, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	firstID := s.nextID - len(s.events) + 1
+	if lastID+1 < firstID {
+		return nil, s.done, s.updated, ErrEventsUnavailable
+	}
+
+	start := lastID + 1 - firstID
+	if start >= len(s.events) {
+		return nil, s.done, s.updated, nil
+	}
+
+	events := make([]Event, len(s.events)-start)
+	copy(events, s.events[start:])
+
+	return events, s.done, s.updated, nil
+}
+
+func (s *Stream) appendLocked(raw []byte) {
+	s.nextID++
+	s.events = append(s.events, Event{ID: s.nextID, Raw: raw})
+	s.size += len(raw)
+
+	// Drop the oldest events when over the limit, always keep the latest
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.events) > 1 {
+		s.size -= len(s.events[0].Raw)
+		s.events[0] = Event{}
+		s.events = s.events[1:]
+	}
+}
+
+func (s *Stream) notifyLocked() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *Stream) expired(now time.Time, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.done && now.Sub(s.finishedAt) > ttl
+}
+
+// eventEnd returns the index after the blank line terminating the first event
+// in b, or -1 if there is no complete event
+func eventEnd(b []byte) int {
+	end := -1
+
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		end = i + 2
+	}
+
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 && (end < 0 || i+4 < end) {
+		end = i + 4
+	}
+
+	return end
+}
+
+// RegistryConfig is the configuration for a Registry
+type RegistryConfig struct {
+	// TTL is how long a finished stream is kept for reconnects
+	TTL time.Duration
+	// MaxBytes is the maximum size of buffered events per stream, the oldest
+	// events are dropped when exceeded
+	MaxBytes int
+	// MaxDuration is the maximum time the upstream request of a stream may
+	// run after the client disconnects
+	MaxDuration time.Duration
+}
+
+// Registry holds the in-progress and recently finished streams
+type Registry struct {
+	config RegistryConfig
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+}
+
+// minRemoveInterval is the shortest interval between removals of expired
+// streams, used when the TTL is shorter
+const minRemoveInterval = time.Second
+
+// NewRegistry creates a new Registry. Run removes its expired streams.
+func NewRegistry(config RegistryConfig) *Registry {
+	return &Registry{
+		config:  config,
+		streams: make(map[string]*Stream),
+	}
+}
+
+// Run removes expired streams every TTL, or every minRemoveInterval if the
+// TTL is shorter, until the context is canceled
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(max(r.config.TTL, minRemoveInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.removeExpired(now)
+		}
+	}
+}
+
+// MaxDuration returns the maximum duration of an upstream stream request
+func (r *Registry) MaxDuration() time.Duration {
+	return r.config.MaxDuration
+}
+
+// Create creates and registers a new stream of the owner with a random ID
+func (r *Registry) Create(owner string) (*Stream, error) {
+	id, err := newStreamID()
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &Stream{
+		ID:       id,
+		Owner:    owner,
+		maxBytes: r.config.MaxBytes,
+		updated:  make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.streams[id] = stream
+
+	return stream, nil
+}
+
+// Get returns the stream with the given ID
+func (r *Registry) Get(id string) (*Stream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stream, ok := r.streams[id]
+	return stream, ok
+}
+
+func (r *Registry) removeExpired(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, stream := range r.streams {
+		if stream.expired(now, r.config.TTL) {
+			delete(r.streams, id)
+		}
+	}
+}
+
+// newStreamID returns a random hex ID. Stream IDs grant access to the stream
+// so they must not be guessable, unlike ULIDs which are sequential within
+// the same millisecond.
+func newStreamID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
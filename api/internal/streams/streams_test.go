@@ -0,0 +1,123 @@
+package streams
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream_WriteAndEventsAfter(t *testing.T) {
+	registry := NewRegistry(RegistryConfig{TTL: time.Minute})
+
+	stream, err := registry.Create("")
+	require.NoError(t, err)
+	require.Len(t, stream.ID, 32)
+
+	events, done, wait, err := stream.EventsAfter(0)
+	require.NoError(t, err)
+	require.Empty(t, events)
+	require.False(t, done)
+
+	// Event split across writes
+	_, err = stream.Write([]byte("data: one\n\ndata: t"))
+	require.NoError(t, err)
+
+	select {
+	case <-wait:
+	default:
+		t.Fatal("wait channel should be closed after write")
+	}
+
+	_, err = stream.Write([]byte("wo\r\n\r\n"))
+	require.NoError(t, err)
+
+	events, done, _, err = stream.EventsAfter(0)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Equal(t, []Event{
+		{ID: 1, Raw: []byte("data: one\n\n")},
+		{ID: 2, Raw: []byte("data: two\r\n\r\n")},
+	}, events)
+
+	events, _, _, err = stream.EventsAfter(1)
+	require.NoError(t, err)
+	require.Equal(t, []Event{{ID: 2, Raw: []byte("data: two\r\n\r\n")}}, events)
+
+	events, _, _, err = stream.EventsAfter(2)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// Partial event is flushed on finish
+	_, err = stream.Write([]byte("data: partial"))
+	require.NoError(t, err)
+	stream.Finish()
+
+	events, done, _, err = stream.EventsAfter(2)
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, []Event{{ID: 3, Raw: []byte("data: partial")}}, events)
+
+	got, ok := registry.Get(stream.ID)
+	require.True(t, ok)
+	require.Equal(t, stream, got)
+}
+
+func TestStream_MaxBytes(t *testing.T) {
+	registry := NewRegistry(RegistryConfig{TTL: time.Minute, MaxBytes: 25})
+
+	stream, err := registry.Create("")
+	require.NoError(t, err)
+
+	for _, data := range []string{"data: 1\n\n", "data: 2\n\n", "data: 3\n\n"} {
+		_, err := stream.Write([]byte(data))
+		require.NoError(t, err)
+	}
+
+	// First event dropped to stay under 25 bytes
+	_, _, _, err = stream.EventsAfter(0)
+	require.ErrorIs(t, err, ErrEventsUnavailable)
+
+	events, _, _, err := stream.EventsAfter(1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, 2, events[0].ID)
+}
+
+func TestRegistry_RemoveExpired(t *testing.T) {
+	registry := NewRegistry(RegistryConfig{TTL: time.Minute})
+
+	finished, err := registry.Create("")
+	require.NoError(t, err)
+	finished.Finish()
+
+	running, err := registry.Create("")
+	require.NoError(t, err)
+
+	registry.removeExpired(time.Now().Add(2 * time.Minute))
+
+	_, ok := registry.Get(finished.ID)
+	require.False(t, ok, "finished stream should be removed after TTL")
+
+	_, ok = registry.Get(running.ID)
+	require.True(t, ok, "running stream should not be removed")
+}
+
+func TestRegistry_Run(t *testing.T) {
+	registry := NewRegistry(RegistryConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		registry.Run(ctx)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was canceled")
+	}
+}
@@ -0,0 +1,64 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CurrentTime is a tool that returns the current time in a timezone
+type CurrentTime struct {
+	// now is optional, time.Now is used if nil
+	now func() time.Time
+}
+
+// Name implements Tool
+func (CurrentTime) Name() string {
+	return "current_time"
+}
+
+// Description implements Tool
+func (CurrentTime) Description() string {
+	return "Get the current date and time. Use this when the user asks about the current date or time."
+}
+
+// Parameters implements Tool
+func (CurrentTime) Parameters() json.RawMessage {
+	return json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"timezone": {
+				"type": "string",
+				"description": "IANA timezone name, e.g. America/New_York. Defaults to UTC."
+			}
+		},
+		"additionalProperties": false
+	}`)
+}
+
+// Execute implements Tool
+func (t CurrentTime) Execute(_ context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	location := time.UTC
+	if args.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown timezone %s", args.Timezone)
+		}
+	}
+
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+
+	return now().In(location).Format(time.RFC3339), nil
+}
@@ -0,0 +1,281 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tool is a function the model can call that is executed by the server
+type Tool interface {
+	// Name is the function name advertised to the model
+	Name() string
+	// Description tells the model when to use the tool
+	Description() string
+	// Parameters is the JSON schema of the function arguments
+	Parameters() json.RawMessage
+	// Execute runs the tool with the JSON encoded arguments from the model and
+	// returns the result given to the model. Implementations should return
+	// when ctx is done.
+	Execute(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+// Definition is an OpenAI function tool definition
+type Definition struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition is the function of a tool definition
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// Registry holds the tools that can be executed by the server
+type Registry struct {
+	tools map[string]Tool
+}
+
+// NewRegistry creates a registry with the given tools
+func NewRegistry(tools ...Tool) (*Registry, error) {
+	r := &Registry{
+		tools: make(map[string]Tool),
+	}
+
+	for _, tool := range tools {
+		if err := r.Register(tool); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Register adds a tool to the registry, names must be unique
+func (r *Registry) Register(tool Tool) error {
+	name := tool.Name()
+	if name == "" {
+		return errors.New("tool name cannot be empty")
+	}
+
+	if !json.Valid(tool.Parameters()) {
+		return fmt.Errorf("tool %s has invalid parameters schema", name)
+	}
+
+	if _, exists := r.tools[name]; exists {
+		return fmt.Errorf("tool %s is already registered", name)
+	}
+
+	r.tools[name] = tool
+
+	return nil
+}
+
+// Get returns the tool with the given name
+func (r *Registry) Get(name string) (Tool, bool) {
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// Names returns the names of all registered tools in sorted order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ExecutorConfig is the configuration of an Executor
+type ExecutorConfig struct {
+	// ModelTools are the tool names each model may use, models that are not
+	// listed cannot use server tools
+	ModelTools map[string][]string
+	// Timeout limits each tool execution
+	Timeout time.Duration
+	// MaxIterations is the maximum number of rounds of tool calls for a
+	// single request
+	MaxIterations int
+}
+
+// Executor executes tool calls for the models allowed to use them
+type Executor struct {
+	registry      *Registry
+	modelTools    map[string][]Tool
+	timeout       time.Duration
+	maxIterations int
+}
+
+// NewExecutor creates an Executor, every tool in the model allowlists must be
+// registered
+func NewExecutor(registry *Registry, cfg ExecutorConfig) (*Executor, error) {
+	if cfg.Timeout <= 0 {
+		return nil, errors.New("tool timeout must be positive")
+	}
+
+	if cfg.MaxIterations <= 0 {
+		return nil, errors.New("max tool iterations must be positive")
+	}
+
+	e := &Executor{
+		registry:      registry,
+		modelTools:    make(map[string][]Tool),
+		timeout:       cfg.Timeout,
+		maxIterations: cfg.MaxIterations,
+	}
+
+	for model, names := range cfg.ModelTools {
+		for _, name := range names {
+			tool, ok := registry.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown tool %s for model %s", name, model)
+			}
+
+			e.modelTools[model] = append(e.modelTools[model], tool)
+		}
+	}
+
+	return e, nil
+}
+
+// MaxIterations is the maximum number of rounds of tool calls per request
+func (e *Executor) MaxIterations() int {
+	return e.maxIterations
+}
+
+// Definitions returns the definitions of the tools the model may use
+func (e *Executor) Definitions(model string) []Definition {
+	var definitions []Definition
+	for _, tool := range e.modelTools[model] {
+		definitions = append(definitions, Definition{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        tool.Name(),
+				Description: tool.Description(),
+				Parameters:  tool.Parameters(),
+			},
+		})
+	}
+
+	return definitions
+}
+
+// Allowed returns true if the model may use the tool
+func (e *Executor) Allowed(model, name string) bool {
+	_, ok := e.allowedTool(model, name)
+	return ok
+}
+
+func (e *Executor) allowedTool(model, name string) (Tool, bool) {
+	for _, tool := range e.modelTools[model] {
+		if tool.Name() == name {
+			return tool, true
+		}
+	}
+
+	return nil, false
+}
+
+// Call is a tool call made by the model
+type Call struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// Result is the result of a tool call
+type Result struct {
+	// Content is the tool output, empty if Err is set
+	Content  string
+	Err      error
+	Duration time.Duration
+}
+
+// ModelContent is the content of the tool message sent back to the model.
+// Errors are given to the model so it can recover, e.g. by fixing arguments.
+func (r Result) ModelContent() string {
+	if r.Err == nil {
+		return r.Content
+	}
+
+	data, _ := json.Marshal(map[string]string{"error": r.Err.Error()})
+	return string(data)
+}
+
+// Execute runs a tool call for the model with the configured timeout. Each
+// execution is recorded as a tool.execute span.
+func (e *Executor) Execute(ctx context.Context, model string, call Call) Result {
+	tracer := trace.SpanFromContext(ctx).
+		TracerProvider().
+		Tracer("tools")
+
+	ctx, span := tracer.Start(ctx, "tool.execute")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("tool.name", call.Name),
+		attribute.String("tool.call_id", call.ID),
+		attribute.String("model", model),
+	)
+
+	start := time.Now()
+	result := e.execute(ctx, model, call)
+	result.Duration = time.Since(start)
+
+	span.SetAttributes(attribute.Int64("duration_ms", result.Duration.Milliseconds()))
+	if result.Err != nil {
+		span.SetStatus(codes.Error, "tool execution error")
+		span.RecordError(result.Err)
+	}
+
+	return result
+}
+
+func (e *Executor) execute(ctx context.Context, model string, call Call) Result {
+	tool, ok := e.allowedTool(model, call.Name)
+	if !ok {
+		return Result{Err: fmt.Errorf("tool %s is not available", call.Name)}
+	}
+
+	arguments := json.RawMessage(call.Arguments)
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+
+	if !json.Valid(arguments) {
+		return Result{Err: errors.New("arguments are not valid JSON")}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	// Run in a goroutine so tools that ignore the context cannot block the
+	// request past the timeout
+	done := make(chan Result, 1)
+	go func() {
+		content, err := tool.Execute(ctx, arguments)
+		done <- Result{Content: content, Err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return Result{Err: fmt.Errorf("tool %s timed out after %s", call.Name, e.timeout)}
+		}
+
+		return Result{Err: ctx.Err()}
+	}
+}
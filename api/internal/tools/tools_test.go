@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type funcTool struct {
+	name    string
+	execute func(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+func (t funcTool) Name() string                { return t.name }
+func (t funcTool) Description() string         { return "test tool" }
+func (t funcTool) Parameters() json.RawMessage { return json.RawMessage(`{"type":"object"}`) }
+func (t funcTool) Execute(ctx context.Context, arguments json.RawMessage) (string, error) {
+	return t.execute(ctx, arguments)
+}
+
+func TestRegistry(t *testing.T) {
+	registry, err := NewRegistry(CurrentTime{})
+	require.NoError(t, err)
+
+	_, ok := registry.Get("current_time")
+	require.True(t, ok)
+
+	err = registry.Register(CurrentTime{})
+	require.EqualError(t, err, "tool current_time is already registered")
+
+	require.Equal(t, []string{"current_time"}, registry.Names())
+}
+
+func TestNewExecutor_UnknownTool(t *testing.T) {
+	registry, err := NewRegistry(CurrentTime{})
+	require.NoError(t, err)
+
+	_, err = NewExecutor(registry, ExecutorConfig{
+		ModelTools:    map[string][]string{"gpt-4o": {"weather"}},
+		Timeout:       time.Second,
+		MaxIterations: 1,
+	})
+	require.EqualError(t, err, "unknown tool weather for model gpt-4o")
+}
+
+func TestExecutor(t *testing.T) {
+	slow := funcTool{
+		name: "slow",
+		execute: func(ctx context.Context, _ json.RawMessage) (string, error) {
+			// Ignores the context, the executor still returns on timeout
+			time.Sleep(time.Second)
+			return "too late", nil
+		},
+	}
+	failing := funcTool{
+		name: "failing",
+		execute: func(context.Context, json.RawMessage) (string, error) {
+			return "", errors.New("backend unavailable")
+		},
+	}
+	now := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	registry, err := NewRegistry(CurrentTime{now: func() time.Time { return now }}, slow, failing)
+	require.NoError(t, err)
+
+	executor, err := NewExecutor(registry, ExecutorConfig{
+		ModelTools: map[string][]string{
+			"gpt-4o": {"current_time", "slow", "failing"},
+		},
+		Timeout:       50 * time.Millisecond,
+		MaxIterations: 3,
+	})
+	require.NoError(t, err)
+
+	t.Run("definitions are per model", func(t *testing.T) {
+		definitions := executor.Definitions("gpt-4o")
+		require.Len(t, definitions, 3)
+		require.Equal(t, "function", definitions[0].Type)
+		require.Equal(t, "current_time", definitions[0].Function.Name)
+
+		require.Empty(t, executor.Definitions("other-model"))
+		require.True(t, executor.Allowed("gpt-4o", "slow"))
+		require.False(t, executor.Allowed("other-model", "slow"))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		result := executor.Execute(context.Background(), "gpt-4o", Call{
+			ID:        "call_1",
+			Name:      "current_time",
+			Arguments: `{"timezone": "Asia/Tokyo"}`,
+		})
+		require.NoError(t, result.Err)
+		require.Equal(t, "2025-01-03T00:04:05+09:00", result.Content)
+		require.Equal(t, result.Content, result.ModelContent())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		result := executor.Execute(context.Background(), "gpt-4o", Call{ID: "call_2", Name: "slow"})
+		require.EqualError(t, result.Err, "tool slow timed out after 50ms")
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("error is given to the model", func(t *testing.T) {
+		result := executor.Execute(context.Background(), "gpt-4o", Call{ID: "call_3", Name: "failing"})
+		require.Error(t, result.Err)
+		require.JSONEq(t, `{"error": "backend unavailable"}`, result.ModelContent())
+	})
+
+	t.Run("tool not allowed for model", func(t *testing.T) {
+		result := executor.Execute(context.Background(), "other-model", Call{ID: "call_4", Name: "current_time"})
+		require.EqualError(t, result.Err, "tool current_time is not available")
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		result := executor.Execute(context.Background(), "gpt-4o", Call{ID: "call_5", Name: "current_time", Arguments: "{"})
+		require.EqualError(t, result.Err, "arguments are not valid JSON")
+	})
+}
@@ -28,12 +28,21 @@ type OpenAIPassthroughClient struct {
 // NewOpenAIClient creates a new OpenAI client with the given base URL and API
 // key
 func NewOpenAIClient(baseURL, apiKey string) *OpenAIPassthroughClient {
+	return NewOpenAIClientWithTransport(baseURL, apiKey, http.DefaultTransport)
+}
+
+// NewOpenAIClientWithTransport creates a new OpenAI client with the given base
+// URL, API key and upstream transport
+func NewOpenAIClientWithTransport(
+	baseURL, apiKey string,
+	transport http.RoundTripper,
+) *OpenAIPassthroughClient {
 	return &OpenAIPassthroughClient{
 		BaseURL: baseURL,
 		APIKey:  apiKey,
 		client: &http.Client{
 			Transport: otelhttp.NewTransport(
-				http.DefaultTransport,
+				transport,
 				otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
 					return otelhttptrace.NewClientTrace(ctx, otelhttptrace.WithoutSubSpans())
 				}),
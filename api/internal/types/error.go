@@ -1,10 +1,34 @@
 package types
 
-import (
-	"github.com/openai/openai-go"
-)
+import "context"
 
-// ErrorResponse is the response body for an error
+const CTX_REQUEST_ID_KEY = "request_id"
+
+// ErrorResponse is the response body for an error, the OpenAI error envelope
 type ErrorResponse struct {
-	ErrorBody *openai.Error `json:"error"`
+	ErrorBody *Error `json:"error"`
+}
+
+// Error is the error object of an OpenAI error response. Param and Code are
+// null when not applicable, the same as the OpenAI API.
+type Error struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+	// RequestID is the ID of the request that failed, also sent in the
+	// X-Request-ID response header
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AddRequestIDToContext adds the request ID to the context
+func AddRequestIDToContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, CTX_REQUEST_ID_KEY, requestID)
+}
+
+// RequestIDFromContext returns the request ID in the context, or an empty
+// string if there is none
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(CTX_REQUEST_ID_KEY).(string)
+	return requestID
 }
@@ -0,0 +1,18 @@
+package types
+
+import "context"
+
+const CTX_OWNER_KEY = "owner"
+
+// AddOwnerToContext adds the owner of the request to the context, either an
+// authenticated user or an anonymous session
+func AddOwnerToContext(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, CTX_OWNER_KEY, owner)
+}
+
+// OwnerFromContext returns the owner of the request, or an empty string if
+// there is none
+func OwnerFromContext(ctx context.Context) string {
+	owner, _ := ctx.Value(CTX_OWNER_KEY).(string)
+	return owner
+}
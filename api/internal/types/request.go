@@ -0,0 +1,257 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RequestBody is a loosely typed OpenAI request body. Only the fields the
+// proxy needs to inspect or modify are decoded, every other field is kept as
+// raw JSON so the body can be forwarded upstream without losing anything.
+type RequestBody map[string]json.RawMessage
+
+// ParseRequestBody decodes a JSON object request body
+func ParseRequestBody(data []byte) (RequestBody, error) {
+	body := RequestBody{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode request body: %w", err)
+	}
+
+	return body, nil
+}
+
+// GetString returns the string value of the given field, or an empty string if
+// the field is missing or not a string
+func (b RequestBody) GetString(key string) string {
+	var s string
+	if err := json.Unmarshal(b[key], &s); err != nil {
+		return ""
+	}
+
+	return s
+}
+
+// GetBool returns the bool value of the given field, or false if the field is
+// missing or not a bool
+func (b RequestBody) GetBool(key string) bool {
+	var v bool
+	if err := json.Unmarshal(b[key], &v); err != nil {
+		return false
+	}
+
+	return v
+}
+
+// Set encodes the value and sets it as the given field
+func (b RequestBody) Set(key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode field %s: %w", key, err)
+	}
+
+	b[key] = raw
+
+	return nil
+}
+
+// Messages decodes the messages field of a chat completion request
+func (b RequestBody) Messages() ([]Message, error) {
+	raw, ok := b["messages"]
+	if !ok {
+		return nil, nil
+	}
+
+	var messages []Message
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, fmt.Errorf("failed to decode messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// SetMessages replaces the messages field of a chat completion request
+func (b RequestBody) SetMessages(messages []Message) error {
+	return b.Set("messages", messages)
+}
+
+// Bytes encodes the request body to JSON
+func (b RequestBody) Bytes() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+// Message is a loosely typed chat completion message. Fields other than role
+// and content, e.g. tool_calls or name, are preserved as raw JSON.
+type Message map[string]json.RawMessage
+
+// NewTextMessage creates a message with the given role and string content
+func NewTextMessage(role, text string) Message {
+	roleRaw, _ := json.Marshal(role)
+	textRaw, _ := json.Marshal(text)
+
+	return Message{
+		"role":    roleRaw,
+		"content": textRaw,
+	}
+}
+
+// NewToolMessage creates a tool message with the result of a tool call
+func NewToolMessage(toolCallID, content string) Message {
+	idRaw, _ := json.Marshal(toolCallID)
+	contentRaw, _ := json.Marshal(content)
+
+	return Message{
+		"role":         json.RawMessage(`"tool"`),
+		"tool_call_id": idRaw,
+		"content":      contentRaw,
+	}
+}
+
+// Role returns the role of the message
+func (m Message) Role() string {
+	var role string
+	if err := json.Unmarshal(m["role"], &role); err != nil {
+		return ""
+	}
+
+	return role
+}
+
+// ContentParts returns the content of the message as content parts. Messages
+// with plain string content return a nil slice and false.
+func (m Message) ContentParts() ([]ContentPart, bool) {
+	var parts []ContentPart
+	if err := json.Unmarshal(m["content"], &parts); err != nil {
+		return nil, false
+	}
+
+	return parts, true
+}
+
+// SetContentParts replaces the content of the message with content parts
+func (m Message) SetContentParts(parts []ContentPart) error {
+	raw, err := json.Marshal(parts)
+	if err != nil {
+		return fmt.Errorf("failed to encode content parts: %w", err)
+	}
+
+	m["content"] = raw
+
+	return nil
+}
+
+// Text returns the text content of the message. For messages with content
+// parts, the text parts are joined with newlines and other parts are ignored.
+func (m Message) Text() string {
+	var s string
+	if err := json.Unmarshal(m["content"], &s); err == nil {
+		return s
+	}
+
+	parts, ok := m.ContentParts()
+	if !ok {
+		return ""
+	}
+
+	var texts []string
+	for _, part := range parts {
+		if part.Type() == "text" {
+			texts = append(texts, part.Text())
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// ContentPart is a loosely typed part of a message content array, e.g. a text
+// or image_url part.
+type ContentPart map[string]json.RawMessage
+
+// NewTextContentPart creates a text content part
+func NewTextContentPart(text string) ContentPart {
+	textRaw, _ := json.Marshal(text)
+
+	return ContentPart{
+		"type": json.RawMessage(`"text"`),
+		"text": textRaw,
+	}
+}
+
+// Type returns the type of the content part
+func (p ContentPart) Type() string {
+	var t string
+	if err := json.Unmarshal(p["type"], &t); err != nil {
+		return ""
+	}
+
+	return t
+}
+
+// Text returns the text of a text content part
+func (p ContentPart) Text() string {
+	var t string
+	if err := json.Unmarshal(p["text"], &t); err != nil {
+		return ""
+	}
+
+	return t
+}
+
+// ImageURL returns the URL of an image_url content part
+func (p ContentPart) ImageURL() string {
+	var image struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(p["image_url"], &image); err != nil {
+		return ""
+	}
+
+	return image.URL
+}
+
+// SetImageURL replaces the URL of an image_url content part, keeping other
+// fields such as detail
+func (p ContentPart) SetImageURL(url string) error {
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(p["image_url"], &image); err != nil || image == nil {
+		image = make(map[string]json.RawMessage)
+	}
+
+	urlRaw, err := json.Marshal(url)
+	if err != nil {
+		return fmt.Errorf("failed to encode image url: %w", err)
+	}
+	image["url"] = urlRaw
+
+	raw, err := json.Marshal(image)
+	if err != nil {
+		return fmt.Errorf("failed to encode image_url: %w", err)
+	}
+	p["image_url"] = raw
+
+	return nil
+}
+
+// File returns the file ID and filename of a file content part
+func (p ContentPart) File() (fileID string, filename string) {
+	var file struct {
+		FileID   string `json:"file_id"`
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(p["file"], &file); err != nil {
+		return "", ""
+	}
+
+	return file.FileID, file.Filename
+}
+
+// LastUserMessage returns the last message with the user role, if any
+func LastUserMessage(messages []Message) (Message, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role() == "user" {
+			return messages[i], true
+		}
+	}
+
+	return nil, false
+}
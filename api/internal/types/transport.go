@@ -0,0 +1,208 @@
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TransportConfig is the upstream connection configuration of a backend. Zero
+// values use the http.DefaultTransport settings.
+type TransportConfig struct {
+	// CAFile is a PEM bundle of CAs used to verify the backend instead of the
+	// system roots
+	CAFile string
+	// CertFile and KeyFile are the client certificate for mTLS, reloaded when
+	// the files change
+	CertFile string
+	KeyFile  string
+	// MinTLSVersion is a tls.VersionTLS* constant
+	MinTLSVersion uint16
+	// ProxyURL is the HTTP proxy for requests instead of the proxy from the
+	// environment
+	ProxyURL     string
+	DisableHTTP2 bool
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// NewTransport creates a transport with the given configuration based on
+// http.DefaultTransport
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig := &tls.Config{
+		MinVersion: cfg.MinTLSVersion,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+
+	if cfg.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+
+	return transport, nil
+}
+
+// certReloader loads the client certificate again when the certificate or key
+// file changes, so rotated certificates are used without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certStat fileStat
+	keyStat  fileStat
+}
+
+// fileStat is used to detect file changes
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both client certificate and key files are required")
+	}
+
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certStat, certErr := statFile(r.certFile)
+	keyStat, keyErr := statFile(r.keyFile)
+
+	changed := certErr == nil && keyErr == nil &&
+		(certStat != r.certStat || keyStat != r.keyStat)
+
+	if changed {
+		// Keep the previous certificate if the files are mid-rotation, e.g.
+		// the certificate was replaced but not the key yet
+		_ = r.reloadLocked()
+	}
+
+	return r.cert, nil
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reloadLocked()
+}
+
+func (r *certReloader) reloadLocked() error {
+	certStat, err := statFile(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client certificate: %w", err)
+	}
+
+	keyStat, err := statFile(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client key: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	r.cert = &cert
+	r.certStat = certStat
+	r.keyStat = keyStat
+
+	return nil
+}
+
+func statFile(name string) (fileStat, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStat{}, err
+	}
+
+	return fileStat{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// errorTransport fails every request with err, used when a transport could not
+// be created so requests do not silently bypass the configured TLS settings
+type errorTransport struct {
+	err error
+}
+
+func (t errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// NewErrorTransport returns a transport that fails every request with err
+func NewErrorTransport(err error) http.RoundTripper {
+	return errorTransport{err: err}
+}
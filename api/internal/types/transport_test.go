@@ -0,0 +1,202 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or self-signed if parent
+// is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, name string, data []byte, modTime time.Time) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(name, data, 0o600))
+	require.NoError(t, os.Chtimes(name, modTime, modTime))
+}
+
+func TestNewTransport_MutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "server", ca)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{serverCert.cert.Raw},
+			PrivateKey:  serverCert.key,
+		}},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  caPool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	now := time.Now()
+	client1 := newTestCert(t, "client-1", ca)
+	writeFile(t, caFile, ca.certPEM, now)
+	writeFile(t, certFile, client1.certPEM, now)
+	writeFile(t, keyFile, client1.keyPEM, now)
+
+	transport, err := NewTransport(TransportConfig{
+		CAFile:        caFile,
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		MinTLSVersion: tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	get := func() string {
+		t.Helper()
+
+		// New connection for each request to make a new handshake
+		defer transport.CloseIdleConnections()
+
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+
+		return string(body)
+	}
+
+	require.Equal(t, "client-1", get())
+
+	// Rotated certificate is used without creating a new transport
+	client2 := newTestCert(t, "client-2", ca)
+	later := now.Add(time.Minute)
+	writeFile(t, certFile, client2.certPEM, later)
+	writeFile(t, keyFile, client2.keyPEM, later)
+
+	require.Equal(t, "client-2", get())
+
+	// Previous certificate is kept while the key does not match yet
+	client3 := newTestCert(t, "client-3", ca)
+	writeFile(t, certFile, client3.certPEM, later.Add(time.Minute))
+
+	require.Equal(t, "client-2", get())
+}
+
+func TestNewTransport(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		transport, err := NewTransport(TransportConfig{})
+		require.NoError(t, err)
+
+		defaultTransport := http.DefaultTransport.(*http.Transport)
+		require.True(t, transport.ForceAttemptHTTP2)
+		require.Equal(t, defaultTransport.MaxIdleConns, transport.MaxIdleConns)
+		require.Equal(t, defaultTransport.IdleConnTimeout, transport.IdleConnTimeout)
+		require.Nil(t, transport.TLSClientConfig.RootCAs, "system roots should be used")
+	})
+
+	t.Run("proxy, HTTP/2 and pool settings", func(t *testing.T) {
+		transport, err := NewTransport(TransportConfig{
+			ProxyURL:            "http://proxy.internal:3128",
+			DisableHTTP2:        true,
+			MaxIdleConns:        10,
+			MaxIdleConnsPerHost: 5,
+			IdleConnTimeout:     30 * time.Second,
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "https://api.example.com", nil)
+		proxyURL, err := transport.Proxy(req)
+		require.NoError(t, err)
+		require.Equal(t, "http://proxy.internal:3128", proxyURL.String())
+
+		require.False(t, transport.ForceAttemptHTTP2)
+		require.NotNil(t, transport.TLSNextProto)
+		require.Empty(t, transport.TLSNextProto)
+
+		require.Equal(t, 10, transport.MaxIdleConns)
+		require.Equal(t, 5, transport.MaxIdleConnsPerHost)
+		require.Equal(t, 30*time.Second, transport.IdleConnTimeout)
+	})
+
+	t.Run("invalid CA file", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+		_, err := NewTransport(TransportConfig{CAFile: caFile})
+		require.ErrorContains(t, err, "no certificates found in CA file")
+	})
+
+	t.Run("missing key file", func(t *testing.T) {
+		_, err := NewTransport(TransportConfig{CertFile: "client.pem"})
+		require.EqualError(t, err, "both client certificate and key files are required")
+	})
+}
@@ -0,0 +1,108 @@
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signed URLs
+const (
+	ParamExpires   = "expires"
+	ParamKeyID     = "key_id"
+	ParamSignature = "signature"
+)
+
+var (
+	// ErrMissingSignature is returned for URLs without a signature
+	ErrMissingSignature = errors.New("missing signature")
+	// ErrInvalidSignature is returned for signatures that do not match, or
+	// are signed with an unknown key
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired is returned for valid signatures that have expired
+	ErrExpired = errors.New("signature expired")
+)
+
+// Signer signs and verifies URLs with HMAC-SHA256 signatures that expire.
+// URLs are signed with the current key, and verified with any known key so
+// keys can be rotated without invalidating URLs signed with the old key.
+type Signer struct {
+	// keys are the secrets by key ID
+	keys map[string][]byte
+	// keyID is the ID of the key used to sign new URLs
+	keyID string
+
+	now func() time.Time
+}
+
+// NewSigner creates a new Signer that signs with the key with the key ID and
+// verifies with all keys.
+func NewSigner(keys map[string][]byte, keyID string) (*Signer, error) {
+	if _, ok := keys[keyID]; !ok {
+		return nil, fmt.Errorf("signing key %q not found", keyID)
+	}
+
+	return &Signer{
+		keys:  keys,
+		keyID: keyID,
+		now:   time.Now,
+	}, nil
+}
+
+// Sign returns the query parameters that sign the resource until the expiry
+func (s *Signer) Sign(resource string, expireAt time.Time) url.Values {
+	expires := strconv.FormatInt(expireAt.Unix(), 10)
+
+	return url.Values{
+		ParamExpires:   {expires},
+		ParamKeyID:     {s.keyID},
+		ParamSignature: {s.signature(s.keys[s.keyID], s.keyID, resource, expires)},
+	}
+}
+
+// Verify returns nil if the query parameters have a valid signature of the
+// resource that has not expired. Other query parameters are ignored.
+func (s *Signer) Verify(resource string, query url.Values) error {
+	signature := query.Get(ParamSignature)
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	keyID := query.Get(ParamKeyID)
+	key, ok := s.keys[keyID]
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	expires := query.Get(ParamExpires)
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	expected := s.signature(key, keyID, resource, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	// Checked after the signature so the expiry cannot be changed
+	if !s.now().Before(time.Unix(expiresUnix, 0)) {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// signature returns the base64 URL encoded HMAC of the resource and expiry.
+// The key ID is included so a signature is only valid for its key.
+func (s *Signer) signature(key []byte, keyID string, resource string, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyID + "\n" + resource + "\n" + expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
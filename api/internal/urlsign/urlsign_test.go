@@ -0,0 +1,70 @@
+package urlsign
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := map[string][]byte{
+		"old": []byte("old-secret-old-secret-old-secret"),
+		"new": []byte("new-secret-new-secret-new-secret"),
+	}
+
+	_, err := NewSigner(keys, "missing")
+	require.Error(t, err, "signing key must exist")
+
+	oldSigner, err := NewSigner(keys, "old")
+	require.NoError(t, err)
+	oldSigner.now = func() time.Time { return now }
+
+	signer, err := NewSigner(keys, "new")
+	require.NoError(t, err)
+	signer.now = func() time.Time { return now }
+
+	query := signer.Sign("file1", now.Add(time.Hour))
+	require.Equal(t, "new", query.Get(ParamKeyID))
+	require.NoError(t, signer.Verify("file1", query))
+
+	// Other parameters such as the variant are not signed
+	withVariant := url.Values{"variant": {"thumb"}}
+	for key, values := range query {
+		withVariant[key] = values
+	}
+	require.NoError(t, signer.Verify("file1", withVariant))
+
+	require.ErrorIs(t, signer.Verify("file2", query), ErrInvalidSignature, "other resource")
+	require.ErrorIs(t, signer.Verify("file1", url.Values{}), ErrMissingSignature)
+
+	// URLs signed with the old key are valid after rotation
+	require.NoError(t, signer.Verify("file1", oldSigner.Sign("file1", now.Add(time.Hour))))
+
+	removed, err := NewSigner(map[string][]byte{"new": keys["new"]}, "new")
+	require.NoError(t, err)
+	removed.now = func() time.Time { return now }
+	require.ErrorIs(
+		t,
+		removed.Verify("file1", oldSigner.Sign("file1", now.Add(time.Hour))),
+		ErrInvalidSignature,
+		"removed key",
+	)
+
+	tampered := signer.Sign("file1", now.Add(time.Hour))
+	tampered.Set(ParamExpires, "9999999999")
+	require.ErrorIs(t, signer.Verify("file1", tampered), ErrInvalidSignature, "changed expiry")
+
+	tampered = signer.Sign("file1", now.Add(time.Hour))
+	tampered.Set(ParamKeyID, "old")
+	require.ErrorIs(t, signer.Verify("file1", tampered), ErrInvalidSignature, "changed key ID")
+
+	tampered = signer.Sign("file1", now.Add(time.Hour))
+	tampered.Set(ParamExpires, "soon")
+	require.ErrorIs(t, signer.Verify("file1", tampered), ErrInvalidSignature, "invalid expiry")
+
+	expired := signer.Sign("file1", now)
+	require.ErrorIs(t, signer.Verify("file1", expired), ErrExpired)
+}